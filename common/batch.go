@@ -0,0 +1,220 @@
+package common
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Batch is a list of changes to rules and chains, which ApplyBatch
+// makes all at once: with iptables-restore --noflush, in one call,
+// each table's changes atomically, rather than one exec per rule.
+// The zero value is an empty Batch.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	op       string // as to iptables: -A, -I, -D, -F, -N or -X
+	table    string
+	chain    string
+	pos      int // of -I
+	rulespec []string
+}
+
+func (b *Batch) Append(table, chain string, rulespec ...string) {
+	b.ops = append(b.ops, batchOp{op: "-A", table: table, chain: chain, rulespec: rulespec})
+}
+
+func (b *Batch) Insert(table, chain string, pos int, rulespec ...string) {
+	b.ops = append(b.ops, batchOp{op: "-I", table: table, chain: chain, pos: pos, rulespec: rulespec})
+}
+
+// Delete deletes a rule, which must exist, else the whole batch fails
+func (b *Batch) Delete(table, chain string, rulespec ...string) {
+	b.ops = append(b.ops, batchOp{op: "-D", table: table, chain: chain, rulespec: rulespec})
+}
+
+// ClearChain flushes chain, creating it if it is missing
+func (b *Batch) ClearChain(table, chain string) {
+	b.ops = append(b.ops, batchOp{op: "-F", table: table, chain: chain})
+}
+
+func (b *Batch) NewChain(table, chain string) {
+	b.ops = append(b.ops, batchOp{op: "-N", table: table, chain: chain})
+}
+
+func (b *Batch) DeleteChain(table, chain string) {
+	b.ops = append(b.ops, batchOp{op: "-X", table: table, chain: chain})
+}
+
+// Empty returns whether there is nothing in b to apply
+func (b *Batch) Empty() bool {
+	return len(b.ops) == 0
+}
+
+// Clears returns whether b clears chain, which so has no rules once b
+// is applied other than those b adds
+func (b *Batch) Clears(table, chain string) bool {
+	for _, op := range b.ops {
+		if op.op == "-F" && op.table == table && op.chain == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// tables returns those b changes, joined by commas
+func (b *Batch) tables() string {
+	var tables []string
+	for _, op := range b.ops {
+		found := false
+		for _, t := range tables {
+			found = found || t == op.table
+		}
+		if !found {
+			tables = append(tables, op.table)
+		}
+	}
+	return strings.Join(tables, ",")
+}
+
+// byTable splits b into a Batch of the changes to each table, in the
+// order the tables are first changed in
+func (b *Batch) byTable() []*Batch {
+	var batches []*Batch
+	of := make(map[string]*Batch)
+	for _, op := range b.ops {
+		tb, found := of[op.table]
+		if !found {
+			tb = &Batch{}
+			of[op.table] = tb
+			batches = append(batches, tb)
+		}
+		tb.ops = append(tb.ops, op)
+	}
+	return batches
+}
+
+// builtinChains are those of iptables' tables, which always exist
+var builtinChains = map[string]bool{"PREROUTING": true, "INPUT": true, "FORWARD": true, "OUTPUT": true, "POSTROUTING": true}
+
+// restoreInput returns b as input to iptables-restore --noflush
+func (b *Batch) restoreInput() string {
+	var tables []string
+	lines := make(map[string][]string)
+	for _, op := range b.ops {
+		if _, found := lines[op.table]; !found {
+			tables = append(tables, op.table)
+			lines[op.table] = nil
+		}
+		var line string
+		switch {
+		case op.op == "-F" && !builtinChains[op.chain]:
+			// Declaring a chain creates it, and flushes it if it exists
+			line = ":" + op.chain + " - [0:0]"
+		case op.op == "-I":
+			line = fmt.Sprintf("-I %s %d %s", op.chain, op.pos, restoreArgs(op.rulespec))
+		case len(op.rulespec) > 0:
+			line = op.op + " " + op.chain + " " + restoreArgs(op.rulespec)
+		default:
+			line = op.op + " " + op.chain
+		}
+		lines[op.table] = append(lines[op.table], line)
+	}
+	var input string
+	for _, table := range tables {
+		input += "*" + table + "\n" + strings.Join(lines[table], "\n") + "\nCOMMIT\n"
+	}
+	return input
+}
+
+// restoreArgs joins rulespec as iptables-restore splits it, quoting
+// arguments with spaces, e.g. comments
+func restoreArgs(rulespec []string) string {
+	args := make([]string, len(rulespec))
+	for i, arg := range rulespec {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+			arg = strconv.Quote(arg)
+		}
+		args[i] = arg
+	}
+	return strings.Join(args, " ")
+}
+
+// replay makes the changes of b one at a time, for backends which
+// can't apply it at once
+func (b *Batch) replay(ipt IPTablesBackend) error {
+	for _, op := range b.ops {
+		var err error
+		switch op.op {
+		case "-A":
+			err = ipt.Append(op.table, op.chain, op.rulespec...)
+		case "-I":
+			err = ipt.Insert(op.table, op.chain, op.pos, op.rulespec...)
+		case "-D":
+			err = ipt.Delete(op.table, op.chain, op.rulespec...)
+		case "-F":
+			err = ipt.ClearChain(op.table, op.chain)
+		case "-N":
+			err = ipt.NewChain(op.table, op.chain)
+		case "-X":
+			err = ipt.DeleteChain(op.table, op.chain)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s %s %s: %s", op.table, op.op, op.chain, strings.Join(op.rulespec, " "), err)
+		}
+	}
+	return nil
+}
+
+// batchApplier is an IPTablesBackend which applies a Batch at once
+type batchApplier interface {
+	ApplyBatch(b *Batch) error
+}
+
+// ApplyBatch makes the changes of b with ipt, all at once where ipt
+// can, else one at a time
+func ApplyBatch(ipt IPTablesBackend, b *Batch) error {
+	if b.Empty() {
+		return nil
+	}
+	if a, ok := ipt.(batchApplier); ok {
+		return a.ApplyBatch(b)
+	}
+	return b.replay(ipt)
+}
+
+// RestoreError is iptables-restore failing
+type RestoreError struct {
+	exec.ExitError
+	input  string
+	output string
+}
+
+func (e *RestoreError) Error() string {
+	return fmt.Sprintf("iptables-restore failed: %v: %s; input:\n%s", e.ExitError.Error(), e.output, e.input)
+}
+
+// ApplyBatch makes the changes of b with one call of iptables-restore
+func (ipt *IPTables) ApplyBatch(b *Batch) (err error) {
+	defer observe(ipt.name(), "restore", b.tables(), time.Now(), &err)
+	restore := "iptables-restore"
+	if ipt.proto == iptables.ProtocolIPv6 {
+		restore = "ip6tables-restore"
+	}
+	input := b.restoreInput()
+	return retryLocked(func() error {
+		cmd := exec.Command(restore, "--noflush")
+		cmd.Stdin = strings.NewReader(input)
+		output, err := cmd.CombinedOutput()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return &RestoreError{ExitError: *exitErr, input: input, output: string(output)}
+		}
+		return err
+	})
+}
@@ -0,0 +1,33 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchRestoreInput(t *testing.T) {
+	var b Batch
+	require.True(t, b.Empty())
+	b.ClearChain("mangle", "WEAVE-IPSEC-OUT")
+	b.Append("mangle", "WEAVE-IPSEC-OUT", "-m", "comment", "--comment", "two words", "-j", "ACCEPT")
+	b.ClearChain("filter", "FORWARD")
+	b.Insert("mangle", "OUTPUT", 1, "-j", "WEAVE-IPSEC-OUT")
+	b.Delete("filter", "INPUT", "-i", "weave", "-j", "DROP")
+	b.DeleteChain("filter", "WEAVE-OLD")
+	require.False(t, b.Empty())
+	require.True(t, b.Clears("mangle", "WEAVE-IPSEC-OUT"))
+	require.False(t, b.Clears("filter", "WEAVE-IPSEC-OUT"))
+
+	require.Equal(t, `*mangle
+:WEAVE-IPSEC-OUT - [0:0]
+-A WEAVE-IPSEC-OUT -m comment --comment "two words" -j ACCEPT
+-I OUTPUT 1 -j WEAVE-IPSEC-OUT
+COMMIT
+*filter
+-F FORWARD
+-D INPUT -i weave -j DROP
+-X WEAVE-OLD
+COMMIT
+`, b.restoreInput())
+}
@@ -0,0 +1,294 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// OwnedChain is a chain of weave's, with the rules jumping to it
+type OwnedChain struct {
+	Table string
+	Name  string
+	Jumps []Jump
+}
+
+// Jump is a rule jumping to an OwnedChain from another chain of its
+// table, e.g. a builtin one
+type Jump struct {
+	From string
+	// Matches of the rule, before "-j <chain>"
+	Rulespec []string
+	Position Position
+	// Of the jumps the ChainRegistry knows of to From, at the same
+	// Position, those of lower Priority go first
+	Priority int
+}
+
+// Position is where in its chain a Jump goes: at the top, above any
+// other rule, at the bottom, or just after the last rule matching a
+// regular expression, e.g. those of other software which must see the
+// traffic first. The zero value is the bottom.
+type Position struct {
+	top   bool
+	after *regexp.Regexp
+}
+
+var (
+	Top    = Position{top: true}
+	Bottom = Position{}
+)
+
+// After returns the Position just after the last rule matching re, as
+// iptables -S prints it; at the bottom where none does
+func After(re *regexp.Regexp) Position {
+	return Position{after: re}
+}
+
+// ParsePosition parses "top", "bottom" or "after:<regexp>"
+func ParsePosition(s string) (Position, error) {
+	switch {
+	case s == "top":
+		return Top, nil
+	case s == "bottom":
+		return Bottom, nil
+	case strings.HasPrefix(s, "after:"):
+		re, err := regexp.Compile(strings.TrimPrefix(s, "after:"))
+		if err != nil {
+			return Position{}, fmt.Errorf("invalid position %q: %s", s, err)
+		}
+		return After(re), nil
+	}
+	return Position{}, fmt.Errorf("invalid position %q (top, bottom or after:<regexp>)", s)
+}
+
+func (p Position) String() string {
+	switch {
+	case p.top:
+		return "top"
+	case p.after != nil:
+		return "after:" + p.after.String()
+	}
+	return "bottom"
+}
+
+func (c OwnedChain) jumpRulespec(j Jump) []string {
+	return append(append([]string{}, j.Rulespec...), "-j", c.Name)
+}
+
+// JumpRules returns the rules jumping to c
+func (c OwnedChain) JumpRules() []Rule {
+	var rules []Rule
+	for _, j := range c.Jumps {
+		rules = append(rules, Rule{Table: c.Table, Chain: j.From, Rulespec: c.jumpRulespec(j), Insert: j.Position.top})
+	}
+	return rules
+}
+
+// ChainRegistry creates, flushes and deletes the chains of the parts of
+// weave in a process, e.g. ipsec, the bridge setup and npc, on their
+// behalf, so that each needn't know of the others: it puts the rules
+// jumping to each chain at their positions, ordered by priority rather
+// than by which part started first, and deletes a chain only once no
+// part which claimed it still holds it.
+type ChainRegistry struct {
+	sync.Mutex
+	owners map[string]map[string]struct{} // by "table chain"
+	jumps  map[string]map[string]Jump     // to each chain, by "table from"
+}
+
+// Chains is the ChainRegistry of the process
+var Chains = NewChainRegistry()
+
+func NewChainRegistry() *ChainRegistry {
+	return &ChainRegistry{owners: make(map[string]map[string]struct{}), jumps: make(map[string]map[string]Jump)}
+}
+
+// Claim has owner hold c: it creates c with ipt, where missing, and
+// places the rules jumping to it. It leaves the rules of c as they are.
+func (r *ChainRegistry) Claim(ipt IPTablesBackend, owner string, c OwnedChain) error {
+	r.Lock()
+	defer r.Unlock()
+	key := c.Table + " " + c.Name
+	if r.owners[key] == nil {
+		r.owners[key] = make(map[string]struct{})
+	}
+	r.owners[key][owner] = struct{}{}
+	for _, j := range c.Jumps {
+		from := c.Table + " " + j.From
+		if r.jumps[from] == nil {
+			r.jumps[from] = make(map[string]Jump)
+		}
+		r.jumps[from][c.Name] = j
+	}
+
+	// Listing fails if it is missing
+	if _, err := ipt.List(c.Table, c.Name); err != nil {
+		if err := ipt.NewChain(c.Table, c.Name); err != nil {
+			return err
+		}
+	}
+	_, err := r.place(ipt, c)
+	return err
+}
+
+// Place puts back the rules jumping to c, which Claim placed, where
+// they have gone or are no longer at their positions, e.g. as other
+// software inserted rules above one at the top, and returns them
+func (r *ChainRegistry) Place(ipt IPTablesBackend, c OwnedChain) ([]Rule, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.place(ipt, c)
+}
+
+func (r *ChainRegistry) place(ipt IPTablesBackend, c OwnedChain) ([]Rule, error) {
+	var placed []Rule
+	for i, j := range c.Jumps {
+		rulespec := c.jumpRulespec(j)
+		list, err := ipt.List(c.Table, j.From)
+		if err != nil {
+			return nil, err
+		}
+		var rules []string
+		for _, line := range list {
+			if strings.HasPrefix(line, "-A ") {
+				rules = append(rules, line)
+			}
+		}
+		self := "-A " + j.From + " " + strings.Join(rulespec, " ")
+		at := -1
+		for n, line := range rules {
+			if line == self {
+				at = n
+				rules = append(rules[:n:n], rules[n+1:]...)
+				break
+			}
+		}
+		if at < 0 {
+			// It may be there, as iptables prints it differently
+			exists, err := ipt.Exists(c.Table, j.From, rulespec...)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				continue
+			}
+		} else if r.placed(c.Table, j, rules, at) {
+			continue
+		} else if err := ipt.Delete(c.Table, j.From, rulespec...); err != nil {
+			return nil, err
+		}
+		pos := r.position(c.Table, j, rules)
+		if pos == len(rules) {
+			err = ipt.Append(c.Table, j.From, rulespec...)
+		} else {
+			err = ipt.Insert(c.Table, j.From, pos+1, rulespec...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		placed = append(placed, c.JumpRules()[i])
+	}
+	return placed, nil
+}
+
+// known returns the jump rule is, as iptables -S prints it, where it
+// is one the registry knows of from the chain j is from
+func (r *ChainRegistry) known(table string, j Jump, rule string) (Jump, bool) {
+	for to, k := range r.jumps[table+" "+j.From] {
+		if strings.HasSuffix(rule, " -j "+to) {
+			return k, true
+		}
+	}
+	return Jump{}, false
+}
+
+// position returns where among rules, those of its chain other than
+// it, j goes, as an index; len(rules) for the end
+func (r *ChainRegistry) position(table string, j Jump, rules []string) int {
+	switch {
+	case j.Position.top:
+		// After the known jumps at the top before it
+		n := 0
+		for ; n < len(rules); n++ {
+			k, known := r.known(table, j, rules[n])
+			if !known || !k.Position.top || k.Priority > j.Priority {
+				break
+			}
+		}
+		return n
+	case j.Position.after != nil:
+		for n := len(rules) - 1; n >= 0; n-- {
+			if j.Position.after.MatchString(rules[n]) {
+				return n + 1
+			}
+		}
+		return len(rules)
+	}
+	// Before the first known jump at the bottom after it
+	for n, rule := range rules {
+		if k, known := r.known(table, j, rule); known && k.Position == Bottom && k.Priority > j.Priority {
+			return n
+		}
+	}
+	return len(rules)
+}
+
+// placed returns whether j, at index at among rules, those of its
+// chain other than it, is at its position
+func (r *ChainRegistry) placed(table string, j Jump, rules []string, at int) bool {
+	switch {
+	case j.Position.top:
+		return at == r.position(table, j, rules)
+	case j.Position.after != nil:
+		// Nothing it must come after is below it
+		for _, rule := range rules[at:] {
+			if j.Position.after.MatchString(rule) {
+				return false
+			}
+		}
+		return true
+	}
+	// What else is below it is not ours to mind, but no known jump at
+	// the bottom which goes after it is above it
+	return at <= r.position(table, j, rules)
+}
+
+// Flush empties c, leaving it, and the rules jumping to it, in place
+func (r *ChainRegistry) Flush(ipt IPTablesBackend, c OwnedChain) error {
+	return ipt.ClearChain(c.Table, c.Name)
+}
+
+// Release has owner no longer hold c; once no owner does, it deletes
+// the rules jumping to c and c itself, with ipt, where they exist
+func (r *ChainRegistry) Release(ipt IPTablesBackend, owner string, c OwnedChain) error {
+	r.Lock()
+	defer r.Unlock()
+	key := c.Table + " " + c.Name
+	delete(r.owners[key], owner)
+	if len(r.owners[key]) > 0 {
+		return nil
+	}
+	delete(r.owners, key)
+	for _, j := range c.Jumps {
+		delete(r.jumps[c.Table+" "+j.From], c.Name)
+		rulespec := c.jumpRulespec(j)
+		exists, err := ipt.Exists(c.Table, j.From, rulespec...)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := ipt.Delete(c.Table, j.From, rulespec...); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := ipt.List(c.Table, c.Name); err != nil {
+		return nil // already gone
+	}
+	if err := ipt.ClearChain(c.Table, c.Name); err != nil {
+		return err
+	}
+	return ipt.DeleteChain(c.Table, c.Name)
+}
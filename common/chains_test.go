@@ -0,0 +1,72 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func TestChainRegistry(t *testing.T) {
+	ipt := netfilter.NewMockIPTables()
+	r := NewChainRegistry()
+	first := OwnedChain{Table: "mangle", Name: "WEAVE-FIRST", Jumps: []Jump{{From: "OUTPUT", Position: Top, Priority: 1}}}
+	second := OwnedChain{Table: "mangle", Name: "WEAVE-SECOND", Jumps: []Jump{{From: "OUTPUT", Position: Top, Priority: 2}}}
+	last := OwnedChain{Table: "mangle", Name: "WEAVE-LAST", Jumps: []Jump{{From: "OUTPUT", Rulespec: []string{"-o", "weave"}}}}
+	require.NoError(t, ipt.Append("mangle", "OUTPUT", "-j", "OTHER"))
+
+	// Whichever order they are claimed in, the jumps end up in that of
+	// their priorities
+	require.NoError(t, r.Claim(ipt, "b", last))
+	require.NoError(t, r.Claim(ipt, "a", second))
+	require.NoError(t, r.Claim(ipt, "a", first))
+	expected := []string{"-j WEAVE-FIRST", "-j WEAVE-SECOND", "-j OTHER", "-o weave -j WEAVE-LAST"}
+	require.Equal(t, expected, ipt.Chains["mangle OUTPUT"])
+	require.Contains(t, ipt.Chains, "mangle WEAVE-FIRST")
+
+	// Claiming again leaves the chain's rules
+	require.NoError(t, ipt.Append("mangle", "WEAVE-LAST", "-j", "ACCEPT"))
+	require.NoError(t, r.Claim(ipt, "a", last))
+	require.Equal(t, expected, ipt.Chains["mangle OUTPUT"])
+	require.Equal(t, []string{"-j ACCEPT"}, ipt.Chains["mangle WEAVE-LAST"])
+
+	// Only once neither owner holds it is it deleted
+	require.NoError(t, r.Release(ipt, "a", last))
+	require.Contains(t, ipt.Chains, "mangle WEAVE-LAST")
+	require.NoError(t, r.Release(ipt, "b", last))
+	require.NotContains(t, ipt.Chains, "mangle WEAVE-LAST")
+	require.Equal(t, []string{"-j WEAVE-FIRST", "-j WEAVE-SECOND", "-j OTHER"}, ipt.Chains["mangle OUTPUT"])
+	// Releasing what is gone already is no error
+	require.NoError(t, r.Release(ipt, "b", last))
+}
+
+func TestChainRegistryPlace(t *testing.T) {
+	ipt := netfilter.NewMockIPTables()
+	r := NewChainRegistry()
+	require.NoError(t, ipt.Append("filter", "FORWARD", "-j", "KUBE-FORWARD"))
+	require.NoError(t, ipt.Append("filter", "FORWARD", "-j", "ACCEPT"))
+	top := OwnedChain{Table: "filter", Name: "WEAVE-TOP", Jumps: []Jump{{From: "FORWARD", Position: Top}}}
+	position, err := ParsePosition("after:KUBE-")
+	require.NoError(t, err)
+	after := OwnedChain{Table: "filter", Name: "WEAVE-AFTER", Jumps: []Jump{{From: "FORWARD", Position: position}}}
+	require.NoError(t, r.Claim(ipt, "a", top))
+	require.NoError(t, r.Claim(ipt, "a", after))
+	expected := []string{"-j WEAVE-TOP", "-j KUBE-FORWARD", "-j WEAVE-AFTER", "-j ACCEPT"}
+	require.Equal(t, expected, ipt.Chains["filter FORWARD"])
+
+	placed, err := r.Place(ipt, top)
+	require.NoError(t, err)
+	require.Empty(t, placed)
+
+	// As by other software
+	require.NoError(t, ipt.Insert("filter", "FORWARD", 1, "-j", "OTHER"))
+	require.NoError(t, ipt.Append("filter", "FORWARD", "-j", "KUBE-SERVICES"))
+	placed, err = r.Place(ipt, top)
+	require.NoError(t, err)
+	require.Equal(t, top.JumpRules(), placed)
+	placed, err = r.Place(ipt, after)
+	require.NoError(t, err)
+	require.Equal(t, after.JumpRules(), placed)
+	require.Equal(t, []string{"-j WEAVE-TOP", "-j OTHER", "-j KUBE-FORWARD", "-j ACCEPT", "-j KUBE-SERVICES", "-j WEAVE-AFTER"}, ipt.Chains["filter FORWARD"])
+}
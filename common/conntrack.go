@@ -0,0 +1,107 @@
+package common
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ConntrackFlows selects the conntrack entries of flows, as their
+// original direction has them, from Src to Dst, or, with EitherWay,
+// from Dst to Src too, as either direction of the entry has them, so
+// that flows whose addresses are translated are found too. A nil Src
+// or Dst is any address, a zero Proto or DstPort any protocol or
+// port, and a zero MarkMask any mark.
+type ConntrackFlows struct {
+	Src, Dst  net.IP
+	EitherWay bool
+	Proto     uint8
+	DstPort   uint16
+	Mark      uint32
+	MarkMask  uint32
+}
+
+// ConntrackEitherWay selects the flows to or from ip
+func ConntrackEitherWay(ip net.IP) ConntrackFlows {
+	return ConntrackFlows{Src: ip, EitherWay: true}
+}
+
+func (f ConntrackFlows) matches(src, dst net.IP, proto uint8, dstPort uint16, mark uint32) bool {
+	switch {
+	case f.Proto != 0 && proto != f.Proto:
+		return false
+	case f.DstPort != 0 && dstPort != f.DstPort:
+		return false
+	case mark&f.MarkMask != f.Mark&f.MarkMask:
+		return false
+	}
+	if matchIP(f.Src, src) && matchIP(f.Dst, dst) {
+		return true
+	}
+	return f.EitherWay && matchIP(f.Src, dst) && matchIP(f.Dst, src)
+}
+
+func matchIP(want, ip net.IP) bool {
+	return want == nil || want.Equal(ip)
+}
+
+// families returns those of the addresses f selects
+func (f ConntrackFlows) families() []netlink.InetFamily {
+	for _, ip := range []net.IP{f.Src, f.Dst} {
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			return []netlink.InetFamily{syscall.AF_INET}
+		default:
+			return []netlink.InetFamily{syscall.AF_INET6}
+		}
+	}
+	return []netlink.InetFamily{syscall.AF_INET, syscall.AF_INET6}
+}
+
+// conntrackFilter matches the entries any of its ConntrackFlows selects
+type conntrackFilter []ConntrackFlows
+
+func (filter conntrackFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	fwd, rev := flow.Forward, flow.Reverse
+	for _, f := range filter {
+		if f.matches(fwd.SrcIP, fwd.DstIP, fwd.Protocol, fwd.DstPort, flow.Mark) ||
+			f.EitherWay && f.matches(rev.SrcIP, rev.DstIP, rev.Protocol, rev.DstPort, flow.Mark) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteConntrackFlows deletes the conntrack entries of the flows any
+// of flows selects, returning how many went, so that the packets which
+// follow are checked against rules, and SAs, which changed since the
+// flow started, rather than carrying on under decisions made before:
+// those let in by a rule since narrowed, or saved to the entry, e.g.
+// a mark. Packets of a flow which is still allowed re-create its
+// entry.
+func DeleteConntrackFlows(flows ...ConntrackFlows) (uint, error) {
+	if len(flows) == 0 {
+		return 0, nil
+	}
+	var families []netlink.InetFamily
+	seen := make(map[netlink.InetFamily]bool)
+	for _, f := range flows {
+		for _, family := range f.families() {
+			if !seen[family] {
+				seen[family] = true
+				families = append(families, family)
+			}
+		}
+	}
+	var deleted uint
+	for _, family := range families {
+		n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, family, conntrackFilter(flows))
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestConntrackFlows(t *testing.T) {
+	pod, other := net.ParseIP("10.32.0.2"), net.ParseIP("10.40.0.1")
+
+	f := ConntrackEitherWay(pod)
+	require.True(t, f.matches(pod, other, syscall.IPPROTO_TCP, 80, 0))
+	require.True(t, f.matches(other, pod, syscall.IPPROTO_UDP, 53, 0))
+	require.False(t, f.matches(other, other, syscall.IPPROTO_TCP, 80, 0))
+	require.Equal(t, []netlink.InetFamily{syscall.AF_INET}, f.families())
+
+	// One way, with protocol, port and mark
+	f = ConntrackFlows{Src: pod, Dst: other, Proto: syscall.IPPROTO_UDP, DstPort: 6784, Mark: 0x20000, MarkMask: 0x20000}
+	require.True(t, f.matches(pod, other, syscall.IPPROTO_UDP, 6784, 0x20001))
+	require.False(t, f.matches(other, pod, syscall.IPPROTO_UDP, 6784, 0x20000))
+	require.False(t, f.matches(pod, other, syscall.IPPROTO_TCP, 6784, 0x20000))
+	require.False(t, f.matches(pod, other, syscall.IPPROTO_UDP, 6783, 0x20000))
+	require.False(t, f.matches(pod, other, syscall.IPPROTO_UDP, 6784, 0))
+
+	// Any address, of either family
+	f = ConntrackFlows{Proto: syscall.IPPROTO_UDP}
+	require.True(t, f.matches(other, pod, syscall.IPPROTO_UDP, 6784, 0))
+	require.Equal(t, []netlink.InetFamily{syscall.AF_INET, syscall.AF_INET6}, f.families())
+	require.Equal(t, []netlink.InetFamily{syscall.AF_INET6}, ConntrackEitherWay(net.ParseIP("fd00::1")).families())
+
+	// The entry matches by its reply direction, as after DNAT
+	flow := &netlink.ConntrackFlow{}
+	flow.Forward.SrcIP, flow.Forward.DstIP = other, net.ParseIP("10.96.0.10")
+	flow.Reverse.SrcIP, flow.Reverse.DstIP = pod, other
+	require.True(t, conntrackFilter{ConntrackEitherWay(pod)}.MatchConntrackFlow(flow))
+	require.False(t, conntrackFilter{{Src: other, Dst: pod}}.MatchConntrackFlow(flow))
+}
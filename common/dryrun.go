@@ -0,0 +1,319 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	dryRun      bool
+	dryRunsLock sync.Mutex
+	dryRuns     []*DryRun
+)
+
+// SetDryRun has the IPTablesBackends made from then on, by
+// NewIPTablesBackend, NewDualStackBackend and WithDryRun, log the
+// changes they would make rather than make them
+func SetDryRun(enabled bool) {
+	dryRun = enabled
+}
+
+// DryRunEnabled returns whether SetDryRun enabled dry runs
+func DryRunEnabled() bool {
+	return dryRun
+}
+
+// WithDryRun returns ipt, or a DryRun over it where SetDryRun enabled
+// dry runs
+func WithDryRun(ipt IPTablesBackend) IPTablesBackend {
+	if !dryRun {
+		return ipt
+	}
+	d := NewDryRun(ipt)
+	dryRunsLock.Lock()
+	dryRuns = append(dryRuns, d)
+	dryRunsLock.Unlock()
+	return d
+}
+
+// DryRunDiff returns the Diff of every DryRun WithDryRun returned
+func DryRunDiff() []string {
+	dryRunsLock.Lock()
+	defer dryRunsLock.Unlock()
+	var diff []string
+	for _, d := range dryRuns {
+		diff = append(diff, d.Diff()...)
+	}
+	return diff
+}
+
+// DryRun is an IPTablesBackend which changes nothing, but logs each
+// change it is asked for and answers from then on as if it had made
+// it: what it reads comes from the backend it is over, with the
+// changes laid on top. Diff returns what they would do to the rules.
+type DryRun struct {
+	ipt IPTablesBackend
+
+	sync.Mutex
+	chains map[string]*dryRunChain // "table chain"
+	order  []string                // of chains, as first changed
+}
+
+// dryRunChain is what would be done to a chain; rules are rulespecs
+// joined by spaces
+type dryRunChain struct {
+	table, chain string
+	created      bool // though missing
+	cleared      bool
+	deleted      bool
+	inserted     []string // before the rules it had
+	appended     []string // after them
+	removed      []string // of the rules it had
+}
+
+// NewDryRun returns a DryRun over ipt
+func NewDryRun(ipt IPTablesBackend) *DryRun {
+	return &DryRun{ipt: ipt, chains: make(map[string]*dryRunChain)}
+}
+
+// Backend returns the IPTablesBackend d is over
+func (d *DryRun) Backend() IPTablesBackend {
+	return d.ipt
+}
+
+func (d *DryRun) would(format string, args ...interface{}) {
+	Log.Infof("Dry run: would "+format, args...)
+}
+
+func (d *DryRun) chain(table, chain string) *dryRunChain {
+	key := table + " " + chain
+	c, found := d.chains[key]
+	if !found {
+		c = &dryRunChain{table: table, chain: chain}
+		d.chains[key] = c
+		d.order = append(d.order, key)
+	}
+	return c
+}
+
+// liveChain returns whether chain exists, regardless of d
+func (d *DryRun) liveChain(table, chain string) bool {
+	// Listing fails if it is missing
+	_, err := d.ipt.List(table, chain)
+	return err == nil
+}
+
+func (d *DryRun) chainExists(c *dryRunChain) bool {
+	return !c.deleted && (c.created || c.cleared || d.liveChain(c.table, c.chain))
+}
+
+func (d *DryRun) exists(c *dryRunChain, rule string, rulespec []string) (bool, error) {
+	switch {
+	case c.deleted:
+		return false, nil
+	case containsRule(c.inserted, rule) || containsRule(c.appended, rule):
+		return true, nil
+	case c.created || c.cleared || containsRule(c.removed, rule):
+		return false, nil
+	}
+	return d.ipt.Exists(c.table, c.chain, rulespec...)
+}
+
+func (d *DryRun) Exists(table, chain string, rulespec ...string) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.exists(d.chain(table, chain), strings.Join(rulespec, " "), rulespec)
+}
+
+func (d *DryRun) Insert(table, chain string, pos int, rulespec ...string) error {
+	d.Lock()
+	defer d.Unlock()
+	c := d.chain(table, chain)
+	if !d.chainExists(c) {
+		return fmt.Errorf("dry run: no chain %s in table %s", chain, table)
+	}
+	rule := strings.Join(rulespec, " ")
+	d.would("-t %s -I %s %d %s", table, chain, pos, rule)
+	if !removeRule(&c.removed, rule) {
+		c.inserted = append([]string{rule}, c.inserted...)
+	}
+	return nil
+}
+
+func (d *DryRun) Append(table, chain string, rulespec ...string) error {
+	d.Lock()
+	defer d.Unlock()
+	return d.append(d.chain(table, chain), rulespec)
+}
+
+func (d *DryRun) append(c *dryRunChain, rulespec []string) error {
+	if !d.chainExists(c) {
+		return fmt.Errorf("dry run: no chain %s in table %s", c.chain, c.table)
+	}
+	rule := strings.Join(rulespec, " ")
+	d.would("-t %s -A %s %s", c.table, c.chain, rule)
+	if !removeRule(&c.removed, rule) {
+		c.appended = append(c.appended, rule)
+	}
+	return nil
+}
+
+func (d *DryRun) AppendUnique(table, chain string, rulespec ...string) error {
+	d.Lock()
+	defer d.Unlock()
+	c := d.chain(table, chain)
+	exists, err := d.exists(c, strings.Join(rulespec, " "), rulespec)
+	if err != nil || exists {
+		return err
+	}
+	return d.append(c, rulespec)
+}
+
+func (d *DryRun) Delete(table, chain string, rulespec ...string) error {
+	d.Lock()
+	defer d.Unlock()
+	c := d.chain(table, chain)
+	rule := strings.Join(rulespec, " ")
+	exists, err := d.exists(c, rule, rulespec)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("dry run: no such rule in chain %s of table %s: %s", chain, table, rule)
+	}
+	d.would("-t %s -D %s %s", table, chain, rule)
+	if !removeRule(&c.inserted, rule) && !removeRule(&c.appended, rule) {
+		c.removed = append(c.removed, rule)
+	}
+	return nil
+}
+
+func (d *DryRun) List(table, chain string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	c := d.chain(table, chain)
+	if !d.chainExists(c) {
+		return nil, fmt.Errorf("dry run: no chain %s in table %s", chain, table)
+	}
+	var list []string
+	if !c.created && !c.cleared {
+		live, err := d.ipt.List(table, chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range live {
+			if !containsRule(c.removed, strings.TrimPrefix(line, "-A "+chain+" ")) {
+				list = append(list, line)
+			}
+		}
+	}
+	// The first line declares the chain
+	header := []string{"-N " + chain}
+	if len(list) > 0 && !strings.HasPrefix(list[0], "-A ") {
+		header, list = list[:1], list[1:]
+	}
+	rules := header
+	for _, rule := range c.inserted {
+		rules = append(rules, "-A "+chain+" "+rule)
+	}
+	rules = append(rules, list...)
+	for _, rule := range c.appended {
+		rules = append(rules, "-A "+chain+" "+rule)
+	}
+	return rules, nil
+}
+
+func (d *DryRun) NewChain(table, chain string) error {
+	d.Lock()
+	defer d.Unlock()
+	c := d.chain(table, chain)
+	if d.chainExists(c) {
+		return fmt.Errorf("dry run: chain %s already exists in table %s", chain, table)
+	}
+	d.would("-t %s -N %s", table, chain)
+	c.deleted, c.created = false, true
+	return nil
+}
+
+func (d *DryRun) ClearChain(table, chain string) error {
+	d.Lock()
+	defer d.Unlock()
+	c := d.chain(table, chain)
+	d.would("-t %s -F %s", table, chain)
+	if !d.chainExists(c) {
+		c.deleted, c.created = false, true
+	}
+	c.cleared = true
+	c.inserted, c.appended, c.removed = nil, nil, nil
+	return nil
+}
+
+func (d *DryRun) DeleteChain(table, chain string) error {
+	d.Lock()
+	defer d.Unlock()
+	c := d.chain(table, chain)
+	if !d.chainExists(c) {
+		return fmt.Errorf("dry run: no chain %s in table %s", chain, table)
+	}
+	d.would("-t %s -X %s", table, chain)
+	// Were it created again, it would be empty
+	c.deleted, c.created, c.cleared = true, false, true
+	c.inserted, c.appended, c.removed = nil, nil, nil
+	return nil
+}
+
+// Diff returns what the changes d was asked for would do, as the
+// chains and rules they would remove, prefixed by "-", and add,
+// prefixed by "+"
+func (d *DryRun) Diff() []string {
+	d.Lock()
+	defer d.Unlock()
+	var diff []string
+	for _, key := range d.order {
+		c := d.chains[key]
+		live, err := d.ipt.List(c.table, c.chain)
+		wasThere, isThere := err == nil, d.chainExists(c)
+		prefix := "-t " + c.table + " "
+		switch {
+		case wasThere && !isThere:
+			diff = append(diff, "- "+prefix+"-N "+c.chain)
+		case !wasThere && isThere:
+			diff = append(diff, "+ "+prefix+"-N "+c.chain)
+		}
+		if wasThere && (c.cleared || c.deleted) {
+			for _, line := range live {
+				if strings.HasPrefix(line, "-A ") {
+					diff = append(diff, "- "+prefix+line)
+				}
+			}
+		}
+		for _, rule := range c.removed {
+			diff = append(diff, "- "+prefix+"-A "+c.chain+" "+rule)
+		}
+		for _, rule := range append(append([]string{}, c.inserted...), c.appended...) {
+			diff = append(diff, "+ "+prefix+"-A "+c.chain+" "+rule)
+		}
+	}
+	return diff
+}
+
+func containsRule(rules []string, rule string) bool {
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// removeRule removes rule from rules, returning whether it was there
+func removeRule(rules *[]string, rule string) bool {
+	for i, r := range *rules {
+		if r == rule {
+			*rules = append((*rules)[:i], (*rules)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
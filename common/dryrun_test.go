@@ -0,0 +1,60 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func TestDryRun(t *testing.T) {
+	ipt := netfilter.NewMockIPTables()
+	require.NoError(t, ipt.NewChain("filter", "WEAVE-OLD"))
+	require.NoError(t, ipt.Append("filter", "WEAVE-OLD", "-j", "DROP"))
+	require.NoError(t, ipt.Append("filter", "INPUT", "-p", "esp", "-j", "ACCEPT"))
+	live := make(map[string][]string)
+	for c, rules := range ipt.Chains {
+		live[c] = rules
+	}
+
+	d := NewDryRun(ipt)
+	var b Batch
+	b.ClearChain("filter", "WEAVE-NEW")
+	b.Append("filter", "WEAVE-NEW", "-j", "ACCEPT")
+	b.Insert("filter", "INPUT", 1, "-j", "WEAVE-NEW")
+	b.Delete("filter", "INPUT", "-p", "esp", "-j", "ACCEPT")
+	b.ClearChain("filter", "WEAVE-OLD")
+	b.DeleteChain("filter", "WEAVE-OLD")
+	require.NoError(t, ApplyBatch(d, &b))
+
+	// Nothing changed, but d answers as if it had
+	require.Equal(t, live, ipt.Chains)
+	exists, err := d.Exists("filter", "INPUT", "-j", "WEAVE-NEW")
+	require.NoError(t, err)
+	require.True(t, exists)
+	exists, err = d.Exists("filter", "INPUT", "-p", "esp", "-j", "ACCEPT")
+	require.NoError(t, err)
+	require.False(t, exists)
+	rules, err := d.List("filter", "WEAVE-NEW")
+	require.NoError(t, err)
+	require.Equal(t, []string{"-N WEAVE-NEW", "-A WEAVE-NEW -j ACCEPT"}, rules)
+	_, err = d.List("filter", "WEAVE-OLD")
+	require.Error(t, err)
+	require.Error(t, d.Delete("filter", "INPUT", "-p", "esp", "-j", "ACCEPT"))
+
+	require.Equal(t, []string{
+		"+ -t filter -N WEAVE-NEW",
+		"+ -t filter -A WEAVE-NEW -j ACCEPT",
+		"- -t filter -A INPUT -p esp -j ACCEPT",
+		"+ -t filter -A INPUT -j WEAVE-NEW",
+		"- -t filter -N WEAVE-OLD",
+		"- -t filter -A WEAVE-OLD -j DROP",
+	}, d.Diff())
+
+	// Undoing a change leaves nothing to show
+	require.NoError(t, d.Delete("filter", "INPUT", "-j", "WEAVE-NEW"))
+	require.NoError(t, d.Append("filter", "INPUT", "-p", "esp", "-j", "ACCEPT"))
+	require.NotContains(t, d.Diff(), "+ -t filter -A INPUT -j WEAVE-NEW")
+	require.NotContains(t, d.Diff(), "- -t filter -A INPUT -p esp -j ACCEPT")
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// DualStack is an IPTablesBackend over both IPv4 and IPv6, e.g.
+// iptables and ip6tables. Each rule goes to the family of the
+// addresses it matches, or to both if it matches none; chains are in
+// both. Listing a chain returns the rules of both, once each.
+type DualStack struct {
+	v4, v6 IPTablesBackend
+}
+
+// NewDualStack returns a DualStack over v4 and v6
+func NewDualStack(v4, v6 IPTablesBackend) *DualStack {
+	return &DualStack{v4: v4, v6: v6}
+}
+
+// NewDualStackBackend returns an IPTablesBackend for both IPv4 and
+// IPv6, of the backend chosen by SetNetfilterBackend: an NFTables of
+// the inet family, whose tables hold the rules of both, or a DualStack
+// over iptables and ip6tables, over firewalld's IPv4 and IPv6 direct
+// rules, or over tables in memory; a DryRun over that where SetDryRun
+// enabled dry runs.
+func NewDualStackBackend() (IPTablesBackend, error) {
+	switch netfilterBackend {
+	case NetfilterNFTables:
+		nft, err := newNFTables("inet")
+		if err != nil {
+			return nil, err
+		}
+		return WithDryRun(nft), nil
+	case NetfilterFirewalld:
+		v4, err := NewFirewalld(iptables.ProtocolIPv4)
+		if err != nil {
+			return nil, err
+		}
+		v6, err := NewFirewalld(iptables.ProtocolIPv6)
+		if err != nil {
+			return nil, err
+		}
+		return WithDryRun(NewDualStack(v4, v6)), nil
+	case netfilterMemory:
+		return WithDryRun(NewDualStack(memIPTables(iptables.ProtocolIPv4), memIPTables(iptables.ProtocolIPv6))), nil
+	}
+	v4, err := NewIPTablesWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := NewIPTablesWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		return nil, err
+	}
+	return WithDryRun(NewDualStack(v4, v6)), nil
+}
+
+// families returns whether rulespec is for IPv4 and IPv6: only that of
+// the first address it matches, else both
+func families(rulespec []string) (v4, v6 bool) {
+	for i := 0; i+1 < len(rulespec); i++ {
+		switch rulespec[i] {
+		case "-s", "--source", "-d", "--destination":
+			if strings.Contains(rulespec[i+1], ":") {
+				return false, true
+			}
+			return true, false
+		}
+	}
+	return true, true
+}
+
+// backends returns those of d rulespec is for
+func (d *DualStack) backends(rulespec []string) []IPTablesBackend {
+	var backends []IPTablesBackend
+	v4, v6 := families(rulespec)
+	if v4 {
+		backends = append(backends, d.v4)
+	}
+	if v6 {
+		backends = append(backends, d.v6)
+	}
+	return backends
+}
+
+// Exists returns whether the rule is in each family it is for
+func (d *DualStack) Exists(table, chain string, rulespec ...string) (bool, error) {
+	for _, ipt := range d.backends(rulespec) {
+		if exists, err := ipt.Exists(table, chain, rulespec...); err != nil || !exists {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (d *DualStack) Insert(table, chain string, pos int, rulespec ...string) error {
+	for _, ipt := range d.backends(rulespec) {
+		if err := ipt.Insert(table, chain, pos, rulespec...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DualStack) Append(table, chain string, rulespec ...string) error {
+	for _, ipt := range d.backends(rulespec) {
+		if err := ipt.Append(table, chain, rulespec...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DualStack) AppendUnique(table, chain string, rulespec ...string) error {
+	for _, ipt := range d.backends(rulespec) {
+		if err := ipt.AppendUnique(table, chain, rulespec...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DualStack) Delete(table, chain string, rulespec ...string) error {
+	for _, ipt := range d.backends(rulespec) {
+		if err := ipt.Delete(table, chain, rulespec...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the rules of chain in IPv4, followed by those only in
+// IPv6
+func (d *DualStack) List(table, chain string) ([]string, error) {
+	list, err := d.v4.List(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	list6, err := d.v6.List(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(list))
+	for _, r := range list {
+		seen[r] = struct{}{}
+	}
+	for _, r := range list6 {
+		if _, found := seen[r]; !found {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+func (d *DualStack) NewChain(table, chain string) error {
+	if err := d.v4.NewChain(table, chain); err != nil {
+		return err
+	}
+	return d.v6.NewChain(table, chain)
+}
+
+func (d *DualStack) ClearChain(table, chain string) error {
+	if err := d.v4.ClearChain(table, chain); err != nil {
+		return err
+	}
+	return d.v6.ClearChain(table, chain)
+}
+
+func (d *DualStack) DeleteChain(table, chain string) error {
+	if err := d.v4.DeleteChain(table, chain); err != nil {
+		return err
+	}
+	return d.v6.DeleteChain(table, chain)
+}
+
+// ApplyBatch applies the changes of b for each family with its
+// backend, IPv4's first
+func (d *DualStack) ApplyBatch(b *Batch) error {
+	var b4, b6 Batch
+	for _, op := range b.ops {
+		v4, v6 := families(op.rulespec)
+		if v4 {
+			b4.ops = append(b4.ops, op)
+		}
+		if v6 {
+			b6.ops = append(b6.ops, op)
+		}
+	}
+	if err := ApplyBatch(d.v4, &b4); err != nil {
+		return err
+	}
+	return ApplyBatch(d.v6, &b6)
+}
@@ -0,0 +1,43 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func TestDualStack(t *testing.T) {
+	v4, v6 := netfilter.NewMockIPTables(), netfilter.NewMockIPTables()
+	ipt := NewDualStack(v4, v6)
+
+	require.NoError(t, ipt.NewChain("nat", "WEAVE"))
+	require.NoError(t, ipt.Append("nat", "WEAVE", "-s", "10.32.0.0/12", "-j", "MASQUERADE"))
+	require.NoError(t, ipt.Append("nat", "WEAVE", "-s", "fd00::/64", "-j", "MASQUERADE"))
+	require.NoError(t, ipt.Append("nat", "WEAVE", "-o", "weave", "-j", "RETURN"))
+	require.Equal(t, []string{"-s 10.32.0.0/12 -j MASQUERADE", "-o weave -j RETURN"}, v4.Chains["nat WEAVE"])
+	require.Equal(t, []string{"-s fd00::/64 -j MASQUERADE", "-o weave -j RETURN"}, v6.Chains["nat WEAVE"])
+
+	rules, err := ipt.List("nat", "WEAVE")
+	require.NoError(t, err)
+	require.Equal(t, []string{"-N WEAVE", "-A WEAVE -s 10.32.0.0/12 -j MASQUERADE", "-A WEAVE -o weave -j RETURN", "-A WEAVE -s fd00::/64 -j MASQUERADE"}, rules)
+
+	// A rule for both families is only there if it is in both
+	require.NoError(t, v6.Delete("nat", "WEAVE", "-o", "weave", "-j", "RETURN"))
+	exists, err := ipt.Exists("nat", "WEAVE", "-o", "weave", "-j", "RETURN")
+	require.NoError(t, err)
+	require.False(t, exists)
+	require.NoError(t, ipt.AppendUnique("nat", "WEAVE", "-o", "weave", "-j", "RETURN"))
+	exists, err = ipt.Exists("nat", "WEAVE", "-o", "weave", "-j", "RETURN")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	var b Batch
+	b.ClearChain("filter", "WEAVE-SERVICES")
+	b.Append("filter", "WEAVE-SERVICES", "-d", "10.96.0.0/12", "-j", "REJECT")
+	b.Append("filter", "WEAVE-SERVICES", "-d", "fd01::/108", "-j", "REJECT")
+	require.NoError(t, ApplyBatch(ipt, &b))
+	require.Equal(t, []string{"-d 10.96.0.0/12 -j REJECT"}, v4.Chains["filter WEAVE-SERVICES"])
+	require.Equal(t, []string{"-d fd01::/108 -j REJECT"}, v6.Chains["filter WEAVE-SERVICES"])
+}
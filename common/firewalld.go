@@ -0,0 +1,275 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	// The priority of the direct rules Append adds; those of lower
+	// priority go first
+	firewalldAppendPriority = 0
+)
+
+// Firewalld is an IPTablesBackend which has firewalld put rules in
+// place, with the direct interface of firewall-cmd, rather than
+// changing them behind its back. Chains of weave's are direct chains,
+// and they and their rules are made in both the runtime and the
+// permanent configuration, so that firewalld puts them back as it
+// reloads, which otherwise flushes the rules of everyone else, and
+// traffic is never left unprotected in between. Clearing a chain, as
+// weave does of its own as it starts, clears it in the permanent
+// configuration too, of the rules of peers and connections gone while
+// weave was not running. Rules matching ipsets only go in the runtime
+// configuration, as firewalld would fail to load them, on boot, before
+// the sets exist; the reconcilers put those back after a reload. The
+// rules of builtin chains go to the chains firewalld jumps to from
+// them, e.g. OUTPUT_direct, after its own.
+//
+// Rules are ordered by priority, not position, and the order of those
+// of the same priority is not fixed: Insert picks a priority between
+// those of the rules either side of pos, and fails where there is
+// none.
+type Firewalld struct {
+	family string // "ipv4" or "ipv6"
+}
+
+// firewalldRule is a direct rule, as firewall-cmd lists it
+type firewalldRule struct {
+	priority string
+	rulespec []string
+}
+
+// NewFirewalld returns a Firewalld for proto
+func NewFirewalld(proto iptables.Protocol) (*Firewalld, error) {
+	if _, err := exec.LookPath("firewall-cmd"); err != nil {
+		return nil, err
+	}
+	if proto == iptables.ProtocolIPv6 {
+		return &Firewalld{family: "ipv6"}, nil
+	}
+	return &Firewalld{family: "ipv4"}, nil
+}
+
+// firewallCmd runs firewall-cmd with args, returning what it printed;
+// a variable so that tests can fake it
+var firewallCmd = func(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("firewall-cmd", args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("firewall-cmd %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (f *Firewalld) run(args ...string) (string, error) {
+	return firewallCmd(args...)
+}
+
+// change makes a change, given by args to firewall-cmd --direct, to
+// the runtime configuration, then, if permanent, to the permanent one
+func (f *Firewalld) change(permanent bool, args ...string) error {
+	if _, err := f.run(append([]string{"--direct"}, args...)...); err != nil || !permanent {
+		return err
+	}
+	_, err := f.run(append([]string{"--permanent", "--direct"}, args...)...)
+	return err
+}
+
+// changeRule adds or removes, as op says, the rule of priority, in the
+// permanent configuration as well unless it matches an ipset
+func (f *Firewalld) changeRule(op, table, chain, priority string, rulespec []string) error {
+	return f.change(!matchesSet(rulespec), append([]string{op, f.family, table, chain, priority}, rulespec...)...)
+}
+
+// matchesSet says whether rulespec matches an ipset
+func matchesSet(rulespec []string) bool {
+	for _, arg := range rulespec {
+		if arg == "--match-set" {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Firewalld) rules(table, chain string) ([]firewalldRule, error) {
+	output, err := f.run("--direct", "--get-rules", f.family, table, chain)
+	if err != nil {
+		return nil, err
+	}
+	return parseFirewalldRules(output), nil
+}
+
+// parseFirewalldRules parses the rules firewall-cmd --get-rules lists,
+// one per line, each its priority followed by its rulespec
+func parseFirewalldRules(output string) []firewalldRule {
+	var rules []firewalldRule
+	for _, line := range strings.Split(output, "\n") {
+		args := splitListed(strings.TrimSpace(line))
+		if len(args) > 0 {
+			rules = append(rules, firewalldRule{priority: args[0], rulespec: args[1:]})
+		}
+	}
+	return rules
+}
+
+// find returns the priority of the rule; empty where it is missing
+func (f *Firewalld) find(table, chain string, rulespec []string) (string, error) {
+	rules, err := f.rules(table, chain)
+	if err != nil {
+		return "", err
+	}
+	self := strings.Join(rulespec, " ")
+	for _, r := range rules {
+		if strings.Join(r.rulespec, " ") == self {
+			return r.priority, nil
+		}
+	}
+	return "", nil
+}
+
+func (f *Firewalld) chainExists(table, chain string) bool {
+	if builtinChains[chain] {
+		return true
+	}
+	// It exits 1 where the chain is missing
+	_, err := f.run("--direct", "--query-chain", f.family, table, chain)
+	return err == nil
+}
+
+func (f *Firewalld) Exists(table, chain string, rulespec ...string) (exists bool, err error) {
+	defer observe("firewalld", "exists", table, time.Now(), &err)
+	priority, err := f.find(table, chain, rulespec)
+	return priority != "", err
+}
+
+func (f *Firewalld) Insert(table, chain string, pos int, rulespec ...string) (err error) {
+	defer observe("firewalld", "insert", table, time.Now(), &err)
+	rules, err := f.rules(table, chain)
+	if err != nil {
+		return err
+	}
+	sort.Stable(firewalldRules(rules))
+	priority, err := insertPriority(rules, pos)
+	if err != nil {
+		return fmt.Errorf("firewalld: cannot insert at %d in chain %s of table %s: %v", pos, chain, table, err)
+	}
+	return f.changeRule("--add-rule", table, chain, strconv.Itoa(priority), rulespec)
+}
+
+// insertPriority returns a priority putting a rule at pos, from 1, in
+// rules, sorted by priority: below the lowest, and those Append adds,
+// for 1, above the highest past the end, and otherwise between those of its neighbours, where
+// they leave room for one
+func insertPriority(rules []firewalldRule, pos int) (int, error) {
+	if pos < 1 || pos > len(rules)+1 {
+		return 0, fmt.Errorf("out of range")
+	}
+	priorities := make([]int, len(rules))
+	for i, r := range rules {
+		p, err := strconv.Atoi(r.priority)
+		if err != nil {
+			return 0, fmt.Errorf("priority %q: %v", r.priority, err)
+		}
+		priorities[i] = p
+	}
+	switch {
+	case pos == 1:
+		// Before those Append adds, too
+		priority := firewalldAppendPriority - 1
+		if len(rules) > 0 && priorities[0] <= priority {
+			priority = priorities[0] - 1
+		}
+		return priority, nil
+	case pos == len(rules)+1:
+		return priorities[len(rules)-1] + 1, nil
+	}
+	before, after := priorities[pos-2], priorities[pos-1]
+	if after-before < 2 {
+		return 0, fmt.Errorf("rules either side are of priorities %d and %d", before, after)
+	}
+	return before + 1, nil
+}
+
+func (f *Firewalld) Append(table, chain string, rulespec ...string) (err error) {
+	defer observe("firewalld", "append", table, time.Now(), &err)
+	return f.changeRule("--add-rule", table, chain, strconv.Itoa(firewalldAppendPriority), rulespec)
+}
+
+func (f *Firewalld) AppendUnique(table, chain string, rulespec ...string) error {
+	exists, err := f.Exists(table, chain, rulespec...)
+	if err != nil || exists {
+		return err
+	}
+	return f.Append(table, chain, rulespec...)
+}
+
+func (f *Firewalld) Delete(table, chain string, rulespec ...string) (err error) {
+	defer observe("firewalld", "delete", table, time.Now(), &err)
+	priority, err := f.find(table, chain, rulespec)
+	if err != nil {
+		return err
+	}
+	if priority == "" {
+		return fmt.Errorf("firewalld: no such rule in chain %s of table %s: %s", chain, table, strings.Join(rulespec, " "))
+	}
+	return f.changeRule("--remove-rule", table, chain, priority, rulespec)
+}
+
+// List returns the direct rules of chain, as iptables -S would print
+// them, in the order of their priorities
+func (f *Firewalld) List(table, chain string) (_ []string, err error) {
+	defer observe("firewalld", "list", table, time.Now(), &err)
+	if !f.chainExists(table, chain) {
+		return nil, fmt.Errorf("firewalld: no chain %s in table %s", chain, table)
+	}
+	rules, err := f.rules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(firewalldRules(rules))
+	list := []string{"-N " + chain}
+	for _, r := range rules {
+		list = append(list, "-A "+chain+" "+restoreArgs(r.rulespec))
+	}
+	return list, nil
+}
+
+// firewalldRules sort by priority
+type firewalldRules []firewalldRule
+
+func (s firewalldRules) Len() int      { return len(s) }
+func (s firewalldRules) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s firewalldRules) Less(i, j int) bool {
+	pi, _ := strconv.Atoi(s[i].priority)
+	pj, _ := strconv.Atoi(s[j].priority)
+	return pi < pj
+}
+
+func (f *Firewalld) NewChain(table, chain string) (err error) {
+	defer observe("firewalld", "new_chain", table, time.Now(), &err)
+	return f.change(true, "--add-chain", f.family, table, chain)
+}
+
+// ClearChain clears the chain from the permanent configuration too,
+// of the jumps it may hold
+func (f *Firewalld) ClearChain(table, chain string) (err error) {
+	defer observe("firewalld", "clear_chain", table, time.Now(), &err)
+	if !f.chainExists(table, chain) {
+		return f.change(true, "--add-chain", f.family, table, chain)
+	}
+	return f.change(true, "--remove-rules", f.family, table, chain)
+}
+
+func (f *Firewalld) DeleteChain(table, chain string) (err error) {
+	defer observe("firewalld", "delete_chain", table, time.Now(), &err)
+	return f.change(true, "--remove-chain", f.family, table, chain)
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFirewalldRules(t *testing.T) {
+	rules := parseFirewalldRules(`0 -m comment --comment 'weave:two words' -j ACCEPT
+-1 -p esp -j ACCEPT
+
+10 -j DROP
+`)
+	require.Equal(t, []firewalldRule{
+		{priority: "0", rulespec: []string{"-m", "comment", "--comment", "weave:two words", "-j", "ACCEPT"}},
+		{priority: "-1", rulespec: []string{"-p", "esp", "-j", "ACCEPT"}},
+		{priority: "10", rulespec: []string{"-j", "DROP"}},
+	}, rules)
+
+	sort.Stable(firewalldRules(rules))
+	require.Equal(t, []string{"-1", "0", "10"}, []string{rules[0].priority, rules[1].priority, rules[2].priority})
+}
+
+// fakeFirewallCmd stands in for firewall-cmd, with chains of the
+// runtime configuration holding rules as it lists them, and records
+// the changes made to the permanent configuration
+type fakeFirewallCmd struct {
+	chains    map[string][]string // "table chain" -> rules
+	permanent [][]string
+}
+
+func (c *fakeFirewallCmd) run(args ...string) (string, error) {
+	if args[0] == "--permanent" {
+		c.permanent = append(c.permanent, args[2:])
+		return "", nil
+	}
+	// --direct <op> <family> <table> <chain> ...
+	op, key := args[1], args[3]+" "+args[4]
+	rule := strings.Join(args[5:], " ")
+	switch op {
+	case "--add-chain":
+		c.chains[key] = nil
+	case "--query-chain":
+		if _, found := c.chains[key]; !found {
+			return "", fmt.Errorf("no chain %s", key)
+		}
+	case "--get-rules":
+		return strings.Join(c.chains[key], "\n"), nil
+	case "--add-rule":
+		c.chains[key] = append(c.chains[key], rule)
+	case "--remove-rule":
+		rules := c.chains[key]
+		removeRule(&rules, rule)
+		c.chains[key] = rules
+	}
+	return "", nil
+}
+
+func TestFirewalldPermanent(t *testing.T) {
+	c := &fakeFirewallCmd{chains: make(map[string][]string)}
+	defer func(cmd func(...string) (string, error)) { firewallCmd = cmd }(firewallCmd)
+	firewallCmd = c.run
+	f := &Firewalld{family: "ipv4"}
+
+	require.NoError(t, f.NewChain("filter", "WEAVE-IN"))
+	require.NoError(t, f.Append("filter", "WEAVE-IN", "-p", "esp", "-j", "ACCEPT"))
+	require.NoError(t, f.Append("filter", "WEAVE-IN", "-m", "set", "--match-set", "weave-peers", "src", "-j", "ACCEPT"))
+	require.NoError(t, f.Append("filter", "INPUT", "-j", "WEAVE-IN"))
+	require.NoError(t, f.ClearChain("filter", "WEAVE-IN"))
+	require.NoError(t, f.Delete("filter", "INPUT", "-j", "WEAVE-IN"))
+	require.NoError(t, f.DeleteChain("filter", "WEAVE-IN"))
+
+	// Everything but the rule matching an ipset is kept across
+	// reloads, and clearing the chain clears the kept rules too
+	require.Equal(t, [][]string{
+		{"--add-chain", "ipv4", "filter", "WEAVE-IN"},
+		{"--add-rule", "ipv4", "filter", "WEAVE-IN", "0", "-p", "esp", "-j", "ACCEPT"},
+		{"--add-rule", "ipv4", "filter", "INPUT", "0", "-j", "WEAVE-IN"},
+		{"--remove-rules", "ipv4", "filter", "WEAVE-IN"},
+		{"--remove-rule", "ipv4", "filter", "INPUT", "0", "-j", "WEAVE-IN"},
+		{"--remove-chain", "ipv4", "filter", "WEAVE-IN"},
+	}, c.permanent)
+}
+
+func TestFirewalldInsert(t *testing.T) {
+	c := &fakeFirewallCmd{chains: make(map[string][]string)}
+	defer func(cmd func(...string) (string, error)) { firewallCmd = cmd }(firewallCmd)
+	firewallCmd = c.run
+	f := &Firewalld{family: "ipv4"}
+
+	require.NoError(t, f.NewChain("filter", "WEAVE-IN"))
+	require.NoError(t, f.Insert("filter", "WEAVE-IN", 1, "-j", "RETURN"))
+	require.NoError(t, f.Append("filter", "WEAVE-IN", "-j", "DROP"))
+	require.NoError(t, f.Insert("filter", "WEAVE-IN", 1, "-p", "esp", "-j", "ACCEPT"))
+	require.NoError(t, f.Insert("filter", "WEAVE-IN", 4, "-j", "LOG"))
+	list, err := f.List("filter", "WEAVE-IN")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-N WEAVE-IN",
+		"-A WEAVE-IN -p esp -j ACCEPT",
+		"-A WEAVE-IN -j RETURN",
+		"-A WEAVE-IN -j DROP",
+		"-A WEAVE-IN -j LOG",
+	}, list)
+
+	// Between rules of priorities -1 and 0 there is no room
+	require.Error(t, f.Insert("filter", "WEAVE-IN", 3, "-j", "ACCEPT"))
+	require.Error(t, f.Insert("filter", "WEAVE-IN", 6, "-j", "ACCEPT"))
+	require.Error(t, f.Insert("filter", "WEAVE-IN", 0, "-j", "ACCEPT"))
+}
+
+func TestInsertPriority(t *testing.T) {
+	rules := []firewalldRule{{priority: "-1"}, {priority: "0"}, {priority: "5"}}
+	for _, tc := range []struct {
+		pos      int
+		priority int
+		ok       bool
+	}{
+		{pos: 1, priority: -2, ok: true},
+		{pos: 2},
+		{pos: 3, priority: 1, ok: true},
+		{pos: 4, priority: 6, ok: true},
+		{pos: 5},
+	} {
+		priority, err := insertPriority(rules, tc.pos)
+		if !tc.ok {
+			require.Error(t, err, "position %d", tc.pos)
+			continue
+		}
+		require.NoError(t, err, "position %d", tc.pos)
+		require.Equal(t, tc.priority, priority, "position %d", tc.pos)
+	}
+	priority, err := insertPriority(nil, 1)
+	require.NoError(t, err)
+	require.Equal(t, -1, priority)
+}
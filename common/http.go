@@ -1,9 +1,15 @@
 package common
 
 import (
+	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// How long a subsystem log level set over HTTP lasts, if not specified
+const defaultLogLevelTimeout = 10 * time.Minute
+
 type loggingHandler struct {
 	next http.Handler
 }
@@ -16,3 +22,34 @@ func (l *loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func LoggingHTTPHandler(h http.Handler) http.Handler {
 	return &loggingHandler{next: h}
 }
+
+// LogLevelHTTPHandler serves, under /log-level/, a GET of the levels
+// of all subsystems, and a PUT of /log-level/<subsystem> with form
+// values level and (optionally) timeout, which overrides the level of
+// that subsystem for a while.
+func LogLevelHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/log-level"), "/")
+		switch {
+		case r.Method == "GET" && name == "":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(SubsystemLogLevels())
+		case r.Method == "PUT" && name != "":
+			timeout := defaultLogLevelTimeout
+			if str := r.FormValue("timeout"); str != "" {
+				var err error
+				if timeout, err = time.ParseDuration(str); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := SetSubsystemLogLevel(name, r.FormValue("level"), timeout); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			Log.Infof("[http] log level of %s set to %s for %s", name, r.FormValue("level"), timeout)
+		default:
+			http.Error(w, "unsupported method or path", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// IPSets manages ipsets, sets of addresses or networks which a single
+// iptables rule matches with "-m set --match-set <name>", in constant
+// time however many there are, rather than one rule per address.
+// The zero value runs the ipset binary.
+type IPSets struct{}
+
+// Create creates the set name of setType, e.g. hash:ip or hash:net,
+// failing if it exists
+func (IPSets) Create(name, setType string) error {
+	return ipset("create", name, setType)
+}
+
+// Add adds entry to the set name, failing if it is there
+func (IPSets) Add(name, entry string) error {
+	return ipset("add", name, entry)
+}
+
+// Del deletes entry from the set name, failing if it is not there
+func (IPSets) Del(name, entry string) error {
+	return ipset("del", name, entry)
+}
+
+// Flush empties the set name, or every set if name is empty
+func (IPSets) Flush(name string) error {
+	return ipset(withName("flush", name)...)
+}
+
+// Swap exchanges the contents of the sets from and to, which must be
+// of the same type, at once, so that the rules matching either see
+// the old contents or the new
+func (IPSets) Swap(from, to string) error {
+	return ipset("swap", from, to)
+}
+
+// Destroy deletes the set name, which no rule may match, or every such
+// set if name is empty
+func (IPSets) Destroy(name string) error {
+	return ipset(withName("destroy", name)...)
+}
+
+// Restore has the set name of setType, created if it is missing,
+// hold entries and nothing else, replacing its contents at once
+func (IPSets) Restore(name, setType string, entries []string) error {
+	input := ipsetRestoreInput(name, setType, entries)
+	cmd := exec.Command("ipset", "restore", "-exist")
+	cmd.Stdin = strings.NewReader(input)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ipset restore of %s failed: %s: %s", name, err, output)
+	}
+	return nil
+}
+
+// ipsetRestoreInput returns the input to ipset restore -exist which
+// fills a set alongside name with entries and swaps it for name
+func ipsetRestoreInput(name, setType string, entries []string) string {
+	tmp := ipsetTempName(name)
+	lines := []string{
+		"create " + tmp + " " + setType,
+		"flush " + tmp,
+	}
+	for _, entry := range entries {
+		lines = append(lines, "add "+tmp+" "+entry)
+	}
+	lines = append(lines,
+		"create "+name+" "+setType,
+		"swap "+tmp+" "+name,
+		"destroy "+tmp)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// ipsetMaxNameLen is how long the name of an ipset can be
+const ipsetMaxNameLen = 31
+
+// ipsetTempName returns the name of the set Restore fills for name
+func ipsetTempName(name string) string {
+	if len(name) > ipsetMaxNameLen-2 {
+		name = name[:ipsetMaxNameLen-2]
+	}
+	return name + "-r"
+}
+
+func withName(op, name string) []string {
+	if name == "" {
+		return []string{op}
+	}
+	return []string{op, name}
+}
+
+func ipset(args ...string) error {
+	if output, err := exec.Command("ipset", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ipset %v failed: %s: %s", args, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPSetRestoreInput(t *testing.T) {
+	require.Equal(t, `create weave-expose-r hash:net
+flush weave-expose-r
+add weave-expose-r 10.32.0.0/12
+add weave-expose-r 10.96.0.0/12
+create weave-expose hash:net
+swap weave-expose-r weave-expose
+destroy weave-expose-r
+`, ipsetRestoreInput("weave-expose", "hash:net", []string{"10.32.0.0/12", "10.96.0.0/12"}))
+
+	long := "weave-0123456789012345678901234"
+	require.Len(t, ipsetTempName(long), ipsetMaxNameLen)
+	require.NotEqual(t, long, ipsetTempName(long))
+}
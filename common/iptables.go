@@ -0,0 +1,159 @@
+package common
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	// How many times, and how soon at first, to try an iptables
+	// operation again while another process holds the xtables lock;
+	// the wait doubles each time, for up to ~3s in all
+	xtablesLockAttempts       = 6
+	xtablesLockInitialBackoff = 100 * time.Millisecond
+)
+
+// IPTablesBackend is what is done with the rules and chains of a
+// netfilter table. IPTables implements it; anything else which does,
+// e.g. NFTables or DualStack, or testing/netfilter's MockIPTables in
+// tests, can be used in its place.
+type IPTablesBackend interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	// List returns the rules of chain, as iptables -S prints them
+	List(table, chain string) ([]string, error)
+	NewChain(table, chain string) error
+	// ClearChain flushes chain, creating it if it is missing
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+}
+
+// IPTables is an iptables.IPTables, which passes --wait where iptables
+// supports it, whose operations are tried again, a bounded number of
+// times, when they fail because the xtables lock is held, e.g. by
+// kube-proxy or another CNI plugin, rather than failing outright.
+type IPTables struct {
+	*iptables.IPTables
+	proto iptables.Protocol
+}
+
+// NewIPTables returns an IPTables for IPv4
+func NewIPTables() (*IPTables, error) {
+	ipt, err := iptables.New()
+	if err != nil {
+		return nil, err
+	}
+	return &IPTables{IPTables: ipt, proto: iptables.ProtocolIPv4}, nil
+}
+
+// NewIPTablesWithProtocol returns an IPTables for proto
+func NewIPTablesWithProtocol(proto iptables.Protocol) (*IPTables, error) {
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, err
+	}
+	return &IPTables{IPTables: ipt, proto: proto}, nil
+}
+
+// xtablesLocked returns whether err is from iptables failing to take
+// the xtables lock
+func xtablesLocked(err error) bool {
+	var exitErr *exec.ExitError
+	switch ierr := err.(type) {
+	case *iptables.Error:
+		exitErr = &ierr.ExitError
+	case *RestoreError:
+		exitErr = &ierr.ExitError
+	default:
+		return false
+	}
+	// (magic exit code 4 found in iptables source code; undocumented)
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 4 {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "xtables lock") || strings.Contains(msg, "Resource temporarily unavailable")
+}
+
+// retryLocked calls f until it doesn't fail because the xtables lock is
+// held, backing off in between, or it has been tried
+// xtablesLockAttempts times
+func retryLocked(f func() error) error {
+	backoff := xtablesLockInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt == xtablesLockAttempts || !xtablesLocked(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// name is that of the backend, in metrics
+func (ipt *IPTables) name() string {
+	if ipt.proto == iptables.ProtocolIPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (ipt *IPTables) Exists(table, chain string, rulespec ...string) (exists bool, err error) {
+	defer observe(ipt.name(), "exists", table, time.Now(), &err)
+	err = retryLocked(func() error {
+		exists, err = ipt.IPTables.Exists(table, chain, rulespec...)
+		return err
+	})
+	return
+}
+
+func (ipt *IPTables) Insert(table, chain string, pos int, rulespec ...string) (err error) {
+	defer observe(ipt.name(), "insert", table, time.Now(), &err)
+	return retryLocked(func() error { return ipt.IPTables.Insert(table, chain, pos, rulespec...) })
+}
+
+func (ipt *IPTables) Append(table, chain string, rulespec ...string) (err error) {
+	defer observe(ipt.name(), "append", table, time.Now(), &err)
+	return retryLocked(func() error { return ipt.IPTables.Append(table, chain, rulespec...) })
+}
+
+func (ipt *IPTables) AppendUnique(table, chain string, rulespec ...string) (err error) {
+	defer observe(ipt.name(), "append_unique", table, time.Now(), &err)
+	return retryLocked(func() error { return ipt.IPTables.AppendUnique(table, chain, rulespec...) })
+}
+
+func (ipt *IPTables) Delete(table, chain string, rulespec ...string) (err error) {
+	defer observe(ipt.name(), "delete", table, time.Now(), &err)
+	return retryLocked(func() error { return ipt.IPTables.Delete(table, chain, rulespec...) })
+}
+
+func (ipt *IPTables) List(table, chain string) (rules []string, err error) {
+	defer observe(ipt.name(), "list", table, time.Now(), &err)
+	err = retryLocked(func() error {
+		rules, err = ipt.IPTables.List(table, chain)
+		return err
+	})
+	return
+}
+
+func (ipt *IPTables) NewChain(table, chain string) (err error) {
+	defer observe(ipt.name(), "new_chain", table, time.Now(), &err)
+	return retryLocked(func() error { return ipt.IPTables.NewChain(table, chain) })
+}
+
+func (ipt *IPTables) ClearChain(table, chain string) (err error) {
+	defer observe(ipt.name(), "clear_chain", table, time.Now(), &err)
+	return retryLocked(func() error { return ipt.IPTables.ClearChain(table, chain) })
+}
+
+func (ipt *IPTables) DeleteChain(table, chain string) (err error) {
+	defer observe(ipt.name(), "delete_chain", table, time.Now(), &err)
+	return retryLocked(func() error { return ipt.IPTables.DeleteChain(table, chain) })
+}
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The variants of iptables: legacy, with the kernel's x_tables, and
+// nft, which translates to nf_tables. Rules of one are unseen by the
+// other, and both apply, so whichever the host's other software, e.g.
+// kube-proxy and docker, uses is the one to add rules with.
+const (
+	IPTablesModeAuto   = "auto"
+	IPTablesModeLegacy = "legacy"
+	IPTablesModeNFT    = "nft"
+)
+
+// iptablesBinaries are those useIPTablesMode has run in a mode
+var iptablesBinaries = []string{
+	"iptables", "iptables-save", "iptables-restore",
+	"ip6tables", "ip6tables-save", "ip6tables-restore",
+}
+
+// SetIPTablesMode has the iptables binaries run from then on, by weave
+// and the programs it runs, be those of mode: legacy, nft, or auto,
+// which picks the one with weave's rules in place, else, as kube-proxy
+// does, that with more rules, and leaves them as they are where the
+// host has only one. Auto fails where weave's rules are in both, as
+// then some of them are unseen by the other. It returns the mode
+// chosen; empty where there was no choice to make.
+func SetIPTablesMode(mode string) (string, error) {
+	switch mode {
+	case IPTablesModeAuto:
+		legacy, nft, found := iptablesModeRules()
+		if !found {
+			return "", nil
+		}
+		if legacy.weave > 0 && nft.weave > 0 {
+			return "", fmt.Errorf("weave's iptables rules are in both iptables-legacy (%d) and iptables-nft (%d); remove those of the one not in use, e.g. by rebooting, or choose one explicitly", legacy.weave, nft.weave)
+		}
+		mode = chooseIPTablesMode(legacy, nft)
+	case IPTablesModeLegacy, IPTablesModeNFT:
+	default:
+		return "", fmt.Errorf("unknown iptables mode %q (auto, legacy or nft)", mode)
+	}
+	return mode, useIPTablesMode(mode)
+}
+
+// iptablesModeCount is how many rules, and of those weave's, one
+// variant of iptables has
+type iptablesModeCount struct {
+	rules int
+	weave int
+}
+
+// chooseIPTablesMode returns the mode of the variant with weave's
+// rules, else of that with more rules, else nft
+func chooseIPTablesMode(legacy, nft iptablesModeCount) string {
+	switch {
+	case legacy.weave > 0:
+		return IPTablesModeLegacy
+	case nft.weave > 0:
+		return IPTablesModeNFT
+	case legacy.rules > nft.rules:
+		return IPTablesModeLegacy
+	}
+	return IPTablesModeNFT
+}
+
+// iptablesModeRules counts the rules of each variant, returning
+// whether both are installed
+func iptablesModeRules() (legacy, nft iptablesModeCount, found bool) {
+	for _, v := range []string{"legacy", "nft"} {
+		if _, err := exec.LookPath("iptables-" + v + "-save"); err != nil {
+			return legacy, nft, false
+		}
+	}
+	return countIPTablesRules("legacy"), countIPTablesRules("nft"), true
+}
+
+func countIPTablesRules(mode string) iptablesModeCount {
+	var count iptablesModeCount
+	for _, save := range []string{"iptables-" + mode + "-save", "ip6tables-" + mode + "-save"} {
+		// Failing, e.g. as the kernel lacks ip6tables, is no rules
+		output, _ := exec.Command(save).Output()
+		c := countSavedRules(output)
+		count.rules += c.rules
+		count.weave += c.weave
+	}
+	return count
+}
+
+// countSavedRules counts the rules in what iptables-save printed
+func countSavedRules(saved []byte) iptablesModeCount {
+	var count iptablesModeCount
+	scanner := bufio.NewScanner(bytes.NewReader(saved))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		count.rules++
+		if strings.Contains(line, "WEAVE") {
+			count.weave++
+		}
+	}
+	return count
+}
+
+// useIPTablesMode puts first in PATH a directory in which each of
+// iptablesBinaries is a link to that of mode, e.g. iptables to
+// iptables-legacy
+func useIPTablesMode(mode string) error {
+	dir := filepath.Join(os.TempDir(), "weave-iptables-"+mode)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, name := range iptablesBinaries {
+		target, err := exec.LookPath(modeBinary(name, mode))
+		if err != nil {
+			return fmt.Errorf("iptables mode %s: %s", mode, err)
+		}
+		link := filepath.Join(dir, name)
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(target, link); err != nil {
+			return err
+		}
+	}
+	return os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// modeBinary returns the name of the binary of mode for name, e.g.
+// iptables-legacy-save for iptables-save
+func modeBinary(name, mode string) string {
+	i := strings.Index(name, "-")
+	if i < 0 {
+		return name + "-" + mode
+	}
+	return name[:i] + "-" + mode + name[i:]
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChooseIPTablesMode(t *testing.T) {
+	saved := []byte(`*nat
+:PREROUTING ACCEPT [0:0]
+:WEAVE - [0:0]
+-A POSTROUTING -j WEAVE
+-A WEAVE -s 10.32.0.0/12 -d 224.0.0.0/4 -j RETURN
+-A DOCKER -i docker0 -j RETURN
+COMMIT
+`)
+	count := countSavedRules(saved)
+	require.Equal(t, iptablesModeCount{rules: 3, weave: 2}, count)
+
+	for _, c := range []struct {
+		legacy, nft iptablesModeCount
+		expected    string
+	}{
+		{iptablesModeCount{}, iptablesModeCount{}, IPTablesModeNFT},
+		{iptablesModeCount{rules: 10}, iptablesModeCount{rules: 2}, IPTablesModeLegacy},
+		{iptablesModeCount{rules: 2}, iptablesModeCount{rules: 10}, IPTablesModeNFT},
+		// Weave's own rules decide, e.g. on restarting
+		{iptablesModeCount{rules: 2, weave: 2}, iptablesModeCount{rules: 10}, IPTablesModeLegacy},
+		{iptablesModeCount{rules: 10}, iptablesModeCount{rules: 2, weave: 2}, IPTablesModeNFT},
+	} {
+		require.Equal(t, c.expected, chooseIPTablesMode(c.legacy, c.nft))
+	}
+
+	require.Equal(t, "iptables-legacy", modeBinary("iptables", IPTablesModeLegacy))
+	require.Equal(t, "ip6tables-nft-restore", modeBinary("ip6tables-restore", IPTablesModeNFT))
+}
@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -51,7 +55,117 @@ func SetLogLevel(levelname string) {
 	if err != nil {
 		Log.Fatal(err)
 	}
-	Log.Level = level
+	subsystems.Lock()
+	defer subsystems.Unlock()
+	setLevel(Log, level)
+	for _, s := range subsystems.byName {
+		if s.revert == nil {
+			setLevel(s.Logger, level)
+		}
+	}
+}
+
+// setLevel sets the level of logger while others may be logging
+// through it, as logrus' own SetLevel does: atomically, as logrus
+// reads it.
+func setLevel(logger *logrus.Logger, level logrus.Level) {
+	atomic.StoreUint32((*uint32)(&logger.Level), uint32(level))
+}
+
+func getLevel(logger *logrus.Logger) logrus.Level {
+	return logrus.Level(atomic.LoadUint32((*uint32)(&logger.Level)))
+}
+
+// Subsystems, such as odp or ipam, log through loggers of their own.
+// These follow the level of Log, except while it has been overridden
+// with SetSubsystemLogLevel, so that one subsystem can be debugged in
+// production without drowning in the output of all the others.
+type subsystemLogger struct {
+	*logrus.Logger
+	revert *time.Timer
+	until  time.Time
+}
+
+var subsystems = struct {
+	sync.Mutex
+	byName map[string]*subsystemLogger
+}{byName: make(map[string]*subsystemLogger)}
+
+// SubsystemLog returns the logger of the named subsystem
+func SubsystemLog(name string) *logrus.Logger {
+	subsystems.Lock()
+	defer subsystems.Unlock()
+	if s, found := subsystems.byName[name]; found {
+		return s.Logger
+	}
+	logger := logrus.New()
+	logger.Formatter = standardTextFormatter
+	logger.Level = getLevel(Log)
+	subsystems.byName[name] = &subsystemLogger{Logger: logger}
+	return logger
+}
+
+// SetSubsystemLogLevel sets the level of the named subsystem, which
+// reverts to that of Log once timeout has passed.
+func SetSubsystemLogLevel(name, levelname string, timeout time.Duration) error {
+	level, err := logrus.ParseLevel(levelname)
+	if err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("invalid timeout %s", timeout)
+	}
+	subsystems.Lock()
+	defer subsystems.Unlock()
+	s, found := subsystems.byName[name]
+	if !found {
+		return fmt.Errorf("unknown subsystem %q", name)
+	}
+	if s.revert != nil {
+		s.revert.Stop()
+	}
+	setLevel(s.Logger, level)
+	s.until = time.Now().Add(timeout)
+	var revert *time.Timer
+	revert = time.AfterFunc(timeout, func() {
+		subsystems.Lock()
+		defer subsystems.Unlock()
+		// We may have lost a race with a later override
+		if s.revert == revert {
+			setLevel(s.Logger, getLevel(Log))
+			s.revert = nil
+		}
+	})
+	s.revert = revert
+	return nil
+}
+
+type SubsystemLogLevel struct {
+	Name  string
+	Level string
+	Until *time.Time `json:"Until,omitempty"` // when an override expires
+}
+
+// SubsystemLogLevels returns the current level of every subsystem
+func SubsystemLogLevels() []SubsystemLogLevel {
+	subsystems.Lock()
+	defer subsystems.Unlock()
+	var names []string
+	for name := range subsystems.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var levels []SubsystemLogLevel
+	for _, name := range names {
+		s := subsystems.byName[name]
+		level := SubsystemLogLevel{Name: name, Level: getLevel(s.Logger).String()}
+		if s.revert != nil {
+			until := s.until
+			level.Until = &until
+		}
+		levels = append(levels, level)
+	}
+	return levels
 }
 
 func CheckFatal(e error) {
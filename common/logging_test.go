@@ -0,0 +1,117 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func subsystemLogLevel(name string) *SubsystemLogLevel {
+	for _, level := range SubsystemLogLevels() {
+		if level.Name == name {
+			return &level
+		}
+	}
+	return nil
+}
+
+func TestSetSubsystemLogLevel(t *testing.T) {
+	SetLogLevel("info")
+	logger := SubsystemLog("logtest-set")
+	other := SubsystemLog("logtest-other")
+	require.Equal(t, logrus.InfoLevel, getLevel(logger))
+
+	require.NoError(t, SetSubsystemLogLevel("logtest-set", "debug", time.Hour))
+	require.Equal(t, logrus.DebugLevel, getLevel(logger))
+	require.Equal(t, logrus.InfoLevel, getLevel(other))
+	level := subsystemLogLevel("logtest-set")
+	require.NotNil(t, level)
+	require.Equal(t, "debug", level.Level)
+	require.NotNil(t, level.Until)
+	require.Nil(t, subsystemLogLevel("logtest-other").Until)
+
+	// The override outlasts changes to the level of everything else
+	SetLogLevel("warning")
+	require.Equal(t, logrus.DebugLevel, getLevel(logger))
+	require.Equal(t, logrus.WarnLevel, getLevel(other))
+	SetLogLevel("info")
+
+	require.Error(t, SetSubsystemLogLevel("logtest-unknown", "debug", time.Hour))
+	require.Error(t, SetSubsystemLogLevel("logtest-set", "chatty", time.Hour))
+	require.Error(t, SetSubsystemLogLevel("logtest-set", "debug", 0))
+	require.Equal(t, logrus.DebugLevel, getLevel(logger))
+}
+
+func TestSubsystemLogLevelReverts(t *testing.T) {
+	SetLogLevel("info")
+	logger := SubsystemLog("logtest-revert")
+
+	// A later override replaces the earlier, and its timeout with it
+	require.NoError(t, SetSubsystemLogLevel("logtest-revert", "error", 10*time.Millisecond))
+	require.NoError(t, SetSubsystemLogLevel("logtest-revert", "debug", time.Hour))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, logrus.DebugLevel, getLevel(logger))
+
+	require.NoError(t, SetSubsystemLogLevel("logtest-revert", "debug", 10*time.Millisecond))
+	deadline := time.Now().Add(5 * time.Second)
+	for getLevel(logger) != logrus.InfoLevel && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, logrus.InfoLevel, getLevel(logger))
+	require.Nil(t, subsystemLogLevel("logtest-revert").Until)
+}
+
+func TestLogLevelHTTPHandler(t *testing.T) {
+	SetLogLevel("info")
+	logger := SubsystemLog("logtest-http")
+	handler := LogLevelHTTPHandler()
+	serve := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("PUT", "/log-level/logtest-http", url.Values{"level": {"debug"}, "timeout": {"1h"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, logrus.DebugLevel, getLevel(logger))
+
+	w = serve("GET", "/log-level", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var levels []SubsystemLogLevel
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&levels))
+	var found bool
+	for _, level := range levels {
+		if level.Name == "logtest-http" {
+			found = true
+			require.Equal(t, "debug", level.Level)
+			require.NotNil(t, level.Until)
+		}
+	}
+	require.True(t, found)
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+		code   int
+	}{
+		{name: "unknown subsystem", method: "PUT", path: "/log-level/logtest-unknown", form: url.Values{"level": {"debug"}}, code: http.StatusBadRequest},
+		{name: "unknown level", method: "PUT", path: "/log-level/logtest-http", form: url.Values{"level": {"chatty"}}, code: http.StatusBadRequest},
+		{name: "invalid timeout", method: "PUT", path: "/log-level/logtest-http", form: url.Values{"level": {"info"}, "timeout": {"soon"}}, code: http.StatusBadRequest},
+		{name: "no subsystem", method: "PUT", path: "/log-level", form: url.Values{"level": {"debug"}}, code: http.StatusMethodNotAllowed},
+		{name: "unsupported method", method: "DELETE", path: "/log-level/logtest-http", code: http.StatusMethodNotAllowed},
+	} {
+		require.Equal(t, tc.code, serve(tc.method, tc.path, tc.form).Code, tc.name)
+	}
+	require.Equal(t, logrus.DebugLevel, getLevel(logger))
+}
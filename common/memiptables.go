@@ -0,0 +1,171 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// MemIPTables is an IPTablesBackend holding its tables in memory, so
+// that weaver --simulate can run everything which manages firewall
+// rules, e.g. encryption, as an unprivileged process, and the rules can
+// still be listed and reported.
+type MemIPTables struct {
+	sync.Mutex
+	chains map[string][]string // "table chain" -> rulespecs joined by spaces
+}
+
+// memBuiltinChains are those of the tables a MemIPTables starts with
+var memBuiltinChains = map[string][]string{
+	"filter": {"INPUT", "FORWARD", "OUTPUT"},
+	"mangle": {"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"},
+	"nat":    {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
+	"raw":    {"PREROUTING", "OUTPUT"},
+}
+
+var (
+	memTablesLock sync.Mutex
+	memTables     = make(map[iptables.Protocol]*MemIPTables)
+)
+
+// NewMemIPTables returns an empty MemIPTables, with the built-in
+// chains of the filter, mangle, nat and raw tables
+func NewMemIPTables() *MemIPTables {
+	ipt := &MemIPTables{chains: make(map[string][]string)}
+	for table, chains := range memBuiltinChains {
+		for _, chain := range chains {
+			ipt.chains[table+" "+chain] = nil
+		}
+	}
+	return ipt
+}
+
+// memIPTables returns the MemIPTables of proto, shared by every
+// backend the memory netfilter backend returns, as the kernel's tables
+// are
+func memIPTables(proto iptables.Protocol) *MemIPTables {
+	memTablesLock.Lock()
+	defer memTablesLock.Unlock()
+	ipt, found := memTables[proto]
+	if !found {
+		ipt = NewMemIPTables()
+		memTables[proto] = ipt
+	}
+	return ipt
+}
+
+func (ipt *MemIPTables) rules(table, chain string) ([]string, error) {
+	rules, found := ipt.chains[table+" "+chain]
+	if !found {
+		return nil, fmt.Errorf("no chain %s in table %s", chain, table)
+	}
+	return rules, nil
+}
+
+func (ipt *MemIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	return containsRule(rules, strings.Join(rulespec, " ")), err
+}
+
+func (ipt *MemIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	if err != nil {
+		return err
+	}
+	if pos < 1 || pos > len(rules)+1 {
+		return fmt.Errorf("index of insertion %d out of range in chain %s of table %s", pos, chain, table)
+	}
+	rules = append(rules[:pos-1:pos-1], append([]string{strings.Join(rulespec, " ")}, rules[pos-1:]...)...)
+	ipt.chains[table+" "+chain] = rules
+	return nil
+}
+
+func (ipt *MemIPTables) Append(table, chain string, rulespec ...string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	if err != nil {
+		return err
+	}
+	ipt.chains[table+" "+chain] = append(rules, strings.Join(rulespec, " "))
+	return nil
+}
+
+func (ipt *MemIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	if err != nil {
+		return err
+	}
+	if rule := strings.Join(rulespec, " "); !containsRule(rules, rule) {
+		ipt.chains[table+" "+chain] = append(rules, rule)
+	}
+	return nil
+}
+
+func (ipt *MemIPTables) Delete(table, chain string, rulespec ...string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	if err != nil {
+		return err
+	}
+	rules = append([]string(nil), rules...)
+	if !removeRule(&rules, strings.Join(rulespec, " ")) {
+		return fmt.Errorf("no such rule in chain %s of table %s: %s", chain, table, strings.Join(rulespec, " "))
+	}
+	ipt.chains[table+" "+chain] = rules
+	return nil
+}
+
+func (ipt *MemIPTables) List(table, chain string) ([]string, error) {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	list := []string{"-N " + chain}
+	for _, rule := range rules {
+		list = append(list, "-A "+chain+" "+rule)
+	}
+	return list, nil
+}
+
+func (ipt *MemIPTables) NewChain(table, chain string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	if _, err := ipt.rules(table, chain); err == nil {
+		return fmt.Errorf("chain %s already exists in table %s", chain, table)
+	}
+	ipt.chains[table+" "+chain] = nil
+	return nil
+}
+
+func (ipt *MemIPTables) ClearChain(table, chain string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	ipt.chains[table+" "+chain] = nil
+	return nil
+}
+
+func (ipt *MemIPTables) DeleteChain(table, chain string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	switch {
+	case err != nil:
+		return err
+	case len(rules) != 0:
+		return fmt.Errorf("chain %s of table %s is not empty", chain, table)
+	}
+	delete(ipt.chains, table+" "+chain)
+	return nil
+}
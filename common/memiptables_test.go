@@ -0,0 +1,58 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemIPTables(t *testing.T) {
+	ipt := NewMemIPTables()
+	require.NoError(t, ipt.NewChain("filter", "WEAVE"))
+	require.Error(t, ipt.NewChain("filter", "WEAVE"))
+	require.NoError(t, ipt.Append("filter", "WEAVE", "-j", "DROP"))
+	require.NoError(t, ipt.Insert("filter", "WEAVE", 1, "-s", "10.32.0.0/12", "-j", "ACCEPT"))
+	require.NoError(t, ipt.Insert("filter", "WEAVE", 3, "-j", "LOG"))
+	require.Error(t, ipt.Insert("filter", "WEAVE", 5, "-j", "RETURN"), "beyond the end")
+	require.NoError(t, ipt.AppendUnique("filter", "WEAVE", "-j", "DROP"))
+
+	rules, err := ipt.List("filter", "WEAVE")
+	require.NoError(t, err)
+	require.Equal(t, []string{"-N WEAVE", "-A WEAVE -s 10.32.0.0/12 -j ACCEPT", "-A WEAVE -j DROP", "-A WEAVE -j LOG"}, rules)
+	exists, err := ipt.Exists("filter", "WEAVE", "-j", "DROP")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	require.Error(t, ipt.DeleteChain("filter", "WEAVE"), "not empty")
+	require.NoError(t, ipt.Delete("filter", "WEAVE", "-j", "DROP"))
+	require.Error(t, ipt.Delete("filter", "WEAVE", "-j", "DROP"))
+	require.NoError(t, ipt.ClearChain("filter", "WEAVE"))
+	require.NoError(t, ipt.DeleteChain("filter", "WEAVE"))
+	_, err = ipt.List("filter", "WEAVE")
+	require.Error(t, err)
+	_, err = ipt.List("raw", "PREROUTING")
+	require.NoError(t, err)
+}
+
+func TestMemoryNetfilterBackend(t *testing.T) {
+	defer func(backend string) { netfilterBackend = backend }(netfilterBackend)
+	_, err := SetNetfilterBackend(netfilterMemory)
+	require.Error(t, err, "only for --simulate")
+	require.Equal(t, netfilterMemory, SimulateNetfilter())
+
+	// Backends share the tables of their protocol, as the kernel's are
+	a, err := NewIPTablesBackend(iptables.ProtocolIPv4)
+	require.NoError(t, err)
+	b, err := NewIPTablesBackend(iptables.ProtocolIPv4)
+	require.NoError(t, err)
+	require.NoError(t, a.NewChain("filter", "WEAVE-MEM-TEST"))
+	defer a.DeleteChain("filter", "WEAVE-MEM-TEST")
+	_, err = b.List("filter", "WEAVE-MEM-TEST")
+	require.NoError(t, err)
+
+	ip6t, err := NewIPTablesBackend(iptables.ProtocolIPv6)
+	require.NoError(t, err)
+	_, err = ip6t.List("filter", "WEAVE-MEM-TEST")
+	require.Error(t, err)
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NetfilterMetrics is a prometheus.Collector of the operations of
+// IPTables and NFTables: how long they take, by backend, operation and
+// table, and how many of them fail, also by why.
+var NetfilterMetrics prometheus.Collector = netfilterMetrics
+
+type netfilterMetricsCollector struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+var netfilterMetrics = &netfilterMetricsCollector{
+	duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "weave_netfilter_operation_duration_seconds",
+		Help:    "Time taken by iptables, ip6tables and nftables operations, including retries while the xtables lock is held; its count is that of operations.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"backend", "operation", "table"}),
+	errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "weave_netfilter_errors_total",
+		Help: "Number of iptables, ip6tables and nftables operations which failed, by reason: lock (contention for the xtables lock), module (a kernel module is missing), chain (a chain is missing), rule (the rule is invalid, or to delete missing), permission, or other.",
+	}, []string{"backend", "operation", "table", "reason"}),
+}
+
+func (m *netfilterMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	m.duration.Describe(ch)
+	m.errors.Describe(ch)
+}
+
+func (m *netfilterMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	m.duration.Collect(ch)
+	m.errors.Collect(ch)
+}
+
+// observe records an operation started at start, which failed if *errp
+// isn't nil, in which case it makes *errp a NetfilterError
+func observe(backend, op, table string, start time.Time, errp *error) {
+	netfilterMetrics.duration.WithLabelValues(backend, op, table).Observe(time.Since(start).Seconds())
+	if *errp != nil {
+		if _, wrapped := (*errp).(*NetfilterError); wrapped {
+			// Of an operation within this one, already counted
+			return
+		}
+		e := newNetfilterError(backend, op, table, *errp)
+		netfilterMetrics.errors.WithLabelValues(backend, op, table, e.Reason).Inc()
+		*errp = e
+	}
+}
+
+// failureReason returns why a netfilter operation failed with err,
+// from what iptables and nft print
+func failureReason(err error) string {
+	if xtablesLocked(err) {
+		return FailureLock
+	}
+	msg := err.Error()
+	has := func(substrs ...string) bool {
+		for _, s := range substrs {
+			if strings.Contains(msg, s) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("Permission denied", "Operation not permitted", "you must be root"):
+		return FailurePermission
+	case has("insmod", "missing kernel module", "Couldn't load match", "Table does not exist", "Operation not supported"):
+		return FailureModule
+	case has("No chain/target/match by that name", "Couldn't load target", "No such file or directory"):
+		return FailureChain
+	case has("Bad argument", "Bad rule", "Invalid argument", "unknown option", "Syntax error", "syntax error", "not supported with nftables", "no rule"):
+		return FailureRule
+	}
+	return FailureOther
+}
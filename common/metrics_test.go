@@ -0,0 +1,22 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureReason(t *testing.T) {
+	for msg, reason := range map[string]string{
+		"iptables: Permission denied (you must be root).":                                 "permission",
+		"iptables v1.6.1: Couldn't load match `policy':No such file or directory":         "module",
+		"iptables v1.6.1: can't initialize iptables table `mangle': Table does not exist": "module",
+		"iptables: No chain/target/match by that name.":                                   "chain",
+		"iptables: Bad rule (does a matching rule exist in that chain?).":                 "rule",
+		"match physdev is not supported with nftables":                                    "rule",
+		"exit status 3": "other",
+	} {
+		require.Equal(t, reason, failureReason(errors.New(msg)), msg)
+	}
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// The netfilter backends NewIPTablesBackend can return rules managers of
+const (
+	NetfilterAuto     = "auto"
+	NetfilterIPTables = "iptables"
+	NetfilterNFTables = "nftables"
+	// Through firewalld, on hosts it manages, so that the rules
+	// survive it reloading
+	NetfilterFirewalld = "firewalld"
+)
+
+// Tables held in memory, leaving the kernel's alone, for weaver
+// --simulate; not for users to choose, as nothing would be protected
+const netfilterMemory = "memory"
+
+var netfilterBackend = NetfilterIPTables
+
+// SetNetfilterBackend chooses what NewIPTablesBackend returns:
+// iptables, nftables, firewalld, or with auto nftables where nft is
+// installed and the iptables binary is missing or is the nft shim. It
+// returns the backend chosen.
+func SetNetfilterBackend(backend string) (string, error) {
+	switch backend {
+	case NetfilterAuto:
+		backend = detectNetfilterBackend()
+	case NetfilterIPTables, NetfilterNFTables, NetfilterFirewalld:
+	default:
+		return "", fmt.Errorf("unknown netfilter backend %q (auto, iptables, nftables or firewalld)", backend)
+	}
+	netfilterBackend = backend
+	return backend, nil
+}
+
+// SimulateNetfilter has NewIPTablesBackend return tables held in
+// memory, for weaver --simulate only. It returns the backend chosen.
+func SimulateNetfilter() string {
+	netfilterBackend = netfilterMemory
+	return netfilterBackend
+}
+
+func detectNetfilterBackend() string {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return NetfilterIPTables
+	}
+	output, err := exec.Command("iptables", "--version").CombinedOutput()
+	if err != nil || strings.Contains(string(output), "nf_tables") {
+		return NetfilterNFTables
+	}
+	return NetfilterIPTables
+}
+
+// NetfilterNFTablesChosen returns whether SetNetfilterBackend chose
+// nftables
+func NetfilterNFTablesChosen() bool {
+	return netfilterBackend == NetfilterNFTables
+}
+
+// NewIPTablesBackend returns an IPTablesBackend for proto, of the
+// backend chosen by SetNetfilterBackend; iptables if none was. Where
+// SetDryRun enabled dry runs, it is a DryRun over that.
+func NewIPTablesBackend(proto iptables.Protocol) (IPTablesBackend, error) {
+	switch netfilterBackend {
+	case NetfilterNFTables:
+		nft, err := NewNFTables(proto)
+		if err != nil {
+			return nil, err
+		}
+		return WithDryRun(nft), nil
+	case NetfilterFirewalld:
+		f, err := NewFirewalld(proto)
+		if err != nil {
+			return nil, err
+		}
+		return WithDryRun(f), nil
+	case netfilterMemory:
+		return WithDryRun(memIPTables(proto)), nil
+	}
+	ipt, err := NewIPTablesWithProtocol(proto)
+	if err != nil {
+		return nil, err
+	}
+	return WithDryRun(ipt), nil
+}
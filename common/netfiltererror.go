@@ -0,0 +1,122 @@
+package common
+
+import (
+	"regexp"
+)
+
+// Why a netfilter operation failed, as NetfilterError has it, and the
+// weave_netfilter_errors_total metric counts it
+const (
+	// Another process held the xtables lock for longer than IPTables
+	// tries again for; worth trying again later
+	FailureLock = "lock"
+	// A kernel module is missing, e.g. xt_esp or xt_policy; trying
+	// again won't help until it is loaded
+	FailureModule = "module"
+	// The chain is missing, e.g. as something else flushed it
+	FailureChain = "chain"
+	// The rule is invalid, or the one to delete missing
+	FailureRule = "rule"
+	// Not run as root, or without CAP_NET_ADMIN
+	FailurePermission = "permission"
+	FailureOther      = "other"
+)
+
+// NetfilterError is an operation of an IPTablesBackend failing, with
+// why, so that callers can tell what is worth trying again from what
+// needs the host fixing. Its message is that of the error it is of.
+type NetfilterError struct {
+	Backend string // iptables, ip6tables or nftables
+	Op      string // e.g. append, or restore
+	Table   string
+	Reason  string // one of the Failure constants
+	// Where Reason is FailureModule, the kernel module missing, where
+	// known, e.g. xt_policy
+	Module string
+	Err    error
+}
+
+func (e *NetfilterError) Error() string {
+	return e.Err.Error()
+}
+
+// newNetfilterError returns err, of op of backend on table, as a
+// NetfilterError
+func newNetfilterError(backend, op, table string, err error) *NetfilterError {
+	if e, ok := err.(*NetfilterError); ok {
+		return e
+	}
+	e := &NetfilterError{Backend: backend, Op: op, Table: table, Reason: failureReason(err), Err: err}
+	if e.Reason == FailureModule {
+		e.Module = missingModule(err.Error())
+	}
+	return e
+}
+
+// AsNetfilterError returns the NetfilterError err is, or wraps with
+// github.com/pkg/errors, if any
+func AsNetfilterError(err error) (*NetfilterError, bool) {
+	for err != nil {
+		if e, ok := err.(*NetfilterError); ok {
+			return e, true
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return nil, false
+}
+
+// NetfilterFailure returns why the netfilter operation which failed
+// with err did: one of the Failure constants. Where err isn't, nor
+// wraps, a NetfilterError, e.g. as it was formatted into another
+// error, it goes by the message.
+func NetfilterFailure(err error) string {
+	if e, ok := AsNetfilterError(err); ok {
+		return e.Reason
+	}
+	return failureReason(err)
+}
+
+// IsLockContention returns whether err is of a netfilter operation
+// failing as another process held the xtables lock
+func IsLockContention(err error) bool {
+	return err != nil && NetfilterFailure(err) == FailureLock
+}
+
+// IsModuleMissing returns whether err is of a netfilter operation
+// failing as the kernel lacks a module
+func IsModuleMissing(err error) bool {
+	return err != nil && NetfilterFailure(err) == FailureModule
+}
+
+// IsChainMissing returns whether err is of a netfilter operation
+// failing as the chain is missing
+func IsChainMissing(err error) bool {
+	return err != nil && NetfilterFailure(err) == FailureChain
+}
+
+// IsPermissionDenied returns whether err is of a netfilter operation
+// failing as the process lacks the privilege
+func IsPermissionDenied(err error) bool {
+	return err != nil && NetfilterFailure(err) == FailurePermission
+}
+
+var (
+	missingMatchRE = regexp.MustCompile("Couldn't load match `([a-z0-9_]+)'")
+	missingTableRE = regexp.MustCompile("can't initialize (ip6?)tables table `([a-z]+)'")
+)
+
+// missingModule returns the kernel module whose absence the message
+// of iptables shows, if it does
+func missingModule(msg string) string {
+	if m := missingMatchRE.FindStringSubmatch(msg); m != nil {
+		return "xt_" + m[1]
+	}
+	if m := missingTableRE.FindStringSubmatch(msg); m != nil {
+		return m[1] + "table_" + m[2]
+	}
+	return ""
+}
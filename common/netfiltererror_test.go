@@ -0,0 +1,34 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetfilterError(t *testing.T) {
+	err := errors.New("iptables v1.6.1: Couldn't load match `policy':No such file or directory")
+	observe("iptables", "append", "mangle", time.Now(), &err)
+	e, ok := AsNetfilterError(pkgerrors.Wrap(err, "iptables append"))
+	require.True(t, ok)
+	require.Equal(t, FailureModule, e.Reason)
+	require.Equal(t, "xt_policy", e.Module)
+	require.Equal(t, "mangle", e.Table)
+	require.Contains(t, err.Error(), "Couldn't load match")
+	require.True(t, IsModuleMissing(pkgerrors.Wrap(err, "iptables append")))
+	require.False(t, IsLockContention(err))
+
+	// Formatted into another error, it goes by the message
+	chain := fmt.Errorf("nat -A WEAVE: %s", errors.New("iptables: No chain/target/match by that name."))
+	require.True(t, IsChainMissing(chain))
+	require.False(t, IsPermissionDenied(chain))
+	require.False(t, IsChainMissing(nil))
+
+	require.Equal(t, "iptable_mangle", missingModule("iptables v1.6.1: can't initialize iptables table `mangle': Table does not exist"))
+	require.Equal(t, "ip6table_nat", missingModule("ip6tables v1.8.4 (legacy): can't initialize ip6tables table `nat': Table does not exist"))
+	require.Equal(t, "", missingModule("iptables: Bad rule"))
+}
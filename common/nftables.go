@@ -0,0 +1,534 @@
+package common
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	// nftTablePrefix prefixes the names of the nftables tables the
+	// rules of each iptables table are kept in, e.g. weave-filter, so
+	// that they are not mixed with those of iptables-nft, which can't
+	// list rules it didn't make
+	nftTablePrefix = "weave-"
+	// nftCommentPrefix starts the comment by which each rule is found
+	// again: the rulespec itself, or if that doesn't fit a hash of it
+	nftCommentPrefix = "weave:"
+	// nftCommentMax is how long a comment nft accepts
+	nftCommentMax = 128
+)
+
+// nftBaseChains are the chains of each iptables table which hook into
+// netfilter, with the same hooks and priorities as iptables', so that
+// rules run in the same order
+var nftBaseChains = map[string]map[string]string{
+	"filter": {
+		"INPUT":   "type filter hook input priority 0",
+		"FORWARD": "type filter hook forward priority 0",
+		"OUTPUT":  "type filter hook output priority 0",
+	},
+	"mangle": {
+		"PREROUTING":  "type filter hook prerouting priority -150",
+		"INPUT":       "type filter hook input priority -150",
+		"FORWARD":     "type filter hook forward priority -150",
+		"OUTPUT":      "type route hook output priority -150",
+		"POSTROUTING": "type filter hook postrouting priority -150",
+	},
+	"nat": {
+		"PREROUTING":  "type nat hook prerouting priority -100",
+		"INPUT":       "type nat hook input priority 100",
+		"OUTPUT":      "type nat hook output priority -100",
+		"POSTROUTING": "type nat hook postrouting priority 100",
+	},
+	"raw": {
+		"PREROUTING": "type filter hook prerouting priority -300",
+		"OUTPUT":     "type filter hook output priority -300",
+	},
+}
+
+// NFTables is an IPTablesBackend over nftables, for hosts where the
+// iptables binary is missing, or is the nft shim. Rulespecs are given
+// as to iptables, and translated to nft rules; only the matches and
+// targets weave uses are understood.
+type NFTables struct {
+	family string // "ip", "ip6", or "inet" for both
+
+	sync.Mutex
+	specs map[string][]string // rulespecs by the comment of a hash
+}
+
+// NewNFTables returns an NFTables for proto
+func NewNFTables(proto iptables.Protocol) (*NFTables, error) {
+	if proto == iptables.ProtocolIPv6 {
+		return newNFTables("ip6")
+	}
+	return newNFTables("ip")
+}
+
+func newNFTables(family string) (*NFTables, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, err
+	}
+	return &NFTables{family: family, specs: make(map[string][]string)}, nil
+}
+
+// nftRule is a rule of a chain, as listed
+type nftRule struct {
+	handle  string
+	comment string // empty if the rule isn't ours
+}
+
+var (
+	nftHandleRE  = regexp.MustCompile(`# handle (\d+)$`)
+	nftCommentRE = regexp.MustCompile(`comment "([^"]*)"`)
+)
+
+// run runs script with nft
+func (n *NFTables) run(script string) (string, error) {
+	cmd := exec.Command("nft", "-f", "/dev/stdin")
+	cmd.Stdin = strings.NewReader(script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("nft %q failed: %v: %s", script, err, output)
+	}
+	return string(output), nil
+}
+
+// Table returns the family and name of the nftables table the rules of
+// the iptables table are kept in, e.g. "ip weave-filter"
+func (n *NFTables) Table(table string) string {
+	return n.family + " " + nftTablePrefix + table
+}
+
+// ensure returns the commands adding table, and chain if it is a base
+// chain, which iptables has from the start, so that they can be used
+// at once
+func (n *NFTables) ensure(table, chain string) string {
+	script := "add table " + n.Table(table) + "\n"
+	if hook, ok := nftBaseChains[table][chain]; ok {
+		script += fmt.Sprintf("add chain %s %s { %s; policy accept; }\n", n.Table(table), chain, hook)
+	}
+	return script
+}
+
+// rules lists the rules of chain; the chain not existing is only an
+// error if it isn't a base chain
+func (n *NFTables) rules(table, chain string) ([]nftRule, error) {
+	output, err := n.run(n.ensure(table, chain) + fmt.Sprintf("list chain %s %s\n", n.Table(table), chain))
+	if err != nil {
+		return nil, err
+	}
+	var rules []nftRule
+	for _, line := range strings.Split(output, "\n") {
+		m := nftHandleRE.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		r := nftRule{handle: m[1]}
+		if c := nftCommentRE.FindStringSubmatch(line); c != nil && strings.HasPrefix(c[1], nftCommentPrefix) {
+			r.comment = c[1]
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// comment returns the comment of the rule with rulespec, remembering
+// the rulespec if the comment is a hash of it
+func (n *NFTables) comment(rulespec []string) string {
+	// What List returns of rules hashed by another process
+	if len(rulespec) == 4 && rulespec[0] == "-m" && rulespec[2] == "--comment" && strings.HasPrefix(rulespec[3], nftCommentPrefix) {
+		return rulespec[3]
+	}
+	spec := strings.Join(rulespec, " ")
+	if c := nftCommentPrefix + " " + spec; len(c) <= nftCommentMax && !strings.ContainsAny(spec, `"\`) && splitsBack(rulespec) {
+		return c
+	}
+	sum := sha1.Sum([]byte(spec))
+	c := nftCommentPrefix + hex.EncodeToString(sum[:8])
+	n.Lock()
+	n.specs[c] = rulespec
+	n.Unlock()
+	return c
+}
+
+// splitsBack returns whether rulespec, joined by spaces, splits back
+// into the same arguments, i.e. none is empty or has a space in it, as
+// the --comment of a rule may
+func splitsBack(rulespec []string) bool {
+	for _, arg := range rulespec {
+		if arg == "" || strings.Contains(arg, " ") {
+			return false
+		}
+	}
+	return true
+}
+
+// rulespec returns the rulespec of the rule with comment
+func (n *NFTables) rulespec(comment string) []string {
+	if spec := strings.TrimPrefix(comment, nftCommentPrefix+" "); spec != comment {
+		return strings.Split(spec, " ")
+	}
+	n.Lock()
+	defer n.Unlock()
+	if rulespec, ok := n.specs[comment]; ok {
+		return rulespec
+	}
+	return []string{"-m", "comment", "--comment", comment}
+}
+
+// find returns the handle of the first rule with rulespec in chain,
+// or "" if there is none
+func (n *NFTables) find(table, chain string, rulespec []string) (string, error) {
+	rules, err := n.rules(table, chain)
+	if err != nil {
+		return "", err
+	}
+	comment := n.comment(rulespec)
+	for _, r := range rules {
+		if r.comment == comment {
+			return r.handle, nil
+		}
+	}
+	return "", nil
+}
+
+// statement returns the nft rule of rulespec, with its comment
+func (n *NFTables) statement(rulespec []string) (string, error) {
+	rule, err := nftTranslate(n.family, rulespec)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s comment %q", rule, n.comment(rulespec)), nil
+}
+
+func (n *NFTables) Exists(table, chain string, rulespec ...string) (exists bool, err error) {
+	defer observe("nftables", "exists", table, time.Now(), &err)
+	if _, ok := nftBaseChains[table][chain]; !ok {
+		if exists, err := n.chainExists(table, chain); err != nil || !exists {
+			return false, err
+		}
+	}
+	handle, err := n.find(table, chain, rulespec)
+	return handle != "", err
+}
+
+func (n *NFTables) Insert(table, chain string, pos int, rulespec ...string) (err error) {
+	defer observe("nftables", "insert", table, time.Now(), &err)
+	stmt, err := n.statement(rulespec)
+	if err != nil {
+		return err
+	}
+	rules, err := n.rules(table, chain)
+	if err != nil {
+		return err
+	}
+	switch {
+	case pos < 1 || pos > len(rules)+1:
+		return fmt.Errorf("index of insertion %d too big for chain %s", pos, chain)
+	case pos == len(rules)+1:
+		_, err = n.run(fmt.Sprintf("add rule %s %s %s\n", n.Table(table), chain, stmt))
+	default:
+		_, err = n.run(fmt.Sprintf("insert rule %s %s position %s %s\n", n.Table(table), chain, rules[pos-1].handle, stmt))
+	}
+	return err
+}
+
+func (n *NFTables) Append(table, chain string, rulespec ...string) (err error) {
+	defer observe("nftables", "append", table, time.Now(), &err)
+	stmt, err := n.statement(rulespec)
+	if err != nil {
+		return err
+	}
+	_, err = n.run(n.ensure(table, chain) + fmt.Sprintf("add rule %s %s %s\n", n.Table(table), chain, stmt))
+	return err
+}
+
+func (n *NFTables) AppendUnique(table, chain string, rulespec ...string) error {
+	exists, err := n.Exists(table, chain, rulespec...)
+	if err != nil || exists {
+		return err
+	}
+	return n.Append(table, chain, rulespec...)
+}
+
+func (n *NFTables) Delete(table, chain string, rulespec ...string) (err error) {
+	defer observe("nftables", "delete", table, time.Now(), &err)
+	handle, err := n.find(table, chain, rulespec)
+	if err != nil {
+		return err
+	}
+	if handle == "" {
+		return fmt.Errorf("no rule %q in chain %s of table %s", strings.Join(rulespec, " "), chain, table)
+	}
+	_, err = n.run(fmt.Sprintf("delete rule %s %s handle %s\n", n.Table(table), chain, handle))
+	return err
+}
+
+// List returns the rules of chain, as iptables -S prints them, other
+// than those not added through an NFTables
+func (n *NFTables) List(table, chain string) (_ []string, err error) {
+	defer observe("nftables", "list", table, time.Now(), &err)
+	rules, err := n.rules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	list := []string{"-N " + chain}
+	if _, ok := nftBaseChains[table][chain]; ok {
+		list = []string{"-P " + chain + " ACCEPT"}
+	}
+	for _, r := range rules {
+		if r.comment != "" {
+			list = append(list, "-A "+chain+" "+strings.Join(n.rulespec(r.comment), " "))
+		}
+	}
+	return list, nil
+}
+
+func (n *NFTables) chainExists(table, chain string) (bool, error) {
+	_, err := n.run(n.ensure(table, chain) + fmt.Sprintf("list chain %s %s\n", n.Table(table), chain))
+	if err != nil && strings.Contains(err.Error(), "No such file or directory") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (n *NFTables) NewChain(table, chain string) (err error) {
+	defer observe("nftables", "new_chain", table, time.Now(), &err)
+	_, err = n.run(n.ensure(table, chain) + fmt.Sprintf("create chain %s %s\n", n.Table(table), chain))
+	return err
+}
+
+func (n *NFTables) ClearChain(table, chain string) (err error) {
+	defer observe("nftables", "clear_chain", table, time.Now(), &err)
+	_, err = n.run(n.ensure(table, chain) + fmt.Sprintf("add chain %s %s\nflush chain %s %s\n", n.Table(table), chain, n.Table(table), chain))
+	return err
+}
+
+func (n *NFTables) DeleteChain(table, chain string) (err error) {
+	defer observe("nftables", "delete_chain", table, time.Now(), &err)
+	_, err = n.run(fmt.Sprintf("delete chain %s %s\n", n.Table(table), chain))
+	return err
+}
+
+// nftAddrFamily returns the family addr is matched in, in a table of
+// family: in inet that of addr itself. Sets, with no addr, are of IPv4
+// addresses in inet, as npc's are.
+func nftAddrFamily(family, addr string) string {
+	switch {
+	case family != "inet":
+		return family
+	case strings.Contains(addr, ":"):
+		return "ip6"
+	}
+	return "ip"
+}
+
+// nftTranslate returns the nft rule, in family, of the iptables
+// rulespec
+func nftTranslate(family string, rulespec []string) (string, error) {
+	var (
+		stmts     []string
+		negate    bool
+		proto     string
+		policyDir string
+	)
+	op := func() string {
+		if negate {
+			return "!= "
+		}
+		return ""
+	}
+	// Of masked values, which nft would otherwise take as flags
+	eq := func() string {
+		if negate {
+			return "!= "
+		}
+		return "== "
+	}
+	for i := 0; i < len(rulespec); i++ {
+		arg := rulespec[i]
+		if arg == "!" {
+			negate = true
+			continue
+		}
+		// Every option but the targets without arguments takes one
+		value := func() (string, error) {
+			if i+1 >= len(rulespec) {
+				return "", fmt.Errorf("%s needs an argument", arg)
+			}
+			i++
+			return rulespec[i], nil
+		}
+		v, err := value()
+		if err != nil {
+			return "", err
+		}
+		switch arg {
+		case "-s", "--source":
+			stmts = append(stmts, fmt.Sprintf("%s saddr %s%s", nftAddrFamily(family, v), op(), v))
+		case "-d", "--destination":
+			stmts = append(stmts, fmt.Sprintf("%s daddr %s%s", nftAddrFamily(family, v), op(), v))
+		case "-i", "--in-interface":
+			stmts = append(stmts, fmt.Sprintf("iifname %s%q", op(), strings.Replace(v, "+", "*", 1)))
+		case "-o", "--out-interface":
+			stmts = append(stmts, fmt.Sprintf("oifname %s%q", op(), strings.Replace(v, "+", "*", 1)))
+		case "-p", "--protocol":
+			proto = v
+			stmts = append(stmts, fmt.Sprintf("meta l4proto %s%s", op(), v))
+		case "--dport", "--destination-port", "--sport", "--source-port":
+			if proto != "tcp" && proto != "udp" {
+				return "", fmt.Errorf("%s without -p tcp or -p udp", arg)
+			}
+			field := "dport"
+			if arg == "--sport" || arg == "--source-port" {
+				field = "sport"
+			}
+			stmts = append(stmts, fmt.Sprintf("%s %s %s%s", proto, field, op(), strings.Replace(v, ":", "-", 1)))
+		case "-m", "--match":
+			switch v {
+			case "mark", "comment", "set", "state", "conntrack", "u32", "policy", "tcp", "udp":
+			default:
+				return "", fmt.Errorf("match %s is not supported with nftables", v)
+			}
+			// The options of the match follow
+		case "--mark":
+			value, mask := v, ""
+			if j := strings.Index(v, "/"); j >= 0 {
+				value, mask = v[:j], v[j+1:]
+			}
+			if mask == "" {
+				stmts = append(stmts, fmt.Sprintf("meta mark %s%s", op(), value))
+			} else {
+				stmts = append(stmts, fmt.Sprintf("meta mark and %s %s%s", mask, eq(), value))
+			}
+		case "--comment":
+			// Kept in the rule's comment, with the rest of the rulespec
+		case "--match-set":
+			dir, err := value()
+			if err != nil {
+				return "", err
+			}
+			field := "saddr"
+			if dir == "dst" {
+				field = "daddr"
+			}
+			stmts = append(stmts, fmt.Sprintf("%s %s %s@%s", nftAddrFamily(family, ""), field, op(), v))
+		case "--state", "--ctstate":
+			stmts = append(stmts, fmt.Sprintf("ct state %s%s", op(), strings.ToLower(v)))
+		case "--u32":
+			m := nftU32RE.FindStringSubmatch(v)
+			if m == nil || negate {
+				return "", fmt.Errorf("u32 match %q is not supported with nftables", v)
+			}
+			offset, _ := strconv.Atoi(m[1])
+			stmts = append(stmts, fmt.Sprintf("@th,%d,32 %s", offset*8, m[2]))
+		case "--dir":
+			policyDir = v
+		case "--pol":
+			expr := "meta secpath"
+			if policyDir == "out" {
+				expr = "rt ipsec"
+			}
+			exists := v == "ipsec"
+			if negate {
+				exists = !exists
+			}
+			if exists {
+				stmts = append(stmts, expr+" exists")
+			} else {
+				stmts = append(stmts, expr+" missing")
+			}
+		case "--tcp-flags":
+			comp, err := value()
+			if err != nil {
+				return "", err
+			}
+			mask := strings.ToLower(strings.Replace(v, ",", " | ", -1))
+			stmts = append(stmts, fmt.Sprintf("tcp flags & (%s) %s%s", mask, eq(), strings.ToLower(strings.Replace(comp, ",", " | ", -1))))
+		case "-j", "--jump":
+			target, err := nftTarget(v, rulespec[i+1:])
+			if err != nil {
+				return "", err
+			}
+			stmts = append(stmts, target)
+			i = len(rulespec)
+		default:
+			return "", fmt.Errorf("option %s is not supported with nftables", arg)
+		}
+		negate = false
+	}
+	return strings.Join(stmts, " "), nil
+}
+
+// nftU32RE matches the u32 expressions weave uses: 4 bytes at an
+// offset into the transport header
+var nftU32RE = regexp.MustCompile(`^0>>22&0x3C@(\d+)=(0x[0-9a-fA-F]+)$`)
+
+// nftTarget returns the nft statement of the iptables target, given
+// the options following it
+func nftTarget(target string, options []string) (string, error) {
+	switch target {
+	case "ACCEPT", "DROP", "RETURN":
+		return strings.ToLower(target), nil
+	case "REJECT":
+		return "reject", nil
+	case "MASQUERADE":
+		return "masquerade", nil
+	case "MARK":
+		if len(options) != 2 || options[0] != "--set-xmark" {
+			return "", fmt.Errorf("MARK %s is not supported with nftables", strings.Join(options, " "))
+		}
+		value, mask, err := nftParseMark(options[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("meta mark set meta mark and 0x%08x xor 0x%08x", ^mask, value), nil
+	case "TCPMSS":
+		if len(options) != 1 || options[0] != "--clamp-mss-to-pmtu" {
+			return "", fmt.Errorf("TCPMSS %s is not supported with nftables", strings.Join(options, " "))
+		}
+		return "tcp option maxseg size set rt mtu", nil
+	case "CT":
+		if len(options) != 1 || options[0] != "--notrack" {
+			return "", fmt.Errorf("CT %s is not supported with nftables", strings.Join(options, " "))
+		}
+		return "notrack", nil
+	case "NFLOG":
+		if len(options) != 2 || options[0] != "--nflog-group" {
+			return "", fmt.Errorf("NFLOG %s is not supported with nftables", strings.Join(options, " "))
+		}
+		return "log group " + options[1], nil
+	}
+	if len(options) > 0 {
+		return "", fmt.Errorf("target %s %s is not supported with nftables", target, strings.Join(options, " "))
+	}
+	return "jump " + target, nil
+}
+
+// nftParseMark parses a mark as --set-xmark takes it, value[/mask]
+func nftParseMark(s string) (value, mask uint32, err error) {
+	mask = 0xffffffff
+	parts := strings.SplitN(s, "/", 2)
+	v, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid mark %q: %s", s, err)
+	}
+	if len(parts) == 2 {
+		m, err := strconv.ParseUint(parts[1], 0, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid mark %q: %s", s, err)
+		}
+		mask = uint32(m)
+	}
+	return uint32(v), mask, nil
+}
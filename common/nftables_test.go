@@ -0,0 +1,88 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNFTTranslate(t *testing.T) {
+	for _, tc := range []struct {
+		rulespec string
+		rule     string
+	}{
+		{"-j WEAVE-IPSEC-OUT", "jump WEAVE-IPSEC-OUT"},
+		{"-s 10.0.0.1 -d 10.0.0.2 -p udp --dport 6784 -m mark ! --mark 0x40000/0x40000 -m comment --comment weave-ipsec:aa:bb -j WEAVE-IPSEC-OUT-MARK",
+			"ip saddr 10.0.0.1 ip daddr 10.0.0.2 meta l4proto udp udp dport 6784 meta mark and 0x40000 != 0x40000 jump WEAVE-IPSEC-OUT-MARK"},
+		{"-j MARK --set-xmark 0x20000/0x20000", "meta mark set meta mark and 0xfffdffff xor 0x00020000"},
+		{"! -p esp -m policy --dir out --pol none -m mark --mark 0x20000/0x20000 -j DROP",
+			"meta l4proto != esp rt ipsec missing meta mark and 0x20000 == 0x20000 drop"},
+		{"-p udp -m udp --sport 4500 -j ACCEPT", "meta l4proto udp udp sport 4500 accept"},
+		{"-p tcp -m set --match-set weave-abc src -m set --match-set weave-def dst --dport 80 -j ACCEPT",
+			"meta l4proto tcp ip saddr @weave-abc ip daddr @weave-def tcp dport 80 accept"},
+		{"-m state --state RELATED,ESTABLISHED -j ACCEPT", "ct state related,established accept"},
+		{"-p udp --dport 6784 -m u32 --u32 0>>22&0x3C@20=0x0a000001 -j MARK --set-xmark 0x40000/0x40000",
+			"meta l4proto udp udp dport 6784 @th,160,32 0x0a000001 meta mark set meta mark and 0xfffbffff xor 0x00040000"},
+		{"-p tcp --tcp-flags SYN,RST SYN -j TCPMSS --clamp-mss-to-pmtu", "meta l4proto tcp tcp flags & (syn | rst) == syn tcp option maxseg size set rt mtu"},
+		{"-o weave+ -m state --state NEW -j NFLOG --nflog-group 86", `oifname "weave*" ct state new log group 86`},
+		{"-d 10.96.0.0/12 ! -s 10.32.0.0/12 -j MASQUERADE", "ip daddr 10.96.0.0/12 ip saddr != 10.32.0.0/12 masquerade"},
+		{"-p esp -j CT --notrack", "meta l4proto esp notrack"},
+	} {
+		rule, err := nftTranslate("ip", strings.Split(tc.rulespec, " "))
+		require.NoError(t, err, tc.rulespec)
+		require.Equal(t, tc.rule, rule, tc.rulespec)
+	}
+
+	// In inet, addresses are matched in their own family
+	for rulespec, rule := range map[string]string{
+		"-s fd00::/64 ! -d fd00::1 -j MASQUERADE":    "ip6 saddr fd00::/64 ip6 daddr != fd00::1 masquerade",
+		"-s 10.32.0.0/12 -j MASQUERADE":              "ip saddr 10.32.0.0/12 masquerade",
+		"-m set --match-set weave-abc src -j ACCEPT": "ip saddr @weave-abc accept",
+	} {
+		r, err := nftTranslate("inet", strings.Split(rulespec, " "))
+		require.NoError(t, err, rulespec)
+		require.Equal(t, rule, r, rulespec)
+	}
+
+	for _, rulespec := range []string{
+		"--dport 80 -j ACCEPT",          // no protocol
+		"-m physdev --physdev-in x",     // unknown match
+		"-j MARK --set-mark 1",          // unknown target option
+		"-m u32 --u32 0>>22&0x3C@0>>16", // unknown u32 expression
+		"-s",                            // no argument
+	} {
+		_, err := nftTranslate("ip", strings.Split(rulespec, " "))
+		require.Error(t, err, rulespec)
+	}
+}
+
+func TestNFTComment(t *testing.T) {
+	n := &NFTables{family: "ip", specs: make(map[string][]string)}
+
+	short := []string{"-j", "WEAVE-NPC"}
+	require.Equal(t, "weave: -j WEAVE-NPC", n.comment(short))
+	require.Equal(t, short, n.rulespec(n.comment(short)))
+
+	long := strings.Split("-s 255.255.255.255 -d 255.255.255.255 -p udp --dport 65535 -m mark ! --mark 0x40000/0x40000 -m comment --comment weave-wireguard:aa:bb:cc:dd:ee:ff -j MARK --set-xmark 0x20000/0x20000", " ")
+	c := n.comment(long)
+	require.True(t, len(c) <= nftCommentMax)
+	require.Equal(t, long, n.rulespec(c))
+
+	// Arguments with spaces, e.g. the comments of weave-npc's rules,
+	// would not split back, so such rulespecs are hashed too
+	spaced := []string{"-m", "comment", "--comment", "DefaultAllow isolation for namespace: default", "-j", "ACCEPT"}
+	c = n.comment(spaced)
+	require.False(t, strings.HasPrefix(c, nftCommentPrefix+" "), c)
+	require.Equal(t, spaced, n.rulespec(c))
+	require.Equal(t, c, n.comment(n.rulespec(c)))
+	empty := []string{"-m", "comment", "--comment", "", "-j", "ACCEPT"}
+	require.Equal(t, empty, n.rulespec(n.comment(empty)))
+
+	// Of rules hashed by another process only the comment is known, by
+	// which they can be deleted
+	other := &NFTables{family: "ip", specs: make(map[string][]string)}
+	rulespec := other.rulespec(c)
+	require.Equal(t, []string{"-m", "comment", "--comment", c}, rulespec)
+	require.Equal(t, c, other.comment(rulespec))
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule is a rule a Reconciler keeps in place
+type Rule struct {
+	Table    string
+	Chain    string
+	Rulespec []string
+	// Put back at the top of Chain, rather than the end, e.g. as it
+	// must come before the rules of other software
+	Insert bool
+	// Of the connection the rule is for, if any; only for reports
+	Peer string
+}
+
+func (r Rule) key() string {
+	return r.Table + " " + r.Chain + " " + strings.Join(r.Rulespec, " ")
+}
+
+func (r Rule) String() string {
+	return "-t " + r.Table + " -A " + r.Chain + " " + strings.Join(r.Rulespec, " ")
+}
+
+// Reconciler holds the chains and rules which should be in place, and
+// puts back those which have gone, e.g. as firewalld reloading or
+// docker restarting flushed them. It never removes anything; what is
+// no longer wanted is for its owner to remove.
+type Reconciler struct {
+	ipt IPTablesBackend
+
+	sync.Mutex
+	chains map[string]bool // "table chain"
+	owned  []OwnedChain
+	rules  map[string]Rule
+	order  []string // of the keys of rules, as wanted
+}
+
+func NewReconciler(ipt IPTablesBackend) *Reconciler {
+	return &Reconciler{ipt: ipt, chains: make(map[string]bool), rules: make(map[string]Rule)}
+}
+
+// WantChain has chain kept in place, even while no rule is wanted in it
+func (r *Reconciler) WantChain(table, chain string) {
+	r.Lock()
+	r.chains[table+" "+chain] = true
+	r.Unlock()
+}
+
+// WantOwned has c, which Chains holds, kept in place, with the rules
+// jumping to it at their positions
+func (r *Reconciler) WantOwned(c OwnedChain) {
+	r.Lock()
+	defer r.Unlock()
+	r.chains[c.Table+" "+c.Name] = true
+	for _, o := range r.owned {
+		if o.Table == c.Table && o.Name == c.Name {
+			return
+		}
+	}
+	r.owned = append(r.owned, c)
+}
+
+// Want has rules kept in place
+func (r *Reconciler) Want(rules ...Rule) {
+	r.Lock()
+	defer r.Unlock()
+	for _, rule := range rules {
+		if _, found := r.rules[rule.key()]; !found {
+			r.order = append(r.order, rule.key())
+		}
+		r.rules[rule.key()] = rule
+	}
+}
+
+// Unwant stops keeping rules in place; it must be called before they
+// are removed, lest they are put back meanwhile
+func (r *Reconciler) Unwant(rules ...Rule) {
+	r.Lock()
+	defer r.Unlock()
+	for _, rule := range rules {
+		delete(r.rules, rule.key())
+	}
+	order := r.order[:0]
+	for _, key := range r.order {
+		if _, found := r.rules[key]; found {
+			order = append(order, key)
+		}
+	}
+	r.order = order
+}
+
+// Reset stops keeping anything in place
+func (r *Reconciler) Reset() {
+	r.Lock()
+	r.chains = make(map[string]bool)
+	r.owned = nil
+	r.rules = make(map[string]Rule)
+	r.order = nil
+	r.Unlock()
+}
+
+// Reconcile puts back the chains and rules which are missing, all at
+// once, then the jumps to owned chains which are missing or out of
+// place, and returns the rules it put back
+func (r *Reconciler) Reconcile() ([]Rule, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	var b Batch
+	exists := make(map[string]bool)
+	chainExists := func(table, chain string) bool {
+		c := table + " " + chain
+		if e, checked := exists[c]; checked {
+			return e
+		}
+		// Listing fails if it is missing
+		_, err := r.ipt.List(table, chain)
+		exists[c] = err == nil
+		if err != nil {
+			b.NewChain(table, chain)
+		}
+		return exists[c]
+	}
+	for c := range r.chains {
+		tc := strings.SplitN(c, " ", 2)
+		chainExists(tc[0], tc[1])
+	}
+
+	var missing []Rule
+	for _, key := range r.order {
+		rule := r.rules[key]
+		if !chainExists(rule.Table, rule.Chain) {
+			missing = append(missing, rule)
+			continue
+		}
+		ok, err := r.ipt.Exists(rule.Table, rule.Chain, rule.Rulespec...)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, rule)
+		}
+	}
+	// Those put at the top go in reverse, so as to end up in order
+	for i := len(missing) - 1; i >= 0; i-- {
+		if rule := missing[i]; rule.Insert {
+			b.Insert(rule.Table, rule.Chain, 1, rule.Rulespec...)
+		}
+	}
+	for _, rule := range missing {
+		if !rule.Insert {
+			b.Append(rule.Table, rule.Chain, rule.Rulespec...)
+		}
+	}
+	if err := ApplyBatch(r.ipt, &b); err != nil {
+		return nil, err
+	}
+	for _, c := range r.owned {
+		placed, err := Chains.Place(r.ipt, c)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, placed...)
+	}
+	return missing, nil
+}
+
+// Run reconciles every interval until stop is closed, passing what
+// it put back, or why it failed, to report
+func (r *Reconciler) Run(interval time.Duration, stop <-chan struct{}, report func([]Rule, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			repaired, err := r.Reconcile()
+			if err != nil || len(repaired) > 0 {
+				report(repaired, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func TestReconcile(t *testing.T) {
+	ipt := netfilter.NewMockIPTables()
+	r := NewReconciler(ipt)
+	r.WantChain("mangle", "WEAVE-IPSEC-OUT")
+	r.Want(
+		Rule{Table: "mangle", Chain: "OUTPUT", Rulespec: []string{"-j", "WEAVE-IPSEC-OUT"}},
+		Rule{Table: "mangle", Chain: "WEAVE-IPSEC-OUT-MARK", Rulespec: []string{"-j", "MARK", "--set-xmark", "0x20000/0x20000"}},
+		Rule{Table: "filter", Chain: "INPUT", Rulespec: []string{"-p", "udp", "--sport", "4500", "-j", "ACCEPT"}, Insert: true},
+		Rule{Table: "filter", Chain: "INPUT", Rulespec: []string{"-p", "esp", "-j", "ACCEPT"}, Insert: true},
+	)
+	require.NoError(t, ipt.Append("filter", "INPUT", "-j", "DROP"))
+
+	repaired, err := r.Reconcile()
+	require.NoError(t, err)
+	require.Len(t, repaired, 4)
+	require.Contains(t, ipt.Chains, "mangle WEAVE-IPSEC-OUT")
+	require.Equal(t, []string{"-j WEAVE-IPSEC-OUT"}, ipt.Chains["mangle OUTPUT"])
+	require.Equal(t, []string{"-j MARK --set-xmark 0x20000/0x20000"}, ipt.Chains["mangle WEAVE-IPSEC-OUT-MARK"])
+	require.Equal(t, []string{"-p udp --sport 4500 -j ACCEPT", "-p esp -j ACCEPT", "-j DROP"}, ipt.Chains["filter INPUT"])
+
+	// Nothing to do while all is in place
+	repaired, err = r.Reconcile()
+	require.NoError(t, err)
+	require.Empty(t, repaired)
+
+	// What is flushed is put back
+	require.NoError(t, ipt.ClearChain("mangle", "OUTPUT"))
+	require.NoError(t, ipt.ClearChain("mangle", "WEAVE-IPSEC-OUT-MARK"))
+	require.NoError(t, ipt.DeleteChain("mangle", "WEAVE-IPSEC-OUT-MARK"))
+	repaired, err = r.Reconcile()
+	require.NoError(t, err)
+	require.Len(t, repaired, 2)
+	require.Equal(t, []string{"-j WEAVE-IPSEC-OUT"}, ipt.Chains["mangle OUTPUT"])
+	require.Equal(t, []string{"-j MARK --set-xmark 0x20000/0x20000"}, ipt.Chains["mangle WEAVE-IPSEC-OUT-MARK"])
+
+	// What isn't wanted any more is left alone
+	r.Unwant(Rule{Table: "mangle", Chain: "OUTPUT", Rulespec: []string{"-j", "WEAVE-IPSEC-OUT"}})
+	require.NoError(t, ipt.ClearChain("mangle", "OUTPUT"))
+	repaired, err = r.Reconcile()
+	require.NoError(t, err)
+	require.Empty(t, repaired)
+	require.Empty(t, ipt.Chains["mangle OUTPUT"])
+}
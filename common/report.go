@@ -0,0 +1,79 @@
+package common
+
+import (
+	"sort"
+	"strings"
+)
+
+// ReportedChain is a chain a ChainRegistry holds, with the parts of
+// weave holding it and the rules jumping to it
+type ReportedChain struct {
+	Table  string
+	Chain  string
+	Owners []string
+	// As Rule.String prints them
+	Jumps []string
+}
+
+// ReportedRule is a rule a part of weave, its Owner, keeps in place,
+// as Rule.String prints it, with the peer it is for, if any
+type ReportedRule struct {
+	Owner string
+	Peer  string `json:",omitempty"`
+	Rule  string
+}
+
+// Report returns the chains r holds, ordered by table and name
+func (r *ChainRegistry) Report() []ReportedChain {
+	r.Lock()
+	defer r.Unlock()
+	var chains []ReportedChain
+	for key, owners := range r.owners {
+		tc := strings.SplitN(key, " ", 2)
+		c := ReportedChain{Table: tc[0], Chain: tc[1]}
+		for owner := range owners {
+			c.Owners = append(c.Owners, owner)
+		}
+		sort.Strings(c.Owners)
+		for from, jumps := range r.jumps {
+			if !strings.HasPrefix(from, c.Table+" ") {
+				continue
+			}
+			if j, found := jumps[c.Chain]; found {
+				oc := OwnedChain{Table: c.Table, Name: c.Chain}
+				c.Jumps = append(c.Jumps, Rule{Table: c.Table, Chain: j.From, Rulespec: oc.jumpRulespec(j)}.String())
+			}
+		}
+		sort.Strings(c.Jumps)
+		chains = append(chains, c)
+	}
+	sort.Sort(reportedChains(chains))
+	return chains
+}
+
+type reportedChains []ReportedChain
+
+func (s reportedChains) Len() int      { return len(s) }
+func (s reportedChains) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s reportedChains) Less(i, j int) bool {
+	if s[i].Table != s[j].Table {
+		return s[i].Table < s[j].Table
+	}
+	return s[i].Chain < s[j].Chain
+}
+
+// Report returns the rules r keeps in place, as owner's, in the order
+// they were wanted; none where r is nil
+func (r *Reconciler) Report(owner string) []ReportedRule {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	rules := make([]ReportedRule, 0, len(r.order))
+	for _, key := range r.order {
+		rule := r.rules[key]
+		rules = append(rules, ReportedRule{Owner: owner, Peer: rule.Peer, Rule: rule.String()})
+	}
+	return rules
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func TestReport(t *testing.T) {
+	ipt, r := netfilter.NewMockIPTables(), NewChainRegistry()
+	c := OwnedChain{Table: "mangle", Name: "WEAVE-IPSEC-OUT", Jumps: []Jump{{From: "OUTPUT"}}}
+	require.NoError(t, r.Claim(ipt, "ipsec", c))
+	require.NoError(t, r.Claim(ipt, "wireguard", c))
+	require.NoError(t, r.Claim(ipt, "bridge", OwnedChain{Table: "filter", Name: "WEAVE-SERVICES"}))
+	require.Equal(t, []ReportedChain{
+		{Table: "filter", Chain: "WEAVE-SERVICES", Owners: []string{"bridge"}},
+		{Table: "mangle", Chain: "WEAVE-IPSEC-OUT", Owners: []string{"ipsec", "wireguard"}, Jumps: []string{"-t mangle -A OUTPUT -j WEAVE-IPSEC-OUT"}},
+	}, r.Report())
+
+	rc := NewReconciler(ipt)
+	rc.Want(
+		Rule{Table: "mangle", Chain: "WEAVE-IPSEC-OUT", Rulespec: []string{"-d", "10.0.0.2", "-j", "MARK"}, Peer: "aa:bb:cc:dd:ee:ff"},
+		Rule{Table: "filter", Chain: "OUTPUT", Rulespec: []string{"-j", "DROP"}},
+	)
+	require.Equal(t, []ReportedRule{
+		{Owner: "ipsec", Peer: "aa:bb:cc:dd:ee:ff", Rule: "-t mangle -A WEAVE-IPSEC-OUT -d 10.0.0.2 -j MARK"},
+		{Owner: "ipsec", Rule: "-t filter -A OUTPUT -j DROP"},
+	}, rc.Report("ipsec"))
+
+	var none *Reconciler
+	require.Empty(t, none.Report("bridge"))
+}
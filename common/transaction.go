@@ -0,0 +1,304 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Transaction is an IPTablesBackend over another which records how to
+// undo each change made through it, so that, where a change of several
+// fails part way, Rollback puts back what was there before rather than
+// leaving half of it in place, e.g. a rule marking packets to drop
+// without the policies letting those encrypted through. Changes made
+// other than with iptables are undone too, with OnRollback.
+//
+//	tx := common.NewTransaction(ipt)
+//	defer tx.End(&err)
+type Transaction struct {
+	ipt IPTablesBackend
+
+	sync.Mutex
+	undo []func() error // in the order the changes were made
+}
+
+// NewTransaction returns a Transaction over ipt, with nothing to undo
+func NewTransaction(ipt IPTablesBackend) *Transaction {
+	return &Transaction{ipt: ipt}
+}
+
+// OnRollback has Rollback call undo, in its turn, for a change made
+// other than through tx
+func (tx *Transaction) OnRollback(undo func() error) {
+	tx.Lock()
+	tx.undo = append(tx.undo, undo)
+	tx.Unlock()
+}
+
+// Commit keeps the changes made so far, which Rollback then leaves
+func (tx *Transaction) Commit() {
+	tx.Lock()
+	tx.undo = nil
+	tx.Unlock()
+}
+
+// Rollback undoes the changes made since NewTransaction or Commit, the
+// last first. It carries on past those it fails to undo, e.g. as
+// something else removed a rule meanwhile, and returns the first error.
+func (tx *Transaction) Rollback() error {
+	tx.Lock()
+	undo := tx.undo
+	tx.undo = nil
+	tx.Unlock()
+	var first error
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := undo[i](); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// End rolls tx back where *errp is an error, else commits it. Failing
+// to roll back is logged, as *errp says what went wrong.
+func (tx *Transaction) End(errp *error) {
+	if *errp == nil {
+		tx.Commit()
+		return
+	}
+	if err := tx.Rollback(); err != nil {
+		Log.Errorf("Rolling back iptables changes after %q: %s", *errp, err)
+	}
+}
+
+// deleteRule undoes adding rulespec
+func (tx *Transaction) deleteRule(table, chain string, rulespec []string) func() error {
+	return func() error { return tx.ipt.Delete(table, chain, rulespec...) }
+}
+
+// restoreChain returns how to put chain back as it is now: with the
+// same rules, or gone where it is missing
+func (tx *Transaction) restoreChain(table, chain string) func() error {
+	// Listing fails if it is missing
+	list, err := tx.ipt.List(table, chain)
+	if err != nil {
+		return func() error {
+			if _, err := tx.ipt.List(table, chain); err != nil {
+				return nil
+			}
+			return tx.ipt.DeleteChain(table, chain)
+		}
+	}
+	rules := listedRules(chain, list)
+	return func() error {
+		// Clearing creates it, should it have been deleted
+		if err := tx.ipt.ClearChain(table, chain); err != nil {
+			return err
+		}
+		for _, rulespec := range rules {
+			if err := tx.ipt.Append(table, chain, rulespec...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// listedRules returns the rulespecs of the rules of chain, as listed
+func listedRules(chain string, list []string) [][]string {
+	var rules [][]string
+	for _, line := range list {
+		if strings.HasPrefix(line, "-A "+chain+" ") {
+			rules = append(rules, splitListed(strings.TrimPrefix(line, "-A "+chain+" ")))
+		}
+	}
+	return rules
+}
+
+// splitListed splits a rule as iptables -S prints it into arguments,
+// which it quotes where they have spaces, e.g. comments: with double
+// quotes, or as firewall-cmd does, with single ones
+func splitListed(rule string) []string {
+	var args []string
+	var arg bytes.Buffer
+	var quote byte // while within quotes
+	started := false
+	for i := 0; i < len(rule); i++ {
+		switch c := rule[i]; {
+		case c == '\\' && quote == '"' && i+1 < len(rule):
+			i++
+			arg.WriteByte(rule[i])
+		case quote == 0 && (c == '"' || c == '\''):
+			quote, started = c, true
+		case c == quote:
+			quote = 0
+		case c == ' ' && quote == 0:
+			if started {
+				args = append(args, arg.String())
+				arg.Reset()
+				started = false
+			}
+		default:
+			arg.WriteByte(c)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// position returns where rulespec is in chain, counting from 1; 0
+// where it isn't there
+func (tx *Transaction) position(table, chain string, rulespec []string) int {
+	list, err := tx.ipt.List(table, chain)
+	if err != nil {
+		return 0
+	}
+	self := "-A " + chain + " " + strings.Join(rulespec, " ")
+	n := 0
+	for _, line := range list {
+		if strings.HasPrefix(line, "-A ") {
+			n++
+			if line == self {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+func (tx *Transaction) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return tx.ipt.Exists(table, chain, rulespec...)
+}
+
+func (tx *Transaction) Insert(table, chain string, pos int, rulespec ...string) error {
+	if err := tx.ipt.Insert(table, chain, pos, rulespec...); err != nil {
+		return err
+	}
+	tx.OnRollback(tx.deleteRule(table, chain, rulespec))
+	return nil
+}
+
+func (tx *Transaction) Append(table, chain string, rulespec ...string) error {
+	if err := tx.ipt.Append(table, chain, rulespec...); err != nil {
+		return err
+	}
+	tx.OnRollback(tx.deleteRule(table, chain, rulespec))
+	return nil
+}
+
+func (tx *Transaction) AppendUnique(table, chain string, rulespec ...string) error {
+	exists, err := tx.ipt.Exists(table, chain, rulespec...)
+	if err != nil || exists {
+		return err
+	}
+	return tx.Append(table, chain, rulespec...)
+}
+
+// Delete deletes a rule, which Rollback puts back where it was, as
+// far as it can tell, else at the end of its chain
+func (tx *Transaction) Delete(table, chain string, rulespec ...string) error {
+	pos := tx.position(table, chain, rulespec)
+	if err := tx.ipt.Delete(table, chain, rulespec...); err != nil {
+		return err
+	}
+	tx.OnRollback(func() error {
+		if pos == 0 {
+			return tx.ipt.Append(table, chain, rulespec...)
+		}
+		return tx.ipt.Insert(table, chain, pos, rulespec...)
+	})
+	return nil
+}
+
+func (tx *Transaction) List(table, chain string) ([]string, error) {
+	return tx.ipt.List(table, chain)
+}
+
+func (tx *Transaction) NewChain(table, chain string) error {
+	if err := tx.ipt.NewChain(table, chain); err != nil {
+		return err
+	}
+	tx.OnRollback(func() error { return tx.ipt.DeleteChain(table, chain) })
+	return nil
+}
+
+func (tx *Transaction) ClearChain(table, chain string) error {
+	undo := tx.restoreChain(table, chain)
+	if err := tx.ipt.ClearChain(table, chain); err != nil {
+		return err
+	}
+	tx.OnRollback(undo)
+	return nil
+}
+
+func (tx *Transaction) DeleteChain(table, chain string) error {
+	undo := tx.restoreChain(table, chain)
+	if err := tx.ipt.DeleteChain(table, chain); err != nil {
+		return err
+	}
+	tx.OnRollback(undo)
+	return nil
+}
+
+// ApplyBatch makes the changes of b with the backend tx is over, so
+// that Rollback undoes each of them that was made before one failed.
+// Where the backend can't apply b at once, they are made one at a time
+// through tx, recording how to undo each as it is made. Else, as
+// iptables-restore only commits each table atomically, they are
+// applied a table at a time, with how to undo them worked out before,
+// and recorded once the table's are made: a rule added is deleted, and
+// a chain cleared, deleted or with a rule deleted from it has its rules
+// put back as they were.
+func (tx *Transaction) ApplyBatch(b *Batch) error {
+	if _, ok := tx.ipt.(batchApplier); !ok {
+		return b.replay(tx)
+	}
+	for _, tb := range b.byTable() {
+		undo, err := tx.batchUndo(tb)
+		if err != nil {
+			return err
+		}
+		if err := ApplyBatch(tx.ipt, tb); err != nil {
+			return err
+		}
+		tx.Lock()
+		tx.undo = append(tx.undo, undo...)
+		tx.Unlock()
+	}
+	return nil
+}
+
+// batchUndo returns how to undo the changes of b, in the order they
+// are made in
+func (tx *Transaction) batchUndo(b *Batch) ([]func() error, error) {
+	// Chains put back as they were need no rule of theirs deleted
+	restored := make(map[string]bool)
+	for _, op := range b.ops {
+		if op.op == "-D" || op.op == "-F" || op.op == "-X" {
+			restored[op.table+" "+op.chain] = false
+		}
+	}
+	var undo []func() error
+	for _, op := range b.ops {
+		op := op
+		key := op.table + " " + op.chain
+		done, restore := restored[key]
+		switch {
+		case restore && !done:
+			restored[key] = true
+			undo = append(undo, tx.restoreChain(op.table, op.chain))
+		case restore:
+		case op.op == "-A" || op.op == "-I":
+			undo = append(undo, tx.deleteRule(op.table, op.chain, op.rulespec))
+		case op.op == "-N":
+			undo = append(undo, func() error { return tx.ipt.DeleteChain(op.table, op.chain) })
+		default:
+			return nil, fmt.Errorf("unknown batch operation %s", op.op)
+		}
+	}
+	return undo, nil
+}
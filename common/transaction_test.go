@@ -0,0 +1,116 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func TestTransactionRollback(t *testing.T) {
+	ipt := netfilter.NewMockIPTables()
+	require.NoError(t, ipt.Append("filter", "INPUT", "-p", "esp", "-j", "ACCEPT"))
+	require.NoError(t, ipt.Append("filter", "INPUT", "-j", "DROP"))
+	// Of each chain, whether or not rolling back left its slice nil
+	chains := func() map[string]string {
+		m := make(map[string]string)
+		for k, v := range ipt.Chains {
+			m[k] = strings.Join(v, "; ")
+		}
+		return m
+	}
+	before := chains()
+
+	tx := NewTransaction(ipt)
+	undone := false
+	tx.OnRollback(func() error { undone = true; return nil })
+	require.NoError(t, tx.NewChain("mangle", "WEAVE-IPSEC-OUT"))
+	require.NoError(t, tx.Append("mangle", "WEAVE-IPSEC-OUT", "-j", "MARK", "--set-xmark", "0x20000/0x20000"))
+	require.NoError(t, tx.Insert("mangle", "OUTPUT", 1, "-j", "WEAVE-IPSEC-OUT"))
+	require.NoError(t, tx.Delete("filter", "INPUT", "-p", "esp", "-j", "ACCEPT"))
+	var b Batch
+	b.ClearChain("filter", "INPUT")
+	b.Append("filter", "INPUT", "-m", "comment", "--comment", "weave", "-j", "ACCEPT")
+	b.NewChain("nat", "WEAVE")
+	b.Append("nat", "POSTROUTING", "-j", "WEAVE")
+	require.NoError(t, ApplyBatch(tx, &b))
+	require.Equal(t, []string{"-m comment --comment weave -j ACCEPT"}, ipt.Chains["filter INPUT"])
+
+	err := errors.New("failed")
+	tx.End(&err)
+	require.True(t, undone)
+	require.Equal(t, before, chains())
+
+	// Once committed, nothing is undone
+	tx = NewTransaction(ipt)
+	require.NoError(t, tx.AppendUnique("filter", "INPUT", "-j", "DROP"))
+	require.NoError(t, tx.Append("filter", "FORWARD", "-j", "DROP"))
+	err = nil
+	tx.End(&err)
+	require.NoError(t, tx.Rollback())
+	require.Equal(t, []string{"-j DROP"}, ipt.Chains["filter FORWARD"])
+}
+
+// restoringIPTables applies a Batch at once, table by table, as
+// iptables-restore does, failing those of failTable
+type restoringIPTables struct {
+	*netfilter.MockIPTables
+	failTable string
+	applied   []string // the tables of each Batch applied
+}
+
+func (ipt *restoringIPTables) ApplyBatch(b *Batch) error {
+	ipt.applied = append(ipt.applied, b.tables())
+	for _, tb := range b.byTable() {
+		if tb.ops[0].table == ipt.failTable {
+			return errors.New("restore failed")
+		}
+		if err := tb.replay(ipt.MockIPTables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestTransactionBatchFailure(t *testing.T) {
+	for _, atOnce := range []bool{false, true} {
+		mock := netfilter.NewMockIPTables()
+		var ipt IPTablesBackend = mock
+		restoring := &restoringIPTables{MockIPTables: mock, failTable: "nat"}
+		if atOnce {
+			ipt = restoring
+		}
+		require.NoError(t, ipt.Append("filter", "INPUT", "-j", "DROP"))
+
+		tx := NewTransaction(ipt)
+		var b Batch
+		b.ClearChain("filter", "INPUT")
+		b.NewChain("filter", "WEAVE")
+		b.Append("filter", "INPUT", "-j", "WEAVE")
+		// Fails, as there is no such rule, or its table is failed
+		b.Delete("nat", "POSTROUTING", "-j", "WEAVE")
+		b.Append("mangle", "OUTPUT", "-j", "MARK", "--set-xmark", "0x20000/0x20000")
+		err := ApplyBatch(tx, &b)
+		require.Error(t, err)
+		if atOnce {
+			require.Equal(t, []string{"filter", "nat"}, restoring.applied, "a table at a time")
+		}
+		require.Equal(t, []string{"-j WEAVE"}, mock.Chains["filter INPUT"], "made before the failure")
+		require.Empty(t, mock.Chains["mangle OUTPUT"])
+
+		tx.End(&err)
+		require.Equal(t, []string{"-j DROP"}, mock.Chains["filter INPUT"])
+		_, found := mock.Chains["filter WEAVE"]
+		require.False(t, found)
+	}
+}
+
+func TestSplitListed(t *testing.T) {
+	require.Equal(t, []string{"-m", "comment", "--comment", "weave:two words", "-j", "ACCEPT"},
+		splitListed(`-m comment --comment "weave:two words" -j ACCEPT`))
+	require.Equal(t, []string{"--comment", `say "hi"`, "-j", "DROP"}, splitListed(`--comment "say \"hi\"" -j DROP`))
+	require.Equal(t, []string{"--comment", ""}, splitListed(`--comment ""`))
+}
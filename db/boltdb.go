@@ -9,11 +9,6 @@ import (
 	"github.com/boltdb/bolt"
 )
 
-type DB interface {
-	Load(string, interface{}) (bool, error)
-	Save(string, interface{}) error
-}
-
 type BoltDB struct {
 	db *bolt.DB
 }
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"fmt"
+	"os"
+)
+
+type DB interface {
+	Load(string, interface{}) (bool, error)
+	Save(string, interface{}) error
+}
+
+type ClosableDB interface {
+	DB
+	Close() error
+}
+
+// Names of the backends which Open understands
+const (
+	BoltBackend   = "bolt"
+	JSONBackend   = "json"
+	ConsulBackend = "consul"
+	EtcdBackend   = "etcd"
+)
+
+// Open returns a DB of the given backend. The bolt and json backends
+// keep their data in a file whose name starts with pathPrefix; consul
+// and etcd keep it, outside the host, under kv.Prefix (weave/<hostname>
+// if empty) in the key/value store kv gives, so that diskless nodes can
+// resume.
+func Open(backend, pathPrefix string, kv KVConfig) (ClosableDB, error) {
+	switch backend {
+	case BoltBackend:
+		return NewBoltDB(pathPrefix + FileName)
+	case JSONBackend:
+		return NewJSONFileDB(pathPrefix + JSONFileName)
+	case ConsulBackend, EtcdBackend:
+		if kv.Addr == "" {
+			return nil, fmt.Errorf("the %s persistence backend needs the address of the store", backend)
+		}
+		if kv.Prefix == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+			kv.Prefix = "weave/" + hostname
+		}
+		return NewKVDB(backend, kv)
+	}
+	return nil, fmt.Errorf("unknown persistence backend %q", backend)
+}
+
+// IsKV returns whether backend keeps its data outside the host
+func IsKV(backend string) bool {
+	return backend == ConsulBackend || backend == EtcdBackend
+}
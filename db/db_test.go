@@ -0,0 +1,204 @@
+package db
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testData struct {
+	Name  string
+	Peers []uint64
+}
+
+func testLoadSave(t *testing.T, d DB) {
+	var data testData
+	found, err := d.Load("data", &data)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	saved := testData{Name: "foo", Peers: []uint64{1, 2, 3}}
+	require.NoError(t, d.Save("data", saved))
+	found, err = d.Load("data", &data)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, saved, data)
+}
+
+func TestBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weavedb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, backend := range []string{BoltBackend, JSONBackend} {
+		d, err := Open(backend, filepath.Join(dir, backend), KVConfig{})
+		require.NoError(t, err, backend)
+		testLoadSave(t, d)
+		require.NoError(t, d.Close())
+	}
+
+	// What we saved survives a restart
+	d, err := NewJSONFileDB(filepath.Join(dir, JSONBackend+JSONFileName))
+	require.NoError(t, err)
+	var data testData
+	found, err := d.Load("data", &data)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "foo", data.Name)
+
+	_, err = Open("floppy", dir, KVConfig{})
+	require.Error(t, err)
+	_, err = Open(ConsulBackend, dir, KVConfig{})
+	require.Error(t, err)
+}
+
+// fakeKVStore answers just enough of the Consul and etcd (v2) APIs;
+// with token or user set, only requests giving them
+type fakeKVStore struct {
+	sync.Mutex
+	values map[string]string
+	token  string
+	user   string
+}
+
+func (s *fakeKVStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	user, _, _ := r.BasicAuth()
+	if r.Header.Get("X-Consul-Token") != s.token || user != s.user {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	etcd := strings.HasPrefix(r.URL.Path, "/v2/keys/")
+	switch r.Method {
+	case "GET":
+		value, found := s.values[r.URL.Path]
+		switch {
+		case !found:
+			http.NotFound(w, r)
+		case etcd:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"action": "get",
+				"node":   map[string]string{"value": value},
+			})
+		default:
+			w.Write([]byte(value))
+		}
+	case "PUT":
+		if etcd {
+			s.values[r.URL.Path] = r.FormValue("value")
+		} else {
+			body, _ := ioutil.ReadAll(r.Body)
+			s.values[r.URL.Path] = string(body)
+		}
+	}
+}
+
+func (s *fakeKVStore) value(path string) string {
+	s.Lock()
+	defer s.Unlock()
+	return s.values[path]
+}
+
+func TestKVDB(t *testing.T) {
+	store := &fakeKVStore{values: make(map[string]string)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	for _, backend := range []string{ConsulBackend, EtcdBackend} {
+		d, err := Open(backend, "", KVConfig{Addr: server.URL, Prefix: "weave/host1"})
+		require.NoError(t, err, backend)
+		testLoadSave(t, d)
+		require.NoError(t, d.Close())
+	}
+	require.Equal(t, "1", store.value("/v1/kv/weave/host1/version"))
+	require.Equal(t, "1", store.value("/v2/keys/weave/host1/version"))
+	require.Equal(t, `{"Name":"foo","Peers":[1,2,3]}`, store.value("/v1/kv/weave/host1/data"))
+	require.Equal(t, `{"Name":"foo","Peers":[1,2,3]}`, store.value("/v2/keys/weave/host1/data"))
+
+	store.values["/v1/kv/weave/host2/version"] = "2"
+	_, err := Open(ConsulBackend, "", KVConfig{Addr: server.URL, Prefix: "weave/host2"})
+	require.Error(t, err)
+}
+
+func TestKVDBAuth(t *testing.T) {
+	store := &fakeKVStore{values: make(map[string]string), token: "secret"}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	_, err := Open(ConsulBackend, "", KVConfig{Addr: server.URL, Prefix: "weave/host1"})
+	require.Error(t, err, "without the token")
+	d, err := Open(ConsulBackend, "", KVConfig{Addr: server.URL, Prefix: "weave/host1", Token: "secret"})
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	store.token, store.user = "", "weave"
+	d, err = Open(EtcdBackend, "", KVConfig{Addr: server.URL, Prefix: "weave/host1", Username: "weave", Password: "pass"})
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+}
+
+func TestKVDBTLS(t *testing.T) {
+	store := &fakeKVStore{values: make(map[string]string)}
+	server := httptest.NewTLSServer(store)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "weavedb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]}), 0644))
+
+	_, err = Open(ConsulBackend, "", KVConfig{Addr: server.URL, Prefix: "weave/host1"})
+	require.Error(t, err, "with an unknown CA")
+	d, err := Open(ConsulBackend, "", KVConfig{Addr: strings.TrimPrefix(server.URL, "https://"), Prefix: "weave/host1", CAFile: caFile})
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	require.Equal(t, "1", store.value("/v1/kv/weave/host1/version"))
+}
+
+// Saving doesn't wait for a store which is down, and what is saved
+// meanwhile is written once it is back
+func TestKVDBOutage(t *testing.T) {
+	store := &fakeKVStore{values: make(map[string]string)}
+	var down sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		down.Lock()
+		down.Unlock()
+		store.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	d, err := Open(ConsulBackend, "", KVConfig{Addr: server.URL, Prefix: "weave/host1"})
+	require.NoError(t, err)
+
+	down.Lock()
+	saved := make(chan error)
+	go func() { saved <- d.Save("data", testData{Name: "foo"}) }()
+	select {
+	case err := <-saved:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Save waited for the store")
+	}
+	var data testData
+	found, err := d.Load("data", &data)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "foo", data.Name)
+	down.Unlock()
+
+	require.NoError(t, d.Close())
+	require.Equal(t, `{"Name":"foo","Peers":null}`, store.value("/v1/kv/weave/host1/data"))
+}
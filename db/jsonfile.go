@@ -0,0 +1,84 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const JSONFileName = "data.json"
+
+// JSONFileDB keeps everything in one, human-readable, JSON file, which
+// is rewritten in full on every Save. That suits our data, which is
+// small and rarely changes, and makes it easy to inspect.
+type JSONFileDB struct {
+	sync.Mutex
+	pathname string
+	contents jsonFileContents
+}
+
+type jsonFileContents struct {
+	Version int
+	Data    map[string]json.RawMessage
+}
+
+func NewJSONFileDB(pathname string) (*JSONFileDB, error) {
+	d := &JSONFileDB{
+		pathname: pathname,
+		contents: jsonFileContents{Version: int(persistenceVersion[0]), Data: make(map[string]json.RawMessage)},
+	}
+	buf, err := ioutil.ReadFile(pathname)
+	switch {
+	case os.IsNotExist(err):
+		return d, nil
+	case err != nil:
+		return nil, fmt.Errorf("[jsonDB] Unable to read %s: %s", pathname, err)
+	}
+	if err := json.Unmarshal(buf, &d.contents); err != nil {
+		return nil, fmt.Errorf("[jsonDB] Cannot use persistence file %s: %s", pathname, err)
+	}
+	if d.contents.Version != int(persistenceVersion[0]) {
+		return nil, fmt.Errorf("[jsonDB] Cannot use persistence file %s: mismatched version %d", pathname, d.contents.Version)
+	}
+	if d.contents.Data == nil {
+		d.contents.Data = make(map[string]json.RawMessage)
+	}
+	return d, nil
+}
+
+func (d *JSONFileDB) Load(ident string, data interface{}) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	value, found := d.contents.Data[ident]
+	if !found {
+		return false, nil
+	}
+	return true, json.Unmarshal(value, data)
+}
+
+func (d *JSONFileDB) Save(ident string, data interface{}) error {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.contents.Data[ident] = value
+	buf, err := json.MarshalIndent(d.contents, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write a new file and rename it over the old, so that a crash
+	// part-way through doesn't lose everything
+	tmp := d.pathname + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.pathname)
+}
+
+func (d *JSONFileDB) Close() error {
+	return nil
+}
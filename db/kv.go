@@ -0,0 +1,302 @@
+package db
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/weave/common"
+)
+
+const (
+	kvTimeout  = 10 * time.Second
+	kvRetryMin = 1 * time.Second
+	kvRetryMax = 1 * time.Minute
+)
+
+// KVConfig says where a Consul or etcd store is and how to
+// authenticate to it
+type KVConfig struct {
+	Addr     string // URL of the server; http:// is assumed without a scheme, https:// with TLS options
+	Prefix   string // of our keys
+	Token    string // Consul ACL token
+	Username string // etcd user, with Password
+	Password string
+	CAFile   string // PEM certificates to verify the server with; the host's if empty
+	CertFile string // PEM client certificate and key, to present to the server
+	KeyFile  string
+}
+
+func (c KVConfig) tls() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != ""
+}
+
+func (c KVConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// KVDB keeps our data, encoded as JSON, in a Consul or etcd (v2 API)
+// key/value store, one key per ident under a prefix of our own.
+//
+// Save only queues the data, which is written to the store in the
+// background, retrying while the store can't be reached, so that the
+// callers, e.g. the IP allocator, are never held up by it; Load sees
+// what is queued.
+type KVDB struct {
+	backend string
+	baseURL string // scheme, host and path up to the keys
+	prefix  string
+	config  KVConfig
+	client  *http.Client
+
+	sync.Mutex
+	pending map[string][]byte // ident -> value not yet written
+	wake    chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func NewKVDB(backend string, config KVConfig) (*KVDB, error) {
+	addr := config.Addr
+	if !strings.Contains(addr, "://") {
+		if config.tls() {
+			addr = "https://" + addr
+		} else {
+			addr = "http://" + addr
+		}
+	}
+	d := &KVDB{
+		backend: backend,
+		prefix:  strings.Trim(config.Prefix, "/"),
+		config:  config,
+		client:  &http.Client{Timeout: kvTimeout},
+		pending: make(map[string][]byte),
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if config.tls() {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("[%s] Unable to set up TLS: %s", backend, err)
+		}
+		d.client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	}
+	switch backend {
+	case ConsulBackend:
+		d.baseURL = strings.TrimSuffix(addr, "/") + "/v1/kv/"
+	case EtcdBackend:
+		d.baseURL = strings.TrimSuffix(addr, "/") + "/v2/keys/"
+	default:
+		return nil, fmt.Errorf("unknown key/value store %q", backend)
+	}
+
+	// The version is checked, and written, before we go on, so that a
+	// store we can't use is known of at once
+	var version int
+	found, err := d.Load(string(versionIdent), &version)
+	switch {
+	case err != nil:
+		return nil, err
+	case !found:
+		var value []byte
+		if value, err = json.Marshal(int(persistenceVersion[0])); err == nil {
+			err = d.put(string(versionIdent), value)
+		}
+	case version != int(persistenceVersion[0]):
+		err = fmt.Errorf("[%s] Cannot use %s: mismatched version %d", backend, d.url(""), version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	go d.writer()
+	return d, nil
+}
+
+func (d *KVDB) url(ident string) string {
+	return d.baseURL + d.prefix + "/" + url.QueryEscape(ident)
+}
+
+func (d *KVDB) do(req *http.Request) (*http.Response, error) {
+	if d.config.Token != "" && d.backend == ConsulBackend {
+		req.Header.Set("X-Consul-Token", d.config.Token)
+	}
+	if d.config.Username != "" {
+		req.SetBasicAuth(d.config.Username, d.config.Password)
+	}
+	return d.client.Do(req)
+}
+
+func (d *KVDB) Load(ident string, data interface{}) (bool, error) {
+	d.Lock()
+	value, found := d.pending[ident]
+	d.Unlock()
+	if found {
+		return true, json.Unmarshal(value, data)
+	}
+
+	u := d.url(ident)
+	if d.backend == ConsulBackend {
+		u += "?raw"
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return false, fmt.Errorf("[%s] Unable to load %s: %s", d.backend, ident, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("[%s] Unable to load %s: %s", d.backend, ident, resp.Status)
+	}
+	value, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if d.backend == EtcdBackend {
+		var reply struct {
+			Node struct {
+				Value string `json:"value"`
+			} `json:"node"`
+		}
+		if err := json.Unmarshal(value, &reply); err != nil {
+			return false, fmt.Errorf("[%s] Unable to parse reply for %s: %s", d.backend, ident, err)
+		}
+		value = []byte(reply.Node.Value)
+	}
+	return true, json.Unmarshal(value, data)
+}
+
+// Save queues data to be written under ident, replacing anything
+// queued for it before
+func (d *KVDB) Save(ident string, data interface{}) error {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	d.pending[ident] = value
+	d.Unlock()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writer writes what is queued, backing off while the store fails
+func (d *KVDB) writer() {
+	defer close(d.done)
+	for {
+		select {
+		case <-d.wake:
+		case <-d.quit:
+			return
+		}
+		for delay := kvRetryMin; ; delay *= 2 {
+			err := d.flush()
+			if err == nil {
+				break
+			}
+			if delay > kvRetryMax {
+				delay = kvRetryMax
+			}
+			common.Log.Errorf("%s; retrying in %s", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-d.quit:
+				return
+			}
+		}
+	}
+}
+
+// flush writes each queued value, dropping it from the queue unless
+// it has been replaced meanwhile
+func (d *KVDB) flush() error {
+	d.Lock()
+	pending := make(map[string][]byte, len(d.pending))
+	for ident, value := range d.pending {
+		pending[ident] = value
+	}
+	d.Unlock()
+	for ident, value := range pending {
+		if err := d.put(ident, value); err != nil {
+			return err
+		}
+		d.Lock()
+		if bytes.Equal(d.pending[ident], value) {
+			delete(d.pending, ident)
+		}
+		d.Unlock()
+	}
+	return nil
+}
+
+func (d *KVDB) put(ident string, value []byte) error {
+	var (
+		req *http.Request
+		err error
+	)
+	if d.backend == EtcdBackend {
+		form := url.Values{"value": {string(value)}}
+		req, err = http.NewRequest("PUT", d.url(ident), strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest("PUT", d.url(ident), bytes.NewReader(value))
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return fmt.Errorf("[%s] Unable to save %s: %s", d.backend, ident, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("[%s] Unable to save %s: %s", d.backend, ident, resp.Status)
+	}
+	return nil
+}
+
+// Close stops writing in the background, and makes one last attempt
+// at writing what is still queued
+func (d *KVDB) Close() error {
+	close(d.quit)
+	<-d.done
+	return d.flush()
+}
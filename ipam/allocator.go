@@ -7,6 +7,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/weaveworks/mesh"
 
 	"github.com/weaveworks/weave/common"
@@ -18,6 +19,8 @@ import (
 	"github.com/weaveworks/weave/net/address"
 )
 
+var log = common.SubsystemLog("ipam")
+
 // Kinds of message we can unicast to other peers
 const (
 	msgSpaceRequest = iota
@@ -72,8 +75,10 @@ type Allocator struct {
 	ticker            *time.Ticker
 	shuttingDown      bool // to avoid doing any requests while trying to shut down
 	isKnownPeer       func(mesh.PeerName) bool
+	onFree            func(address.Address) // optional, called on each freed address
 	quorum            func() uint
 	now               func() time.Time
+	log               *logrus.Logger
 }
 
 // PreClaims are IP addresses discovered before we could initialize IPAM
@@ -95,6 +100,8 @@ type Config struct {
 	Db          db.DB
 	IsKnownPeer func(name mesh.PeerName) bool
 	Tracker     tracker.LocalRangeTracker
+	OnFree      func(addr address.Address) // invoked from the allocator's goroutine, so must not call back into it, nor take long
+	Log         *logrus.Logger             // optional; defaults to the "ipam" subsystem log
 }
 
 // NewAllocator creates and initialises a new Allocator
@@ -127,9 +134,14 @@ func NewAllocator(config Config) *Allocator {
 		paxos:       participant,
 		nicknames:   map[mesh.PeerName]string{config.OurName: config.OurNickname},
 		isKnownPeer: config.IsKnownPeer,
+		onFree:      config.OnFree,
 		quorum:      config.Quorum,
 		dead:        make(map[string]time.Time),
 		now:         time.Now,
+		log:         config.Log,
+	}
+	if alloc.log == nil {
+		alloc.log = log
 	}
 
 	alloc.pendingClaims = make([]operation, len(config.PreClaims))
@@ -403,18 +415,28 @@ func (alloc *Allocator) delete(ident string) error {
 		return fmt.Errorf("Delete: no addresses for %s", ident)
 	}
 	for _, cidr := range cidrs {
-		alloc.space.Free(cidr.Addr)
+		alloc.free(cidr.Addr)
 	}
 	return nil
 }
 
+// free returns addr to our space, and tells whoever is interested so
+// they can clear out anything left over from its previous owner before
+// it is handed to someone else.
+func (alloc *Allocator) free(addr address.Address) {
+	alloc.space.Free(addr)
+	if alloc.onFree != nil {
+		alloc.onFree(addr)
+	}
+}
+
 // Free (Sync) - release single IP address for container
 func (alloc *Allocator) Free(ident string, addrToFree address.Address) error {
 	errChan := make(chan error)
 	alloc.actionChan <- func() {
 		if alloc.removeOwned(ident, addrToFree) {
 			alloc.debugln("Freed", addrToFree, "for", ident)
-			alloc.space.Free(addrToFree)
+			alloc.free(addrToFree)
 			errChan <- nil
 			return
 		}
@@ -1080,7 +1102,7 @@ func (alloc *Allocator) pruneOwned(ids map[string]struct{}) {
 		}
 		if _, found := ids[ident]; !found {
 			for _, cidr := range d.Cidrs {
-				alloc.space.Free(cidr.Addr)
+				alloc.free(cidr.Addr)
 			}
 			alloc.debugf("Deleting old entry %s: %v", ident, d.Cidrs)
 			delete(alloc.owned, ident)
@@ -1095,23 +1117,23 @@ func (alloc *Allocator) pruneOwned(ids map[string]struct{}) {
 // Logging
 
 func (alloc *Allocator) fatalf(fmt string, args ...interface{}) {
-	alloc.logf(common.Log.Fatalf, fmt, args...)
+	alloc.logf(alloc.log.Fatalf, fmt, args...)
 }
 func (alloc *Allocator) warnf(fmt string, args ...interface{}) {
-	alloc.logf(common.Log.Warnf, fmt, args...)
+	alloc.logf(alloc.log.Warnf, fmt, args...)
 }
 func (alloc *Allocator) errorf(fmt string, args ...interface{}) {
-	common.Log.Errorf("[allocator %s] "+fmt, append([]interface{}{alloc.ourName}, args...)...)
+	alloc.log.Errorf("[allocator %s] "+fmt, append([]interface{}{alloc.ourName}, args...)...)
 }
 func (alloc *Allocator) infof(fmt string, args ...interface{}) {
-	alloc.logf(common.Log.Infof, fmt, args...)
+	alloc.logf(alloc.log.Infof, fmt, args...)
 }
 func (alloc *Allocator) debugf(fmt string, args ...interface{}) {
-	alloc.logf(common.Log.Debugf, fmt, args...)
+	alloc.logf(alloc.log.Debugf, fmt, args...)
 }
 func (alloc *Allocator) logf(f func(string, ...interface{}), fmt string, args ...interface{}) {
 	f("[allocator %s] "+fmt, append([]interface{}{alloc.ourName}, args...)...)
 }
 func (alloc *Allocator) debugln(args ...interface{}) {
-	common.Log.Debugln(append([]interface{}{fmt.Sprintf("[allocator %s]:", alloc.ourName)}, args...)...)
+	alloc.log.Debugln(append([]interface{}{fmt.Sprintf("[allocator %s]:", alloc.ourName)}, args...)...)
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
 
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/net/address"
@@ -95,6 +96,45 @@ func TestAllocFree(t *testing.T) {
 	require.Equal(t, address.Count(spaceSize+1), alloc.NumFreeAddresses(subnet.Range()))
 }
 
+func TestAllocFreeCallsOnFree(t *testing.T) {
+	const (
+		container1 = "abcdef"
+		container2 = "baddf00d"
+		universe   = "10.0.3.0/26"
+	)
+
+	peername, _ := mesh.PeerNameFromString("01:00:00:01:00:00")
+	cidr, _ := address.ParseCIDR(universe)
+	var freed []address.Address
+	alloc := NewAllocator(Config{
+		OurName:     peername,
+		OurUID:      mesh.PeerUID(rand.Int63()),
+		OurNickname: "nick-01:00:00:01:00:00",
+		Universe:    cidr,
+		Quorum:      func() uint { return 1 },
+		Db:          new(mockDB),
+		IsKnownPeer: func(mesh.PeerName) bool { return true },
+		OnFree:      func(addr address.Address) { freed = append(freed, addr) },
+	})
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.Start()
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	addr1, err := alloc.SimplyAllocate(container1, cidr)
+	require.NoError(t, err)
+	addr2, err := alloc.SimplyAllocate(container2, cidr)
+	require.NoError(t, err)
+
+	// Deleting a container frees its address, and only its own
+	require.NoError(t, alloc.Delete(container1))
+	require.Equal(t, []address.Address{addr1}, freed)
+
+	// as does releasing an address
+	require.NoError(t, alloc.Free(container2, addr2))
+	require.Equal(t, []address.Address{addr1, addr2}, freed)
+}
+
 func TestBootstrap(t *testing.T) {
 	const (
 		donateSize     = 5
@@ -6,7 +6,6 @@ import (
 	"github.com/weaveworks/mesh"
 
 	"github.com/weaveworks/weave/api"
-	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/net/address"
 )
 
@@ -29,7 +28,7 @@ func (c *claim) sendResult(result error) {
 		return
 	}
 	if result != nil {
-		common.Log.Errorln("[allocator] " + result.Error())
+		log.Errorln("[allocator] " + result.Error())
 	}
 }
 
@@ -0,0 +1,11 @@
+// Package ipam allocates IP addresses across a weave network without
+// any central coordination: peers agree on how the address range is
+// divided between them by gossiping a ring of ownership.
+//
+// To embed an Allocator outside weaver, fill in a Config, call
+// NewAllocator, hand it a mesh.Gossip with SetInterfaces and call
+// Start. The Allocator keeps no package-level state other than the
+// default logger, which Config.Log replaces. Config, Allocator's
+// exported methods and Status follow the versioning of weave releases;
+// the ring, space and paxos subpackages are implementation details.
+package ipam
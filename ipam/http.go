@@ -6,14 +6,13 @@ import (
 
 	"github.com/gorilla/mux"
 
-	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/common/docker"
 	"github.com/weaveworks/weave/net/address"
 )
 
 func badRequest(w http.ResponseWriter, err error) {
 	http.Error(w, err.Error(), http.StatusBadRequest)
-	common.Log.Warningln("[allocator]:", err.Error())
+	log.Warningln("[allocator]:", err.Error())
 }
 
 func parseCIDR(w http.ResponseWriter, cidrStr string, net bool) (address.CIDR, bool) {
@@ -55,7 +54,7 @@ func hasBeenCancelled(dockerCli *docker.Client, closedChan <-chan bool, ident st
 
 func cancellationErr(w http.ResponseWriter, err error) bool {
 	if _, ok := err.(*errorCancelled); ok {
-		common.Log.Infoln("[allocator]:", err.Error())
+		log.Infoln("[allocator]:", err.Error())
 		fmt.Fprint(w, "cancelled")
 		return true
 	}
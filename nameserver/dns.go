@@ -98,18 +98,53 @@ type DNSServer struct {
 	udpClient *dns.Client
 }
 
+// DNSServerConfig holds the options for NewDNSServerWithConfig. Zero
+// values get the defaults weave itself uses.
+type DNSServerConfig struct {
+	Domain        string
+	ListenAddress string
+	Upstream      Upstream // where to forward queries outside Domain; defaults to /etc/resolv.conf
+	TTL           uint32
+	ClientTimeout time.Duration // for queries forwarded upstream
+}
+
 func NewDNSServer(ns *Nameserver, domain, address string, upstream Upstream, ttl uint32, clientTimeout time.Duration) (*DNSServer, error) {
+	return NewDNSServerWithConfig(ns, DNSServerConfig{
+		Domain:        domain,
+		ListenAddress: address,
+		Upstream:      upstream,
+		TTL:           ttl,
+		ClientTimeout: clientTimeout,
+	})
+}
+
+func NewDNSServerWithConfig(ns *Nameserver, config DNSServerConfig) (*DNSServer, error) {
+	if config.Domain == "" {
+		config.Domain = DefaultDomain
+	}
+	if config.ListenAddress == "" {
+		config.ListenAddress = DefaultListenAddress
+	}
+	if config.Upstream == nil {
+		config.Upstream = NewUpstream("/etc/resolv.conf", config.ListenAddress)
+	}
+	if config.TTL == 0 {
+		config.TTL = DefaultTTL
+	}
+	if config.ClientTimeout == 0 {
+		config.ClientTimeout = DefaultClientTimeout
+	}
 	s := &DNSServer{
 		ns:        ns,
-		domain:    dns.Fqdn(domain),
-		ttl:       ttl,
-		address:   address,
-		upstream:  upstream,
-		tcpClient: &dns.Client{Net: "tcp", ReadTimeout: clientTimeout},
-		udpClient: &dns.Client{Net: "udp", ReadTimeout: clientTimeout, UDPSize: udpBuffSize},
+		domain:    dns.Fqdn(config.Domain),
+		ttl:       config.TTL,
+		address:   config.ListenAddress,
+		upstream:  config.Upstream,
+		tcpClient: &dns.Client{Net: "tcp", ReadTimeout: config.ClientTimeout},
+		udpClient: &dns.Client{Net: "udp", ReadTimeout: config.ClientTimeout, UDPSize: udpBuffSize},
 	}
 
-	err := s.listen(address)
+	err := s.listen(config.ListenAddress)
 	return s, err
 }
 
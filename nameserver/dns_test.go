@@ -35,6 +35,41 @@ func startServer(t *testing.T, upstream *dns.ClientConfig) (*DNSServer, *Nameser
 	return dnsserver, nameserver, udpPort, tcpPort
 }
 
+func TestDNSServerConfig(t *testing.T) {
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.Nil(t, err)
+	nameserver := New(peername, "", func(mesh.PeerName) bool { return true })
+
+	// What is left out takes its default
+	dnsserver, err := NewDNSServerWithConfig(nameserver, DNSServerConfig{
+		ListenAddress: "127.0.0.1:0",
+		Upstream:      &mockUpstream{nil},
+	})
+	require.Nil(t, err)
+	defer dnsserver.servers[0].PacketConn.Close()
+	defer dnsserver.servers[1].Listener.Close()
+	require.Equal(t, DefaultDomain, dnsserver.domain)
+	require.Equal(t, uint32(DefaultTTL), dnsserver.ttl)
+	require.Equal(t, DefaultClientTimeout, dnsserver.udpClient.ReadTimeout)
+	require.Equal(t, DefaultClientTimeout, dnsserver.tcpClient.ReadTimeout)
+
+	// and the rest is used as given
+	dnsserver, err = NewDNSServerWithConfig(nameserver, DNSServerConfig{
+		Domain:        "example.com",
+		ListenAddress: "127.0.0.1:0",
+		Upstream:      &mockUpstream{nil},
+		TTL:           30,
+		ClientTimeout: time.Second,
+	})
+	require.Nil(t, err)
+	defer dnsserver.servers[0].PacketConn.Close()
+	defer dnsserver.servers[1].Listener.Close()
+	require.Equal(t, "example.com.", dnsserver.domain)
+	require.Equal(t, uint32(30), dnsserver.ttl)
+	require.Equal(t, time.Second, dnsserver.udpClient.ReadTimeout)
+	require.Equal(t, time.Second, dnsserver.tcpClient.ReadTimeout)
+}
+
 func TestTruncation(t *testing.T) {
 	//common.SetLogLevel("debug")
 	dnsserver, nameserver, udpPort, tcpPort := startServer(t, nil)
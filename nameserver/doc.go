@@ -0,0 +1,9 @@
+// Package nameserver is weaveDNS: a Nameserver holding the DNS entries
+// of the whole weave network, replicated by gossip, and a DNSServer
+// answering queries from it.
+//
+// To embed it outside weaver, create a Nameserver with New, give it a
+// mesh.Gossip with SetGossip and call Start, then serve it with a
+// DNSServer made by NewDNSServerWithConfig. The exported API follows the
+// versioning of weave releases.
+package nameserver
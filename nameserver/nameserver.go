@@ -27,6 +27,8 @@ const (
 	DefaultDomain = "weave.local."
 )
 
+var log = common.SubsystemLog("dns")
+
 // Nameserver: gossip-based, in memory nameserver.
 // - Holds a sorted list of (hostname, peer, container id, ip) tuples for the whole cluster.
 // - This list is gossiped & merged around the cluser.
@@ -262,13 +264,13 @@ func (n *Nameserver) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.Gossip
 // Logging
 
 func (n *Nameserver) infof(fmt string, args ...interface{}) {
-	n.logf(common.Log.Infof, fmt, args...)
+	n.logf(log.Infof, fmt, args...)
 }
 func (n *Nameserver) debugf(fmt string, args ...interface{}) {
-	n.logf(common.Log.Debugf, fmt, args...)
+	n.logf(log.Debugf, fmt, args...)
 }
 func (n *Nameserver) errorf(fmt string, args ...interface{}) {
-	n.logf(common.Log.Errorf, fmt, args...)
+	n.logf(log.Errorf, fmt, args...)
 }
 func (n *Nameserver) logf(f func(string, ...interface{}), fmt string, args ...interface{}) {
 	f("[nameserver %s] "+fmt, append([]interface{}{n.ourName}, args...)...)
@@ -1,6 +1,7 @@
 package address
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 
@@ -183,6 +184,19 @@ func (addr Address) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("%q", addr.String())), nil
 }
 
+func (addr *Address) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	parsed, err := ParseIP(str)
+	if err != nil {
+		return err
+	}
+	*addr = parsed
+	return nil
+}
+
 func (addr Address) String() string {
 	return addr.IP4().String()
 }
@@ -1,6 +1,7 @@
 package address
 
 import (
+	"encoding/json"
 	"testing"
 	"testing/quick"
 
@@ -67,3 +68,15 @@ func TestCIDRStartAndEnd(t *testing.T) {
 	require.Equal(t, ip("10.0.0.0"), cidr.Start(), "")
 	require.Equal(t, ip("10.0.1.0"), cidr.End(), "")
 }
+
+func TestAddressJSON(t *testing.T) {
+	cidr, err := ParseCIDR("10.32.1.0/24")
+	require.NoError(t, err)
+	buf, err := json.Marshal(cidr)
+	require.NoError(t, err)
+	require.Equal(t, `{"Addr":"10.32.1.0","PrefixLen":24}`, string(buf))
+	var decoded CIDR
+	require.NoError(t, json.Unmarshal(buf, &decoded))
+	require.Equal(t, cidr, decoded)
+	require.Error(t, json.Unmarshal([]byte(`"10.32.1"`), &decoded.Addr))
+}
@@ -0,0 +1,73 @@
+package net
+
+import (
+	"net"
+	"sync"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// DeleteConntrackFlows removes the conntrack entries for all flows to
+// or from any of ips, returning how many went. Packets of a flow that
+// is still allowed will re-create its entry (TCP included, as long as
+// nf_conntrack_tcp_loose is on, as it is by default), so this is a way
+// of getting established connections to be checked against the current
+// rules, or of making sure none of them are mistaken for a connection to
+// whoever gets an address next.
+func DeleteConntrackFlows(ips ...net.IP) (uint, error) {
+	flows := make([]common.ConntrackFlows, len(ips))
+	for i, ip := range ips {
+		flows[i] = common.ConntrackEitherWay(ip)
+	}
+	return common.DeleteConntrackFlows(flows...)
+}
+
+// ConntrackDeleter deletes, in the background, the conntrack entries of
+// the addresses given to Delete: those given meanwhile all go in one
+// pass over the table, and callers, e.g. the IP allocator, don't wait
+// for it. Failure is only logged.
+type ConntrackDeleter struct {
+	sync.Mutex
+	pending     []net.IP
+	wake        chan struct{}
+	deleteFlows func(ips ...net.IP) (uint, error)
+}
+
+func NewConntrackDeleter() *ConntrackDeleter {
+	return newConntrackDeleter(DeleteConntrackFlows)
+}
+
+func newConntrackDeleter(deleteFlows func(ips ...net.IP) (uint, error)) *ConntrackDeleter {
+	d := &ConntrackDeleter{wake: make(chan struct{}, 1), deleteFlows: deleteFlows}
+	go d.run()
+	return d
+}
+
+// Delete queues the deletion of the entries for flows to or from ip
+func (d *ConntrackDeleter) Delete(ip net.IP) {
+	d.Lock()
+	d.pending = append(d.pending, ip)
+	d.Unlock()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *ConntrackDeleter) run() {
+	for range d.wake {
+		d.Lock()
+		ips := d.pending
+		d.pending = nil
+		d.Unlock()
+		if len(ips) == 0 {
+			continue
+		}
+		n, err := d.deleteFlows(ips...)
+		if err != nil {
+			common.Log.Warningf("Unable to delete conntrack entries for %v: %s", ips, err)
+		} else if n > 0 {
+			common.Log.Debugf("Deleted %d conntrack entries for %v", n, ips)
+		}
+	}
+}
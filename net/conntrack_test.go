@@ -0,0 +1,50 @@
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConntrackDeleter(t *testing.T) {
+	calls := make(chan []net.IP)
+	release := make(chan struct{})
+	d := newConntrackDeleter(func(ips ...net.IP) (uint, error) {
+		calls <- ips
+		<-release
+		return uint(len(ips)), nil
+	})
+
+	ip := func(s string) net.IP { return net.ParseIP(s).To4() }
+	d.Delete(ip("10.32.0.1"))
+	select {
+	case ips := <-calls:
+		require.Equal(t, []net.IP{ip("10.32.0.1")}, ips)
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing deleted")
+	}
+
+	// Delete doesn't wait for the deletion under way, and what is given
+	// meanwhile goes in one pass
+	done := make(chan struct{})
+	go func() {
+		d.Delete(ip("10.32.0.2"))
+		d.Delete(ip("10.32.0.3"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Delete waited for the deletion under way")
+	}
+	release <- struct{}{}
+	select {
+	case ips := <-calls:
+		require.Equal(t, []net.IP{ip("10.32.0.2"), ip("10.32.0.3")}, ips)
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued addresses not deleted")
+	}
+	release <- struct{}{}
+}
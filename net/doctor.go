@@ -0,0 +1,173 @@
+package net
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// A Divergence is a way in which the host's plumbing for the weave
+// bridge no longer matches what was set up, typically because
+// NetworkManager or some other agent has been at it.
+type Divergence struct {
+	Check    string
+	Problem  string
+	Repaired bool
+}
+
+// BridgeDoctor compares the bridge, datapath, veths, sysctls and
+// addresses of an Instance against the model weave set up. Divergences
+// which weave itself would have put right when creating the bridge,
+// like an interface being down, are repaired; the rest, like sysctls
+// which are host-wide policy, are only reported.
+type BridgeDoctor struct {
+	Instance Instance
+	// ExpectedAddrs, if set, returns the addresses the bridge should
+	// have, i.e. those given to it by expose
+	ExpectedAddrs func() []*net.IPNet
+}
+
+func (d *BridgeDoctor) Check() []Divergence {
+	var found []Divergence
+	report := func(check string, repaired bool, format string, args ...interface{}) {
+		found = append(found, Divergence{Check: check, Problem: fmt.Sprintf(format, args...), Repaired: repaired})
+	}
+
+	bridgeName := d.Instance.BridgeName()
+	bridgeType := DetectBridgeType(bridgeName, d.Instance.DatapathName())
+	switch bridgeType {
+	case None:
+		report("bridge", false, "bridge %q does not exist", bridgeName)
+		return found
+	case Inconsistent:
+		report("bridge", false, "bridge %q and datapath %q are of inconsistent types; 'weave reset' is needed", bridgeName, d.Instance.DatapathName())
+		return found
+	}
+
+	bridge := d.ensureUp("bridge", bridgeName, report)
+	if bridge == nil {
+		return found
+	}
+	if bridgeType == BridgedFastdp {
+		d.ensureUp("datapath", d.Instance.DatapathName(), report)
+		if port := d.ensureUp("vports", d.Instance.BridgePortName(), report); port != nil && port.Attrs().MasterIndex != bridge.Attrs().Index {
+			err := netlink.LinkSetMasterByIndex(port, bridge.Attrs().Index)
+			report("vports", err == nil, "%q is not attached to bridge %q%s", d.Instance.BridgePortName(), bridgeName, failure(err))
+		}
+		// Attaching a vport to the datapath needs the ODP machinery
+		// in the router, so a missing one is only reported
+		d.ensureUp("vports", d.Instance.DatapathPortName(), report)
+	}
+
+	d.checkVeths(bridge, report)
+	d.checkSysctls(bridgeName, report)
+	if d.ExpectedAddrs != nil {
+		d.checkAddrs(bridge, d.ExpectedAddrs(), report)
+	}
+	return found
+}
+
+func (d *BridgeDoctor) ensureUp(check, name string, report func(string, bool, string, ...interface{})) netlink.Link {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		report(check, false, "unable to find %q: %s", name, err)
+		return nil
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		err := netlink.LinkSetUp(link)
+		report(check, err == nil, "%q is down%s", name, failure(err))
+	}
+	return link
+}
+
+func (d *BridgeDoctor) checkSysctls(bridgeName string, report func(string, bool, string, ...interface{})) {
+	if value, err := readSysctl("net/ipv4/ip_forward"); err == nil && value != "1" {
+		report("sysctl", false, "IP forwarding is disabled, so containers cannot reach other hosts")
+	}
+	// The effective rp_filter of an interface is the larger of its own
+	// and the "all" setting: 1 is strict, 2 loose
+	all, err1 := readSysctl("net/ipv4/conf/all/rp_filter")
+	own, err2 := readSysctl(fmt.Sprintf("net/ipv4/conf/%s/rp_filter", bridgeName))
+	if err1 == nil && err2 == nil && maxSysctl(all, own) == 1 {
+		report("sysctl", false, "strict reverse path filtering is enabled on %q, which drops asymmetrically routed traffic", bridgeName)
+	}
+	if value, err := readSysctl("net/bridge/bridge-nf-call-iptables"); err != nil {
+		report("sysctl", false, "br_netfilter is not loaded, so network policy and iptables kube-proxy may not work")
+	} else if value != "1" {
+		report("sysctl", false, "bridge-nf-call-iptables is disabled, so network policy and iptables kube-proxy may not work")
+	}
+	if value, err := readSysctl(fmt.Sprintf("net/ipv4/neigh/%s/ucast_solicit", bridgeName)); err == nil && value != "1" {
+		err := ConfigureARPCache(bridgeName)
+		report("sysctl", err == nil, "ARP cache parameters of %q have been changed%s", bridgeName, failure(err))
+	}
+}
+
+func (d *BridgeDoctor) checkAddrs(bridge netlink.Link, expected []*net.IPNet, report func(string, bool, string, ...interface{})) {
+	addrs, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+	if err != nil {
+		report("address", false, "unable to list addresses of %q: %s", bridge.Attrs().Name, err)
+		return
+	}
+	for _, ipnet := range expected {
+		if contains(addrs, ipnet) {
+			continue
+		}
+		err := netlink.AddrAdd(bridge, &netlink.Addr{IPNet: ipnet})
+		report("address", err == nil, "%q is missing address %s%s", bridge.Attrs().Name, ipnet, failure(err))
+	}
+}
+
+// maxSysctl returns the largest of the numeric values; those which are
+// not numbers count as 0
+func maxSysctl(values ...string) int {
+	max := 0
+	for _, value := range values {
+		if n, err := strconv.Atoi(value); err == nil && n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// checkVeths puts the veths of containers attached to bridge back up,
+// and reports those of weave's which are attached to no bridge: with
+// several weave networks on the host, which one they belong to is not
+// known.
+func (d *BridgeDoctor) checkVeths(bridge netlink.Link, report func(string, bool, string, ...interface{})) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		report("veths", false, "unable to list links: %s", err)
+		return
+	}
+	ours := map[string]bool{d.Instance.BridgePortName(): true, d.Instance.DatapathPortName(): true}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if link.Type() != "veth" || ours[attrs.Name] {
+			continue
+		}
+		switch {
+		case attrs.MasterIndex == bridge.Attrs().Index && attrs.Flags&net.FlagUp == 0:
+			err := netlink.LinkSetUp(link)
+			report("veths", err == nil, "container veth %q on bridge %q is down%s", attrs.Name, bridge.Attrs().Name, failure(err))
+		case attrs.MasterIndex == 0 && strings.HasPrefix(attrs.Name, vethPrefix+"pl"):
+			report("veths", false, "container veth %q is attached to no bridge", attrs.Name)
+		}
+	}
+}
+
+// readSysctl is a variable so that tests can fake the sysctls
+var readSysctl = func(variable string) (string, error) {
+	value, err := ioutil.ReadFile(fmt.Sprintf("/proc/sys/%s", variable))
+	return strings.TrimSpace(string(value)), err
+}
+
+func failure(err error) string {
+	if err == nil {
+		return ""
+	}
+	return fmt.Sprintf(" and repairing it failed: %s", err)
+}
@@ -0,0 +1,78 @@
+// +build netns
+
+package net
+
+// The bridge doctor repairing a bridge in a fresh network namespace.
+// It needs root, so only runs with the netns build tag:
+//
+//     sudo go test -tags netns ./net/
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func TestBridgeDoctorRepairs(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	require.NoError(t, err)
+	defer orig.Close()
+	ns, err := netns.New()
+	require.NoError(t, err)
+	defer ns.Close()
+	defer netns.Set(orig)
+
+	instance := Instance("dtest")
+	addr := &net.IPNet{IP: net.IPv4(10, 32, 0, 1).To4(), Mask: net.CIDRMask(12, 32)}
+	d := &BridgeDoctor{Instance: instance, ExpectedAddrs: func() []*net.IPNet { return []*net.IPNet{addr} }}
+	require.Equal(t, []Divergence{{Check: "bridge", Problem: `bridge "weave-dtest" does not exist`}}, d.Check())
+
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: instance.BridgeName()}}
+	require.NoError(t, netlink.LinkAdd(bridge))
+
+	// A bridge which is down and missing its address is put right
+	repaired := make(map[string]bool)
+	for _, div := range d.Check() {
+		if div.Check != "sysctl" {
+			require.True(t, div.Repaired, div.Problem)
+			repaired[div.Check] = true
+		}
+	}
+	require.Equal(t, map[string]bool{"bridge": true, "address": true}, repaired)
+	link, err := netlink.LinkByName(instance.BridgeName())
+	require.NoError(t, err)
+	require.NotZero(t, link.Attrs().Flags&net.FlagUp)
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	require.NoError(t, err)
+	require.True(t, contains(addrs, addr))
+
+	// and then left alone
+	for _, div := range d.Check() {
+		require.Equal(t, "sysctl", div.Check, div.Problem)
+	}
+
+	// A container veth on the bridge which is down is put back up, and
+	// one detached from it reported
+	attached, err := CreateAndAttachVeth(vethPrefix+"pl1", vethPrefix+"pg1", instance.BridgeName(), 0, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkSetDown(attached))
+	detached, err := CreateAndAttachVeth(vethPrefix+"pl2", vethPrefix+"pg2", instance.BridgeName(), 0, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkSetNoMaster(detached))
+	var veths []Divergence
+	for _, div := range d.Check() {
+		if div.Check == "veths" {
+			veths = append(veths, Divergence{Check: div.Check, Repaired: div.Repaired})
+		}
+	}
+	require.Equal(t, []Divergence{{Check: "veths", Repaired: true}, {Check: "veths"}}, veths)
+	link, err = netlink.LinkByName(vethPrefix + "pl1")
+	require.NoError(t, err)
+	require.NotZero(t, link.Attrs().Flags&net.FlagUp)
+}
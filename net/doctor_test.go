@@ -0,0 +1,86 @@
+package net
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func withSysctls(values map[string]string) func() {
+	orig := readSysctl
+	readSysctl = func(variable string) (string, error) {
+		if value, found := values[variable]; found {
+			return value, nil
+		}
+		return "", os.ErrNotExist
+	}
+	return func() { readSysctl = orig }
+}
+
+func checkSysctls(d *BridgeDoctor, bridgeName string) []Divergence {
+	var found []Divergence
+	d.checkSysctls(bridgeName, func(check string, repaired bool, format string, args ...interface{}) {
+		found = append(found, Divergence{Check: check, Repaired: repaired})
+	})
+	return found
+}
+
+func TestBridgeDoctorSysctls(t *testing.T) {
+	healthy := map[string]string{
+		"net/ipv4/ip_forward":                "1",
+		"net/ipv4/conf/all/rp_filter":        "0",
+		"net/ipv4/conf/weave/rp_filter":      "2",
+		"net/bridge/bridge-nf-call-iptables": "1",
+		"net/ipv4/neigh/weave/ucast_solicit": "1",
+	}
+	defer withSysctls(healthy)()
+	d := &BridgeDoctor{}
+	require.Empty(t, checkSysctls(d, "weave"))
+
+	for _, tc := range []struct {
+		name     string
+		variable string
+		value    string
+	}{
+		{name: "forwarding disabled", variable: "net/ipv4/ip_forward", value: "0"},
+		{name: "strict rp_filter for all", variable: "net/ipv4/conf/all/rp_filter", value: "1"},
+		{name: "strict rp_filter on the bridge", variable: "net/ipv4/conf/weave/rp_filter", value: "1"},
+		{name: "bridge-nf-call-iptables disabled", variable: "net/bridge/bridge-nf-call-iptables", value: "0"},
+		{name: "br_netfilter not loaded", variable: "net/bridge/bridge-nf-call-iptables"},
+	} {
+		values := make(map[string]string)
+		for variable, value := range healthy {
+			values[variable] = value
+		}
+		if tc.value == "" {
+			delete(values, tc.variable)
+		} else {
+			values[tc.variable] = tc.value
+		}
+		restore := withSysctls(values)
+		require.Equal(t, []Divergence{{Check: "sysctl"}}, checkSysctls(d, "weave"), tc.name)
+		restore()
+	}
+}
+
+func TestBridgeDoctorLooseRPFilter(t *testing.T) {
+	// Loose filtering for all overrides strict filtering on the bridge
+	values := map[string]string{
+		"net/ipv4/ip_forward":                "1",
+		"net/ipv4/conf/all/rp_filter":        "2",
+		"net/ipv4/conf/weave/rp_filter":      "1",
+		"net/bridge/bridge-nf-call-iptables": "1",
+		"net/ipv4/neigh/weave/ucast_solicit": "1",
+	}
+	defer withSysctls(values)()
+	require.Empty(t, checkSysctls(&BridgeDoctor{}, "weave"))
+	require.Equal(t, 2, maxSysctl("2", "1"))
+	require.Equal(t, 1, maxSysctl("0", "1", ""))
+}
+
+func TestBridgeDoctorFailure(t *testing.T) {
+	require.Equal(t, "", failure(nil))
+	require.Equal(t, " and repairing it failed: no such device", failure(errors.New("no such device")))
+}
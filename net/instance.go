@@ -0,0 +1,84 @@
+package net
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// An Instance is one of several independent weave networks on a host,
+// which must not share any host resources. The empty Instance is the
+// default network, whose resources have the traditional names. These
+// names must match those the weave script derives from WEAVE_INSTANCE.
+type Instance string
+
+// Instance names are kept short so that derived interface names fit
+// in IFNAMSIZ.
+var instanceNameRegexp = regexp.MustCompile(`^[a-z0-9]{1,6}$`)
+
+func ParseInstance(name string) (Instance, error) {
+	if name != "" && !instanceNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid instance name %q: must be 1-6 lower case letters or digits", name)
+	}
+	return Instance(name), nil
+}
+
+func (i Instance) BridgeName() string {
+	if i == "" {
+		return WeaveBridgeName
+	}
+	return WeaveBridgeName + "-" + string(i)
+}
+
+func (i Instance) DatapathName() string {
+	if i == "" {
+		return DatapathName
+	}
+	return DatapathName + "-" + string(i)
+}
+
+// BridgePortName is the name of the veth end which attaches the
+// datapath, or the pcap interface, to the bridge.
+func (i Instance) BridgePortName() string {
+	if i == "" {
+		return vethPrefix + "-bridge"
+	}
+	return "vw" + string(i) + "-br"
+}
+
+// DatapathPortName is the other end of the BridgePortName veth, which
+// is attached to the datapath with bridged fast datapath.
+func (i Instance) DatapathPortName() string {
+	if i == "" {
+		return vethPrefix + "-datapath"
+	}
+	return "vw" + string(i) + "-dp"
+}
+
+// NATChain is the iptables nat chain holding the masquerading rules
+// for the bridge's exposed subnets.
+func (i Instance) NATChain() string {
+	if i == "" {
+		return DefaultNATChain
+	}
+	return DefaultNATChain + "-" + strings.ToUpper(string(i))
+}
+
+// ServicesChain is the iptables filter chain rejecting the traffic
+// from the bridge to the service CIDR which kube-proxy did not
+// translate.
+func (i Instance) ServicesChain() string {
+	if i == "" {
+		return DefaultServicesChain
+	}
+	return DefaultServicesChain + "-" + strings.ToUpper(string(i))
+}
+
+// MSSChain is the iptables mangle chain clamping the MSS of TCP
+// connections through the bridge.
+func (i Instance) MSSChain() string {
+	if i == "" {
+		return DefaultMSSChain
+	}
+	return DefaultMSSChain + "-" + strings.ToUpper(string(i))
+}
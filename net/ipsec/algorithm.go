@@ -0,0 +1,186 @@
+package ipsec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// An Algorithm is an AEAD with which ESP payloads are encrypted. Each
+// takes a 32 byte key plus a 4 byte salt, i.e. keySize.
+type Algorithm byte
+
+const (
+	// AESGCM is understood by all peers, so is the fallback
+	AESGCM Algorithm = iota
+	// ChaCha20Poly1305 is much faster than AES-GCM on CPUs without
+	// AES instructions, but needs Linux 4.2 or later
+	ChaCha20Poly1305
+)
+
+// AlgorithmsFeature is the connection feature listing the algorithms a
+// peer supports, most preferred first. Peers without it only support
+// AESGCM.
+const AlgorithmsFeature = "IPsecAlgorithms"
+
+// NoAESFeature is the connection feature of peers whose CPUs have no
+// AES instructions, which would rather encrypt what they send with
+// ChaCha20Poly1305, where their peers support it
+const NoAESFeature = "IPsecNoAES"
+
+// Where the CPU's instruction set extensions are listed
+const cpuInfoPath = "/proc/cpuinfo"
+
+var algorithmNames = map[Algorithm]string{
+	AESGCM:           "aes-gcm",
+	ChaCha20Poly1305: "chacha20-poly1305",
+}
+
+var algorithmXfrmNames = map[Algorithm]string{
+	AESGCM:           "rfc4106(gcm(aes))",
+	ChaCha20Poly1305: "rfc7539esp(chacha20,poly1305)",
+}
+
+func (a Algorithm) String() string {
+	if name, found := algorithmNames[a]; found {
+		return name
+	}
+	return fmt.Sprintf("algorithm-%d", a)
+}
+
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for a, n := range algorithmNames {
+		if n == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown IPsec algorithm %q", name)
+}
+
+// ParseAlgorithms parses a comma or space separated list of
+// algorithm names.
+func ParseAlgorithms(names string) ([]Algorithm, error) {
+	var algos []Algorithm
+	for _, name := range strings.FieldsFunc(names, func(r rune) bool { return r == ',' || r == ' ' }) {
+		a, err := ParseAlgorithm(name)
+		if err != nil {
+			return nil, err
+		}
+		algos = append(algos, a)
+	}
+	return algos, nil
+}
+
+// preferredAlgorithms returns algos, without duplicates and always
+// ending with AESGCM if it isn't preferred to anything else
+func preferredAlgorithms(algos []Algorithm) []Algorithm {
+	var preferred []Algorithm
+	seen := make(map[Algorithm]bool)
+	for _, a := range append(algos, AESGCM) {
+		if !seen[a] {
+			seen[a] = true
+			preferred = append(preferred, a)
+		}
+	}
+	return preferred
+}
+
+func (ipsec *IPSec) addAlgorithmsFeatureTo(features map[string]string) {
+	names := make([]string, len(ipsec.algorithms))
+	for i, a := range ipsec.algorithms {
+		names[i] = a.String()
+	}
+	features[AlgorithmsFeature] = strings.Join(names, " ")
+	if ipsec.noAES {
+		features[NoAESFeature] = "true"
+	}
+}
+
+// ChooseAlgorithm returns our most preferred algorithm which the peer
+// with the given connection features also supports, unless the peer
+// has no AES instructions, in which case ChaCha20Poly1305 is, if both
+// support it. What we choose is what the peer encrypts with.
+func (ipsec *IPSec) ChooseAlgorithm(features map[string]string) Algorithm {
+	remote := map[Algorithm]bool{AESGCM: true}
+	if names, found := features[AlgorithmsFeature]; found {
+		for _, name := range strings.Fields(names) {
+			// Ignore any the remote knows of and we don't
+			if a, err := ParseAlgorithm(name); err == nil {
+				remote[a] = true
+			}
+		}
+	}
+	if features[NoAESFeature] != "" && remote[ChaCha20Poly1305] {
+		for _, a := range ipsec.algorithms {
+			if a == ChaCha20Poly1305 {
+				return a
+			}
+		}
+	}
+	for _, a := range ipsec.algorithms {
+		if remote[a] {
+			return a
+		}
+	}
+	return AESGCM
+}
+
+// chooseAlgorithms sets the algorithms, when none are configured, by
+// whether the CPU has AES instructions. Without them, AES-GCM is
+// several times slower than ChaCha20Poly1305, so that is preferred;
+// with them, ChaCha20Poly1305 is still supported, for peers without.
+// Either way, only if the kernel supports it.
+func (ipsec *IPSec) chooseAlgorithms() {
+	if err := ipsec.probeAlgorithm(ChaCha20Poly1305); err != nil {
+		if ipsec.noAES {
+			ipsec.log.Warnf("ipsec: no AES instructions, but encrypting with %s anyway, as the kernel does not support %s: %s", AESGCM, ChaCha20Poly1305, err)
+		}
+		return
+	}
+	if ipsec.noAES {
+		ipsec.log.Infof("ipsec: no AES instructions, so preferring %s", ChaCha20Poly1305)
+		ipsec.algorithms = []Algorithm{ChaCha20Poly1305, AESGCM}
+	} else {
+		ipsec.algorithms = []Algorithm{AESGCM, ChaCha20Poly1305}
+	}
+}
+
+// HasAESInstructions returns whether the CPU has AES instructions, e.g.
+// AES-NI; true if that can't be told
+func HasAESInstructions() bool {
+	f, err := os.Open(cpuInfoPath)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	has, err := aesInstructions(f)
+	return has || err != nil
+}
+
+// aesInstructions returns whether the first list of CPU flags in
+// cpuinfo, that of x86, or of features, that of ARM, has AES
+// instructions
+func aesInstructions(cpuinfo io.Reader) (bool, error) {
+	scanner := bufio.NewScanner(cpuinfo)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if name := strings.TrimSpace(parts[0]); name != "flags" && name != "Features" {
+			continue
+		}
+		for _, flag := range strings.Fields(parts[1]) {
+			if flag == "aes" {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("no CPU flags in %s", cpuInfoPath)
+}
@@ -0,0 +1,78 @@
+package ipsec
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChooseAlgorithm(t *testing.T) {
+	algos, err := ParseAlgorithms("chacha20-poly1305,aes-gcm")
+	require.NoError(t, err)
+	ipsec := &IPSec{algorithms: preferredAlgorithms(algos)}
+
+	features := make(map[string]string)
+	ipsec.addAlgorithmsFeatureTo(features)
+	require.Equal(t, "chacha20-poly1305 aes-gcm", features[AlgorithmsFeature])
+
+	require.Equal(t, ChaCha20Poly1305, ipsec.ChooseAlgorithm(features))
+	require.Equal(t, AESGCM, ipsec.ChooseAlgorithm(map[string]string{}), "old peer")
+	require.Equal(t, AESGCM, ipsec.ChooseAlgorithm(map[string]string{AlgorithmsFeature: "aes-gcm some-future-algo"}))
+
+	ipsec = &IPSec{algorithms: preferredAlgorithms(nil)}
+	require.Equal(t, AESGCM, ipsec.ChooseAlgorithm(features))
+
+	_, err = ParseAlgorithms("aes-gcm,des")
+	require.Error(t, err)
+
+	// Peers without AES instructions are sent ChaCha20Poly1305 where
+	// both support it
+	ipsec = &IPSec{algorithms: []Algorithm{AESGCM, ChaCha20Poly1305}, noAES: true}
+	features = make(map[string]string)
+	ipsec.addAlgorithmsFeatureTo(features)
+	require.Equal(t, "true", features[NoAESFeature])
+	ipsec.noAES = false
+	require.Equal(t, ChaCha20Poly1305, ipsec.ChooseAlgorithm(features))
+	require.Equal(t, AESGCM, ipsec.ChooseAlgorithm(map[string]string{AlgorithmsFeature: "aes-gcm", NoAESFeature: "true"}))
+	ipsec = &IPSec{algorithms: preferredAlgorithms(nil)}
+	require.Equal(t, AESGCM, ipsec.ChooseAlgorithm(features))
+}
+
+func TestAESInstructions(t *testing.T) {
+	for _, c := range []struct {
+		cpuinfo string
+		aes     bool
+	}{
+		{"processor\t: 0\nflags\t\t: fpu vme sse2 aes avx\n", true},
+		{"processor\t: 0\nflags\t\t: fpu vme sse2 avx\n", false},
+		{"processor\t: 0\nFeatures\t: fp asimd evtstrm aes pmull sha1\n", true},
+		{"processor\t: 0\nFeatures\t: half thumb fastmult vfp edsp neon\n", false},
+	} {
+		aes, err := aesInstructions(strings.NewReader(c.cpuinfo))
+		require.NoError(t, err)
+		require.Equal(t, c.aes, aes, c.cpuinfo)
+	}
+	_, err := aesInstructions(strings.NewReader("processor\t: 0\n"))
+	require.Error(t, err)
+}
+
+func TestMsgInitSARemote(t *testing.T) {
+	nonce := make([]byte, nonceSize)
+	nonce[0] = 7
+	for _, algo := range []Algorithm{AESGCM, ChaCha20Poly1305} {
+		b := (&msgInitSARemote{nonce, 0x1234, algo, 0}).serialize()
+		msg, err := deserializeMsgInitSARemote(b)
+		require.NoError(t, err)
+		require.Equal(t, nonce, msg.nonce)
+		require.Equal(t, SPI(0x1234), msg.spi)
+		require.Equal(t, algo, msg.algo)
+	}
+	// AESGCM is sent as before algorithms were negotiated
+	require.Len(t, (&msgInitSARemote{nonce, 0x1234, AESGCM, 0}).serialize(), nonceSize+32)
+}
+
+func TestCheckFIPS(t *testing.T) {
+	require.NoError(t, CheckFIPS([]Algorithm{AESGCM}))
+	require.Error(t, CheckFIPS([]Algorithm{ChaCha20Poly1305, AESGCM}))
+}
@@ -0,0 +1,133 @@
+package ipsec
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// Kinds of AuditEvent
+const (
+	AuditCreated   = "created"
+	AuditRekeyed   = "rekeyed"
+	AuditExpired   = "expired"
+	AuditDestroyed = "destroyed"
+	// Not of an SA, but of a rule the SAs depend on having gone, and
+	// been put back; the Reason is the rule
+	AuditRepaired = "repaired"
+)
+
+// An AuditEvent records when an SA started or stopped protecting
+// traffic between two hosts, and why, or when a rule without which
+// traffic would go in the clear was found missing and put back.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Reason     string    `json:"reason,omitempty"`
+	LocalPeer  string    `json:"localPeer,omitempty"`
+	RemotePeer string    `json:"remotePeer,omitempty"`
+	Direction  string    `json:"direction,omitempty"`
+	Src        string    `json:"src,omitempty"`
+	Dst        string    `json:"dst,omitempty"`
+	SPI        string    `json:"spi,omitempty"`
+}
+
+// An AuditSink is where AuditEvents are sent. Audit is called with
+// IPSec's lock held, so should not block for long.
+type AuditSink interface {
+	Audit(AuditEvent) error
+}
+
+// NewAuditSink returns the sink described by spec, which is either
+// "file:" followed by the pathname of a file to append JSON lines to,
+// or "syslog", or nil for an empty spec.
+func NewAuditSink(spec string) (AuditSink, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "weave-ipsec")
+		if err != nil {
+			return nil, err
+		}
+		return &syslogAuditSink{w}, nil
+	case strings.HasPrefix(spec, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(spec, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &fileAuditSink{file: f}, nil
+	}
+	return nil, fmt.Errorf("unknown audit sink %q: expected file:<path> or syslog", spec)
+}
+
+type fileAuditSink struct {
+	sync.Mutex
+	file *os.File
+}
+
+func (s *fileAuditSink) Audit(e AuditEvent) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.file.Write(append(buf, '\n'))
+	return err
+}
+
+type syslogAuditSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogAuditSink) Audit(e AuditEvent) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(buf))
+}
+
+// audit sends an event about si to the sink, if any
+func (ipsec *IPSec) audit(event, reason string, si *spiInfo) {
+	if ipsec.auditSink == nil {
+		return
+	}
+	direction := "in"
+	if si.isDirOut {
+		direction = "out"
+	}
+	e := AuditEvent{
+		Time:       time.Now(),
+		Event:      event,
+		Reason:     reason,
+		LocalPeer:  si.localPeer.String(),
+		RemotePeer: si.remotePeer.String(),
+		Direction:  direction,
+		Src:        si.src.String(),
+		Dst:        si.dst.String(),
+		SPI:        fmt.Sprintf("0x%08x", uint32(si.spi)),
+	}
+	if err := ipsec.auditSink.Audit(e); err != nil {
+		ipsec.log.Warnf("ipsec: audit %s of SA %s -> %s 0x%x failed: %s", event, si.src, si.dst, si.spi, err)
+	}
+}
+
+// auditRepaired sends an event about r, a rule of name, i.e. iptables
+// or ip6tables, having been put back to the sink, if any
+func (ipsec *IPSec) auditRepaired(name string, r common.Rule) {
+	if ipsec.auditSink == nil {
+		return
+	}
+	e := AuditEvent{Time: time.Now(), Event: AuditRepaired, Reason: name + " " + r.String()}
+	if err := ipsec.auditSink.Audit(e); err != nil {
+		ipsec.log.Warnf("ipsec: audit %s of %s rule %s failed: %s", AuditRepaired, name, r, err)
+	}
+}
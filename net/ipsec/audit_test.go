@@ -0,0 +1,41 @@
+package ipsec
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipsec")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	sink, err := NewAuditSink("file:" + path)
+	require.NoError(t, err)
+	ipsec := &IPSec{log: logrus.New(), auditSink: sink}
+	si := &spiInfo{spi: 0x1234, isDirOut: true, localPeer: 1, remotePeer: 2, src: net.ParseIP("10.0.0.1"), dst: net.ParseIP("10.0.0.2")}
+	ipsec.audit(AuditCreated, "test", si)
+
+	buf, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var e AuditEvent
+	require.NoError(t, json.Unmarshal(buf, &e))
+	require.Equal(t, AuditCreated, e.Event)
+	require.Equal(t, "out", e.Direction)
+	require.Equal(t, "10.0.0.2", e.Dst)
+	require.Equal(t, "0x00001234", e.SPI)
+
+	_, err = NewAuditSink("kafka")
+	require.Error(t, err)
+	sink, err = NewAuditSink("")
+	require.NoError(t, err)
+	require.Nil(t, sink)
+}
@@ -0,0 +1,50 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// SPIConflictError is returned when an SPI we are about to use, to the
+// same destination, is already used by an SA not created by us, e.g.
+// one of strongSwan or libreswan on the same host. The kernel tells
+// inbound ESP apart by destination, SPI and mark only, so the two
+// would take each other's traffic, which would then be dropped.
+type SPIConflictError struct {
+	Dst   net.IP
+	SPI   SPI
+	State netlink.XfrmState // the conflicting one
+}
+
+func (e *SPIConflictError) Error() string {
+	s := e.State
+	return fmt.Sprintf("SPI 0x%x to %s is already used by an SA not managed by weave (%s -> %s, reqid %d, mode %s, mark %s), e.g. of an IKE daemon such as strongSwan or libreswan",
+		uint32(e.SPI), e.Dst, s.Src, s.Dst, s.Reqid, s.Mode, markString(s.Mark))
+}
+
+func markString(m *netlink.XfrmMark) string {
+	if m == nil {
+		return "none"
+	}
+	return fmt.Sprintf("0x%x/0x%x", m.Value, m.Mask)
+}
+
+// checkSPIConflict returns an *SPIConflictError if an ESP SA to dst
+// with spi, other than one of ours, is in the kernel
+func (ipsec *IPSec) checkSPIConflict(dst net.IP, spi SPI) error {
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	states, err := ipsec.xfrm.StateList(nl.GetIPFamily(dst))
+	if err != nil {
+		return err
+	}
+	for _, s := range states {
+		if s.Proto == netlink.XFRM_PROTO_ESP && SPI(s.Spi) == spi && s.Dst.Equal(dst) && s.Reqid != reqID {
+			return &SPIConflictError{Dst: dst, SPI: spi, State: s}
+		}
+	}
+	return nil
+}
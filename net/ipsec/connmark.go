@@ -0,0 +1,20 @@
+package ipsec
+
+import (
+	"fmt"
+)
+
+// connMarkRules are the rules with which, with ConnMark, the packets
+// of a flow whose first packet was marked to encrypt are marked from
+// its conntrack entry, and skip the rules of each connection, which
+// otherwise every packet goes through. Exempt traffic is left as it is.
+func connMarkRules(cfg ruleConfig) []rule {
+	mask := fmt.Sprintf("0x%x", cfg.mark.Mask)
+	return []rule{
+		{tableMangle, cfg.chains.out, []string{
+			"-m", "mark", "!", "--mark", ExemptMarkStr,
+			"-j", "CONNMARK", "--restore-mark", "--nfmask", mask, "--ctmask", mask}, true},
+		{tableMangle, cfg.chains.out, []string{"-m", "mark", "--mark", cfg.mark.String(), "-j", "RETURN"}, true},
+		{tableMangle, cfg.chains.outMark, []string{"-j", "CONNMARK", "--save-mark", "--nfmask", mask, "--ctmask", mask}, true},
+	}
+}
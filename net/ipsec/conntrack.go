@@ -0,0 +1,29 @@
+package ipsec
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// forgetFlows deletes the conntrack entries of the UDP flows from src
+// to dst at port, or with nil src and dst of all of them, and with
+// marked only those whose mark they saved, whenever the rules for the
+// pair change: otherwise a flow, which carries VXLAN and so lives as
+// long as it keeps coming, would carry on under what was decided at
+// its first packet, e.g. a mark restored once the connection is no
+// longer encrypted, as its peer moved into a trusted subnet, and what
+// it carries be dropped.
+func (ipsec *IPSec) forgetFlows(src, dst net.IP, port int, marked bool) {
+	if ipsec.conntrack == nil {
+		return
+	}
+	flows := common.ConntrackFlows{Src: src, Dst: dst, Proto: syscall.IPPROTO_UDP, DstPort: uint16(port)}
+	if marked {
+		flows.Mark, flows.MarkMask = ipsec.mark.Value, ipsec.mark.Mask
+	}
+	if _, err := ipsec.conntrack(flows); err != nil {
+		ipsec.log.Warnf("ipsec: deleting conntrack entries of flows from %s to %s:%d: %s", src, dst, port, err)
+	}
+}
@@ -0,0 +1,205 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/weaveworks/mesh"
+)
+
+// ConsistencyCheckInterval is how often the SAs we set up are checked
+// against the kernel. Only those set up at least this long before are
+// checked, so not ones still being set up.
+const ConsistencyCheckInterval = time.Minute
+
+// inconsistency is what is wrong with the IPsec state of a connection
+type inconsistency struct {
+	remotePeer mesh.PeerName
+	connUID    uint64
+	reason     string
+}
+
+// StartConsistencyCheck starts checking, every ConsistencyCheckInterval
+// until the IPSec is destroyed, that each connection's IPsec state is
+// whole: its SAs in both directions, the outbound policy using the
+// outbound SA, the inbound policies, and the rule marking what it
+// sends. A connection with only part of that, e.g. as its peer's
+// InitSARemote never arrived, or the kernel lost a state, is passed to
+// broken, once, to be closed, and so re-established with a fresh
+// handshake.
+func (ipsec *IPSec) StartConsistencyCheck(broken func(remotePeer mesh.PeerName, connUID uint64)) {
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(ConsistencyCheckInterval)
+		defer ticker.Stop()
+		reported := make(map[uint64]bool)
+		for {
+			select {
+			case <-ticker.C:
+				found, err := ipsec.inconsistencies(time.Now().Add(-ConsistencyCheckInterval))
+				if err != nil {
+					ipsec.log.Warnf("ipsec: checking consistency: %s", err)
+					continue
+				}
+				for _, c := range found {
+					if reported[c.connUID] {
+						continue
+					}
+					reported[c.connUID] = true
+					ipsec.log.Warnf("ipsec: IPsec state of connection to %s incomplete: %s; closing it to be re-established", c.remotePeer, c.reason)
+					ipsec.metrics.inconsistencies.Inc()
+					broken(c.remotePeer, c.connUID)
+				}
+				ipsec.forgetReported(reported)
+			case <-stop:
+				return
+			}
+		}
+	}(ipsec.stop)
+}
+
+// forgetReported removes from reported the connections of which no SA
+// is left
+func (ipsec *IPSec) forgetReported(reported map[uint64]bool) {
+	live := make(map[uint64]bool)
+	for _, si := range ipsec.sas() {
+		live[si.connUID] = true
+	}
+	for connUID := range reported {
+		if !live[connUID] {
+			delete(reported, connUID)
+		}
+	}
+}
+
+// inconsistencies returns the connections whose SAs, set up before
+// since, are missing any of their state in the kernel, with the first
+// thing found missing of each
+func (ipsec *IPSec) inconsistencies(since time.Time) ([]inconsistency, error) {
+	states, policies, err := ipsec.dump()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []inconsistency
+	seen := make(map[uint64]bool)
+	for _, si := range ipsec.sas() {
+		// Retiring SAs are kept alone on purpose, and expired ones are
+		// gone from the kernel, after which heartbeats fail
+		if si.retiring || si.expired || !si.created.Before(since) || seen[si.connUID] {
+			continue
+		}
+		reason := ipsec.missing(si, states, policies)
+		if reason == "" && !si.isDirOut {
+			if _, ok := ipsec.spiInfoOf(getSPIId(si.localPeer, si.remotePeer, si.connUID, si.udpPort)); !ok {
+				reason = "no outbound SA, as the peer's InitSARemote never arrived or failed"
+			}
+		}
+		if reason != "" {
+			seen[si.connUID] = true
+			found = append(found, inconsistency{si.remotePeer, si.connUID, reason})
+		}
+	}
+	return found, nil
+}
+
+// spiInfoOf returns the SA of id, if we know of it
+func (ipsec *IPSec) spiInfoOf(id spiID) (spiInfo, bool) {
+	ipsec.RLock()
+	defer ipsec.RUnlock()
+	si, found := ipsec.spiInfo[id]
+	return si, found
+}
+
+// dump returns the SPIs of our states in the kernel, by destination,
+// and our policies
+func (ipsec *IPSec) dump() (map[string]bool, []netlink.XfrmPolicy, error) {
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	states := make(map[string]bool)
+	var policies []netlink.XfrmPolicy
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		ss, err := ipsec.xfrm.StateList(family)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, s := range ss {
+			if s.Reqid == reqID && s.Proto == netlink.XFRM_PROTO_ESP {
+				states[stateID(s.Dst, SPI(s.Spi))] = true
+			}
+		}
+		ps, err := ipsec.xfrm.PolicyList(family)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range ps {
+			if ours(&p) {
+				policies = append(policies, p)
+			}
+		}
+	}
+	return states, policies, nil
+}
+
+func stateID(dst net.IP, spi SPI) string {
+	return fmt.Sprintf("%s 0x%x", dst, spi)
+}
+
+// missing returns what of the state of the SA si is missing from the
+// kernel's states and policies, and the rules; empty if nothing is
+func (ipsec *IPSec) missing(si spiInfo, states map[string]bool, policies []netlink.XfrmPolicy) string {
+	if !states[stateID(si.dst, si.spi)] {
+		return fmt.Sprintf("SA %s -> %s 0x%x gone from the kernel", si.src, si.dst, si.spi)
+	}
+
+	if si.isDirOut {
+		p := findPolicy(policies, xfrmPolicy(si.src, si.dst, si.udpPort, si.spi, si.mode, ipsec.mark))
+		if p == nil {
+			return fmt.Sprintf("outbound policy %s -> %s :%d gone from the kernel", si.src, si.dst, si.udpPort)
+		}
+		// A newer connection's SA may have taken it over; any SA it
+		// uses must be there, or what we send is dropped
+		spi := SPI(p.Tmpls[len(p.Tmpls)-1].Spi)
+		if !states[stateID(si.dst, spi)] {
+			return fmt.Sprintf("outbound policy %s -> %s :%d uses SA 0x%x, which is gone from the kernel", si.src, si.dst, si.udpPort, spi)
+		}
+		return ""
+	}
+
+	for _, sp := range xfrmInPolicies(si.src, si.dst, si.udpPort, si.mode) {
+		if findPolicy(policies, sp) == nil {
+			return fmt.Sprintf("inbound policy %s -> %s :%d gone from the kernel", si.src, si.dst, si.udpPort)
+		}
+	}
+	ipt, err := ipsec.iptablesFor(si.dst)
+	if err != nil {
+		return ""
+	}
+	// The rule is of the traffic we send, so from dst
+	r := ruleMarkOutbound(ipsec.chains, si.dst, si.src, si.udpPort, si.remotePeer)
+	if ok, err := ipt.Exists(r.table, r.chain, r.rulespec...); err == nil && !ok {
+		return fmt.Sprintf("rule marking traffic to %s :%d missing", si.src, si.udpPort)
+	}
+	return ""
+}
+
+// findPolicy returns the policy out of policies with the selector,
+// direction and mark of sp, which the kernel tells them apart by
+func findPolicy(policies []netlink.XfrmPolicy, sp *netlink.XfrmPolicy) *netlink.XfrmPolicy {
+	for i, p := range policies {
+		if p.Dir == sp.Dir && p.Src.String() == sp.Src.String() && p.Dst.String() == sp.Dst.String() &&
+			p.Proto == sp.Proto && p.DstPort == sp.DstPort && sameMark(p.Mark, sp.Mark) {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+func sameMark(a, b *netlink.XfrmMark) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
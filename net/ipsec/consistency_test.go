@@ -0,0 +1,65 @@
+package ipsec
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func initFakeSALocal(t *testing.T, ipsec *IPSec, connUID uint64) {
+	var sessionKey [32]byte
+	require.NoError(t, ipsec.InitSALocal(fakeLocalPeer, fakeRemotePeer, connUID, fakeLocalIP, fakeRemoteIP, 6784, &sessionKey,
+		Params{MsgVersion: MsgVersionTLV, Algorithm: AESGCM},
+		func([]byte) error { return nil }))
+}
+
+func TestInconsistencies(t *testing.T) {
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt})
+	require.NoError(t, err)
+	require.NoError(t, ipsec.Flush(false))
+
+	initFakeSALocal(t, ipsec, 1)
+	require.NoError(t, initFakeSARemote(t, ipsec, 1, 0x100))
+	later := time.Now().Add(time.Second)
+
+	found, err := ipsec.inconsistencies(later)
+	require.NoError(t, err)
+	require.Empty(t, found)
+
+	// Only the peer's half of the handshake
+	initFakeSALocal(t, ipsec, 2)
+	found, err = ipsec.inconsistencies(time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	require.Empty(t, found, "too recent to check")
+	found, err = ipsec.inconsistencies(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	require.Equal(t, uint64(2), found[0].connUID)
+	require.True(t, strings.Contains(found[0].reason, "no outbound SA"), found[0].reason)
+	require.NoError(t, ipsec.Destroy(fakeLocalPeer, fakeRemotePeer, 2, fakeLocalIP, fakeRemoteIP, 6784))
+
+	// The outbound SA lost by the kernel
+	out := &netlink.XfrmState{Src: fakeLocalIP, Dst: fakeRemoteIP, Proto: netlink.XFRM_PROTO_ESP, Spi: 0x100}
+	require.NoError(t, x.StateDel(out))
+	found, err = ipsec.inconsistencies(later)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	require.Equal(t, uint64(1), found[0].connUID)
+	require.Equal(t, fakeRemotePeer, found[0].remotePeer)
+	require.NoError(t, x.StateAdd(out))
+
+	// The rule marking what we send removed by hand
+	r := ruleMarkOutbound(instanceChains(""), fakeLocalIP, fakeRemoteIP, 6784, fakeRemotePeer)
+	require.NoError(t, ipt.Delete(r.table, r.chain, r.rulespec...))
+	found, err = ipsec.inconsistencies(later)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	require.True(t, strings.Contains(found[0].reason, "rule"), found[0].reason)
+}
@@ -0,0 +1,95 @@
+package ipsec
+
+import (
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// DefaultDeadPeerTimeout is how long, by default, an inbound SA may
+// receive nothing before its peer is taken to have gone. Heartbeats
+// are sent over every connection at least every 10s.
+const DefaultDeadPeerTimeout = 30 * time.Second
+
+// StartDeadPeerDetection starts checking, until the IPSec is destroyed,
+// that ESP keeps arriving on the inbound SA of each connection. When
+// none has for the dead peer timeout, the remote host has most likely
+// gone without closing the connection, and dead is called to close it,
+// which tears its SAs and rules down without waiting for them to
+// expire. Does nothing if the timeout is zero.
+func (ipsec *IPSec) StartDeadPeerDetection(dead func(remotePeer mesh.PeerName, connUID uint64)) {
+	timeout := ipsec.deadPeerTimeout
+	if timeout == 0 {
+		return
+	}
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(timeout / 3)
+		defer ticker.Stop()
+		l := liveness{timeout: timeout, seen: make(map[SPI]lastReceived)}
+		for {
+			select {
+			case <-ticker.C:
+				for _, si := range l.check(ipsec.sas(), ipsec.packets, time.Now()) {
+					ipsec.log.Infof("ipsec: nothing received with SA %s -> %s 0x%x for %s; taking %s to have gone", si.src, si.dst, si.spi, timeout, si.remotePeer)
+					dead(si.remotePeer, si.connUID)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(ipsec.stop)
+}
+
+func (ipsec *IPSec) packets(si spiInfo) (uint64, error) {
+	_, packets, err := ipsec.traffic(si)
+	return packets, err
+}
+
+type lastReceived struct {
+	packets  uint64
+	at       time.Time
+	reported bool
+}
+
+// liveness tracks when each inbound SA last received a packet
+type liveness struct {
+	timeout time.Duration
+	seen    map[SPI]lastReceived
+}
+
+// check returns the inbound SAs out of sas which have received
+// nothing for the timeout, each only once
+func (l *liveness) check(sas []spiInfo, packets func(spiInfo) (uint64, error), now time.Time) []spiInfo {
+	var dead []spiInfo
+	current := make(map[SPI]bool)
+	for _, si := range sas {
+		// The kernel may not count the packets of offloaded SAs, and
+		// retiring ones are expected to fall silent
+		if si.isDirOut || si.retiring || si.offloaded || si.expired {
+			continue
+		}
+		n, err := packets(si)
+		if err != nil {
+			continue
+		}
+		current[si.spi] = true
+		last, found := l.seen[si.spi]
+		switch {
+		case !found && n == 0:
+			last = lastReceived{packets: n, at: si.created}
+		case !found || n != last.packets:
+			last = lastReceived{packets: n, at: now}
+		}
+		if !last.reported && now.Sub(last.at) >= l.timeout {
+			last.reported = true
+			dead = append(dead, si)
+		}
+		l.seen[si.spi] = last
+	}
+	for spi := range l.seen {
+		if !current[spi] {
+			delete(l.seen, spi)
+		}
+	}
+	return dead
+}
@@ -0,0 +1,37 @@
+package ipsec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiveness(t *testing.T) {
+	start := time.Now()
+	in := spiInfo{spi: 0x100, created: start}
+	out := spiInfo{spi: 0x200, isDirOut: true, created: start}
+	counts := map[SPI]uint64{}
+	packets := func(si spiInfo) (uint64, error) { return counts[si.spi], nil }
+
+	l := liveness{timeout: 30 * time.Second, seen: make(map[SPI]lastReceived)}
+	require.Empty(t, l.check([]spiInfo{in, out}, packets, start.Add(10*time.Second)))
+
+	// Receiving keeps it alive
+	counts[in.spi] = 3
+	require.Empty(t, l.check([]spiInfo{in, out}, packets, start.Add(20*time.Second)))
+	require.Empty(t, l.check([]spiInfo{in, out}, packets, start.Add(40*time.Second)))
+
+	// Nothing since, for the timeout; reported once
+	require.Equal(t, []spiInfo{in}, l.check([]spiInfo{in, out}, packets, start.Add(50*time.Second)))
+	require.Empty(t, l.check([]spiInfo{in, out}, packets, start.Add(60*time.Second)))
+
+	// Never receiving anything counts from its creation
+	silent := spiInfo{spi: 0x300, created: start}
+	require.Equal(t, []spiInfo{silent}, l.check([]spiInfo{silent}, packets, start.Add(30*time.Second)))
+	_, found := l.seen[in.spi]
+	require.False(t, found, "forgotten once gone")
+
+	retiring := spiInfo{spi: 0x400, created: start, retiring: true}
+	require.Empty(t, l.check([]spiInfo{retiring}, packets, start.Add(time.Hour)))
+}
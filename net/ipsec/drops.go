@@ -0,0 +1,190 @@
+package ipsec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DropCheckInterval is how often the kernel's counts of packets which
+// IPsec dropped are checked, for drops to be logged
+const DropCheckInterval = 30 * time.Second
+
+// dropLogInterval is the least time between log lines about the same
+// kind of drop, or the drops with the same SA; drops meanwhile are
+// added up and reported together
+const dropLogInterval = 5 * time.Minute
+
+// Counts the kernel keeps of the packets its IPsec framework dropped,
+// for the whole network namespace, by reason
+const xfrmStatPath = "/proc/net/xfrm_stat"
+
+// What the drops counted by the more telling of the xfrm_stat counters
+// mean for weave
+var xfrmStatHints = map[string]string{
+	"XfrmInNoStates":        "ESP for an SA we don't have, e.g. one removed while the peer still used it",
+	"XfrmInStateProtoError": "ESP which failed to decrypt, e.g. as the peers derived different keys",
+	"XfrmInStateSeqError":   "ESP replayed, or too far out of order for --ipsec-replay-window",
+	"XfrmInStateExpired":    "ESP for an SA which reached a hard limit",
+	"XfrmInTmplMismatch":    "unencrypted traffic to the data port, from a peer whose connection is encrypted",
+	"XfrmInNoPols":          "traffic matching no inbound policy",
+	"XfrmOutNoStates":       "traffic to encrypt, with no SA to encrypt it with",
+	"XfrmOutStateExpired":   "traffic to encrypt with an SA which reached a hard limit",
+	"XfrmOutPolBlock":       "traffic blocked by an outbound policy",
+}
+
+// readXfrmStat parses the lines, of a name and a count each, of
+// xfrm_stat
+func readXfrmStat(r io.Reader) (map[string]uint64, error) {
+	stat := make(map[string]uint64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("xfrm_stat: %s: %s", fields[0], err)
+		}
+		stat[fields[0]] = n
+	}
+	return stat, scanner.Err()
+}
+
+// xfrmStat returns the counts of xfrm_stat, which is missing unless the
+// kernel has CONFIG_XFRM_STATISTICS
+func xfrmStat() (map[string]uint64, error) {
+	f, err := os.Open(xfrmStatPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readXfrmStat(f)
+}
+
+// dropLog rate-limits the reporting of drops, by what they are
+type dropLog struct {
+	interval time.Duration
+	reported map[string]time.Time
+	pending  map[string]uint64
+}
+
+func newDropLog(interval time.Duration) *dropLog {
+	return &dropLog{interval: interval, reported: make(map[string]time.Time), pending: make(map[string]uint64)}
+}
+
+// add counts more drops, and returns those to report now: all since
+// the last report of what they are, once that was at least the
+// interval ago
+func (l *dropLog) add(drops map[string]uint64, now time.Time) map[string]uint64 {
+	for what, n := range drops {
+		l.pending[what] += n
+	}
+	report := make(map[string]uint64)
+	for what, n := range l.pending {
+		if last, found := l.reported[what]; found && now.Sub(last) < l.interval {
+			continue
+		}
+		report[what] = n
+		l.reported[what] = now
+		delete(l.pending, what)
+	}
+	for what, last := range l.reported {
+		if now.Sub(last) >= l.interval && l.pending[what] == 0 {
+			delete(l.reported, what)
+		}
+	}
+	return report
+}
+
+// increases returns by how much each count in cur has gone up since
+// prev, in which those of new SAs are missing, so taken to be zero
+func increases(prev, cur map[string]uint64) map[string]uint64 {
+	up := make(map[string]uint64)
+	for what, n := range cur {
+		if last := prev[what]; n > last {
+			up[what] = n - last
+		}
+	}
+	return up
+}
+
+// monitorDrops logs, no more often than dropLogInterval for each,
+// what the kernel counts of the packets IPsec dropped, until done is
+// closed. Drops with our SAs, of packets replayed or failing their
+// integrity check, are put down to the peer and SA; the rest are of the
+// whole network namespace, so not only weave's traffic.
+func (ipsec *IPSec) monitorDrops(done <-chan struct{}) {
+	ticker := time.NewTicker(DropCheckInterval)
+	defer ticker.Stop()
+	l := newDropLog(dropLogInterval)
+	// None until the first read, which is what the drops are counted
+	// from; all SAs are set up since we started
+	var stat map[string]uint64
+	sas := make(map[string]uint64)
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		drops := make(map[string]uint64)
+
+		if cur, err := xfrmStat(); err == nil {
+			if stat != nil {
+				for name, n := range increases(stat, cur) {
+					drops[describeXfrmStat(name)] = n
+				}
+			}
+			stat = cur
+		}
+
+		cur := ipsec.saDrops()
+		for what, n := range increases(sas, cur) {
+			drops[what] = n
+		}
+		sas = cur
+
+		report := l.add(drops, time.Now())
+		whats := make([]string, 0, len(report))
+		for what := range report {
+			whats = append(whats, what)
+		}
+		sort.Strings(whats)
+		for _, what := range whats {
+			ipsec.log.Warnf("ipsec: %d packets dropped: %s", report[what], what)
+		}
+	}
+}
+
+func describeXfrmStat(name string) string {
+	if hint, found := xfrmStatHints[name]; found {
+		return fmt.Sprintf("%s (%s)", name, hint)
+	}
+	return name
+}
+
+// saDrops returns the counts of the received packets our inbound SAs
+// dropped, by what they were and the SA
+func (ipsec *IPSec) saDrops() map[string]uint64 {
+	drops := make(map[string]uint64)
+	for _, si := range ipsec.sas() {
+		if si.isDirOut {
+			continue
+		}
+		c, err := ipsec.counters(si)
+		if err != nil {
+			continue
+		}
+		sa := fmt.Sprintf("with SA %s -> %s 0x%x from %s", si.src, si.dst, si.spi, si.remotePeer)
+		drops["replayed, or too far out of order, "+sa] = c.replayed
+		drops["failing their integrity check "+sa] = c.failed
+	}
+	return drops
+}
@@ -0,0 +1,36 @@
+package ipsec
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadXfrmStat(t *testing.T) {
+	stat, err := readXfrmStat(strings.NewReader("XfrmInError                     \t0\nXfrmInNoStates                  \t12\n"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"XfrmInError": 0, "XfrmInNoStates": 12}, stat)
+
+	_, err = readXfrmStat(strings.NewReader("XfrmInNoStates x\n"))
+	require.Error(t, err)
+}
+
+func TestDropLog(t *testing.T) {
+	require.Equal(t, map[string]uint64{"b": 2, "c": 1},
+		increases(map[string]uint64{"a": 3, "b": 1}, map[string]uint64{"a": 3, "b": 3, "c": 1}))
+
+	start := time.Now()
+	l := newDropLog(time.Minute)
+	require.Equal(t, map[string]uint64{"a": 2}, l.add(map[string]uint64{"a": 2}, start))
+
+	// Added up until the interval is over
+	require.Empty(t, l.add(map[string]uint64{"a": 3}, start.Add(20*time.Second)))
+	require.Equal(t, map[string]uint64{"b": 1}, l.add(map[string]uint64{"a": 1, "b": 1}, start.Add(40*time.Second)))
+	require.Equal(t, map[string]uint64{"a": 4}, l.add(nil, start.Add(time.Minute)))
+
+	// Reported at once after a quiet interval
+	require.Empty(t, l.add(nil, start.Add(3*time.Minute)))
+	require.Equal(t, map[string]uint64{"a": 1}, l.add(map[string]uint64{"a": 1}, start.Add(3*time.Minute+time.Second)))
+}
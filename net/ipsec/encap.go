@@ -0,0 +1,77 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// EncapFeature is the connection feature giving the UDP port on which
+// a peer receives ESP encapsulated in UDP (RFC 3948). Connections
+// between peers which both have it use encapsulation, which gets ESP
+// through NAT gateways and firewalls which only pass TCP and UDP.
+const EncapFeature = "IPsecEncapPort"
+
+const (
+	solUDP           = 17 // SOL_UDP
+	udpEncap         = 100
+	udpEncapESPInUDP = 2
+)
+
+// openEncapSocket opens a UDP socket on port which hands ESP it
+// receives to the kernel for decapsulation. Nothing is read from it;
+// it only needs to stay open.
+func openEncapSocket(port int) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return -1, err
+	}
+	if err := syscall.SetsockoptInt(fd, solUDP, udpEncap, udpEncapESPInUDP); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("setsockopt UDP_ENCAP: %s", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: port}); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("bind to UDP port %d: %s", port, err)
+	}
+	return fd, nil
+}
+
+// ChooseEncapPort returns the port on which the peer with the given
+// connection features receives ESP in UDP, if both it and we support
+// that, or 0 to use plain ESP.
+func (ipsec *IPSec) ChooseEncapPort(features map[string]string, remoteIP net.IP) int {
+	// The kernel only supports encapsulation over IPv4
+	if ipsec.encapPort == 0 || remoteIP.To4() == nil {
+		return 0
+	}
+	port, err := strconv.Atoi(features[EncapFeature])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0
+	}
+	return port
+}
+
+func xfrmEncap(srcPort, dstPort int) *netlink.XfrmStateEncap {
+	return &netlink.XfrmStateEncap{
+		Type:            netlink.XFRM_ENCAP_ESPINUDP,
+		SrcPort:         srcPort,
+		DstPort:         dstPort,
+		OriginalAddress: net.IPv4zero,
+	}
+}
+
+// ruleAcceptOutboundEncap lets out encapsulated ESP, which would
+// otherwise be dropped as marked, unencrypted traffic by the rule
+// which stops traffic leaking out in the clear. It must come first.
+func ruleAcceptOutboundEncap(encapPort int, mark Mark) rule {
+	return rule{tableFilter, "OUTPUT",
+		[]string{
+			"-p", "udp", "--sport", strconv.Itoa(encapPort),
+			"-m", "mark", "--mark", mark.String(),
+			"-j", "ACCEPT",
+		}, true}
+}
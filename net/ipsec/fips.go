@@ -0,0 +1,48 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// fipsAlgorithms are the algorithms approved by FIPS 140-2. Keys are
+// derived with HKDF-SHA256 (NIST SP 800-56C), which is approved, in
+// every mode.
+var fipsAlgorithms = map[Algorithm]bool{
+	AESGCM: true,
+}
+
+// CheckFIPS returns an error if any of algos is not approved by FIPS
+// 140-2.
+func CheckFIPS(algos []Algorithm) error {
+	for _, a := range algos {
+		if !fipsAlgorithms[a] {
+			return fmt.Errorf("IPsec algorithm %s is not FIPS approved", a)
+		}
+	}
+	return nil
+}
+
+// probeAlgorithm returns an error unless the kernel can set up an SA
+// encrypted with algo, which it finds out by adding, and then
+// deleting, one on loopback.
+func (ipsec *IPSec) probeAlgorithm(algo Algorithm) error {
+	lo := net.IPv4(127, 0, 0, 1)
+	sa, err := ipsec.xfrm.StateAllocSpi(xfrmAllocSpiState(lo, lo, ipsec.replayWindow, netlink.XFRM_MODE_TRANSPORT))
+	if err != nil {
+		return errors.Wrap(err, "ip xfrm state allocspi")
+	}
+	defer ipsec.delState(sa)
+
+	probe, err := xfrmState(lo, lo, SPI(sa.Spi), false, make([]byte, keySize), algo, SALimits{}, ipsec.replayWindow, nil, netlink.XFRM_MODE_TRANSPORT)
+	if err != nil {
+		return err
+	}
+	if err := ipsec.xfrmStateUpdate(probe); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("kernel does not support %s (%s)", algo, algorithmXfrmNames[algo]))
+	}
+	return nil
+}
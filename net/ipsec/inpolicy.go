@@ -0,0 +1,106 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// Inbound policies have the kernel itself drop the traffic of a
+// connection which the remote peer sends in the clear: as it is
+// delivered to the weave port, anything not decrypted with one of our
+// SAs from the peer fails the policy check. Unlike the outbound policy,
+// they can match the port, as the flow of a received packet has it.
+//
+// The policies for a peer are shared by all its connections, several
+// of which have SAs at once while rekeying, so they are counted and
+// only removed along with the last.
+
+const (
+	// Policies with lower priorities take precedence. Ours have
+	// distinctive ones, to tell them from any an IKE daemon adds.
+	inPolicyPriority       = 0x7765
+	inExemptPolicyPriority = inPolicyPriority - 1
+)
+
+func inPolicyKey(srcIP, dstIP net.IP, udpPort int) string {
+	return fmt.Sprintf("%s %s %d", srcIP, dstIP, udpPort)
+}
+
+// xfrmInPolicies returns the policy requiring the traffic from srcIP to
+// udpPort on dstIP to arrive in ESP, with the given mode, and the one
+// letting that of pods exempt from encryption in unencrypted, which
+// precedes it
+func xfrmInPolicies(srcIP, dstIP net.IP, udpPort int, mode netlink.Mode) []*netlink.XfrmPolicy {
+	src, dst := hostNet(srcIP), hostNet(dstIP)
+	exempt := &netlink.XfrmPolicy{
+		Src:      src,
+		Dst:      dst,
+		Proto:    syscall.IPPROTO_UDP,
+		DstPort:  udpPort,
+		Dir:      netlink.XFRM_DIR_IN,
+		Priority: inExemptPolicyPriority,
+		Mark:     exemptMark.xfrm(),
+	}
+	required := &netlink.XfrmPolicy{
+		Src:      src,
+		Dst:      dst,
+		Proto:    syscall.IPPROTO_UDP,
+		DstPort:  udpPort,
+		Dir:      netlink.XFRM_DIR_IN,
+		Priority: inPolicyPriority,
+		Tmpls: []netlink.XfrmPolicyTmpl{
+			{
+				Src:   src.IP,
+				Dst:   dst.IP,
+				Proto: netlink.XFRM_PROTO_ESP,
+				Mode:  mode,
+				Reqid: reqID,
+			},
+		},
+	}
+	if mode == netlink.XFRM_MODE_TRANSPORT {
+		// Accept what was compressed too. Optional, as packets which
+		// don't compress, and those of connections not compressing at
+		// all, come without IPComp.
+		comp := xfrmCompTmpl(src.IP, dst.IP, 0, mode)
+		comp.Optional = 1
+		required.Tmpls = append([]netlink.XfrmPolicyTmpl{comp}, required.Tmpls...)
+	}
+	return []*netlink.XfrmPolicy{exempt, required}
+}
+
+// addInPolicies installs, or updates, the inbound policies for an
+// inbound SA from srcIP. They are not journalled: Flush removes them on
+// start. protectLock must be held.
+func (ipsec *IPSec) addInPolicies(srcIP, dstIP net.IP, udpPort int, mode netlink.Mode) error {
+	for _, sp := range xfrmInPolicies(srcIP, dstIP, udpPort, mode) {
+		if err := ipsec.xfrmPolicyUpdate(sp); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("xfrm policy update (in, %s, %s, %d)", sp.Src, sp.Dst, sp.Priority))
+		}
+	}
+	ipsec.inPolicies[inPolicyKey(srcIP, dstIP, udpPort)]++
+	return nil
+}
+
+// removeInPolicies removes the inbound policies for an inbound SA from
+// srcIP, unless others still use them. protectLock must be held.
+func (ipsec *IPSec) removeInPolicies(srcIP, dstIP net.IP, udpPort int) error {
+	key := inPolicyKey(srcIP, dstIP, udpPort)
+	if n := ipsec.inPolicies[key] - 1; n > 0 {
+		ipsec.inPolicies[key] = n
+		return nil
+	}
+	delete(ipsec.inPolicies, key)
+
+	// The mode doesn't matter for finding them
+	for _, sp := range xfrmInPolicies(srcIP, dstIP, udpPort, netlink.XFRM_MODE_TRANSPORT) {
+		if err := ipsec.delPolicy(sp); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("xfrm policy del (in, %s, %s, %d)", sp.Src, sp.Dst, sp.Priority))
+		}
+	}
+	return nil
+}
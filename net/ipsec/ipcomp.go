@@ -0,0 +1,91 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// CompressFeature is the connection feature of peers which can compress
+// ESP payloads with IPComp (RFC 3173). Each peer decides whether to
+// have what it receives compressed, for the peers it is configured to,
+// and sends the CPI of its IPComp SA in InitSARemote for the remote
+// peer to compress with.
+const CompressFeature = "IPsecCompress"
+
+const (
+	compressAlgorithm = "deflate"
+	// CPIs up to 0xff are reserved for well-known ones
+	cpiMin = 0x100
+	cpiMax = 0xffff
+	// How many random CPIs to try before giving up
+	cpiAttempts = 16
+)
+
+// compressWith returns whether to have the traffic we receive from the
+// peer at remoteIP compressed
+func (ipsec *IPSec) compressWith(remoteIP net.IP) bool {
+	for _, subnet := range ipsec.compressSubnets {
+		if subnet.Contains(remoteIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// addInCompState sets up the inbound IPComp SA from srcIP, with a CPI
+// which it picks at random, as the kernel can't allocate one with the
+// netlink library, and returns the CPI.
+func (ipsec *IPSec) addInCompState(srcIP, dstIP net.IP, mode netlink.Mode) (uint16, error) {
+	for i := 0; i < cpiAttempts; i++ {
+		ipsec.Lock()
+		cpi := uint16(cpiMin + ipsec.random.Intn(cpiMax-cpiMin+1))
+		ipsec.Unlock()
+
+		if err := ipsec.journal.add(journalCompIn, srcIP, dstIP, SPI(cpi)); err != nil {
+			return 0, err
+		}
+		err := ipsec.addCompState(srcIP, dstIP, cpi, mode)
+		if err == nil {
+			return cpi, nil
+		}
+		ipsec.journalDel(journalCompIn, srcIP, dstIP, SPI(cpi))
+		if err != syscall.EEXIST {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("no free CPI after %d attempts", cpiAttempts)
+}
+
+// addCompState adds the IPComp SA with cpi
+func (ipsec *IPSec) addCompState(srcIP, dstIP net.IP, cpi uint16, mode netlink.Mode) error {
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	return ipsec.xfrm.CompStateAdd(srcIP, dstIP, cpi, mode)
+}
+
+// delCompState deletes the IPComp SA with cpi, as long as it is ours
+func (ipsec *IPSec) delCompState(srcIP, dstIP net.IP, cpi uint16) error {
+	return ipsec.delState(&netlink.XfrmState{
+		Src:   srcIP,
+		Dst:   dstIP,
+		Proto: netlink.XFRM_PROTO_COMP,
+		Spi:   int(cpi),
+	})
+}
+
+// xfrmCompTmpl is the template of an IPComp SA with cpi, which comes
+// before that of ESP in a policy, for payloads to be compressed before
+// they are encrypted. A cpi of 0 matches any.
+func xfrmCompTmpl(srcIP, dstIP net.IP, cpi uint16, mode netlink.Mode) netlink.XfrmPolicyTmpl {
+	return netlink.XfrmPolicyTmpl{
+		Src:   srcIP,
+		Dst:   dstIP,
+		Proto: netlink.XFRM_PROTO_COMP,
+		Mode:  mode,
+		Spi:   int(cpi),
+		Reqid: reqID,
+	}
+}
@@ -1,4 +1,8 @@
 // package IPsec provides primitives for establishing IPsec in the fastdp mode.
+//
+// It is driven by the fastdp overlay in the router package and, unlike
+// ipam and nameserver, is not meant to be embedded: its API changes
+// along with the overlay's.
 package ipsec
 
 import (
@@ -7,10 +11,14 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	mathrand "math/rand"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/coreos/go-iptables/iptables"
@@ -19,78 +27,512 @@ import (
 	"golang.org/x/crypto/hkdf"
 
 	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
 )
 
 const (
 	keySize   = 36 // AES-GCM key 32 bytes + 4 bytes salt
 	nonceSize = 32 // HKDF nonce size
 
-	mark    = uint32(0x1) << 17 // iptables marks
-	markStr = "0x20000/0x20000" // update if the above mark changes
+	// reqID is set on every SA and policy template we create, so that
+	// we never remove ones created by anything else, e.g. an IKE
+	// daemon, which happen to have the same mark or SPI
+	reqID = 0x77656176 // "weav"
+
+	// ExemptMarkStr is set, by weave-npc, on packets of pods which have
+	// opted out of encryption. Such packets are sent in the clear and
+	// accepted unencrypted. Update exemptMark if this changes.
+	ExemptMarkStr = "0x40000/0x40000"
+
+	// DefaultReplayWindow is the number of packets by which inbound
+	// ESP may be reordered before the kernel drops it as replayed
+	DefaultReplayWindow = 256
+	// MaxReplayWindow is the largest the kernel allows with ESN
+	MaxReplayWindow = 4096
 
 	tableMangle  = "mangle"
 	tableFilter  = "filter"
-	chainIn      = "WEAVE-IPSEC-IN"
-	chainInMark  = "WEAVE-IPSEC-IN-MARK"
+	tableRaw     = "raw"
 	chainOut     = "WEAVE-IPSEC-OUT"
 	chainOutMark = "WEAVE-IPSEC-OUT-MARK"
+	chainNoTrack = "WEAVE-IPSEC-NOTRACK"
+	// Of the inbound rules which XFRM policies have replaced; only ever
+	// removed, as a previous version may have left them
+	legacyChainIn     = "WEAVE-IPSEC-IN"
+	legacyChainInMark = "WEAVE-IPSEC-IN-MARK"
+	// Of the comment on the rules of each connection, after which
+	// comes the name of the remote peer
+	ruleTagPrefix = "weave-ipsec:"
 )
 
+// chainNames are those of the chains of an IPSec, which differ by
+// weave network instance, so that several on one host each keep to
+// their own
+type chainNames struct {
+	out     string
+	outMark string
+	noTrack string
+}
+
+// instanceChains returns the chainNames of instance; chainOut,
+// chainOutMark and chainNoTrack for the default, unnamed, one
+func instanceChains(instance string) chainNames {
+	if instance == "" {
+		return chainNames{out: chainOut, outMark: chainOutMark, noTrack: chainNoTrack}
+	}
+	prefix := "WEAVE-IPSEC-" + strings.ToUpper(instance)
+	return chainNames{out: prefix + "-OUT", outMark: prefix + "-OUT-MARK", noTrack: prefix + "-NOTRACK"}
+}
+
+// ruleConfig is what the chains and fixed rules of an IPSec depend on
+type ruleConfig struct {
+	chains       chainNames
+	mark         Mark
+	jumpPosition common.Position
+	connMark     bool
+	noTrack      NoTrack
+	encapPort    int
+}
+
 type SPI uint32
 
 // Used to identify:
 // - directional SPIs,
 // - ipsec establishments.
-type spiID [24]byte
+// The data port is part of it, as connections with the same peer may
+// use different ones.
+type spiID [26]byte
 
-func getSPIId(srcPeer, dstPeer mesh.PeerName, connUID uint64) (id spiID) {
+func getSPIId(srcPeer, dstPeer mesh.PeerName, connUID uint64, udpPort int) (id spiID) {
 	binary.BigEndian.PutUint64(id[:], uint64(srcPeer))
 	binary.BigEndian.PutUint64(id[8:], uint64(dstPeer))
 	binary.BigEndian.PutUint64(id[16:], connUID)
+	binary.BigEndian.PutUint16(id[24:], uint16(udpPort))
 	return
 }
 
 type spiInfo struct {
-	spi      SPI
-	isDirOut bool
+	spi        SPI
+	encapPort  int // of the remote peer, if using ESP in UDP
+	isDirOut   bool
+	algo       Algorithm
+	localPeer  mesh.PeerName
+	remotePeer mesh.PeerName
+	src, dst   net.IP
+	created    time.Time
+	connUID    uint64
+	udpPort    int  // of the connection, which its policies and rules match
+	expired    bool // hard limit reached, and the kernel deleted the SA
+	offloaded  bool // to the hardware of the interface it is sent or received over
+	mode       netlink.Mode
+	retiring   bool   // connection closed; kept for the rekey overlap
+	cpi        uint16 // of the IPComp SA alongside, if compressing; 0 if not
+}
+
+// SALimits bound how long, and for how much traffic, each security
+// association is used; zero means no limit. The kernel notifies on
+// reaching a soft limit and deletes the SA on reaching a hard one,
+// after which heartbeats on the connection fail and it is
+// re-established with fresh keys.
+type SALimits struct {
+	TimeSoft   time.Duration
+	TimeHard   time.Duration
+	ByteSoft   uint64
+	ByteHard   uint64
+	PacketSoft uint64
+	PacketHard uint64
+}
+
+func (l SALimits) xfrm() netlink.XfrmStateLimits {
+	return netlink.XfrmStateLimits{
+		TimeSoft:   uint64(l.TimeSoft / time.Second),
+		TimeHard:   uint64(l.TimeHard / time.Second),
+		ByteSoft:   l.ByteSoft,
+		ByteHard:   l.ByteHard,
+		PacketSoft: l.PacketSoft,
+		PacketHard: l.PacketHard,
+	}
+}
+
+// jittered returns l with every limit reduced by the same fraction,
+// random up to jitter, so that SAs set up together, e.g. as a
+// cluster boots, don't all expire together and then all get rekeyed at
+// once. random returns a float64 in [0, 1).
+func (l SALimits) jittered(jitter float64, random func() float64) SALimits {
+	if jitter <= 0 {
+		return l
+	}
+	keep := 1 - jitter*random()
+	l.TimeSoft = time.Duration(float64(l.TimeSoft) * keep)
+	l.TimeHard = time.Duration(float64(l.TimeHard) * keep)
+	l.ByteSoft = uint64(float64(l.ByteSoft) * keep)
+	l.ByteHard = uint64(float64(l.ByteHard) * keep)
+	l.PacketSoft = uint64(float64(l.PacketSoft) * keep)
+	l.PacketHard = uint64(float64(l.PacketHard) * keep)
+	return l
+}
+
+// ParseSALimits parses a comma-separated list of limits, e.g.
+// "time-soft=50m,bytes-hard=1000000000", out of time-soft, time-hard,
+// bytes-soft, bytes-hard, packets-soft and packets-hard, returning
+// limits with those set.
+func ParseSALimits(s string, limits SALimits) (SALimits, error) {
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return SALimits{}, fmt.Errorf("invalid SA limit %q: want name=value", field)
+		}
+		name, value := field[:i], field[i+1:]
+		var err error
+		switch name {
+		case "time-soft":
+			limits.TimeSoft, err = time.ParseDuration(value)
+		case "time-hard":
+			limits.TimeHard, err = time.ParseDuration(value)
+		case "bytes-soft":
+			limits.ByteSoft, err = strconv.ParseUint(value, 10, 64)
+		case "bytes-hard":
+			limits.ByteHard, err = strconv.ParseUint(value, 10, 64)
+		case "packets-soft":
+			limits.PacketSoft, err = strconv.ParseUint(value, 10, 64)
+		case "packets-hard":
+			limits.PacketHard, err = strconv.ParseUint(value, 10, 64)
+		default:
+			return SALimits{}, fmt.Errorf("unknown SA limit %q", name)
+		}
+		if err != nil || limits.TimeSoft < 0 || limits.TimeHard < 0 {
+			return SALimits{}, fmt.Errorf("invalid value %q of SA limit %s", value, name)
+		}
+	}
+	return limits, nil
+}
+
+// Config holds the settings for IPSec which are not per connection.
+type Config struct {
+	Journal    string // pathname to journal to; none if empty
+	Limits     SALimits
+	Algorithms []Algorithm // supported, most preferred first; AESGCM is always supported; by the CPU if empty
+	EncapPort  int         // UDP port to receive ESP in UDP on; 0 to only use plain ESP
+	Offload    bool        // offload SAs to the hardware of the interfaces peers are reached over, where it supports that
+	// Fraction, from 0 to 1, by which Limits are reduced at random for each SA
+	LimitsJitter float64
+	// Of inbound and outbound SAs, instead of Limits if not nil, e.g.
+	// for the outbound SAs to reach a limit first, so that this peer
+	// drives the rekeying of its connections
+	InLimits  *SALimits
+	OutLimits *SALimits
+	// Packets by which inbound ESP may be reordered; DefaultReplayWindow if 0
+	ReplayWindow uint32
+	// Only use FIPS 140-2 approved algorithms, and check that the
+	// kernel supports them
+	FIPS bool
+	// Where to send audit events; none if nil
+	Audit AuditSink
+	// Use tunnel mode SAs with peers which also set this
+	TunnelMode bool
+	// Firewall mark of traffic to encrypt; DefaultMark if zero
+	Mark Mark
+	// How long to keep the inbound SA of a closed connection, for
+	// packets in flight while its replacement is set up; none if zero
+	RekeyOverlap time.Duration
+	// Where to take session keys from, rather than the mesh handshake;
+	// only with peers which do the same if not nil
+	KeySource KeySource
+	// How long an inbound SA may receive nothing before its peer is
+	// taken to have gone; no dead peer detection if zero
+	DeadPeerTimeout time.Duration
+	// Have traffic from peers in these subnets, which also support it,
+	// compressed with IPComp; none if empty
+	CompressSubnets []*net.IPNet
+	// Drop traffic to the data port from any host, not only connected
+	// peers, unless it arrives encrypted, once StrictIngressGrace is
+	// over; at once if zero
+	StrictIngress      bool
+	StrictIngressGrace time.Duration
+	// Of peers whose connections are not encrypted, so whose traffic
+	// strict ingress mode lets in
+	TrustedSubnets []*net.IPNet
+	// Sets up states and policies; over netlink if nil
+	Xfrm XfrmClient
+	// Deletes the conntrack entries of flows whose rules change;
+	// common.DeleteConntrackFlows if nil
+	Conntrack func(...common.ConntrackFlows) (uint, error)
+	// Set up the rules and chains for IPv4 and IPv6; with iptables and
+	// ip6tables if nil
+	IPTables  common.IPTablesBackend
+	IP6Tables common.IPTablesBackend
+	// How often to put back the chains and rules which have gone, e.g.
+	// flushed by firewalld reloading; never if zero
+	ReconcileInterval time.Duration
+	// Where in mangle OUTPUT the rule jumping to the chain marking
+	// what to encrypt goes; at the bottom if zero
+	JumpPosition common.Position
+	// Save the mark of what to encrypt to the conntrack entry of its
+	// flow, and restore it from there, so that only the first packet
+	// of each flow goes through the rules of every connection
+	ConnMark bool
+	// Traffic to exempt from conntrack, with rules in the raw table, so
+	// that it doesn't fill the conntrack table of busy hosts; none if
+	// zero. The data port can't be exempted with ConnMark.
+	NoTrack NoTrack
+	// Name of the weave network, of several on the host, whose chains
+	// these are; those of the default one if empty
+	Instance string
 }
 
 // IPSec
 
 type IPSec struct {
+	// Guards the maps, established and random, and is only held while
+	// using them, so not while talking to the kernel
 	sync.RWMutex
-	ipt *iptables.IPTables
-	log *logrus.Logger
+	ipt  common.IPTablesBackend
+	ip6t common.IPTablesBackend // nil if ip6tables is unavailable
+	// Keep the chains and rules of each of ipt and ip6t in place
+	reconcilers       map[common.IPTablesBackend]*common.Reconciler
+	reconcileInterval time.Duration
+	jumpPosition      common.Position
+	connMark          bool
+	noTrack           NoTrack
+	chains            chainNames
+	// Held while using xfrm, so that a check of a state or policy and
+	// the change it decides on are not interleaved with others
+	xfrmLock sync.Mutex
+	xfrm     XfrmClient
+	// Nil in tests, where there is no conntrack table to clean
+	conntrack func(...common.ConntrackFlows) (uint, error)
+	log       *logrus.Logger
+	// Records xfrm states and policies as they are created, so that
+	// any left behind by a crash are removed on the next start
+	journal *journal
+	// Of inbound and outbound SAs
+	inLimits  SALimits
+	outLimits SALimits
+	// Fraction of limits by which to reduce them at random for each SA
+	limitsJitter float64
+	random       *mathrand.Rand // only used with the lock held
+	// Of every SA, in packets
+	replayWindow uint32
+	// Most preferred first
+	algorithms []Algorithm
+	noAES      bool // the CPU has no AES instructions
+	encapPort  int
+	encapFD    int // the socket on encapPort, if any
+	offload    bool
+	tunnelMode bool
+	mark       Mark
+	// Of inbound SAs, after their connection closes
+	rekeyOverlap time.Duration
+	keySource    KeySource
+	// Of inbound SAs which receive nothing
+	deadPeerTimeout time.Duration
+	compressSubnets []*net.IPNet
+	strictIngress   bool
+	// Before strict ingress mode drops anything
+	strictIngressGrace time.Duration
+	trustedSubnets     []*net.IPNet
+	// Indexes of interfaces found not to support offload
+	noOffload map[int]bool
+
+	metrics   *metrics
+	auditSink AuditSink
+	stop      chan struct{} // closed to stop the expiry monitor and reaper
+	// Peers we have set up inbound SAs from, to count rekeys
+	established map[mesh.PeerName]bool
+	// Held while adding or removing the inbound policies and rules
+	// protecting connections, and guards inPolicies, the number of
+	// inbound SAs using each policy, protected, the number with the peer
+	// of each rule tag, noTrackPorts, of each of ipt and ip6t the number
+	// of connections using each data port whose traffic NoTrack exempts
+	// from conntrack, and strictPorts, the data ports strict ingress
+	// mode covers, and whether their policies are installed
+	protectLock    sync.Mutex
+	inPolicies     map[string]int
+	protected      map[string]int
+	noTrackPorts   map[common.IPTablesBackend]map[int]int
+	strictPorts    map[int]bool
+	strictEnforced bool // the grace period of strict ingress mode is over
+
+	// Held while setting up or destroying the SA of each spiID, so that
+	// those of different connections proceed in parallel
+	spiLocks map[spiID]*spiLock
+	// Journalled states and policies of no SA we know of, as of the
+	// last reap; only used by the reaper
+	reapSuspects map[string]bool
 
 	spiInfo map[spiID]spiInfo
 	// A reference to spiInfo; spiInfo might be of an expired SPI.
 	spis map[SPI]*spiInfo
 }
 
-func New(log *logrus.Logger) (*IPSec, error) {
-	ipt, err := iptables.New()
+type spiLock struct {
+	sync.Mutex
+	refs int // guarded by the IPSec lock
+}
+
+// New returns an IPSec journalling to config.Journal, if given. Any
+// states and policies outstanding in the journal, from a previous run
+// which crashed, are rolled back: their connections died with it.
+func New(log *logrus.Logger, config Config) (*IPSec, error) {
+	var err error
+	if config.IPTables == nil {
+		if config.IPTables, err = common.NewIPTablesBackend(iptables.ProtocolIPv4); err != nil {
+			return nil, errors.Wrap(err, "iptables new")
+		}
+	}
+	if config.IP6Tables == nil {
+		// Only peers connected over IPv6 need ip6tables, so carry on
+		// without it for those which don't have it
+		if ip6t, err := common.NewIPTablesBackend(iptables.ProtocolIPv6); err != nil {
+			log.Warnf("ipsec: ip6tables unavailable, so connections over IPv6 will not be encrypted: %s", err)
+		} else {
+			config.IP6Tables = ip6t
+		}
+	}
+	if config.Xfrm == nil {
+		if config.Xfrm, err = newNetlinkXfrm(); err != nil {
+			return nil, errors.Wrap(err, "netlink handle new")
+		}
+	}
+	if config.Conntrack == nil {
+		config.Conntrack = common.DeleteConntrackFlows
+	}
+
+	ipsec, err := newIPSec(log, config)
 	if err != nil {
-		return nil, errors.Wrap(err, "iptables new")
+		return nil, err
+	}
+
+	if config.FIPS {
+		if err := CheckFIPS(config.Algorithms); err != nil {
+			return nil, err
+		}
+		for _, algo := range ipsec.algorithms {
+			if err := ipsec.probeAlgorithm(algo); err != nil {
+				return nil, errors.Wrap(err, "FIPS mode")
+			}
+		}
+		log.Infof("ipsec: FIPS mode, using %s", ipsec.algorithms)
+	}
+	ipsec.noAES = !HasAESInstructions()
+	if len(config.Algorithms) == 0 && !config.FIPS {
+		ipsec.chooseAlgorithms()
 	}
 
+	if config.Journal != "" {
+		if ipsec.journal, err = openJournal(config.Journal); err != nil {
+			return nil, errors.Wrap(err, "open journal")
+		}
+		ipsec.rollBack()
+	}
+
+	if ipsec.encapPort != 0 {
+		if ipsec.encapFD, err = openEncapSocket(ipsec.encapPort); err != nil {
+			return nil, errors.Wrap(err, "open ESP in UDP socket")
+		}
+	}
+
+	go ipsec.monitorExpiry(ipsec.stop)
+	go ipsec.monitorDrops(ipsec.stop)
+
+	return ipsec, nil
+}
+
+// newIPSec returns an IPSec with the settings of config, using its
+// Xfrm and IPTables, which must be set, and IP6Tables, if set
+func newIPSec(log *logrus.Logger, config Config) (*IPSec, error) {
 	ipsec := &IPSec{
-		ipt:     ipt,
-		log:     log,
-		spiInfo: make(map[spiID]spiInfo),
-		spis:    make(map[SPI]*spiInfo),
+		ipt:                config.IPTables,
+		ip6t:               config.IP6Tables,
+		reconcilers:        make(map[common.IPTablesBackend]*common.Reconciler),
+		reconcileInterval:  config.ReconcileInterval,
+		jumpPosition:       config.JumpPosition,
+		connMark:           config.ConnMark,
+		noTrack:            config.NoTrack,
+		chains:             instanceChains(config.Instance),
+		xfrm:               config.Xfrm,
+		conntrack:          config.Conntrack,
+		log:                log,
+		inLimits:           config.Limits,
+		outLimits:          config.Limits,
+		limitsJitter:       config.LimitsJitter,
+		random:             mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+		replayWindow:       config.ReplayWindow,
+		algorithms:         preferredAlgorithms(config.Algorithms),
+		metrics:            newMetrics(),
+		auditSink:          config.Audit,
+		stop:               make(chan struct{}),
+		established:        make(map[mesh.PeerName]bool),
+		inPolicies:         make(map[string]int),
+		protected:          make(map[string]int),
+		noTrackPorts:       make(map[common.IPTablesBackend]map[int]int),
+		strictPorts:        make(map[int]bool),
+		encapPort:          config.EncapPort,
+		encapFD:            -1,
+		offload:            config.Offload,
+		tunnelMode:         config.TunnelMode,
+		mark:               config.Mark,
+		rekeyOverlap:       config.RekeyOverlap,
+		keySource:          config.KeySource,
+		deadPeerTimeout:    config.DeadPeerTimeout,
+		compressSubnets:    config.CompressSubnets,
+		strictIngress:      config.StrictIngress,
+		strictIngressGrace: config.StrictIngressGrace,
+		trustedSubnets:     config.TrustedSubnets,
+		noOffload:          make(map[int]bool),
+		spiLocks:           make(map[spiID]*spiLock),
+		reapSuspects:       make(map[string]bool),
+		spiInfo:            make(map[spiID]spiInfo),
+		spis:               make(map[SPI]*spiInfo),
 	}
 
+	for _, ipt := range []common.IPTablesBackend{ipsec.ipt, ipsec.ip6t} {
+		if ipt != nil {
+			ipsec.reconcilers[ipt] = common.NewReconciler(ipt)
+		}
+	}
+	if config.InLimits != nil {
+		ipsec.inLimits = *config.InLimits
+	}
+	if config.OutLimits != nil {
+		ipsec.outLimits = *config.OutLimits
+	}
+	if ipsec.replayWindow == 0 {
+		ipsec.replayWindow = DefaultReplayWindow
+	}
+	if ipsec.mark == (Mark{}) {
+		ipsec.mark = DefaultMark
+	}
+	if err := ipsec.mark.check(); err != nil {
+		return nil, err
+	}
+	if ipsec.connMark && ipsec.noTrack.DataPort {
+		return nil, fmt.Errorf("the data port can't be exempted from conntrack with ConnMark, which keeps the mark in its conntrack entries")
+	}
 	return ipsec, nil
 }
 
-// InitSALocal initializes inbound ipsec from remotePeer and triggers
-// the initialization on remotePeer.
-func (ipsec *IPSec) InitSALocal(localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, sessionKey *[32]byte, initRemote func([]byte) error) error {
+// InitSALocal initializes inbound ipsec from remotePeer, with the
+// negotiated params, and triggers the initialization on remotePeer.
+func (ipsec *IPSec) InitSALocal(localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, sessionKey *[32]byte, params Params, initRemote func([]byte) error) (err error) {
+	defer ipsec.countFailure(&err)
+
+	algo, encapPort, mode := params.Algorithm, params.EncapPort, params.mode()
+
 	// ID of inbound SPI
-	spiID := getSPIId(remotePeer, localPeer, connUID)
+	spiID := getSPIId(remotePeer, localPeer, connUID, udpPort)
 
-	ipsec.Lock()
-	defer ipsec.Unlock()
+	defer ipsec.lockSPI(spiID)()
+
+	sessionKey, err = ipsec.sessionKey(localPeer, remotePeer, params, sessionKey)
+	if err != nil {
+		return errors.Wrap(err, "session key")
+	}
 
 	// Derive SA key
 	nonce, err := genNonce()
@@ -103,7 +545,7 @@ func (ipsec *IPSec) InitSALocal(localPeer, remotePeer mesh.PeerName, connUID uin
 	}
 
 	// Allocate SA
-	sa, err := netlink.XfrmStateAllocSpi(xfrmAllocSpiState(remoteIP, localIP))
+	sa, err := ipsec.xfrm.StateAllocSpi(xfrmAllocSpiState(remoteIP, localIP, ipsec.replayWindow, mode))
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("ip xfrm state allocspi (in, %s, %s)", remoteIP, localIP))
 	}
@@ -112,51 +554,121 @@ func (ipsec *IPSec) InitSALocal(localPeer, remotePeer mesh.PeerName, connUID uin
 	// be unique.
 	spi := SPI(sa.Spi)
 
-	ipsec.log.Infof("ipsec: InitSALocal: %s -> %s :%d 0x%x", remoteIP, localIP, udpPort, spi)
+	ipsec.log.Infof("ipsec: InitSALocal: %s -> %s :%d 0x%x %s", remoteIP, localIP, udpPort, spi, algo)
+
+	// The kernel only ensures that no other SA without a mark has it;
+	// one with a mark, e.g. of an IKE daemon, would still clash. The
+	// larval SA expires by itself.
+	if err := ipsec.checkSPIConflict(localIP, spi); err != nil {
+		return errors.Wrap(err, "check SPI (in)")
+	}
+
+	// The allocated SA is larval, and expires by itself if we crash
+	// before journalling it
+	if err := ipsec.journal.add(journalStateIn, remoteIP, localIP, spi); err != nil {
+		return errors.Wrap(err, "journal xfrm state (in)")
+	}
 
 	// Create SA
-	if sa, err := xfrmState(remoteIP, localIP, spi, false, key); err == nil {
-		if err := netlink.XfrmStateUpdate(sa); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("xfrm state update (in, %s, %s, 0x%x)", sa.Src, sa.Dst, sa.Spi))
-		}
-	} else {
+	var encap *netlink.XfrmStateEncap
+	if encapPort != 0 {
+		encap = xfrmEncap(encapPort, ipsec.encapPort)
+	}
+	sa, err = xfrmState(remoteIP, localIP, spi, false, key, algo, ipsec.saLimits(false), ipsec.replayWindow, encap, mode)
+	if err != nil {
 		return errors.Wrap(err, "new xfrm state (in)")
 	}
+	offloaded, err := ipsec.addState(sa, remoteIP, ipsec.xfrmStateUpdate)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("xfrm state update (in, %s, %s, 0x%x)", sa.Src, sa.Dst, sa.Spi))
+	}
+
+	// Have what we receive compressed too
+	var cpi uint16
+	if params.Compress {
+		if cpi, err = ipsec.addInCompState(remoteIP, localIP, mode); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("xfrm comp state add (in, %s, %s)", remoteIP, localIP))
+		}
+	}
 
-	// Install iptables rules
-	if err := ipsec.installDropNonEncrypted(localIP, remoteIP, udpPort, spi); err != nil {
-		return errors.Wrap(err, fmt.Sprintf("install protecting rules (%s, %s, %d, 0x%x)", localIP, remoteIP, udpPort, spi))
+	// Install inbound policies and iptables rules
+	if err := ipsec.installDropNonEncrypted(localIP, remoteIP, udpPort, mode, remotePeer); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("install protecting policies and rules (%s, %s, %d, 0x%x)", localIP, remoteIP, udpPort, spi))
 	}
 
-	si := spiInfo{spi: spi, isDirOut: false}
+	si := spiInfo{spi: spi, encapPort: encapPort, isDirOut: false, algo: algo, localPeer: localPeer, remotePeer: remotePeer, src: remoteIP, dst: localIP, created: time.Now(), connUID: connUID, udpPort: udpPort, offloaded: offloaded, mode: mode, cpi: cpi}
+	ipsec.Lock()
 	ipsec.spiInfo[spiID] = si
 	ipsec.spis[spi] = &si
+	rekeyed := ipsec.established[remotePeer]
+	ipsec.established[remotePeer] = true
+	ipsec.Unlock()
+
+	if rekeyed {
+		ipsec.metrics.rekeys.Inc()
+		ipsec.audit(AuditRekeyed, "new connection", &si)
+	} else {
+		ipsec.audit(AuditCreated, "new connection", &si)
+	}
 
 	// Trigger the initialization on the remote peer
-	msg := &msgInitSARemote{nonce, spi}
-	if err := initRemote(msg.serialize()); err != nil {
+	msg := &msgInitSARemote{nonce, spi, algo, cpi}
+	payload := msg.serialize()
+	if params.MsgVersion == MsgVersionTLV {
+		payload = msg.serializeTLV()
+	}
+	if err := initRemote(payload); err != nil {
 		return errors.Wrap(err, "send InitSARemote")
 	}
 
 	return nil
 }
 
-// InitSARemote initializes outbound ipsec to remotePeer.
-// Triggered by remotePeer.
-func (ipsec *IPSec) InitSARemote(msgInitSARemote []byte, localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, sessionKey *[32]byte) error {
+// InitSARemote initializes outbound ipsec to remotePeer, with the
+// negotiated params. Triggered by remotePeer, with payload, its
+// msgInitSARemote, in the msgVersion format.
+func (ipsec *IPSec) InitSARemote(payload []byte, msgVersion int, localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, sessionKey *[32]byte, params Params) (err error) {
+	defer ipsec.countFailure(&err)
+
+	encapPort, mode := params.EncapPort, params.mode()
+
 	// ID of outbound SPI
-	spiID := getSPIId(localPeer, remotePeer, connUID)
+	spiID := getSPIId(localPeer, remotePeer, connUID, udpPort)
 
-	msg, err := deserializeMsgInitSARemote(msgInitSARemote)
+	var msg *msgInitSARemote
+	if msgVersion == MsgVersionTLV {
+		msg, err = deserializeMsgInitSARemoteTLV(payload)
+	} else {
+		msg, err = deserializeMsgInitSARemote(payload)
+	}
 	if err != nil {
 		return errors.Wrap(err, "deserialize InitSARemote")
 	}
 	spi := msg.spi
 
-	ipsec.Lock()
-	defer ipsec.Unlock()
+	defer ipsec.lockSPI(spiID)()
 
-	ipsec.log.Infof("ipsec: InitSARemote: %s -> %s :%d 0x%x", localIP, remoteIP, udpPort, spi)
+	// A retransmission, after our acknowledgement was slow or lost
+	ipsec.RLock()
+	existing, found := ipsec.spiInfo[spiID]
+	ipsec.RUnlock()
+	if found && existing.spi == spi {
+		ipsec.log.Infof("ipsec: InitSARemote: %s -> %s :%d 0x%x already set up", localIP, remoteIP, udpPort, spi)
+		return nil
+	}
+
+	ipsec.log.Infof("ipsec: InitSARemote: %s -> %s :%d 0x%x %s", localIP, remoteIP, udpPort, spi, msg.algo)
+
+	// The remote peer's kernel picked the SPI, without knowing of the
+	// SAs to it on this host
+	if err := ipsec.checkSPIConflict(remoteIP, spi); err != nil {
+		return errors.Wrap(err, "check SPI (out)")
+	}
+
+	sessionKey, err = ipsec.sessionKey(localPeer, remotePeer, params, sessionKey)
+	if err != nil {
+		return errors.Wrap(err, "session key")
+	}
 
 	// Derive SA key by using the received nonce
 	key, err := deriveKey(sessionKey[:], msg.nonce, remotePeer)
@@ -164,127 +676,473 @@ func (ipsec *IPSec) InitSARemote(msgInitSARemote []byte, localPeer, remotePeer m
 		return errors.Wrap(err, "derive key")
 	}
 
+	if err := ipsec.journal.add(journalStateOut, localIP, remoteIP, spi); err != nil {
+		return errors.Wrap(err, "journal xfrm state (out)")
+	}
+	if err := ipsec.journal.addPolicy(localIP, remoteIP, spi, udpPort); err != nil {
+		return errors.Wrap(err, "journal xfrm policy")
+	}
+
 	// Create SA
-	if sa, err := xfrmState(localIP, remoteIP, spi, true, key); err == nil {
-		if err := netlink.XfrmStateAdd(sa); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("xfrm state update (out, %s, %s, 0x%x)", sa.Src, sa.Dst, sa.Spi))
-		}
-	} else {
+	var encap *netlink.XfrmStateEncap
+	if encapPort != 0 {
+		encap = xfrmEncap(ipsec.encapPort, encapPort)
+	}
+	sa, err := xfrmState(localIP, remoteIP, spi, true, key, msg.algo, ipsec.saLimits(true), ipsec.replayWindow, encap, mode)
+	if err != nil {
 		return errors.Wrap(err, "new xfrm state (out)")
 	}
+	offloaded, err := ipsec.addState(sa, remoteIP, ipsec.xfrmStateAdd)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("xfrm state update (out, %s, %s, 0x%x)", sa.Src, sa.Dst, sa.Spi))
+	}
+
+	// Compress what we send, if the remote peer asked for that
+	if msg.cpi != 0 {
+		if err := ipsec.journal.add(journalCompOut, localIP, remoteIP, SPI(msg.cpi)); err != nil {
+			return errors.Wrap(err, "journal xfrm comp state (out)")
+		}
+		if err := ipsec.addCompState(localIP, remoteIP, msg.cpi, mode); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("xfrm comp state add (out, %s, %s, 0x%x)", localIP, remoteIP, msg.cpi))
+		}
+	}
 
 	// Create or update SP
-	sp := xfrmPolicy(localIP, remoteIP, spi)
-	if err := netlink.XfrmPolicyUpdate(sp); err != nil {
+	sp := xfrmPolicy(localIP, remoteIP, udpPort, spi, mode, ipsec.mark)
+	if msg.cpi != 0 {
+		comp := xfrmCompTmpl(sp.Tmpls[0].Src, sp.Tmpls[0].Dst, msg.cpi, mode)
+		sp.Tmpls = append([]netlink.XfrmPolicyTmpl{comp}, sp.Tmpls...)
+	}
+	if err := ipsec.xfrmPolicyUpdate(sp); err != nil {
 		return errors.Wrap(err, fmt.Sprintf("xfrm policy update (%s, %s, 0x%x)", localIP, remoteIP, spi))
 	}
 
-	si := spiInfo{spi: spi, isDirOut: true}
+	si := spiInfo{spi: spi, encapPort: encapPort, isDirOut: true, algo: msg.algo, localPeer: localPeer, remotePeer: remotePeer, src: localIP, dst: remoteIP, created: time.Now(), connUID: connUID, udpPort: udpPort, offloaded: offloaded, mode: mode, cpi: msg.cpi}
+	ipsec.Lock()
 	ipsec.spiInfo[spiID] = si
 	ipsec.spis[spi] = &si
+	ipsec.Unlock()
+	ipsec.audit(AuditCreated, "requested by remote peer", &si)
 
 	return nil
 }
 
+// saLimits returns the limits for a new SA in the direction given
+func (ipsec *IPSec) saLimits(isDirOut bool) SALimits {
+	ipsec.Lock()
+	defer ipsec.Unlock()
+	limits := ipsec.inLimits
+	if isDirOut {
+		limits = ipsec.outLimits
+	}
+	return limits.jittered(ipsec.limitsJitter, ipsec.random.Float64)
+}
+
+// lockSPI locks the SA identified by id, returning the function to
+// unlock it
+func (ipsec *IPSec) lockSPI(id spiID) func() {
+	ipsec.Lock()
+	l, found := ipsec.spiLocks[id]
+	if !found {
+		l = &spiLock{}
+		ipsec.spiLocks[id] = l
+	}
+	l.refs++
+	ipsec.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		ipsec.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(ipsec.spiLocks, id)
+		}
+		ipsec.Unlock()
+	}
+}
+
 // Destroy destroys any (inbound / outbound) ipsec establishment between the peers.
 func (ipsec *IPSec) Destroy(localPeer, remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int) error {
-	outSPIID := getSPIId(localPeer, remotePeer, connUID)
-	inSPIID := getSPIId(remotePeer, localPeer, connUID)
+	outSPIID := getSPIId(localPeer, remotePeer, connUID, udpPort)
+	inSPIID := getSPIId(remotePeer, localPeer, connUID, udpPort)
+
+	// Always in this order, so as not to deadlock
+	defer ipsec.lockSPI(inSPIID)()
+	defer ipsec.lockSPI(outSPIID)()
+
+	ipsec.RLock()
+	inSPIInfo, inFound := ipsec.spiInfo[inSPIID]
+	outSPIInfo, outFound := ipsec.spiInfo[outSPIID]
+	ipsec.RUnlock()
+
+	switch {
+	case inFound && inSPIInfo.retiring:
+	case inFound && ipsec.rekeyOverlap > 0:
+		ipsec.retire(inSPIID, inSPIInfo)
+	case inFound:
+		ipsec.destroySA(inSPIID, inSPIInfo, "connection closed")
+	}
+	if outFound {
+		ipsec.destroySA(outSPIID, outSPIInfo, "connection closed")
+	}
 
-	ipsec.Lock()
-	defer ipsec.Unlock()
+	return nil
+}
 
-	// Destroy inbound
+// destroySA removes the SA, and its policy or rules, identified by id,
+// for the given reason. Its lockSPI must be held.
+func (ipsec *IPSec) destroySA(id spiID, si spiInfo, reason string) {
+	if si.isDirOut {
+		ipsec.log.Infof("ipsec: destroy: out %s -> %s 0x%x", si.src, si.dst, si.spi)
 
-	if inSPIInfo, ok := ipsec.spiInfo[inSPIID]; ok {
-		ipsec.log.Infof("ipsec: destroy: in %s -> %s 0x%x", remoteIP, localIP, inSPIInfo.spi)
+		if err := ipsec.delPolicy(xfrmPolicy(si.src, si.dst, si.udpPort, si.spi, si.mode, ipsec.mark)); err != nil {
+			ipsec.log.Warnf("ipsec: xfrm policy del (%s, %s, 0x%x) failed: %s", si.src, si.dst, si.spi, err)
+		} else {
+			ipsec.journalDel(journalPolicy, si.src, si.dst, si.spi)
+		}
+	} else {
+		ipsec.log.Infof("ipsec: destroy: in %s -> %s 0x%x", si.src, si.dst, si.spi)
+	}
 
-		inSPI := inSPIInfo.spi
+	sa := &netlink.XfrmState{
+		Src:   si.src,
+		Dst:   si.dst,
+		Proto: netlink.XFRM_PROTO_ESP,
+		Spi:   int(si.spi),
+	}
+	kind := journalStateIn
+	if si.isDirOut {
+		kind = journalStateOut
+	}
+	if si.expired {
+		// The kernel deleted it
+		ipsec.journalDel(kind, si.src, si.dst, si.spi)
+	} else if err := ipsec.delState(sa); err != nil {
+		ipsec.log.Warnf("ipsec: xfrm state del (%s, %s, %s, 0x%x) failed: %s", kind, sa.Src, sa.Dst, sa.Spi, err)
+	} else {
+		ipsec.journalDel(kind, si.src, si.dst, si.spi)
+	}
 
-		inSA := &netlink.XfrmState{
-			Src:   remoteIP,
-			Dst:   localIP,
-			Proto: netlink.XFRM_PROTO_ESP,
-			Spi:   int(inSPI),
+	if si.cpi != 0 {
+		compKind := journalCompIn
+		if si.isDirOut {
+			compKind = journalCompOut
 		}
-		if err := netlink.XfrmStateDel(inSA); err != nil {
-			ipsec.log.Warnf("ipsec: xfrm state del (in, %s, %s, 0x%x) failed: %s", inSA.Src, inSA.Dst, inSA.Spi, err)
+		if err := ipsec.delCompState(si.src, si.dst, si.cpi); err != nil {
+			ipsec.log.Warnf("ipsec: xfrm comp state del (%s, %s, %s, 0x%x) failed: %s", compKind, si.src, si.dst, si.cpi, err)
+		} else {
+			ipsec.journalDel(compKind, si.src, si.dst, SPI(si.cpi))
 		}
+	}
 
-		if err := ipsec.removeDropNonEncrypted(localIP, remoteIP, udpPort, inSPI); err != nil {
-			ipsec.log.Warnf("ipsec: remove protecting rules (%s, %s, %d, 0x%x) failed: %s", localIP, remoteIP, udpPort, inSPI, err)
+	if !si.isDirOut {
+		// The policies are for traffic from the remote peer, i.e. src
+		if err := ipsec.removeDropNonEncrypted(si.dst, si.src, si.udpPort, si.remotePeer); err != nil {
+			ipsec.log.Warnf("ipsec: remove protecting policies and rules (%s, %s, %d, 0x%x) failed: %s", si.dst, si.src, si.udpPort, si.spi, err)
 		}
-
-		delete(ipsec.spiInfo, inSPIID)
-		delete(ipsec.spis, inSPI)
 	}
 
-	// Destroy outbound
+	ipsec.audit(AuditDestroyed, reason, &si)
+	ipsec.Lock()
+	delete(ipsec.spiInfo, id)
+	delete(ipsec.spis, si.spi)
+	ipsec.Unlock()
+}
 
-	if outSPIInfo, ok := ipsec.spiInfo[outSPIID]; ok {
-		ipsec.log.Infof("ipsec: destroy: out %s -> %s 0x%x", localIP, remoteIP, outSPIInfo.spi)
+// SAStatus describes one security association set up by us
+type SAStatus struct {
+	Peer        mesh.PeerName
+	Direction   string // "in" or "out"
+	Src         net.IP
+	Dst         net.IP
+	SPI         SPI
+	Algorithm   string
+	Established time.Time
+	Offloaded   bool
+	// Traffic sent or received with the SA, as counted by the kernel;
+	// zero if it could not be queried, e.g. after expiring
+	Bytes   uint64
+	Packets uint64
+}
 
-		if err := netlink.XfrmPolicyDel(xfrmPolicy(localIP, remoteIP, outSPIInfo.spi)); err != nil {
-			ipsec.log.Warnf("ipsec: xfrm policy del (%s, %s, 0x%x) failed: %s", localIP, remoteIP, outSPIInfo.spi, err)
+// Status returns the SAs currently set up, ordered by peer and then
+// direction, or nil if ipsec is nil.
+func (ipsec *IPSec) Status() []SAStatus {
+	if ipsec == nil {
+		return nil
+	}
+	sas := ipsec.sas()
+	status := make([]SAStatus, 0, len(sas))
+	for _, si := range sas {
+		direction := "in"
+		if si.isDirOut {
+			direction = "out"
 		}
+		bytes, packets, _ := ipsec.traffic(si)
+		status = append(status, SAStatus{
+			Peer:        si.remotePeer,
+			Direction:   direction,
+			Src:         si.src,
+			Dst:         si.dst,
+			SPI:         si.spi,
+			Algorithm:   si.algo.String(),
+			Established: si.created,
+			Offloaded:   si.offloaded,
+			Bytes:       bytes,
+			Packets:     packets,
+		})
+	}
+	sort.Sort(saStatusSlice(status))
+	return status
+}
 
-		outSA := &netlink.XfrmState{
-			Src:   localIP,
-			Dst:   remoteIP,
-			Proto: netlink.XFRM_PROTO_ESP,
-			Spi:   int(outSPIInfo.spi),
-		}
-		if err := netlink.XfrmStateDel(outSA); err != nil {
-			ipsec.log.Warnf("ipsec: xfrm state del (out, %s, %s, 0x%x) failed: %s", outSA.Src, outSA.Dst, outSA.Spi, err)
-		}
+type saStatusSlice []SAStatus
 
-		delete(ipsec.spiInfo, outSPIID)
-		delete(ipsec.spis, outSPIInfo.spi)
+func (s saStatusSlice) Len() int      { return len(s) }
+func (s saStatusSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s saStatusSlice) Less(i, j int) bool {
+	if s[i].Peer != s[j].Peer {
+		return s[i].Peer < s[j].Peer
 	}
-
-	return nil
+	return s[i].Direction < s[j].Direction
 }
 
 // Flush removes all policies/SAs established by us. Also, it removes chains and
 // rules of iptables.
 //
 // If destroy is true, the chains and the rules won't be re-created.
+// Plan lists what it would remove.
 func (ipsec *IPSec) Flush(destroy bool) error {
+	ipsec.protectLock.Lock()
+	defer ipsec.protectLock.Unlock()
 	ipsec.Lock()
 	defer ipsec.Unlock()
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
 
-	policies, err := netlink.XfrmPolicyList(syscall.AF_INET)
+	policies, states, err := ipsec.flushable()
 	if err != nil {
-		return errors.Wrap(err, "xfrm policy list")
+		return err
 	}
 	for _, p := range policies {
-		if p.Mark != nil && p.Mark.Value == mark && len(p.Tmpls) != 0 {
-			spi := SPI(p.Tmpls[0].Spi)
-			if err := netlink.XfrmPolicyDel(&p); err != nil {
-				return errors.Wrap(err, fmt.Sprintf("xfrm policy del (%s, %s, 0x%x)", p.Src, p.Dst, spi))
-			}
+		if err := ipsec.xfrm.PolicyDel(&p); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("xfrm policy del (%s, %s, %s)", p.Src, p.Dst, p.Dir))
 		}
 	}
-
-	states, err := netlink.XfrmStateList(syscall.AF_INET)
-	if err != nil {
-		return errors.Wrap(err, "xfrm state list")
-	}
 	for _, s := range states {
-		if _, ok := ipsec.spis[SPI(s.Spi)]; ok {
-			if err := netlink.XfrmStateDel(&s); err != nil {
-				return errors.Wrap(err, fmt.Sprintf("xfrm state list (%s, %s, 0x%x)", s.Src, s.Dst, s.Spi))
-			}
+		if err := ipsec.xfrm.StateDel(&s); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("xfrm state list (%s, %s, 0x%x)", s.Src, s.Dst, s.Spi))
 		}
 	}
 
+	ipsec.inPolicies = make(map[string]int)
+	ipsec.protected = make(map[string]int)
+	ipsec.noTrackPorts = make(map[common.IPTablesBackend]map[int]int)
+	for udpPort := range ipsec.strictPorts {
+		ipsec.strictPorts[udpPort] = false
+	}
+
 	if err := ipsec.resetIPTables(destroy); err != nil {
+		ipsec.metrics.iptablesErrors.Inc()
 		return errors.Wrap(err, "reset ip tables")
 	}
 
+	if err := ipsec.journal.reset(); err != nil {
+		return errors.Wrap(err, "reset journal")
+	}
+	if destroy {
+		if err := ipsec.journal.Close(); err != nil {
+			return errors.Wrap(err, "close journal")
+		}
+		ipsec.journal = nil
+		if ipsec.stop != nil {
+			close(ipsec.stop)
+			ipsec.stop = nil
+		}
+		if ipsec.encapFD >= 0 {
+			syscall.Close(ipsec.encapFD)
+			ipsec.encapFD = -1
+		}
+	}
+
 	return nil
 }
 
+// FlushPeer removes the SAs we set up with remotePeer, of any
+// connection, along with their policies and rules, and any stray rules
+// tagged for it, leaving those with other peers alone. The caller must
+// close any connection to the peer too, or its traffic would be sent
+// unencrypted. Any state left by failed setups is left to the reaper,
+// as it could be that of a new connection being set up.
+func (ipsec *IPSec) FlushPeer(localPeer, remotePeer mesh.PeerName) error {
+	flush := make(map[spiID]spiInfo)
+	ipsec.RLock()
+	for id, si := range ipsec.spiInfo {
+		if si.localPeer == localPeer && si.remotePeer == remotePeer {
+			flush[id] = si
+		}
+	}
+	ipsec.RUnlock()
+	if len(flush) == 0 {
+		return fmt.Errorf("no IPsec SAs with peer %s", remotePeer)
+	}
+
+	for id, si := range flush {
+		ipsec.flushSA(id, si)
+	}
+	return ipsec.deleteStrayRules(ruleTag(remotePeer))
+}
+
+func (ipsec *IPSec) flushSA(id spiID, si spiInfo) {
+	defer ipsec.lockSPI(id)()
+	// It may have been destroyed meanwhile
+	ipsec.RLock()
+	current, found := ipsec.spiInfo[id]
+	ipsec.RUnlock()
+	if !found || current.spi != si.spi {
+		return
+	}
+	ipsec.destroySA(id, current, "flushed")
+}
+
+// AddFeaturesTo advertises the algorithms and message versions we
+// support, that we acknowledge InitSARemote and can compress, whether
+// we want tunnel mode or use a KeySource, and whether, and where, we
+// receive ESP in UDP
+func (ipsec *IPSec) AddFeaturesTo(features map[string]string) {
+	ipsec.addAlgorithmsFeatureTo(features)
+	addMsgVersionFeatureTo(features)
+	if ipsec.tunnelMode {
+		features[TunnelFeature] = "true"
+	}
+	features[AckFeature] = "true"
+	features[CompressFeature] = "true"
+	if ipsec.keySource != nil {
+		features[KeySourceFeature] = "true"
+	}
+	if ipsec.encapPort != 0 {
+		features[EncapFeature] = strconv.Itoa(ipsec.encapPort)
+	}
+}
+
+func (ipsec *IPSec) countFailure(err *error) {
+	if *err != nil {
+		ipsec.metrics.handshakeFailures.Inc()
+	}
+}
+
+// rollBack removes the states and policies outstanding in the journal,
+// most recent first. Some may never have been created, or have expired,
+// so failures are only logged; anything still left is removed by the
+// Flush which follows on start.
+func (ipsec *IPSec) rollBack() {
+	for _, e := range ipsec.journal.outstanding() {
+		ipsec.rollBackEntry(e)
+	}
+}
+
+func (ipsec *IPSec) rollBackEntry(e journalEntry) {
+	ipsec.log.Infof("ipsec: roll back %s %s -> %s 0x%x", e.Kind, e.Src, e.Dst, e.SPI)
+	var err error
+	switch e.Kind {
+	case journalPolicy:
+		// The template, and so the mode, doesn't matter for finding it
+		err = ipsec.delPolicy(xfrmPolicy(e.Src, e.Dst, e.Port, e.SPI, netlink.XFRM_MODE_TRANSPORT, ipsec.mark))
+	case journalStateIn, journalStateOut:
+		err = ipsec.delState(&netlink.XfrmState{
+			Src:   e.Src,
+			Dst:   e.Dst,
+			Proto: netlink.XFRM_PROTO_ESP,
+			Spi:   int(e.SPI),
+		})
+	case journalCompIn, journalCompOut:
+		err = ipsec.delCompState(e.Src, e.Dst, uint16(e.SPI))
+	}
+	if err != nil {
+		ipsec.log.Debugf("ipsec: roll back %s %s -> %s 0x%x: %s", e.Kind, e.Src, e.Dst, e.SPI, err)
+		return
+	}
+	ipsec.journalDel(e.Kind, e.Src, e.Dst, e.SPI)
+}
+
+func (ipsec *IPSec) xfrmStateAdd(sa *netlink.XfrmState) error {
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	return ipsec.xfrm.StateAdd(sa)
+}
+
+func (ipsec *IPSec) xfrmStateUpdate(sa *netlink.XfrmState) error {
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	return ipsec.xfrm.StateUpdate(sa)
+}
+
+func (ipsec *IPSec) xfrmPolicyUpdate(sp *netlink.XfrmPolicy) error {
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	return ipsec.xfrm.PolicyUpdate(sp)
+}
+
+// ours returns whether we created policy p. Any mark will do, so that
+// policies made before the mark was changed are still flushed.
+func ours(p *netlink.XfrmPolicy) bool {
+	switch {
+	case p.Dir == netlink.XFRM_DIR_IN && p.Priority == inExemptPolicyPriority:
+		// It has no template to tell it by
+		return p.Mark != nil && *p.Mark == *exemptMark.xfrm()
+	case p.Dir == netlink.XFRM_DIR_IN && p.Priority == inStrictExemptPolicyPriority:
+		// Nor have these, so they are tagged with a mark of ours
+		return len(p.Tmpls) == 0 && p.Mark != nil &&
+			(*p.Mark == *exemptMark.xfrm() || *p.Mark == *trustedMark.xfrm())
+	case p.Dir == netlink.XFRM_DIR_IN:
+		return (p.Priority == inPolicyPriority || p.Priority == inStrictPolicyPriority) &&
+			len(p.Tmpls) != 0 && p.Tmpls[0].Reqid == reqID
+	}
+	return p.Mark != nil && p.Mark.Value != 0 && len(p.Tmpls) != 0 && p.Tmpls[0].Reqid == reqID
+}
+
+// delState deletes the SA identified by sa, as long as it is ours
+func (ipsec *IPSec) delState(sa *netlink.XfrmState) error {
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	existing, err := ipsec.xfrm.StateGet(sa)
+	if err != nil {
+		return err
+	}
+	if existing.Reqid != reqID {
+		return fmt.Errorf("not deleting SA with reqid 0x%x, which we did not create", existing.Reqid)
+	}
+	return ipsec.xfrm.StateDel(sa)
+}
+
+// delPolicy deletes the policy matching sp, as long as it is ours and
+// still uses the SA of sp. Once a new connection to the same peer has
+// updated the policy to use its SA, it is left alone.
+func (ipsec *IPSec) delPolicy(sp *netlink.XfrmPolicy) error {
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	existing, err := ipsec.xfrm.PolicyGet(sp)
+	if err != nil {
+		return err
+	}
+	if !ours(existing) {
+		return fmt.Errorf("not deleting policy which we did not create")
+	}
+	// That of ESP is the last template, after any of IPComp
+	if len(sp.Tmpls) != 0 && existing.Tmpls[len(existing.Tmpls)-1].Spi != sp.Tmpls[len(sp.Tmpls)-1].Spi {
+		return nil
+	}
+	return ipsec.xfrm.PolicyDel(sp)
+}
+
+// journalDel records a removal. Failing to do so only means trying
+// the removal again on the next start, so it is not an error.
+func (ipsec *IPSec) journalDel(kind string, src, dst net.IP, spi SPI) {
+	if err := ipsec.journal.del(kind, src, dst, spi); err != nil {
+		ipsec.log.Warnf("ipsec: journal %s del (%s, %s, 0x%x) failed: %s", kind, src, dst, spi, err)
+	}
+}
+
 // iptables
 
 type chain struct {
@@ -298,197 +1156,490 @@ type rule struct {
 	unique   bool
 }
 
-func (ipsec *IPSec) clearChains(chains []chain) error {
+// wanted returns r for a reconciler to keep in place, at the top of
+// its chain if insert
+func (r rule) wanted(insert bool) common.Rule {
+	return common.Rule{Table: r.table, Chain: r.chain, Rulespec: r.rulespec, Insert: insert}
+}
+
+// iptablesFor returns the iptables for the family of ip
+func (ipsec *IPSec) iptablesFor(ip net.IP) (common.IPTablesBackend, error) {
+	if ip.To4() != nil {
+		return ipsec.ipt, nil
+	}
+	if ipsec.ip6t == nil {
+		return nil, fmt.Errorf("ip6tables unavailable for %s", ip)
+	}
+	return ipsec.ip6t, nil
+}
+
+func clearChains(b *common.Batch, chains []chain) {
 	for _, c := range chains {
-		if err := ipsec.ipt.ClearChain(c.table, c.chain); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("iptables clear chain (%s, %s)", c.table, c.chain))
-		}
+		b.ClearChain(c.table, c.chain)
 	}
-	return nil
 }
 
-func (ipsec *IPSec) deleteChains(chains []chain) error {
+func deleteChains(b *common.Batch, chains []chain) {
 	for _, c := range chains {
-		if err := ipsec.ipt.DeleteChain(c.table, c.chain); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("iptables delete chain (%s, %s)", c.table, c.chain))
+		b.DeleteChain(c.table, c.chain)
+	}
+}
+
+// resetRules adds to b appending the rules which don't exist, or with
+// destroy deleting those which do. Rules in chains b clears don't.
+func resetRules(ipt common.IPTablesBackend, b *common.Batch, rules []rule, destroy bool) error {
+	for _, r := range rules {
+		ok := false
+		if !b.Clears(r.table, r.chain) {
+			var err error
+			if ok, err = ipt.Exists(r.table, r.chain, r.rulespec...); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("iptables exists rule (%s, %s, %s)", r.table, r.chain, r.rulespec))
+			}
+		}
+		switch {
+		case !destroy && !ok:
+			b.Append(r.table, r.chain, r.rulespec...)
+		case destroy && ok:
+			b.Delete(r.table, r.chain, r.rulespec...)
 		}
 	}
 	return nil
 }
 
-func (ipsec *IPSec) resetRules(rules []rule, destroy bool) error {
-	for _, r := range rules {
-		ok, err := ipsec.ipt.Exists(r.table, r.chain, r.rulespec...)
+func applyBatch(ipt common.IPTablesBackend, b *common.Batch) error {
+	if err := common.ApplyBatch(ipt, b); err != nil {
+		return errors.Wrap(err, "iptables apply batch")
+	}
+	return nil
+}
+
+func (ipsec *IPSec) resetIPTables(destroy bool) (err error) {
+	for _, rc := range ipsec.reconcilers {
+		rc.Reset()
+	}
+	ipt, ip6t := ipsec.ipt, ipsec.ip6t
+	if !destroy {
+		// Should any of it fail, none of it is left in place
+		tx := ipsec.transaction(ipsec.ipt)
+		defer tx.End(&err)
+		ipt = tx
+		if ip6t != nil {
+			tx6 := ipsec.transaction(ipsec.ip6t)
+			defer tx6.End(&err)
+			ip6t = tx6
+		}
+	}
+	if err := resetIPTables(ipt, destroy, ipsec.ruleConfig()); err != nil {
+		return err
+	}
+	if ipsec.connMark {
+		ipsec.forgetFlows(nil, nil, 0, true)
+	}
+	if !destroy {
+		ipsec.wantFixed(ipsec.ipt)
+	}
+	if ipsec.encapPort != 0 {
+		r := ruleAcceptOutboundEncap(ipsec.encapPort, ipsec.mark)
+		ok, err := ipt.Exists(r.table, r.chain, r.rulespec...)
 		if err != nil {
 			return errors.Wrap(err, fmt.Sprintf("iptables exists rule (%s, %s, %s)", r.table, r.chain, r.rulespec))
 		}
 		switch {
 		case !destroy && !ok:
-			if err := ipsec.ipt.Append(r.table, r.chain, r.rulespec...); err != nil {
-				return errors.Wrap(err, fmt.Sprintf("iptables append rule (%s, %s, %s)", r.table, r.chain, r.rulespec))
+			if err := ipt.Insert(r.table, r.chain, 1, r.rulespec...); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("iptables insert rule (%s, %s, %s)", r.table, r.chain, r.rulespec))
 			}
 		case destroy && ok:
-			if err := ipsec.ipt.Delete(r.table, r.chain, r.rulespec...); err != nil {
+			if err := ipt.Delete(r.table, r.chain, r.rulespec...); err != nil {
 				return errors.Wrap(err, fmt.Sprintf("iptables delete rule (%s, %s, %s)", r.table, r.chain, r.rulespec))
 			}
 		}
+		if !destroy {
+			ipsec.reconcilers[ipsec.ipt].Want(r.wanted(true))
+		}
+	}
+	if ip6t != nil {
+		if err := resetIPTables(ip6t, destroy, ipsec.ruleConfig()); err != nil {
+			return errors.Wrap(err, "ip6tables")
+		}
+		if !destroy {
+			ipsec.wantFixed(ipsec.ip6t)
+		}
 	}
 	return nil
 }
 
-func (ipsec *IPSec) resetIPTables(destroy bool) error {
-	chains := []chain{
-		{tableMangle, chainIn},
-		{tableMangle, chainInMark},
-		{tableFilter, chainIn},
-		{tableMangle, chainOut},
-		{tableMangle, chainOutMark},
-	}
-	rules := []rule{
-		{tableMangle, "INPUT", []string{"-j", chainIn}, true},
-		{tableMangle, chainInMark, []string{"-j", "MARK", "--set-xmark", markStr}, true},
-		{tableFilter, "INPUT", []string{"-j", chainIn}, true},
-		{tableMangle, "OUTPUT", []string{"-j", chainOut}, true},
-		{tableMangle, chainOutMark, []string{"-j", "MARK", "--set-xmark", markStr}, true},
-		{tableFilter, "OUTPUT",
+// transaction returns a common.Transaction over ipt whose rollback
+// resets the reconciler of ipt too
+func (ipsec *IPSec) transaction(ipt common.IPTablesBackend) *common.Transaction {
+	tx := common.NewTransaction(ipt)
+	// Last, lest it puts back what was rolled back
+	tx.OnRollback(func() error {
+		ipsec.reconcilers[ipt].Reset()
+		return nil
+	})
+	return tx
+}
+
+// wantFixed has the reconciler of ipt keep the chains and rules
+// resetIPTables adds in place
+func (ipsec *IPSec) wantFixed(ipt common.IPTablesBackend) {
+	rc := ipsec.reconcilers[ipt]
+	cfg := ipsec.ruleConfig()
+	for _, c := range ownedChains(cfg) {
+		rc.WantOwned(c)
+	}
+	for _, r := range fixedRules(cfg) {
+		// Those restoring the mark come before the rules of connections
+		rc.Want(r.wanted(r.chain == cfg.chains.out))
+	}
+}
+
+func (ipsec *IPSec) ruleConfig() ruleConfig {
+	return ruleConfig{chains: ipsec.chains, mark: ipsec.mark, jumpPosition: ipsec.jumpPosition, connMark: ipsec.connMark, noTrack: ipsec.noTrack, encapPort: ipsec.encapPort}
+}
+
+// chainsOwner is who holds ownedChains in common.Chains
+const chainsOwner = "ipsec"
+
+// ownedChains are the chains resetIPTables claims, with the rules
+// jumping to them, at the jumpPosition of cfg, and empties, and with
+// destroy releases; in the order they can be deleted in. With noTrack,
+// that of the rules exempting traffic from conntrack too.
+func ownedChains(cfg ruleConfig) []common.OwnedChain {
+	chains := []common.OwnedChain{
+		{Table: tableMangle, Name: cfg.chains.out, Jumps: []common.Jump{{From: "OUTPUT", Position: cfg.jumpPosition}}},
+		{Table: tableMangle, Name: cfg.chains.outMark},
+	}
+	if cfg.noTrack.enabled() {
+		chains = append(chains, noTrackChain(cfg))
+	}
+	return chains
+}
+
+// fixedRules are the rules resetIPTables adds, and with destroy
+// deletes, rather than those of each connection or jumping to
+// ownedChains; with connMark, those saving and restoring the mark too,
+// and with noTrack, those exempting ESP from conntrack
+func fixedRules(cfg ruleConfig) []rule {
+	var rules []rule
+	if cfg.connMark {
+		rules = connMarkRules(cfg)
+	}
+	rules = append(rules, noTrackRules(cfg)...)
+	return append(rules,
+		rule{tableMangle, cfg.chains.outMark, []string{"-j", "MARK", "--set-xmark", cfg.mark.String()}, true},
+		rule{tableFilter, "OUTPUT",
 			[]string{
 				"!", "-p", "esp",
 				"-m", "policy", "--dir", "out", "--pol", "none",
-				"-m", "mark", "--mark", markStr,
+				"-m", "mark", "--mark", cfg.mark.String(),
 				"-j", "DROP"}, true},
+	)
+}
+
+func resetIPTables(ipt common.IPTablesBackend, destroy bool, cfg ruleConfig) error {
+	chains, rules := ownedChains(cfg), fixedRules(cfg)
+
+	// Only the default instance had them
+	if cfg.chains == instanceChains("") {
+		if err := removeLegacyInbound(ipt); err != nil {
+			return err
+		}
 	}
 
-	if err := ipsec.clearChains(chains); err != nil {
+	if !cfg.noTrack.enabled() {
+		if err := removeNoTrack(ipt, cfg); err != nil {
+			return err
+		}
+	}
+	if !destroy {
+		for _, c := range chains {
+			if err := common.Chains.Claim(ipt, chainsOwner, c); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("iptables claim chain (%s, %s)", c.Table, c.Name))
+			}
+		}
+	}
+	var b common.Batch
+	for _, c := range chains {
+		b.ClearChain(c.Table, c.Name)
+	}
+	if err := resetRules(ipt, &b, rules, destroy); err != nil {
 		return err
 	}
-
-	if err := ipsec.resetRules(rules, destroy); err != nil {
+	if err := applyBatch(ipt, &b); err != nil {
 		return err
 	}
-
 	if destroy {
-		if err := ipsec.deleteChains(chains); err != nil {
-			return err
+		for _, c := range chains {
+			if err := common.Chains.Release(ipt, chainsOwner, c); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("iptables release chain (%s, %s)", c.Table, c.Name))
+			}
 		}
 	}
-
 	return nil
 }
 
-func ruleMarkInboundESP(srcIP, dstIP net.IP, inSPI SPI) rule {
-	return rule{tableMangle, chainIn,
-		[]string{
-			"-s", dstIP.String(), "-d", srcIP.String(),
-			"-p", "esp",
-			"-m", "esp", "--espspi", "0x" + strconv.FormatUint(uint64(inSPI), 16),
-			"-j", chainInMark,
-		}, true}
-}
-
-func rulesDropNonEncrypted(srcIP, dstIP net.IP, udpPort int, inSPI SPI) []rule {
-	udpPortStr := strconv.FormatUint(uint64(udpPort), 10)
-	return []rule{
-		ruleMarkInboundESP(srcIP, dstIP, inSPI),
-		{tableFilter, chainIn,
-			[]string{
-				"-s", dstIP.String(), "-d", srcIP.String(),
-				"-p", "udp", "--dport", udpPortStr,
-				"-m", "mark", "!", "--mark", markStr,
-				"-j", "DROP",
-			}, false},
-		{tableMangle, chainOut,
-			[]string{
-				"-s", srcIP.String(), "-d", dstIP.String(),
-				"-p", "udp", "--dport", udpPortStr,
-				"-j", chainOutMark,
-			}, false},
+// legacyInbound returns the chains, and the rules jumping to them, of
+// inbound traffic before inbound policies replaced them
+func legacyInbound() ([]chain, []rule) {
+	return []chain{
+		{tableMangle, legacyChainIn},
+		{tableMangle, legacyChainInMark},
+		{tableFilter, legacyChainIn},
+	}, []rule{
+		{tableMangle, "INPUT", []string{"-j", legacyChainIn}, true},
+		{tableFilter, "INPUT", []string{"-j", legacyChainIn}, true},
 	}
 }
 
-func (ipsec *IPSec) installDropNonEncrypted(srcIP, dstIP net.IP, udpPort int, inSPI SPI) error {
-	rules := rulesDropNonEncrypted(srcIP, dstIP, udpPort, inSPI)
-	for _, r := range rules {
-		appendFunc := ipsec.ipt.Append
-		if r.unique {
-			appendFunc = ipsec.ipt.AppendUnique
-		}
-		if err := appendFunc(r.table, r.chain, r.rulespec...); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("iptables append (%s, %s, %s)", r.table, r.chain, r.rulespec))
-		}
+// removeLegacyInbound removes the chains, and the rules jumping to
+// them, which marked inbound ESP and dropped the unmarked traffic of
+// each connection before inbound policies did that. Left in place,
+// they would drop everything from its peers, as nothing marks it any
+// more.
+func removeLegacyInbound(ipt common.IPTablesBackend) error {
+	chains, rules := legacyInbound()
+
+	// Clearing creates them if missing, so that the rules can be looked for
+	var clear common.Batch
+	clearChains(&clear, chains)
+	if err := applyBatch(ipt, &clear); err != nil {
+		return err
+	}
+	var b common.Batch
+	if err := resetRules(ipt, &b, rules, true); err != nil {
+		return err
+	}
+	deleteChains(&b, chains)
+	return applyBatch(ipt, &b)
+}
+
+// ruleMarkOutbound marks the traffic of the connection to remotePeer
+// at dstIP, for the outbound policy to match, unless it is of pods
+// exempt from encryption
+func ruleMarkOutbound(chains chainNames, srcIP, dstIP net.IP, udpPort int, remotePeer mesh.PeerName) rule {
+	return rule{tableMangle, chains.out,
+		[]string{
+			"-s", srcIP.String(), "-d", dstIP.String(),
+			"-p", "udp", "--dport", strconv.FormatUint(uint64(udpPort), 10),
+			"-m", "mark", "!", "--mark", ExemptMarkStr,
+			"-m", "comment", "--comment", ruleTag(remotePeer),
+			"-j", chains.outMark,
+		}, false}
+}
+
+// installDropNonEncrypted protects the connection between srcIP, ours,
+// and remotePeer at dstIP: the inbound policies drop what the remote
+// peer sends in the clear, and the rule marks what we send, so that it
+// is dropped unless the outbound policy encrypts it.
+func (ipsec *IPSec) installDropNonEncrypted(srcIP, dstIP net.IP, udpPort int, mode netlink.Mode, remotePeer mesh.PeerName) (err error) {
+	ipt, err := ipsec.iptablesFor(srcIP)
+	if err != nil {
+		return err
 	}
+
+	ipsec.protectLock.Lock()
+	defer ipsec.protectLock.Unlock()
+
+	// Neither the policies nor the rule are left without the other
+	tx := common.NewTransaction(ipt)
+	defer tx.End(&err)
+	if err := ipsec.addInPolicies(dstIP, srcIP, udpPort, mode); err != nil {
+		return err
+	}
+	tx.OnRollback(func() error { return ipsec.removeInPolicies(dstIP, srcIP, udpPort) })
+	r := ruleMarkOutbound(ipsec.chains, srcIP, dstIP, udpPort, remotePeer)
+	if err := tx.Append(r.table, r.chain, r.rulespec...); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("iptables append (%s, %s, %s)", r.table, r.chain, r.rulespec))
+	}
+	w := r.wanted(false)
+	w.Peer = remotePeer.String()
+	if err := ipsec.addNoTrackPort(ipt, tx, udpPort); err != nil {
+		return err
+	}
+	ipsec.reconcilers[ipt].Want(w)
+	ipsec.protected[ruleTag(remotePeer)]++
+	ipsec.forgetFlows(srcIP, dstIP, udpPort, false)
 	return nil
 }
 
-func (ipsec *IPSec) removeDropNonEncrypted(srcIP, dstIP net.IP, udpPort int, inSPI SPI) error {
-	rules := rulesDropNonEncrypted(srcIP, dstIP, udpPort, inSPI)
-	if err := ipsec.resetRules(rules, true); err != nil {
+// removeDropNonEncrypted undoes installDropNonEncrypted. Should the
+// rule fail to be removed, deleteStrayRules removes it later.
+func (ipsec *IPSec) removeDropNonEncrypted(srcIP, dstIP net.IP, udpPort int, remotePeer mesh.PeerName) error {
+	ipt, err := ipsec.iptablesFor(srcIP)
+	if err != nil {
+		return err
+	}
+
+	ipsec.protectLock.Lock()
+	defer ipsec.protectLock.Unlock()
+
+	tag := ruleTag(remotePeer)
+	if n := ipsec.protected[tag] - 1; n > 0 {
+		ipsec.protected[tag] = n
+	} else {
+		delete(ipsec.protected, tag)
+	}
+	r := ruleMarkOutbound(ipsec.chains, srcIP, dstIP, udpPort, remotePeer)
+	ipsec.reconcilers[ipt].Unwant(r.wanted(false))
+	if err := ipsec.removeInPolicies(dstIP, srcIP, udpPort); err != nil {
+		return err
+	}
+	var b common.Batch
+	if err := resetRules(ipt, &b, []rule{r}, true); err != nil {
+		return err
+	}
+	if err := applyBatch(ipt, &b); err != nil {
+		return err
+	}
+	if err := ipsec.removeNoTrackPort(ipt, udpPort); err != nil {
 		return err
 	}
+	ipsec.forgetFlows(srcIP, dstIP, udpPort, false)
 	return nil
 }
 
-func (ipsec *IPSec) removeDropNonEncryptedInbound(srcIP, dstIP net.IP, inSPI SPI) error {
-	r := ruleMarkInboundESP(srcIP, dstIP, inSPI)
-	if err := ipsec.ipt.Delete(r.table, r.chain, r.rulespec...); err != nil {
-		return errors.Wrap(err, fmt.Sprintf("iptables delete unique (%s, %s, %s)", r.table, r.chain, r.rulespec))
+// ruleTag is the comment on the rules protecting the connections with
+// remotePeer, by which they are found without reconstructing them
+func ruleTag(remotePeer mesh.PeerName) string {
+	return ruleTagPrefix + remotePeer.String()
+}
+
+// taggedRules returns the rulespecs of the rules in chain which have a
+// ruleTag, by tag
+func taggedRules(ipt common.IPTablesBackend, table, chain string) (map[string][][]string, error) {
+	rules, err := ipt.List(table, chain)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("iptables list (%s, %s)", table, chain))
+	}
+	return byTag(rules), nil
+}
+
+// byTag groups the rules, as listed by iptables -S, which have a
+// ruleTag by it
+func byTag(rules []string) map[string][][]string {
+	tagged := make(map[string][][]string)
+	for _, r := range rules {
+		ps := strings.Split(r, " ")
+		if len(ps) < 2 || ps[0] != "-A" {
+			continue
+		}
+		rulespec := ps[2:]
+		for i := 0; i < len(rulespec)-1; i++ {
+			tag := strings.Trim(rulespec[i+1], `"`)
+			if rulespec[i] == "--comment" && strings.HasPrefix(tag, ruleTagPrefix) {
+				rulespec[i+1] = tag
+				tagged[tag] = append(tagged[tag], rulespec)
+				break
+			}
+		}
+	}
+	return tagged
+}
+
+// deleteStrayRules deletes the rules tagged for peers with which no
+// connection is protected, e.g. left behind by failing to remove them;
+// only those with tag, unless it is empty
+func (ipsec *IPSec) deleteStrayRules(tag string) error {
+	ipsec.protectLock.Lock()
+	defer ipsec.protectLock.Unlock()
+
+	for _, ipt := range []common.IPTablesBackend{ipsec.ipt, ipsec.ip6t} {
+		if ipt == nil {
+			continue
+		}
+		tagged, err := taggedRules(ipt, tableMangle, ipsec.chains.out)
+		if err != nil {
+			return err
+		}
+		var b common.Batch
+		for t, rulespecs := range tagged {
+			if (tag != "" && t != tag) || ipsec.protected[t] > 0 {
+				continue
+			}
+			for _, rulespec := range rulespecs {
+				ipsec.log.Infof("ipsec: removing stray rule (%s, %s, %s)", tableMangle, ipsec.chains.out, rulespec)
+				b.Delete(tableMangle, ipsec.chains.out, rulespec...)
+			}
+		}
+		if err := applyBatch(ipt, &b); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // xfrm
 
-func xfrmAllocSpiState(srcIP, dstIP net.IP) *netlink.XfrmState {
+func xfrmAllocSpiState(srcIP, dstIP net.IP, replayWindow uint32, mode netlink.Mode) *netlink.XfrmState {
 	return &netlink.XfrmState{
 		Src:          srcIP,
 		Dst:          dstIP,
 		Proto:        netlink.XFRM_PROTO_ESP,
-		Mode:         netlink.XFRM_MODE_TRANSPORT,
-		ReplayWindow: 256,
+		Mode:         mode,
+		Reqid:        reqID,
+		ReplayWindow: int(replayWindow),
 		ESN:          true,
 	}
 }
 
-func xfrmState(srcIP, dstIP net.IP, spi SPI, isDirOut bool, key []byte) (*netlink.XfrmState, error) {
+func xfrmState(srcIP, dstIP net.IP, spi SPI, isDirOut bool, key []byte, algo Algorithm, limits SALimits, replayWindow uint32, encap *netlink.XfrmStateEncap, mode netlink.Mode) (*netlink.XfrmState, error) {
 	if len(key) != keySize {
 		return nil, fmt.Errorf("key should be %d bytes long", keySize)
 	}
+	algoName, found := algorithmXfrmNames[algo]
+	if !found {
+		return nil, fmt.Errorf("unsupported algorithm %s", algo)
+	}
 
-	state := xfrmAllocSpiState(srcIP, dstIP)
+	state := xfrmAllocSpiState(srcIP, dstIP, replayWindow, mode)
 
 	state.Spi = int(spi)
 	state.Aead = &netlink.XfrmStateAlgo{
-		Name:   "rfc4106(gcm(aes))",
+		Name:   algoName,
 		Key:    key,
 		ICVLen: 128,
 	}
+	state.Limits = limits.xfrm()
+	state.Encap = encap
 
 	return state, nil
 }
 
-func xfrmPolicy(srcIP, dstIP net.IP, spi SPI) *netlink.XfrmPolicy {
-	ipMask := []byte{0xff, 0xff, 0xff, 0xff} // /32
-
+// xfrmPolicy returns the policy encrypting the marked traffic to udpPort
+// on dstIP with the SA with spi. It matches the port, so that the
+// connections with a peer on different data ports each have their own.
+func xfrmPolicy(srcIP, dstIP net.IP, udpPort int, spi SPI, mode netlink.Mode, mark Mark) *netlink.XfrmPolicy {
+	src, dst := hostNet(srcIP), hostNet(dstIP)
 	return &netlink.XfrmPolicy{
-		Src:   &net.IPNet{IP: srcIP, Mask: ipMask},
-		Dst:   &net.IPNet{IP: dstIP, Mask: ipMask},
-		Proto: syscall.IPPROTO_UDP,
-		Dir:   netlink.XFRM_DIR_OUT,
-		Mark: &netlink.XfrmMark{
-			Value: mark,
-			Mask:  mark,
-		},
+		Src:     src,
+		Dst:     dst,
+		Proto:   syscall.IPPROTO_UDP,
+		DstPort: udpPort,
+		Dir:     netlink.XFRM_DIR_OUT,
+		Mark:    mark.xfrm(),
 		Tmpls: []netlink.XfrmPolicyTmpl{
 			{
-				Src:   srcIP,
-				Dst:   dstIP,
+				Src:   src.IP,
+				Dst:   dst.IP,
 				Proto: netlink.XFRM_PROTO_ESP,
-				Mode:  netlink.XFRM_MODE_TRANSPORT,
+				Mode:  mode,
 				Spi:   int(spi),
+				Reqid: reqID,
 			},
 		},
 	}
 }
 
+// hostNet returns the network of exactly ip, in its family
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}
+}
+
 // Key derivation
 
 func genNonce() ([]byte, error) {
@@ -524,18 +1675,29 @@ func deriveKey(sessionKey []byte, nonce []byte, peerName mesh.PeerName) ([]byte,
 
 // Protocol Messages
 
+// The algorithm is appended only when it is not AESGCM, so that peers
+// which predate algorithm negotiation, and only ever get AESGCM, can
+// still parse the message.
 type msgInitSARemote struct {
 	nonce []byte
 	spi   SPI
+	algo  Algorithm
+	cpi   uint16 // of the IPComp SA to compress with; 0 for none, and only in MsgVersionTLV
 }
 
+const msgInitSARemoteBaseSize = nonceSize + 32 // SPI
+
 func deserializeMsgInitSARemote(b []byte) (*msgInitSARemote, error) {
 	if len(b) == 0 {
 		return nil, fmt.Errorf("empty msg")
 	}
 
 	msg := &msgInitSARemote{}
-	if len(b) != msg.size() {
+	switch len(b) {
+	case msgInitSARemoteBaseSize:
+	case msgInitSARemoteBaseSize + 1:
+		msg.algo = Algorithm(b[msgInitSARemoteBaseSize])
+	default:
 		return nil, fmt.Errorf("invalid payload size: %d", len(b))
 	}
 
@@ -549,7 +1711,10 @@ func deserializeMsgInitSARemote(b []byte) (*msgInitSARemote, error) {
 }
 
 func (msg *msgInitSARemote) size() int {
-	return nonceSize + 32 // SPI
+	if msg.algo != AESGCM {
+		return msgInitSARemoteBaseSize + 1
+	}
+	return msgInitSARemoteBaseSize
 }
 
 func (msg *msgInitSARemote) serialize() []byte {
@@ -557,6 +1722,9 @@ func (msg *msgInitSARemote) serialize() []byte {
 
 	copy(b[:nonceSize], msg.nonce)
 	binary.BigEndian.PutUint32(b[nonceSize:], uint32(msg.spi))
+	if msg.algo != AESGCM {
+		b[msgInitSARemoteBaseSize] = byte(msg.algo)
+	}
 
 	return b
 }
@@ -0,0 +1,199 @@
+package ipsec
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/weaveworks/mesh"
+)
+
+func TestXfrmPolicyFamily(t *testing.T) {
+	sp := xfrmPolicy(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 6784, 0x100, netlink.XFRM_MODE_TRANSPORT, DefaultMark)
+	require.Equal(t, "10.0.0.1/32", sp.Src.String())
+	require.Equal(t, "10.0.0.2/32", sp.Dst.String())
+	require.Equal(t, 6784, sp.DstPort)
+	require.Equal(t, net.IPv4len, len(sp.Tmpls[0].Src))
+
+	sp = xfrmPolicy(net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), 6784, 0x100, netlink.XFRM_MODE_TRANSPORT, DefaultMark)
+	require.Equal(t, "fd00::1/128", sp.Src.String())
+	require.Equal(t, "fd00::2/128", sp.Dst.String())
+	require.Equal(t, net.IPv6len, len(sp.Tmpls[0].Dst))
+}
+
+func TestXfrmStateLimits(t *testing.T) {
+	key := make([]byte, keySize)
+	limits := SALimits{TimeSoft: 50 * time.Minute, TimeHard: time.Hour, PacketHard: 1 << 32}
+	sa, err := xfrmState(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 0x100, true, key, AESGCM, limits, DefaultReplayWindow, nil, netlink.XFRM_MODE_TRANSPORT)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3000), sa.Limits.TimeSoft)
+	require.Equal(t, uint64(3600), sa.Limits.TimeHard)
+	require.Equal(t, uint64(1<<32), sa.Limits.PacketHard)
+	require.Equal(t, uint64(0), sa.Limits.ByteHard, "unlimited")
+	require.Equal(t, DefaultReplayWindow, sa.ReplayWindow)
+}
+
+func TestSALimitsJitter(t *testing.T) {
+	limits := SALimits{TimeSoft: 50 * time.Minute, TimeHard: time.Hour, ByteHard: 1000}
+	require.Equal(t, limits, limits.jittered(0, func() float64 { return 0.5 }))
+
+	jittered := limits.jittered(0.2, func() float64 { return 0.5 })
+	require.Equal(t, 45*time.Minute, jittered.TimeSoft)
+	require.Equal(t, 54*time.Minute, jittered.TimeHard)
+	require.Equal(t, uint64(900), jittered.ByteHard)
+	require.Equal(t, uint64(0), jittered.PacketHard, "still unlimited")
+}
+
+func TestChooseEncapPort(t *testing.T) {
+	ipsec := &IPSec{encapPort: 4500}
+	features := make(map[string]string)
+	ipsec.AddFeaturesTo(features)
+	require.Equal(t, "4500", features[EncapFeature])
+
+	v4, v6 := net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")
+	require.Equal(t, 4500, ipsec.ChooseEncapPort(features, v4))
+	require.Equal(t, 0, ipsec.ChooseEncapPort(features, v6), "IPv4 only")
+	require.Equal(t, 0, ipsec.ChooseEncapPort(map[string]string{}, v4), "remote doesn't encapsulate")
+	require.Equal(t, 0, (&IPSec{}).ChooseEncapPort(features, v4), "we don't encapsulate")
+}
+
+func TestOurs(t *testing.T) {
+	sp := xfrmPolicy(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 6784, 0x100, netlink.XFRM_MODE_TRANSPORT, DefaultMark)
+	require.True(t, ours(sp))
+	sp.Tmpls[0].Reqid = 1 // e.g. from an IKE daemon, with the same mark
+	require.False(t, ours(sp))
+
+	in := xfrmInPolicies(net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1"), 6784, netlink.XFRM_MODE_TRANSPORT)
+	require.Len(t, in, 2)
+	for _, sp := range in {
+		require.True(t, ours(sp))
+		require.Equal(t, 6784, sp.DstPort)
+	}
+	require.Empty(t, in[0].Tmpls, "exempt traffic needs no SA")
+	require.True(t, in[0].Priority < in[1].Priority, "exempt policy takes precedence")
+	in[1].Priority = 0
+	require.False(t, ours(in[1]))
+
+	sa, err := xfrmState(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 0x100, true, make([]byte, keySize), AESGCM, SALimits{}, DefaultReplayWindow, nil, netlink.XFRM_MODE_TRANSPORT)
+	require.NoError(t, err)
+	require.Equal(t, reqID, sa.Reqid)
+}
+
+func TestStrictPolicies(t *testing.T) {
+	_, trusted4, _ := net.ParseCIDR("192.168.0.0/16")
+	_, trusted6, _ := net.ParseCIDR("fd00::/8")
+	policies := xfrmStrictPolicies(6784, []*net.IPNet{trusted4, trusted6})
+	require.Len(t, policies, 6)
+	for _, sp := range policies {
+		require.True(t, ours(sp))
+		require.Equal(t, 6784, sp.DstPort)
+		// Those of each peer take precedence
+		require.True(t, sp.Priority > inPolicyPriority)
+		if len(sp.Tmpls) != 0 {
+			require.Equal(t, inStrictPolicyPriority, sp.Priority)
+			require.Equal(t, len(sp.Src.IP), len(sp.Tmpls[0].Src), "template in the family of the selector")
+		} else {
+			require.Equal(t, inStrictExemptPolicyPriority, sp.Priority)
+		}
+	}
+	require.Equal(t, net.IPv4len, len(policies[4].Src.IP))
+	require.Equal(t, "192.168.0.0/16", policies[4].Src.String())
+	require.Equal(t, "fd00::/8", policies[5].Src.String())
+
+	// Not one an IKE daemon might add
+	policies[1].Tmpls[0].Reqid = 1
+	require.False(t, ours(policies[1]))
+	// nor one without a template, at the same priority, but untagged
+	policies[4].Mark = nil
+	require.False(t, ours(policies[4]))
+	policies[5].Mark = &netlink.XfrmMark{Value: 0x1, Mask: 0xff}
+	require.False(t, ours(policies[5]))
+}
+
+func TestLockSPI(t *testing.T) {
+	ipsec := &IPSec{spiLocks: make(map[spiID]*spiLock)}
+	a, b := getSPIId(1, 2, 1, 6784), getSPIId(2, 1, 1, 6784)
+	require.NotEqual(t, a, getSPIId(1, 2, 1, 6785), "connections on other data ports are apart")
+
+	unlockA := ipsec.lockSPI(a)
+	// Another SA can be locked meanwhile
+	unlockB := ipsec.lockSPI(b)
+	unlockB()
+
+	locked := make(chan struct{})
+	go func() {
+		defer ipsec.lockSPI(a)()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked the same SA twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlockA()
+	<-locked
+
+	// Wait for the goroutine to unlock
+	for {
+		ipsec.RLock()
+		n := len(ipsec.spiLocks)
+		ipsec.RUnlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestParseMark(t *testing.T) {
+	mark, err := ParseMark("0x20000/0x20000")
+	require.NoError(t, err)
+	require.Equal(t, DefaultMark, mark)
+	require.Equal(t, "0x20000/0x20000", mark.String())
+
+	mark, err = ParseMark("0x100")
+	require.NoError(t, err)
+	require.Equal(t, Mark{0x100, 0x100}, mark)
+
+	for _, bad := range []string{"", "0", "0x3/0x1", "0x40000", "0x1/0xfffffffff", "mark"} {
+		_, err := ParseMark(bad)
+		require.Error(t, err, bad)
+	}
+
+	sp := xfrmPolicy(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 6784, 0x100, netlink.XFRM_MODE_TRANSPORT, Mark{0x100, 0x300})
+	require.Equal(t, uint32(0x300), sp.Mark.Mask)
+}
+
+func TestByTag(t *testing.T) {
+	a, b := mesh.PeerName(0x111111111111), mesh.PeerName(0x222222222222)
+	r := ruleMarkOutbound(instanceChains(""), net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 6784, a)
+	listed := []string{
+		"-N " + chainOut,
+		"-A " + chainOut + " " + strings.Join(r.rulespec, " "),
+		"-A " + chainOut + " -s 10.0.0.1/32 -m comment --comment \"" + ruleTag(b) + "\" -j " + chainOutMark,
+		"-A " + chainOut + " -s 10.0.0.1/32 -m comment --comment other -j " + chainOutMark,
+	}
+	tagged := byTag(listed)
+	require.Len(t, tagged, 2)
+	require.Equal(t, [][]string{r.rulespec}, tagged[ruleTag(a)])
+	require.Equal(t, [][]string{{"-s", "10.0.0.1/32", "-m", "comment", "--comment", ruleTag(b), "-j", chainOutMark}}, tagged[ruleTag(b)])
+}
+
+func TestParseSALimits(t *testing.T) {
+	base := SALimits{TimeHard: time.Hour, ByteHard: 1000}
+	limits, err := ParseSALimits("time-soft=50m, packets-hard=100,bytes-hard=2000", base)
+	require.NoError(t, err)
+	require.Equal(t, SALimits{TimeSoft: 50 * time.Minute, TimeHard: time.Hour, ByteHard: 2000, PacketHard: 100}, limits)
+
+	limits, err = ParseSALimits("", base)
+	require.NoError(t, err)
+	require.Equal(t, base, limits)
+
+	for _, s := range []string{"time-soft", "time-hard=1", "bytes-hard=-1", "time-hard=-1h", "lifetime=1h"} {
+		_, err = ParseSALimits(s, base)
+		require.Error(t, err, s)
+	}
+}
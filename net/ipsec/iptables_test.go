@@ -0,0 +1,244 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func TestFakeIPTablesInitSALocal(t *testing.T) {
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt})
+	require.NoError(t, err)
+
+	require.NoError(t, ipsec.Flush(false))
+	require.Contains(t, ipt.Chains, "mangle "+chainOut)
+	require.Equal(t, []string{"-j " + chainOut}, ipt.Chains["mangle OUTPUT"])
+
+	var sessionKey [32]byte
+	var msg []byte
+	require.NoError(t, ipsec.InitSALocal(fakeLocalPeer, fakeRemotePeer, 1, fakeLocalIP, fakeRemoteIP, 6784, &sessionKey,
+		Params{MsgVersion: MsgVersionTLV, Algorithm: AESGCM},
+		func(m []byte) error {
+			msg = m
+			return nil
+		}))
+	require.NotEmpty(t, msg)
+	tagged, err := taggedRules(ipt, tableMangle, chainOut)
+	require.NoError(t, err)
+	require.Len(t, tagged[ruleTag(fakeRemotePeer)], 1)
+	require.Len(t, x.policies, 2, "inbound policies")
+
+	require.NoError(t, ipsec.Destroy(fakeLocalPeer, fakeRemotePeer, 1, fakeLocalIP, fakeRemoteIP, 6784))
+	require.Empty(t, ipt.Chains["mangle "+chainOut])
+	require.Empty(t, x.policies)
+	require.Empty(t, x.states)
+
+	// Nothing left behind
+	require.NoError(t, ipsec.Flush(true))
+	require.NotContains(t, ipt.Chains, "mangle "+chainOut)
+	require.NotContains(t, ipt.Chains, "mangle "+chainOutMark)
+	for _, c := range []string{"filter INPUT", "filter OUTPUT", "mangle INPUT", "mangle OUTPUT"} {
+		require.Empty(t, ipt.Chains[c], c)
+	}
+	require.Empty(t, x.states)
+}
+
+func TestFlushPlan(t *testing.T) {
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt})
+	require.NoError(t, err)
+	require.NoError(t, ipsec.Flush(false))
+
+	initFakeSALocal(t, ipsec, 1)
+	require.NoError(t, initFakeSARemote(t, ipsec, 1, 0x100))
+	// An IKE daemon's SA, which is not ours to flush
+	foreign := &netlink.XfrmState{Src: fakeLocalIP, Dst: fakeRemoteIP, Proto: netlink.XFRM_PROTO_ESP, Spi: 0x200, Reqid: 1}
+	require.NoError(t, x.StateAdd(foreign))
+	nStates, nPolicies := len(x.states), len(x.policies)
+
+	plan, err := ipsec.Plan(false)
+	require.NoError(t, err)
+	require.Len(t, plan.States, nStates-1)
+	for _, s := range plan.States {
+		require.NotEqual(t, foreign.Spi, s.Spi)
+	}
+	require.Len(t, plan.Policies, nPolicies)
+	require.Len(t, plan.Rules, 2)
+	require.Empty(t, plan.Chains)
+	// Nothing is removed
+	require.Len(t, x.states, nStates)
+	require.Len(t, x.policies, nPolicies)
+
+	plan, err = ipsec.Plan(true)
+	require.NoError(t, err)
+	require.Len(t, plan.Rules, 4)
+	require.Contains(t, plan.Rules, "-t mangle -A OUTPUT -j "+chainOut)
+	require.Len(t, plan.Chains, 2)
+
+	require.NoError(t, ipsec.Flush(false))
+	require.Len(t, x.states, 1)
+	require.Empty(t, x.policies)
+}
+
+func TestReconcileRules(t *testing.T) {
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt})
+	require.NoError(t, err)
+	require.NoError(t, ipsec.Flush(false))
+	initFakeSALocal(t, ipsec, 1)
+	require.NoError(t, initFakeSARemote(t, ipsec, 1, 0x100))
+	marking := ipt.Chains["mangle "+chainOut]
+	require.Len(t, marking, 1)
+
+	// As by a firewall reload
+	for _, c := range []string{"mangle OUTPUT", "mangle " + chainOut, "filter OUTPUT"} {
+		ipt.Chains[c] = nil
+	}
+	delete(ipt.Chains, "mangle "+chainOutMark)
+
+	repaired, err := ipsec.reconcilers[ipt].Reconcile()
+	require.NoError(t, err)
+	require.Len(t, repaired, 4)
+	require.Equal(t, []string{"-j " + chainOut}, ipt.Chains["mangle OUTPUT"])
+	require.Equal(t, marking, ipt.Chains["mangle "+chainOut])
+	require.Len(t, ipt.Chains["mangle "+chainOutMark], 1)
+	require.Len(t, ipt.Chains["filter OUTPUT"], 1)
+
+	// Nor is the rule of a destroyed connection put back
+	require.NoError(t, ipsec.Destroy(fakeLocalPeer, fakeRemotePeer, 1, fakeLocalIP, fakeRemoteIP, 6784))
+	require.Empty(t, ipt.Chains["mangle "+chainOut])
+	repaired, err = ipsec.reconcilers[ipt].Reconcile()
+	require.NoError(t, err)
+	require.Empty(t, repaired)
+	require.Empty(t, ipt.Chains["mangle "+chainOut])
+}
+
+func TestConnMarkRules(t *testing.T) {
+	ipt := netfilter.NewMockIPTables()
+	require.NoError(t, resetIPTables(ipt, false, ruleConfig{chains: instanceChains(""), mark: DefaultMark, connMark: true}))
+	out := ipt.Chains["mangle "+chainOut]
+	require.Len(t, out, 2)
+	require.Contains(t, out[0], "--restore-mark")
+	require.Contains(t, out[1], "-j RETURN")
+	mark := ipt.Chains["mangle "+chainOutMark]
+	require.Len(t, mark, 2)
+	require.Contains(t, mark[0], "--set-xmark")
+	require.Contains(t, mark[1], "--save-mark")
+
+	// Without, they go
+	require.NoError(t, resetIPTables(ipt, false, ruleConfig{chains: instanceChains(""), mark: DefaultMark}))
+	require.Empty(t, ipt.Chains["mangle "+chainOut])
+	require.Len(t, ipt.Chains["mangle "+chainOutMark], 1)
+}
+
+func TestInstanceChains(t *testing.T) {
+	ipt := netfilter.NewMockIPTables()
+	def := ruleConfig{chains: instanceChains(""), mark: DefaultMark}
+	blue := ruleConfig{chains: instanceChains("blue"), mark: Mark{0x10000, 0x10000}}
+	require.Equal(t, "WEAVE-IPSEC-BLUE-OUT", blue.chains.out)
+
+	require.NoError(t, resetIPTables(ipt, false, def))
+	require.NoError(t, resetIPTables(ipt, false, blue))
+	require.Equal(t, []string{"-j " + chainOut, "-j WEAVE-IPSEC-BLUE-OUT"}, ipt.Chains["mangle OUTPUT"])
+
+	// Flushing one leaves the other
+	require.NoError(t, resetIPTables(ipt, true, blue))
+	require.NotContains(t, ipt.Chains, "mangle WEAVE-IPSEC-BLUE-OUT")
+	require.Contains(t, ipt.Chains, "mangle "+chainOut)
+	require.Equal(t, []string{"-j " + chainOut}, ipt.Chains["mangle OUTPUT"])
+	require.Len(t, ipt.Chains["filter OUTPUT"], 1)
+}
+
+func TestInstallDropNonEncryptedRollback(t *testing.T) {
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt})
+	require.NoError(t, err)
+	require.NoError(t, ipsec.Flush(false))
+
+	// The rule fails to be added, so the policies go too
+	delete(ipt.Chains, "mangle "+chainOut)
+	require.Error(t, ipsec.installDropNonEncrypted(fakeLocalIP, fakeRemoteIP, 6784, netlink.XFRM_MODE_TRANSPORT, fakeRemotePeer))
+	require.Empty(t, x.policies)
+	require.Empty(t, ipsec.inPolicies)
+	require.Empty(t, ipsec.protected)
+}
+
+func TestNoTrack(t *testing.T) {
+	noTrack, err := ParseNoTrack("esp, data-port")
+	require.NoError(t, err)
+	require.Equal(t, NoTrack{DataPort: true, ESP: true}, noTrack)
+	_, err = ParseNoTrack("vxlan")
+	require.Error(t, err)
+
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt, EncapPort: 4500, NoTrack: noTrack})
+	require.NoError(t, err)
+	require.NoError(t, ipsec.Flush(false))
+	for _, c := range []string{"raw PREROUTING", "raw OUTPUT"} {
+		require.Equal(t, []string{"-j " + chainNoTrack}, ipt.Chains[c], c)
+	}
+	fixed := []string{"-p esp -j CT --notrack", "-p udp --dport 4500 -j CT --notrack", "-p udp --sport 4500 -j CT --notrack"}
+	require.Equal(t, fixed, ipt.Chains["raw "+chainNoTrack])
+
+	// The data port is exempted while any connection uses it
+	otherIP := net.ParseIP("10.0.0.3").To4()
+	port := "-p udp --dport 6784 -j CT --notrack"
+	for _, ip := range []net.IP{fakeRemoteIP, otherIP} {
+		require.NoError(t, ipsec.installDropNonEncrypted(fakeLocalIP, ip, 6784, netlink.XFRM_MODE_TRANSPORT, fakeRemotePeer))
+	}
+	require.Equal(t, append(fixed, port), ipt.Chains["raw "+chainNoTrack])
+	require.NoError(t, ipsec.removeDropNonEncrypted(fakeLocalIP, fakeRemoteIP, 6784, fakeRemotePeer))
+	require.Contains(t, ipt.Chains["raw "+chainNoTrack], port)
+	require.NoError(t, ipsec.removeDropNonEncrypted(fakeLocalIP, otherIP, 6784, fakeRemotePeer))
+	require.Equal(t, fixed, ipt.Chains["raw "+chainNoTrack])
+
+	// Without it, the chain left behind goes
+	ipsec.noTrack = NoTrack{}
+	require.NoError(t, ipsec.Flush(false))
+	require.NotContains(t, ipt.Chains, "raw "+chainNoTrack)
+	require.Empty(t, ipt.Chains["raw PREROUTING"])
+	require.Empty(t, ipt.Chains["raw OUTPUT"])
+
+	// ConnMark needs the conntrack entries of the data port
+	_, err = newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt, ConnMark: true, NoTrack: NoTrack{DataPort: true}})
+	require.Error(t, err)
+}
+
+func TestReport(t *testing.T) {
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt})
+	require.NoError(t, err)
+	require.NoError(t, ipsec.Flush(false))
+	initFakeSALocal(t, ipsec, 1)
+	require.NoError(t, initFakeSARemote(t, ipsec, 1, 0x100))
+
+	report, err := ipsec.Report()
+	require.NoError(t, err)
+	require.Len(t, report.SAs, 2)
+	var peers []string
+	for _, r := range report.Rules {
+		require.Equal(t, chainsOwner, r.Owner)
+		if r.Peer != "" {
+			peers = append(peers, r.Peer)
+		}
+	}
+	require.Equal(t, []string{fakeRemotePeer.String()}, peers)
+	require.Len(t, report.Policies, 3, "inbound and outbound")
+	for _, p := range report.Policies {
+		require.Equal(t, fakeRemotePeer.String(), p.Peer, p.Dir)
+		if p.Dir == netlink.XFRM_DIR_OUT.String() {
+			require.Equal(t, "0x100", p.SPI)
+		}
+	}
+
+	var nilIPSec *IPSec
+	report, err = nilIPSec.Report()
+	require.NoError(t, err)
+	require.Nil(t, report)
+}
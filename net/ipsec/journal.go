@@ -0,0 +1,234 @@
+package ipsec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+// JournalFileName is appended to the db prefix to name the journal
+const JournalFileName = "ipsec.journal"
+
+// Compact the journal once it has this many more lines than entries
+// outstanding
+const journalCompactSlack = 1000
+
+const (
+	journalAdd = "add"
+	journalDel = "del"
+
+	journalStateIn  = "state-in"
+	journalStateOut = "state-out"
+	journalPolicy   = "policy"
+	// IPComp states, whose SPI is their CPI
+	journalCompIn  = "comp-in"
+	journalCompOut = "comp-out"
+)
+
+// A journalEntry records that an xfrm state or policy is about to be
+// created ("add"), or has been removed ("del"). Adds are written before
+// the kernel is touched, so after a crash anything we may have created
+// has an add without a del.
+//
+// iptables rules are not journalled: the per-connection ones all live
+// in our own chains, which Flush clears on start.
+type journalEntry struct {
+	Op   string
+	Kind string
+	Src  net.IP
+	Dst  net.IP
+	SPI  SPI
+	// Of policies, which match it; 0 in journals of earlier versions,
+	// whose policies didn't
+	Port int `json:",omitempty"`
+	seq  int
+}
+
+func (e journalEntry) key() string {
+	return fmt.Sprintf("%s %s %s 0x%x", e.Kind, e.Src, e.Dst, e.SPI)
+}
+
+// journal is an append-only file of journalEntries, one JSON object per
+// line. A nil *journal records nothing.
+type journal struct {
+	sync.Mutex
+	pathname string
+	file     *os.File
+	pending  map[string]journalEntry
+	seq      int
+	lines    int
+}
+
+func openJournal(pathname string) (*journal, error) {
+	j := &journal{pathname: pathname, pending: make(map[string]journalEntry)}
+	if err := j.read(); err != nil {
+		return nil, err
+	}
+	// Start afresh, not least so nothing is appended to a partial line
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) read() error {
+	file, err := os.Open(j.pathname)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	var bad error
+	for scanner.Scan() {
+		if bad != nil {
+			return bad
+		}
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A crash part-way through writing leaves a partial last
+			// line, which we ignore; anywhere else it is corruption
+			bad = fmt.Errorf("corrupt journal %s at line %d: %s", j.pathname, j.lines+1, err)
+			continue
+		}
+		j.apply(e)
+	}
+	return scanner.Err()
+}
+
+func (j *journal) apply(e journalEntry) {
+	j.lines++
+	switch e.Op {
+	case journalAdd:
+		e.seq = j.seq
+		j.seq++
+		j.pending[e.key()] = e
+	case journalDel:
+		delete(j.pending, e.key())
+	}
+}
+
+func (j *journal) add(kind string, src, dst net.IP, spi SPI) error {
+	return j.record(journalEntry{Op: journalAdd, Kind: kind, Src: src, Dst: dst, SPI: spi})
+}
+
+func (j *journal) addPolicy(src, dst net.IP, spi SPI, udpPort int) error {
+	return j.record(journalEntry{Op: journalAdd, Kind: journalPolicy, Src: src, Dst: dst, SPI: spi, Port: udpPort})
+}
+
+func (j *journal) del(kind string, src, dst net.IP, spi SPI) error {
+	return j.record(journalEntry{Op: journalDel, Kind: kind, Src: src, Dst: dst, SPI: spi})
+}
+
+func (j *journal) record(e journalEntry) error {
+	if j == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.apply(e)
+	if j.lines > len(j.pending)+journalCompactSlack {
+		return j.compact()
+	}
+	return nil
+}
+
+// outstanding returns the entries added and not since deleted, most
+// recent first, which is the order to undo them in.
+func (j *journal) outstanding() []journalEntry {
+	if j == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	return j.sortedPending()
+}
+
+func (j *journal) sortedPending() []journalEntry {
+	entries := make([]journalEntry, 0, len(j.pending))
+	for _, e := range j.pending {
+		entries = append(entries, e)
+	}
+	sort.Sort(byRecency(entries))
+	return entries
+}
+
+type byRecency []journalEntry
+
+func (es byRecency) Len() int           { return len(es) }
+func (es byRecency) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
+func (es byRecency) Less(i, j int) bool { return es[i].seq > es[j].seq }
+
+// reset forgets everything, once it is known to have been removed
+func (j *journal) reset() error {
+	if j == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	j.pending = make(map[string]journalEntry)
+	return j.compact()
+}
+
+// compact rewrites the journal with just the outstanding entries. As
+// with the JSON file db, a new file is renamed over the old so that a
+// crash part-way through doesn't lose anything. The lock must be held,
+// other than while opening.
+func (j *journal) compact() error {
+	entries := j.sortedPending()
+	tmp := j.pathname + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		buf, err := json.Marshal(entries[i])
+		if err == nil {
+			_, err = file.Write(append(buf, '\n'))
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, j.pathname); err != nil {
+		file.Close()
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	j.lines = len(entries)
+	return nil
+}
+
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	return j.file.Close()
+}
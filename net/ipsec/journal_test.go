@@ -0,0 +1,84 @@
+package ipsec
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	ip1 = net.ParseIP("10.0.0.1")
+	ip2 = net.ParseIP("10.0.0.2")
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipsec-journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pathname := filepath.Join(dir, JournalFileName)
+
+	j, err := openJournal(pathname)
+	require.NoError(t, err)
+	require.Empty(t, j.outstanding())
+	require.NoError(t, j.add(journalStateIn, ip2, ip1, 0x100))
+	require.NoError(t, j.add(journalStateOut, ip1, ip2, 0x200))
+	require.NoError(t, j.addPolicy(ip1, ip2, 0x200, 6784))
+	require.NoError(t, j.del(journalStateOut, ip1, ip2, 0x200))
+	require.NoError(t, j.Close())
+
+	// As after a crash, with a partly written last line
+	f, err := os.OpenFile(pathname, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"Op":"del","Kind":"pol`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	j, err = openJournal(pathname)
+	require.NoError(t, err)
+	require.NoError(t, j.add(journalPolicy, ip2, ip1, 0x300))
+	require.NoError(t, j.del(journalPolicy, ip2, ip1, 0x300))
+	outstanding := j.outstanding()
+	require.Len(t, outstanding, 2)
+	require.Equal(t, journalPolicy, outstanding[0].Kind, "most recent first")
+	require.Equal(t, journalStateIn, outstanding[1].Kind)
+	require.Equal(t, ip2, outstanding[1].Src)
+	require.Equal(t, SPI(0x100), outstanding[1].SPI)
+
+	// Compaction keeps only what is outstanding, in order
+	for i := 0; i < journalCompactSlack; i++ {
+		require.NoError(t, j.add(journalStateIn, ip2, ip1, SPI(0x1000+i)))
+		require.NoError(t, j.del(journalStateIn, ip2, ip1, SPI(0x1000+i)))
+	}
+	require.True(t, j.lines <= len(j.pending)+journalCompactSlack)
+	require.NoError(t, j.Close())
+	j, err = openJournal(pathname)
+	require.NoError(t, err)
+	require.Len(t, j.outstanding(), 2)
+	require.Equal(t, journalPolicy, j.outstanding()[0].Kind)
+	require.Equal(t, 6784, j.outstanding()[0].Port)
+	require.Equal(t, journalStateIn, j.outstanding()[1].Kind)
+
+	require.NoError(t, j.reset())
+	require.NoError(t, j.Close())
+	j, err = openJournal(pathname)
+	require.NoError(t, err)
+	require.Empty(t, j.outstanding())
+	require.NoError(t, j.Close())
+
+	// Corruption other than at the end is an error
+	require.NoError(t, ioutil.WriteFile(pathname, []byte("garbage\n{}\n"), 0660))
+	_, err = openJournal(pathname)
+	require.Error(t, err)
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *journal
+	require.NoError(t, j.add(journalStateIn, ip2, ip1, 1))
+	require.Empty(t, j.outstanding())
+	require.NoError(t, j.reset())
+	require.NoError(t, j.Close())
+}
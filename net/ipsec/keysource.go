@@ -0,0 +1,92 @@
+package ipsec
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// KeySourceFeature is the connection feature of peers which take the
+// session keys of their SAs from a KeySource. Both peers of a
+// connection must do so, or neither.
+const KeySourceFeature = "IPsecKeySource"
+
+// KeySourceTimeout bounds how long fetching a session key may take
+const KeySourceTimeout = 10 * time.Second
+
+// A KeySource supplies the session key from which the keys of the SAs
+// between two peers are derived, in place of the key agreed by the
+// mesh handshake, e.g. from an external key management system which
+// rotates and escrows them. It must return the same key for a pair of
+// peers whichever of them asks. The key is fetched afresh for each
+// connection, so rotated keys are used from the next connection.
+type KeySource interface {
+	SessionKey(localPeer, remotePeer mesh.PeerName) (*[32]byte, error)
+}
+
+// NewKeySource returns the key source described by spec, which is
+// "exec:" followed by the pathname of a program, or nil for an empty
+// spec. The program is run with the names of the two peers, the lower
+// first, and must print the key, as 64 hex digits.
+func NewKeySource(spec string) (KeySource, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "exec:"):
+		path := strings.TrimPrefix(spec, "exec:")
+		if path == "" {
+			return nil, fmt.Errorf("no program given for key source %q", spec)
+		}
+		return &execKeySource{path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown key source %q: expected exec:<path>", spec)
+}
+
+type execKeySource struct {
+	path string
+}
+
+func (s *execKeySource) SessionKey(localPeer, remotePeer mesh.PeerName) (*[32]byte, error) {
+	a, b := localPeer, remotePeer
+	if b < a {
+		a, b = b, a
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), KeySourceTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, s.path, a.String(), b.String()).Output()
+	if err != nil {
+		return nil, fmt.Errorf("key source %s: %s", s.path, err)
+	}
+	return parseSessionKey(string(out))
+}
+
+func parseSessionKey(s string) (*[32]byte, error) {
+	buf, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid session key: %s", err)
+	}
+	var key [32]byte
+	if len(buf) != len(key) {
+		return nil, fmt.Errorf("session key is %d bytes; expected %d", len(buf), len(key))
+	}
+	copy(key[:], buf)
+	return &key, nil
+}
+
+// sessionKey returns the session key for the SAs of a connection to
+// remotePeer: meshKey, the one agreed by the mesh handshake, unless we
+// have a KeySource, which the remote peer must use too.
+func (ipsec *IPSec) sessionKey(localPeer, remotePeer mesh.PeerName, params Params, meshKey *[32]byte) (*[32]byte, error) {
+	if ipsec.keySource == nil {
+		return meshKey, nil
+	}
+	if !params.KeySource {
+		return nil, fmt.Errorf("peer %s does not take session keys from a key source, as we do", remotePeer)
+	}
+	return ipsec.keySource.SessionKey(localPeer, remotePeer)
+}
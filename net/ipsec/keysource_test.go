@@ -0,0 +1,57 @@
+package ipsec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestExecKeySource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysource")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Prints a key made of the two peer names it is given, in order
+	path := filepath.Join(dir, "key")
+	script := "#!/bin/sh\necho \"$1$2\" | tr -d : | cut -c1-24 | sed 's/$/0000000000000000000000000000000000000000/'\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(script), 0700))
+
+	ks, err := NewKeySource("exec:" + path)
+	require.NoError(t, err)
+	a, b := mesh.PeerName(0x111111111111), mesh.PeerName(0x222222222222)
+	key, err := ks.SessionKey(b, a)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x11), key[0], "lower peer first")
+	require.Equal(t, byte(0x22), key[6])
+	other, err := ks.SessionKey(a, b)
+	require.NoError(t, err)
+	require.Equal(t, key, other, "same key for both peers")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh\nexit 1\n"), 0700))
+	_, err = ks.SessionKey(a, b)
+	require.Error(t, err)
+
+	for _, bad := range []string{"exec:", "vault"} {
+		_, err := NewKeySource(bad)
+		require.Error(t, err, bad)
+	}
+	ks, err = NewKeySource("")
+	require.NoError(t, err)
+	require.Nil(t, ks)
+}
+
+func TestParseSessionKey(t *testing.T) {
+	key, err := parseSessionKey(strings.Repeat("ab", 32) + "\n")
+	require.NoError(t, err)
+	require.Equal(t, byte(0xab), key[31])
+
+	for _, bad := range []string{"", strings.Repeat("ab", 31), strings.Repeat("xy", 32)} {
+		_, err := parseSessionKey(bad)
+		require.Error(t, err, bad)
+	}
+}
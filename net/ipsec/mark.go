@@ -0,0 +1,75 @@
+package ipsec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// A Mark is the firewall mark, under a mask, which iptables sets on
+// the packets to be encrypted and which selects our XFRM policies.
+type Mark struct {
+	Value uint32
+	Mask  uint32
+}
+
+// DefaultMark is the Mark used unless another is configured. Change
+// it if other software on the host already uses that bit.
+var DefaultMark = Mark{Value: 1 << 17, Mask: 1 << 17}
+
+// exemptMark is ExemptMarkStr, which must not overlap our mark
+var exemptMark = Mark{Value: 1 << 18, Mask: 1 << 18}
+
+// trustedMark tags the policies letting in the traffic of the trusted
+// subnets, which have no template to tell them by, as ours. It matches
+// the traffic not exempt from encryption, which is all that arrives
+// bar what the policy of exemptMark, of the same priority, lets in
+// anyway, so together they match everything, as no mark would.
+var trustedMark = Mark{Value: 0, Mask: exemptMark.Mask}
+
+// String returns the mark as iptables takes it, e.g. "0x20000/0x20000"
+func (m Mark) String() string {
+	return fmt.Sprintf("0x%x/0x%x", m.Value, m.Mask)
+}
+
+// ParseMark parses a "value/mask" or, meaning the mask is the same as
+// the value, "value" mark, with the numbers in decimal, or hex after
+// "0x", and checks it can be used.
+func ParseMark(s string) (Mark, error) {
+	value, mask := s, s
+	if i := strings.Index(s, "/"); i >= 0 {
+		value, mask = s[:i], s[i+1:]
+	}
+	v, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return Mark{}, fmt.Errorf("invalid IPsec mark value %q", value)
+	}
+	m, err := strconv.ParseUint(mask, 0, 32)
+	if err != nil {
+		return Mark{}, fmt.Errorf("invalid IPsec mark mask %q", mask)
+	}
+	mark := Mark{Value: uint32(v), Mask: uint32(m)}
+	if err := mark.check(); err != nil {
+		return Mark{}, err
+	}
+	return mark, nil
+}
+
+func (m Mark) check() error {
+	switch {
+	case m.Value == 0:
+		// Unmarked packets would then match
+		return fmt.Errorf("IPsec mark %s must not be 0", m)
+	case m.Value&^m.Mask != 0:
+		return fmt.Errorf("IPsec mark %s has bits set outside its mask", m)
+	case m.Mask&exemptMark.Mask != 0:
+		return fmt.Errorf("IPsec mark %s overlaps the mark of pods exempt from encryption, %s", m, ExemptMarkStr)
+	}
+	return nil
+}
+
+func (m Mark) xfrm() *netlink.XfrmMark {
+	return &netlink.XfrmMark{Value: m.Value, Mask: m.Mask}
+}
@@ -0,0 +1,118 @@
+package ipsec
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	activeSAs         *prometheus.Desc
+	saBytes           *prometheus.Desc
+	saPackets         *prometheus.Desc
+	saDrops           *prometheus.Desc
+	xfrmErrors        *prometheus.Desc
+	rekeys            prometheus.Counter
+	expirations       *prometheus.CounterVec
+	handshakeFailures prometheus.Counter
+	iptablesErrors    prometheus.Counter
+	inconsistencies   prometheus.Counter
+	rulesRepaired     prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		activeSAs: prometheus.NewDesc("weave_ipsec_active_sas",
+			"Number of IPsec security associations set up, by direction.", []string{"direction"}, nil),
+		saBytes: prometheus.NewDesc("weave_ipsec_sa_bytes_total",
+			"Bytes sent or received with the current SAs of each peer, by direction.", []string{"peer", "direction"}, nil),
+		saPackets: prometheus.NewDesc("weave_ipsec_sa_packets_total",
+			"Packets sent or received with the current SAs of each peer, by direction.", []string{"peer", "direction"}, nil),
+		saDrops: prometheus.NewDesc("weave_ipsec_sa_dropped_packets_total",
+			"Packets received with the current SAs of each peer which were dropped, by reason: replayed, or failed their integrity check.", []string{"peer", "reason"}, nil),
+		xfrmErrors: prometheus.NewDesc("weave_ipsec_xfrm_errors_total",
+			"Packets dropped by the kernel's IPsec framework, by its error counter in /proc/net/xfrm_stat; of the whole network namespace, not only weave's traffic.", []string{"error"}, nil),
+		rekeys: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "weave_ipsec_rekeys_total",
+			Help: "Number of times SAs from a peer were set up again, with fresh keys, on a new connection.",
+		}),
+		expirations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "weave_ipsec_sa_expirations_total",
+			Help: "Number of SAs which reached a soft or hard limit.",
+		}, []string{"limit"}),
+		handshakeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "weave_ipsec_handshake_failures_total",
+			Help: "Number of failures setting up IPsec for a connection.",
+		}),
+		iptablesErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "weave_ipsec_iptables_reset_errors_total",
+			Help: "Number of failures resetting the IPsec iptables chains and rules.",
+		}),
+		inconsistencies: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "weave_ipsec_inconsistent_connections_total",
+			Help: "Number of connections closed, to be re-established, as their IPsec state was found incomplete.",
+		}),
+		rulesRepaired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "weave_ipsec_iptables_rules_repaired_total",
+			Help: "Number of IPsec iptables rules put back after something else removed them.",
+		}),
+	}
+}
+
+// Describe and Collect make IPSec a prometheus.Collector
+
+func (ipsec *IPSec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ipsec.metrics.activeSAs
+	ch <- ipsec.metrics.saBytes
+	ch <- ipsec.metrics.saPackets
+	ch <- ipsec.metrics.saDrops
+	ch <- ipsec.metrics.xfrmErrors
+	ipsec.metrics.rekeys.Describe(ch)
+	ipsec.metrics.expirations.Describe(ch)
+	ipsec.metrics.handshakeFailures.Describe(ch)
+	ipsec.metrics.iptablesErrors.Describe(ch)
+	ipsec.metrics.inconsistencies.Describe(ch)
+	ipsec.metrics.rulesRepaired.Describe(ch)
+}
+
+func (ipsec *IPSec) Collect(ch chan<- prometheus.Metric) {
+	var in, out int
+	replayed, failed := make(map[string]uint64), make(map[string]uint64)
+	for _, si := range ipsec.sas() {
+		direction := "in"
+		if si.isDirOut {
+			direction = "out"
+			out++
+		} else {
+			in++
+		}
+		if c, err := ipsec.counters(si); err == nil {
+			peer := si.remotePeer.String()
+			ch <- prometheus.MustNewConstMetric(ipsec.metrics.saBytes, prometheus.CounterValue, float64(c.bytes), peer, direction)
+			ch <- prometheus.MustNewConstMetric(ipsec.metrics.saPackets, prometheus.CounterValue, float64(c.packets), peer, direction)
+			if !si.isDirOut {
+				replayed[peer] += c.replayed
+				failed[peer] += c.failed
+			}
+		}
+	}
+	for peer, n := range replayed {
+		ch <- prometheus.MustNewConstMetric(ipsec.metrics.saDrops, prometheus.CounterValue, float64(n), peer, "replayed")
+	}
+	for peer, n := range failed {
+		ch <- prometheus.MustNewConstMetric(ipsec.metrics.saDrops, prometheus.CounterValue, float64(n), peer, "integrity")
+	}
+	// Missing unless the kernel has CONFIG_XFRM_STATISTICS
+	if stat, err := xfrmStat(); err == nil {
+		for name, n := range stat {
+			ch <- prometheus.MustNewConstMetric(ipsec.metrics.xfrmErrors, prometheus.CounterValue, float64(n), name)
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(ipsec.metrics.activeSAs, prometheus.GaugeValue, float64(in), "in")
+	ch <- prometheus.MustNewConstMetric(ipsec.metrics.activeSAs, prometheus.GaugeValue, float64(out), "out")
+	ipsec.metrics.rekeys.Collect(ch)
+	ipsec.metrics.expirations.Collect(ch)
+	ipsec.metrics.handshakeFailures.Collect(ch)
+	ipsec.metrics.iptablesErrors.Collect(ch)
+	ipsec.metrics.inconsistencies.Collect(ch)
+	ipsec.metrics.rulesRepaired.Collect(ch)
+}
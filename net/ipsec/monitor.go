@@ -0,0 +1,134 @@
+package ipsec
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	monitorInitialBackoff = time.Second
+	monitorMaxBackoff     = time.Minute
+)
+
+// monitorExpiry counts the expiry notifications the kernel sends for
+// our SAs, until done is closed. If the subscription fails it is made
+// again, backing off, and any SAs which expired meanwhile are counted
+// from what is missing from the kernel.
+func (ipsec *IPSec) monitorExpiry(done <-chan struct{}) {
+	backoff := monitorInitialBackoff
+	for disconnected := false; ; disconnected = true {
+		stop := make(chan struct{})
+		msgs := make(chan netlink.XfrmMsg)
+		errs := make(chan error, 1)
+		err := ipsec.xfrm.Monitor(msgs, stop, errs, nl.XFRM_MSG_EXPIRE)
+		if err == nil {
+			if disconnected {
+				ipsec.reconcileExpired()
+			}
+			backoff = monitorInitialBackoff
+			err = ipsec.receiveExpiry(msgs, errs, done)
+		}
+		close(stop)
+		if err == nil {
+			return
+		}
+
+		ipsec.log.Warnf("ipsec: monitoring SA expiry: %s; retrying in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-done:
+			return
+		}
+		if backoff *= 2; backoff > monitorMaxBackoff {
+			backoff = monitorMaxBackoff
+		}
+	}
+}
+
+// receiveExpiry handles notifications until done is closed, returning
+// nil, or the subscription fails
+func (ipsec *IPSec) receiveExpiry(msgs <-chan netlink.XfrmMsg, errs <-chan error, done <-chan struct{}) error {
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return syscall.ECONNRESET
+			}
+			if expire, ok := msg.(*netlink.XfrmMsgExpire); ok && expire.XfrmState != nil {
+				ipsec.expired(expire.XfrmState, expire.Hard)
+			}
+		case err := <-errs:
+			return err
+		case <-done:
+			return nil
+		}
+	}
+}
+
+func (ipsec *IPSec) expired(sa *netlink.XfrmState, hard bool) {
+	ipsec.Lock()
+	defer ipsec.Unlock()
+	si, ours := ipsec.spis[SPI(sa.Spi)]
+	if !ours || sa.Reqid != reqID || si.expired {
+		return
+	}
+	limit := "soft"
+	if hard {
+		limit = "hard"
+		si.expired = true
+		ipsec.log.Infof("ipsec: SA %s -> %s 0x%x expired", sa.Src, sa.Dst, sa.Spi)
+		ipsec.audit(AuditExpired, "hard limit reached", si)
+		if si.retiring {
+			// No need to wait for the rest of the overlap
+			go ipsec.endOverlap(getSPIId(si.remotePeer, si.localPeer, si.connUID, si.udpPort), si.spi, "hard limit reached")
+		}
+	}
+	ipsec.metrics.expirations.WithLabelValues(limit).Inc()
+}
+
+// ourStates returns the SPIs of the SAs in the kernel which we created
+func (ipsec *IPSec) ourStates() (map[SPI]bool, error) {
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	present := make(map[SPI]bool)
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		states, err := ipsec.xfrm.StateList(family)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range states {
+			if s.Reqid == reqID {
+				present[SPI(s.Spi)] = true
+			}
+		}
+	}
+	return present, nil
+}
+
+// reconcileExpired counts as hard expirations the SAs we set up which
+// have gone from the kernel, which is the only trace left of any
+// notification missed while not subscribed. Soft expirations leave
+// none, so are not counted.
+func (ipsec *IPSec) reconcileExpired() {
+	// SAs set up after this may not have been listed
+	since := time.Now()
+	present, err := ipsec.ourStates()
+	if err != nil {
+		ipsec.log.Warnf("ipsec: reconciling SA expiry: %s", err)
+		return
+	}
+
+	ipsec.Lock()
+	defer ipsec.Unlock()
+	for spi, si := range ipsec.spis {
+		if !present[spi] && !si.expired && si.created.Before(since) {
+			si.expired = true
+			ipsec.log.Infof("ipsec: SA %s -> %s 0x%x expired while not monitoring", si.src, si.dst, spi)
+			ipsec.metrics.expirations.WithLabelValues("hard").Inc()
+			ipsec.audit(AuditExpired, "gone from the kernel while not monitoring", si)
+		}
+	}
+}
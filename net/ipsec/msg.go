@@ -0,0 +1,150 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Versions of the InitSARemote message format
+const (
+	// MsgVersionLegacy is the fixed layout understood by all peers: the
+	// nonce, the SPI padded to 32 bytes, and the algorithm in a
+	// trailing byte if it isn't AESGCM
+	MsgVersionLegacy = 0
+	// MsgVersionTLV starts with the version, followed by fields each
+	// encoded as a one byte type, a two byte length and the value
+	MsgVersionTLV = 1
+)
+
+// MsgVersionFeature is the connection feature giving the latest
+// InitSARemote format a peer understands. Peers without it only
+// understand MsgVersionLegacy.
+const MsgVersionFeature = "IPsecMsgVersion"
+
+// Field types of MsgVersionTLV. Receivers skip fields of types they
+// don't know, unless the type has tlvCritical set, in which case they
+// reject the message.
+const (
+	tlvNonce     = 1
+	tlvSPI       = 2
+	tlvAlgorithm = 3
+	tlvCPI       = 4
+
+	tlvCritical = 0x80
+
+	tlvHeaderSize = 3
+)
+
+// tlvSizes are the lengths fields of known types must have
+var tlvSizes = map[byte]int{
+	tlvNonce:     nonceSize,
+	tlvSPI:       4,
+	tlvAlgorithm: 1,
+	tlvCPI:       2,
+}
+
+func addMsgVersionFeatureTo(features map[string]string) {
+	features[MsgVersionFeature] = strconv.Itoa(MsgVersionTLV)
+}
+
+// ChooseMsgVersion returns the latest InitSARemote format which both
+// we and the peer with the given connection features understand.
+func ChooseMsgVersion(features map[string]string) int {
+	version, err := strconv.Atoi(features[MsgVersionFeature])
+	switch {
+	case err != nil || version < MsgVersionLegacy:
+		return MsgVersionLegacy
+	case version > MsgVersionTLV:
+		return MsgVersionTLV
+	}
+	return version
+}
+
+func (msg *msgInitSARemote) serializeTLV() []byte {
+	b := []byte{MsgVersionTLV}
+	b = appendTLV(b, tlvNonce, msg.nonce)
+	spi := make([]byte, 4)
+	binary.BigEndian.PutUint32(spi, uint32(msg.spi))
+	b = appendTLV(b, tlvSPI, spi)
+	b = appendTLV(b, tlvAlgorithm, []byte{byte(msg.algo)})
+	if msg.cpi != 0 {
+		cpi := make([]byte, 2)
+		binary.BigEndian.PutUint16(cpi, msg.cpi)
+		b = appendTLV(b, tlvCPI, cpi)
+	}
+	return b
+}
+
+func appendTLV(b []byte, typ byte, value []byte) []byte {
+	var header [tlvHeaderSize]byte
+	header[0] = typ
+	binary.BigEndian.PutUint16(header[1:], uint16(len(value)))
+	return append(append(b, header[:]...), value...)
+}
+
+func deserializeMsgInitSARemoteTLV(b []byte) (*msgInitSARemote, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty msg")
+	}
+	if b[0] != MsgVersionTLV {
+		return nil, fmt.Errorf("unsupported msg version: %d", b[0])
+	}
+	b = b[1:]
+
+	msg := &msgInitSARemote{}
+	seen := make(map[byte]bool)
+	for len(b) > 0 {
+		if len(b) < tlvHeaderSize {
+			return nil, fmt.Errorf("truncated field header")
+		}
+		typ, length := b[0], int(binary.BigEndian.Uint16(b[1:]))
+		b = b[tlvHeaderSize:]
+		if len(b) < length {
+			return nil, fmt.Errorf("truncated field %d: %d bytes of %d", typ, len(b), length)
+		}
+		value := b[:length]
+		b = b[length:]
+
+		if seen[typ] {
+			return nil, fmt.Errorf("duplicate field %d", typ)
+		}
+		seen[typ] = true
+
+		size, known := tlvSizes[typ]
+		if !known {
+			if typ&tlvCritical != 0 {
+				return nil, fmt.Errorf("unknown critical field %d", typ)
+			}
+			continue
+		}
+		if length != size {
+			return nil, fmt.Errorf("invalid size of field %d: %d", typ, length)
+		}
+
+		switch typ {
+		case tlvNonce:
+			msg.nonce = make([]byte, nonceSize)
+			copy(msg.nonce, value)
+		case tlvSPI:
+			msg.spi = SPI(binary.BigEndian.Uint32(value))
+		case tlvAlgorithm:
+			msg.algo = Algorithm(value[0])
+			if _, found := algorithmXfrmNames[msg.algo]; !found {
+				return nil, fmt.Errorf("unknown algorithm %d", value[0])
+			}
+		case tlvCPI:
+			msg.cpi = binary.BigEndian.Uint16(value)
+			if msg.cpi < cpiMin {
+				return nil, fmt.Errorf("invalid CPI 0x%x", msg.cpi)
+			}
+		}
+	}
+
+	for _, typ := range []byte{tlvNonce, tlvSPI} {
+		if !seen[typ] {
+			return nil, fmt.Errorf("missing field %d", typ)
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,50 @@
+package ipsec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgInitSARemoteTLV(t *testing.T) {
+	nonce := make([]byte, nonceSize)
+	nonce[0] = 7
+	b := (&msgInitSARemote{nonce, 0x1234, ChaCha20Poly1305, 0}).serializeTLV()
+	msg, err := deserializeMsgInitSARemoteTLV(b)
+	require.NoError(t, err)
+	require.Equal(t, nonce, msg.nonce)
+	require.Equal(t, SPI(0x1234), msg.spi)
+	require.Equal(t, ChaCha20Poly1305, msg.algo)
+	require.Equal(t, uint16(0), msg.cpi, "not compressed")
+
+	msg, err = deserializeMsgInitSARemoteTLV((&msgInitSARemote{nonce, 0x1234, AESGCM, 0x4321}).serializeTLV())
+	require.NoError(t, err)
+	require.Equal(t, uint16(0x4321), msg.cpi)
+	_, err = deserializeMsgInitSARemoteTLV(appendTLV(b, tlvCPI, []byte{0, 1}))
+	require.Error(t, err, "reserved CPI")
+
+	// Fields added by later versions are skipped, unless critical
+	_, err = deserializeMsgInitSARemoteTLV(appendTLV(b, 0x7f, []byte{1, 2}))
+	require.NoError(t, err)
+	_, err = deserializeMsgInitSARemoteTLV(appendTLV(b, 0x7f|tlvCritical, []byte{1, 2}))
+	require.Error(t, err)
+
+	_, err = deserializeMsgInitSARemoteTLV(b[:len(b)-1])
+	require.Error(t, err, "truncated")
+	_, err = deserializeMsgInitSARemoteTLV(appendTLV(b, tlvSPI, []byte{0, 0, 0, 1}))
+	require.Error(t, err, "duplicate")
+	_, err = deserializeMsgInitSARemoteTLV(appendTLV([]byte{MsgVersionTLV}, tlvNonce, nonce))
+	require.Error(t, err, "no SPI")
+	_, err = deserializeMsgInitSARemoteTLV(appendTLV([]byte{MsgVersionTLV}, tlvSPI, []byte{1, 2}))
+	require.Error(t, err, "short SPI")
+	_, err = deserializeMsgInitSARemoteTLV(append([]byte{MsgVersionTLV + 1}, b[1:]...))
+	require.Error(t, err, "version")
+}
+
+func TestChooseMsgVersion(t *testing.T) {
+	features := make(map[string]string)
+	require.Equal(t, MsgVersionLegacy, ChooseMsgVersion(features), "old peer")
+	addMsgVersionFeatureTo(features)
+	require.Equal(t, MsgVersionTLV, ChooseMsgVersion(features))
+	require.Equal(t, MsgVersionTLV, ChooseMsgVersion(map[string]string{MsgVersionFeature: "5"}))
+}
@@ -0,0 +1,57 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Sizes of what ESP adds to each packet. Both algorithms, in their
+// ESP forms (RFC 4106 and RFC 7539), have an 8 byte IV and a 16 byte
+// ICV, and pad to 4 bytes.
+const (
+	espHeaderSize  = 8 // SPI and sequence number
+	espIVSize      = 8
+	espICVSize     = 16
+	espTrailerSize = 2     // pad length and next header
+	espMaxPadding  = 4 - 1 // to align the trailer to 4 bytes
+	udpHeaderSize  = 8
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+)
+
+// Overhead returns the most bytes which IPsec, as negotiated in p,
+// adds to each packet sent to remoteIP: ESP, plus the UDP header of
+// ESP in UDP and, in tunnel mode, the outer IP header.
+func (p Params) Overhead(remoteIP net.IP) int {
+	n := espHeaderSize + espIVSize + espICVSize + espTrailerSize + espMaxPadding
+	if p.EncapPort != 0 {
+		n += udpHeaderSize
+	}
+	switch {
+	case p.Tunnel && remoteIP.To4() != nil:
+		n += ipv4HeaderSize
+	case p.Tunnel:
+		n += ipv6HeaderSize
+	}
+	return n
+}
+
+// LinkMTU returns the MTU of the interface over which remoteIP is
+// reached, which the packets sent to it, with their IPsec overhead,
+// must fit in.
+func LinkMTU(remoteIP net.IP) (int, error) {
+	routes, err := netlink.RouteGet(remoteIP)
+	if err != nil {
+		return 0, err
+	}
+	if len(routes) == 0 {
+		return 0, fmt.Errorf("no route to %s", remoteIP)
+	}
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return 0, err
+	}
+	return link.Attrs().MTU, nil
+}
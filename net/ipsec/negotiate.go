@@ -0,0 +1,73 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// TunnelFeature is the connection feature of peers which want tunnel
+// mode SAs. Tunnel mode is used between peers which both have it, and
+// transport mode otherwise, since both ends must use the same.
+const TunnelFeature = "IPsecTunnelMode"
+
+// AckFeature is the connection feature of peers which acknowledge the
+// InitSARemote message, so that its sender can retransmit it until
+// they do.
+const AckFeature = "IPsecInitSAAck"
+
+// Params are the settings of IPsec on a connection, negotiated from
+// the features each peer advertised in the connection handshake, so
+// before any SA is set up. Wherever one peer doesn't support something
+// the other does, e.g. during a rolling upgrade, they fall back to what
+// both support.
+type Params struct {
+	MsgVersion int       // the format of the InitSARemote message we send
+	Algorithm  Algorithm // for traffic we receive
+	EncapPort  int       // the remote's port for ESP in UDP; 0 for plain ESP
+	Tunnel     bool      // tunnel rather than transport mode SAs
+	Ack        bool      // acknowledge InitSARemote, and expect it acknowledged
+	KeySource  bool      // the remote takes session keys from a KeySource
+	Compress   bool      // have what we receive compressed with IPComp
+}
+
+// Negotiate returns the Params for a connection to the peer at
+// remoteIP with the given connection features.
+func (ipsec *IPSec) Negotiate(features map[string]string, remoteIP net.IP) Params {
+	p := Params{
+		MsgVersion: ChooseMsgVersion(features),
+		Algorithm:  ipsec.ChooseAlgorithm(features),
+		EncapPort:  ipsec.ChooseEncapPort(features, remoteIP),
+		Tunnel:     ipsec.tunnelMode && features[TunnelFeature] != "",
+		Ack:        features[AckFeature] != "",
+		KeySource:  features[KeySourceFeature] != "",
+	}
+	// The CPI is only sent in MsgVersionTLV, and we only compress in
+	// transport mode
+	p.Compress = ipsec.compressWith(remoteIP) && features[CompressFeature] != "" && p.MsgVersion == MsgVersionTLV && !p.Tunnel
+	return p
+}
+
+func (p Params) mode() netlink.Mode {
+	if p.Tunnel {
+		return netlink.XFRM_MODE_TUNNEL
+	}
+	return netlink.XFRM_MODE_TRANSPORT
+}
+
+func (p Params) String() string {
+	encap := "plain ESP"
+	if p.EncapPort != 0 {
+		encap = fmt.Sprintf("ESP in UDP to port %d", p.EncapPort)
+	}
+	mode := "transport"
+	if p.Tunnel {
+		mode = "tunnel"
+	}
+	s := fmt.Sprintf("msg version %d, %s, %s, %s mode", p.MsgVersion, p.Algorithm, encap, mode)
+	if p.Compress {
+		s += ", IPComp"
+	}
+	return s
+}
@@ -0,0 +1,44 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiate(t *testing.T) {
+	ours := &IPSec{algorithms: preferredAlgorithms([]Algorithm{ChaCha20Poly1305}), encapPort: 4500}
+	features := make(map[string]string)
+	ours.AddFeaturesTo(features)
+	remoteIP := net.ParseIP("10.0.0.2")
+	require.Equal(t, Params{MsgVersionTLV, ChaCha20Poly1305, 4500, false, true, false, false}, ours.Negotiate(features, remoteIP))
+
+	// A peer from before any of these were negotiated
+	require.Equal(t, Params{MsgVersionLegacy, AESGCM, 0, false, false, false, false}, ours.Negotiate(map[string]string{}, remoteIP))
+
+	// Tunnel mode needs both peers to want it
+	tunnel := &IPSec{algorithms: preferredAlgorithms(nil), tunnelMode: true}
+	require.False(t, tunnel.Negotiate(features, remoteIP).Tunnel)
+	require.False(t, ours.Negotiate(map[string]string{TunnelFeature: "true"}, remoteIP).Tunnel)
+	tunnel.AddFeaturesTo(features)
+	require.True(t, tunnel.Negotiate(features, remoteIP).Tunnel)
+
+	// Compression is up to the receiving peer, for the peers it is
+	// configured to compress with
+	_, wan, _ := net.ParseCIDR("10.0.0.0/8")
+	compress := &IPSec{algorithms: preferredAlgorithms(nil), compressSubnets: []*net.IPNet{wan}}
+	require.True(t, compress.Negotiate(features, remoteIP).Compress)
+	require.False(t, compress.Negotiate(features, net.ParseIP("192.168.0.2")).Compress, "not in the subnets")
+	require.False(t, compress.Negotiate(map[string]string{MsgVersionFeature: "1"}, remoteIP).Compress, "remote can't")
+	tunnel.compressSubnets = []*net.IPNet{wan}
+	require.False(t, tunnel.Negotiate(features, remoteIP).Compress, "tunnel mode")
+}
+
+func TestOverhead(t *testing.T) {
+	v4, v6 := net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")
+	require.Equal(t, 37, Params{}.Overhead(v4))
+	require.Equal(t, 45, Params{EncapPort: 4500}.Overhead(v4))
+	require.Equal(t, 57, Params{Tunnel: true}.Overhead(v4))
+	require.Equal(t, 77, Params{Tunnel: true}.Overhead(v6))
+}
@@ -0,0 +1,196 @@
+// +build netns
+
+package ipsec
+
+// An end-to-end test of IPsec between two network namespaces joined by
+// a veth pair. It needs root, iptables and the kernel's XFRM support,
+// so it only runs with the netns build tag:
+//
+//     sudo go test -tags netns ./net/ipsec/
+
+import (
+	"crypto/rand"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"github.com/weaveworks/mesh"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+const netnsPort = 6785
+
+type testPeer struct {
+	name  mesh.PeerName
+	ns    netns.NsHandle
+	ip    net.IP
+	ipsec *IPSec
+}
+
+// do calls f in the network namespace of p. f must not nest another
+// do: before Go 1.10, the inner one would unlock the OS thread.
+func (p *testPeer) do(t *testing.T, f func() error) {
+	require.NoError(t, weavenet.WithNetNSUnsafe(p.ns, f))
+}
+
+// setUpNetNS creates a network namespace for each of two peers, joined
+// by a veth pair, and an IPSec in each
+func setUpNetNS(t *testing.T) (a, b *testPeer, tearDown func()) {
+	a = &testPeer{name: 0xa, ip: net.ParseIP("10.99.0.1").To4()}
+	b = &testPeer{name: 0xb, ip: net.ParseIP("10.99.0.2").To4()}
+
+	func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		orig, err := netns.Get()
+		require.NoError(t, err)
+		defer orig.Close()
+		defer netns.Set(orig)
+
+		// Each is entered as it is created
+		b.ns, err = netns.New()
+		require.NoError(t, err)
+		a.ns, err = netns.New()
+		require.NoError(t, err)
+
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ipsec-a"}, PeerName: "ipsec-b"}
+		require.NoError(t, netlink.LinkAdd(veth))
+		link, err := netlink.LinkByName("ipsec-b")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetNsFd(link, int(b.ns)))
+	}()
+
+	for _, p := range []struct {
+		*testPeer
+		ifName string
+	}{{a, "ipsec-a"}, {b, "ipsec-b"}} {
+		p.do(t, func() error {
+			link, err := netlink.LinkByName(p.ifName)
+			if err != nil {
+				return err
+			}
+			addr := &netlink.Addr{IPNet: &net.IPNet{IP: p.ip, Mask: net.CIDRMask(24, 32)}}
+			if err := netlink.AddrAdd(link, addr); err != nil {
+				return err
+			}
+			if err := netlink.LinkSetUp(link); err != nil {
+				return err
+			}
+			if p.ipsec, err = New(logrus.New(), Config{}); err != nil {
+				return err
+			}
+			return p.ipsec.Flush(false)
+		})
+	}
+
+	return a, b, func() {
+		for _, p := range []*testPeer{a, b} {
+			p.do(t, func() error { return p.ipsec.Flush(true) })
+			p.ns.Close()
+		}
+	}
+}
+
+// connect sets up the SAs, policies and rules of the connection
+// connUID between a and b in both directions, as the fast datapath does
+func connect(t *testing.T, a, b *testPeer, connUID uint64) {
+	var sessionKey [32]byte
+	_, err := rand.Read(sessionKey[:])
+	require.NoError(t, err)
+	params := Params{MsgVersion: MsgVersionTLV, Algorithm: AESGCM}
+
+	for _, p := range []struct{ local, remote *testPeer }{{a, b}, {b, a}} {
+		local, remote := p.local, p.remote
+		var msg []byte
+		local.do(t, func() error {
+			return local.ipsec.InitSALocal(local.name, remote.name, connUID, local.ip, remote.ip, netnsPort, &sessionKey, params,
+				func(m []byte) error {
+					msg = m
+					return nil
+				})
+		})
+		remote.do(t, func() error {
+			return remote.ipsec.InitSARemote(msg, params.MsgVersion, remote.name, local.name, connUID, remote.ip, local.ip, netnsPort, &sessionKey, params)
+		})
+	}
+}
+
+// disconnect closes the connection connUID on local's side only
+func disconnect(t *testing.T, local, remote *testPeer, connUID uint64) {
+	local.do(t, func() error {
+		return local.ipsec.Destroy(local.name, remote.name, connUID, local.ip, remote.ip, netnsPort)
+	})
+}
+
+// send sends a datagram from a to the data port of b, returning
+// whether it arrived on conn
+func send(t *testing.T, a *testPeer, conn *net.UDPConn) bool {
+	var out *net.UDPConn
+	a.do(t, func() (err error) {
+		out, err = net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+		return err
+	})
+	defer out.Close()
+	_, err := out.Write([]byte("weave"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	return err == nil && string(buf[:n]) == "weave"
+}
+
+// outbound returns the outbound SAs of p
+func outbound(p *testPeer) []SAStatus {
+	var out []SAStatus
+	for _, s := range p.ipsec.Status() {
+		if s.Direction == "out" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func TestNetNS(t *testing.T) {
+	a, b, tearDown := setUpNetNS(t)
+	defer tearDown()
+
+	var conn *net.UDPConn
+	b.do(t, func() (err error) {
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: b.ip, Port: netnsPort})
+		return err
+	})
+	defer conn.Close()
+
+	require.True(t, send(t, a, conn), "in the clear before connecting")
+
+	connect(t, a, b, 1)
+	require.True(t, send(t, a, conn))
+	out := outbound(a)
+	require.Len(t, out, 1)
+	require.True(t, out[0].Packets > 0, "sent encrypted")
+	spi := out[0].SPI
+
+	// Rekeyed, on a new connection, and the old one closed
+	connect(t, a, b, 2)
+	disconnect(t, a, b, 1)
+	disconnect(t, b, a, 1)
+	require.True(t, send(t, a, conn))
+	out = outbound(a)
+	require.Len(t, out, 1)
+	require.NotEqual(t, spi, out[0].SPI)
+	require.True(t, out[0].Packets > 0, "sent encrypted with the new SA")
+
+	// Once a has closed the connection, what it sends goes in the
+	// clear, which b drops until it has closed it too
+	disconnect(t, a, b, 2)
+	require.False(t, send(t, a, conn), "cleartext dropped")
+	disconnect(t, b, a, 2)
+	require.True(t, send(t, a, conn), "in the clear after disconnecting")
+}
@@ -0,0 +1,145 @@
+package ipsec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// NoTrack is the traffic of fast datapath encryption to exempt from
+// conntrack. Encrypted overlay traffic gains nothing from conntrack
+// entries, which on busy hosts fill the table, past nf_conntrack_max,
+// at which the kernel drops packets of new flows.
+type NoTrack struct {
+	// The overlay traffic to and from the data port of each
+	// connection, before it is encrypted and after it is decrypted
+	DataPort bool
+	// ESP, and ESP in UDP to and from the encap port
+	ESP bool
+}
+
+const (
+	noTrackDataPort = "data-port"
+	noTrackESP      = "esp"
+)
+
+// ParseNoTrack parses a comma-separated list of the traffic to exempt
+// from conntrack, out of data-port and esp
+func ParseNoTrack(s string) (NoTrack, error) {
+	var n NoTrack
+	if s == "" {
+		return n, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case noTrackDataPort:
+			n.DataPort = true
+		case noTrackESP:
+			n.ESP = true
+		default:
+			return NoTrack{}, fmt.Errorf("unknown traffic to exempt from conntrack %q (data-port or esp)", name)
+		}
+	}
+	return n, nil
+}
+
+func (n NoTrack) enabled() bool {
+	return n.DataPort || n.ESP
+}
+
+// noTrackChain is the chain of the rules exempting traffic from
+// conntrack, which both inbound and outbound traffic goes through
+// before conntrack sees it
+func noTrackChain(cfg ruleConfig) common.OwnedChain {
+	return common.OwnedChain{Table: tableRaw, Name: cfg.chains.noTrack, Jumps: []common.Jump{
+		{From: "PREROUTING", Position: common.Top},
+		{From: "OUTPUT", Position: common.Top},
+	}}
+}
+
+// noTrackRules are the rules of noTrackChain exempting ESP, and ESP in
+// UDP, from conntrack, with noTrack.ESP; the data port of each
+// connection has a rule of its own, ruleNoTrackPort
+func noTrackRules(cfg ruleConfig) []rule {
+	if !cfg.noTrack.ESP {
+		return nil
+	}
+	rules := []rule{{tableRaw, cfg.chains.noTrack, []string{"-p", "esp", "-j", "CT", "--notrack"}, true}}
+	if cfg.encapPort != 0 {
+		port := strconv.Itoa(cfg.encapPort)
+		rules = append(rules,
+			rule{tableRaw, cfg.chains.noTrack, []string{"-p", "udp", "--dport", port, "-j", "CT", "--notrack"}, true},
+			rule{tableRaw, cfg.chains.noTrack, []string{"-p", "udp", "--sport", port, "-j", "CT", "--notrack"}, true},
+		)
+	}
+	return rules
+}
+
+// ruleNoTrackPort exempts the overlay traffic to udpPort, a data port
+// of ours or of a peer, from conntrack
+func ruleNoTrackPort(chains chainNames, udpPort int) rule {
+	return rule{tableRaw, chains.noTrack,
+		[]string{"-p", "udp", "--dport", strconv.Itoa(udpPort), "-j", "CT", "--notrack"}, true}
+}
+
+// removeNoTrack removes the chain exempting traffic from conntrack,
+// and the rules jumping to it, which a run with NoTrack left in place
+func removeNoTrack(ipt common.IPTablesBackend, cfg ruleConfig) error {
+	c := noTrackChain(cfg)
+	// Listing fails if it is missing, as it is unless NoTrack was used
+	if _, err := ipt.List(c.Table, c.Name); err != nil {
+		return nil
+	}
+	if err := common.Chains.Release(ipt, chainsOwner, c); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("iptables release chain (%s, %s)", c.Table, c.Name))
+	}
+	return nil
+}
+
+// addNoTrackPort exempts the traffic of udpPort from conntrack, with
+// noTrack.DataPort, unless another protected connection using it
+// already has, adding the rule with tx, over ipt. protectLock must be
+// held.
+func (ipsec *IPSec) addNoTrackPort(ipt common.IPTablesBackend, tx *common.Transaction, udpPort int) error {
+	if !ipsec.noTrack.DataPort {
+		return nil
+	}
+	ports := ipsec.noTrackPorts[ipt]
+	if ports == nil {
+		ports = make(map[int]int)
+		ipsec.noTrackPorts[ipt] = ports
+	}
+	if ports[udpPort] == 0 {
+		r := ruleNoTrackPort(ipsec.chains, udpPort)
+		if err := tx.AppendUnique(r.table, r.chain, r.rulespec...); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("iptables append (%s, %s, %s)", r.table, r.chain, r.rulespec))
+		}
+		ipsec.reconcilers[ipt].Want(r.wanted(false))
+	}
+	ports[udpPort]++
+	return nil
+}
+
+// removeNoTrackPort undoes addNoTrackPort, removing the rule once no
+// protected connection uses udpPort. protectLock must be held.
+func (ipsec *IPSec) removeNoTrackPort(ipt common.IPTablesBackend, udpPort int) error {
+	ports := ipsec.noTrackPorts[ipt]
+	if ports[udpPort] == 0 {
+		return nil
+	}
+	if ports[udpPort]--; ports[udpPort] > 0 {
+		return nil
+	}
+	delete(ports, udpPort)
+	r := ruleNoTrackPort(ipsec.chains, udpPort)
+	ipsec.reconcilers[ipt].Unwant(r.wanted(false))
+	var b common.Batch
+	if err := resetRules(ipt, &b, []rule{r}, true); err != nil {
+		return err
+	}
+	return applyBatch(ipt, &b)
+}
@@ -0,0 +1,54 @@
+package ipsec
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// offloadDev returns the index of the interface over which remoteIP is
+// reached, if SAs with it should be offloaded to that interface's
+// hardware, or 0 if not.
+func (ipsec *IPSec) offloadDev(remoteIP net.IP) int {
+	if !ipsec.offload {
+		return 0
+	}
+	routes, err := netlink.RouteGet(remoteIP)
+	if err != nil || len(routes) == 0 {
+		ipsec.log.Warnf("ipsec: finding the interface to %s, for offload: %v", remoteIP, err)
+		return 0
+	}
+	dev := routes[0].LinkIndex
+	ipsec.RLock()
+	defer ipsec.RUnlock()
+	if ipsec.noOffload[dev] {
+		return 0
+	}
+	return dev
+}
+
+// addState adds sa with add, offloaded to the hardware of the
+// interface over which remoteIP is reached if enabled and possible,
+// and otherwise processed in software.
+func (ipsec *IPSec) addState(sa *netlink.XfrmState, remoteIP net.IP, add func(*netlink.XfrmState) error) (offloaded bool, err error) {
+	if dev := ipsec.offloadDev(remoteIP); dev != 0 {
+		sa.Offload = &netlink.XfrmStateOffload{Ifindex: dev, Inbound: sa.Src.Equal(remoteIP)}
+		err := add(sa)
+		if err == nil {
+			return true, nil
+		}
+		// The interface can't offload at all, so don't try it again;
+		// any other failure, e.g. its SA table being full, is only
+		// for this SA
+		if cause := errors.Cause(err); cause == syscall.EOPNOTSUPP || cause == syscall.ENODEV {
+			ipsec.Lock()
+			ipsec.noOffload[dev] = true
+			ipsec.Unlock()
+		}
+		ipsec.log.Warnf("ipsec: unable to offload SA %s -> %s 0x%x, so processing it in software: %s", sa.Src, sa.Dst, sa.Spi, err)
+		sa.Offload = nil
+	}
+	return false, add(sa)
+}
@@ -0,0 +1,55 @@
+package ipsec
+
+import (
+	"time"
+)
+
+// DefaultRekeyOverlap is how long the inbound SA of a closed
+// connection is kept, by default, for packets already sent with it.
+const DefaultRekeyOverlap = 30 * time.Second
+
+// retire keeps the inbound SA identified by id, and the inbound
+// policies accepting what it decrypts, for the rekey overlap after its connection closed, so that
+// packets the remote peer sent with it before switching to the SA of
+// a new connection are still accepted. It is destroyed at the end of
+// the overlap, or as soon as it hard-expires. Its lockSPI must be
+// held.
+func (ipsec *IPSec) retire(id spiID, si spiInfo) {
+	ipsec.log.Infof("ipsec: retiring: in %s -> %s 0x%x for %s", si.src, si.dst, si.spi, ipsec.rekeyOverlap)
+
+	ipsec.Lock()
+	si.retiring = true
+	ipsec.spiInfo[id] = si
+	if p, found := ipsec.spis[si.spi]; found {
+		p.retiring = true
+	}
+	stop := ipsec.stop
+	ipsec.Unlock()
+
+	go func() {
+		select {
+		case <-time.After(ipsec.rekeyOverlap):
+			ipsec.endOverlap(id, si.spi, "rekey overlap ended")
+		case <-stop:
+			// Flush removes it
+		}
+	}()
+}
+
+// endOverlap destroys the retired SA identified by id, unless it has
+// been destroyed already
+func (ipsec *IPSec) endOverlap(id spiID, spi SPI, reason string) {
+	defer ipsec.lockSPI(id)()
+	ipsec.RLock()
+	current, found := ipsec.spiInfo[id]
+	var expired bool
+	if p, ok := ipsec.spis[spi]; ok {
+		expired = p.expired
+	}
+	ipsec.RUnlock()
+	if !found || current.spi != spi {
+		return
+	}
+	current.expired = expired
+	ipsec.destroySA(id, current, reason)
+}
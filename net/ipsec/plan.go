@@ -0,0 +1,169 @@
+package ipsec
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// FlushPlan is what Flush would remove, as weave believes it owns it
+type FlushPlan struct {
+	Policies []netlink.XfrmPolicy
+	States   []netlink.XfrmState
+	// Rules are iptables rules, as iptables -t <table> -S prints them,
+	// and ip6tables ones prefixed with "ip6tables "
+	Rules []string
+	// Chains are deleted only with destroy, as "<table> <chain>"
+	Chains []string
+}
+
+// Plan returns what Flush(destroy) would remove, leaving everything in
+// place, so that it can be checked before flushing on a host shared
+// with other IPsec software.
+func (ipsec *IPSec) Plan(destroy bool) (*FlushPlan, error) {
+	ipsec.protectLock.Lock()
+	defer ipsec.protectLock.Unlock()
+	ipsec.RLock()
+	defer ipsec.RUnlock()
+
+	plan := &FlushPlan{}
+	var err error
+	ipsec.xfrmLock.Lock()
+	plan.Policies, plan.States, err = ipsec.flushable()
+	ipsec.xfrmLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := planIPTables(ipsec.ipt, destroy, ipsec.ruleConfig())
+	if err != nil {
+		return nil, err
+	}
+	if destroy && ipsec.encapPort != 0 {
+		r := ruleAcceptOutboundEncap(ipsec.encapPort, ipsec.mark)
+		ok, err := ipsec.ipt.Exists(r.table, r.chain, r.rulespec...)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("iptables exists rule (%s, %s, %s)", r.table, r.chain, r.rulespec))
+		}
+		if ok {
+			rules = append(rules, r.String())
+		}
+	}
+	plan.Rules = rules
+	if ipsec.ip6t != nil {
+		rules, err := planIPTables(ipsec.ip6t, destroy, ipsec.ruleConfig())
+		if err != nil {
+			return nil, errors.Wrap(err, "ip6tables")
+		}
+		for _, r := range rules {
+			plan.Rules = append(plan.Rules, "ip6tables "+r)
+		}
+	}
+	if destroy {
+		for _, c := range ownedChains(ipsec.ruleConfig()) {
+			plan.Chains = append(plan.Chains, c.Table+" "+c.Name)
+		}
+	}
+
+	return plan, nil
+}
+
+// flushable returns the policies and SAs which Flush removes: the
+// policies we create and the SAs of ours we know of, or have
+// journalled. The caller must hold the lock and xfrmLock.
+func (ipsec *IPSec) flushable() ([]netlink.XfrmPolicy, []netlink.XfrmState, error) {
+	journalled := make(map[SPI]struct{})
+	for _, e := range ipsec.journal.outstanding() {
+		journalled[e.SPI] = struct{}{}
+	}
+	cpis := make(map[SPI]bool)
+	for _, si := range ipsec.spiInfo {
+		if si.cpi != 0 {
+			cpis[SPI(si.cpi)] = true
+		}
+	}
+
+	var flushPolicies []netlink.XfrmPolicy
+	var flushStates []netlink.XfrmState
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		policies, err := ipsec.xfrm.PolicyList(family)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "xfrm policy list")
+		}
+		for _, p := range policies {
+			if ours(&p) {
+				flushPolicies = append(flushPolicies, p)
+			}
+		}
+
+		states, err := ipsec.xfrm.StateList(family)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "xfrm state list")
+		}
+		for _, s := range states {
+			_, ok := ipsec.spis[SPI(s.Spi)]
+			if s.Proto == netlink.XFRM_PROTO_COMP {
+				ok = cpis[SPI(s.Spi)]
+			}
+			if _, inJournal := journalled[SPI(s.Spi)]; s.Reqid == reqID && (ok || inJournal) {
+				flushStates = append(flushStates, s)
+			}
+		}
+	}
+	return flushPolicies, flushStates, nil
+}
+
+// planIPTables returns the rules resetIPTables(ipt, destroy, cfg)
+// would remove: those in our chains, which it clears, the rules of the
+// legacy inbound chains, and with destroy the fixed rules.
+func planIPTables(ipt common.IPTablesBackend, destroy bool, cfg ruleConfig) ([]string, error) {
+	var planned []string
+	var rules []rule
+	if cfg.chains == instanceChains("") {
+		_, rules = legacyInbound()
+	}
+	for _, c := range ownedChains(cfg) {
+		list, err := ipt.List(c.Table, c.Name)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("iptables list (%s, %s)", c.Table, c.Name))
+		}
+		for _, r := range list {
+			if strings.HasPrefix(r, "-A ") {
+				planned = append(planned, "-t "+c.Table+" "+r)
+			}
+		}
+		if destroy {
+			for _, j := range c.JumpRules() {
+				rules = append(rules, rule{j.Table, j.Chain, j.Rulespec, true})
+			}
+		}
+	}
+	if destroy {
+		for _, r := range fixedRules(cfg) {
+			// Those in our chains are listed above
+			if r.chain != cfg.chains.out && r.chain != cfg.chains.outMark && r.chain != cfg.chains.noTrack {
+				rules = append(rules, r)
+			}
+		}
+	}
+	for _, r := range rules {
+		ok, err := ipt.Exists(r.table, r.chain, r.rulespec...)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("iptables exists rule (%s, %s, %s)", r.table, r.chain, r.rulespec))
+		}
+		if ok {
+			planned = append(planned, r.String())
+		}
+	}
+	return planned, nil
+}
+
+// String returns r as iptables -t <table> -S prints it
+func (r rule) String() string {
+	return fmt.Sprintf("-t %s -A %s %s", r.table, r.chain, strings.Join(r.rulespec, " "))
+}
@@ -0,0 +1,99 @@
+package ipsec
+
+import (
+	"time"
+)
+
+// ReapInterval is how often the reaper looks for stale SAs
+const ReapInterval = 5 * time.Minute
+
+// StartReaper starts removing, every ReapInterval until the IPSec is
+// destroyed, SAs which would otherwise be left behind: those of
+// connections which are not among the connUIDs returned by live, and
+// journalled states and policies of no SA we know of, e.g. from a
+// connection whose setup failed part way, and iptables rules tagged
+// for peers with which no connection is protected.
+func (ipsec *IPSec) StartReaper(live func() map[uint64]bool) {
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(ReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ipsec.reap(live)
+			case <-stop:
+				return
+			}
+		}
+	}(ipsec.stop)
+}
+
+func (ipsec *IPSec) reap(live func() map[uint64]bool) {
+	// Connections made after this are not in conns, so their SAs are
+	// left alone
+	since := time.Now()
+	conns := live()
+
+	stale := make(map[spiID]spiInfo)
+	ipsec.RLock()
+	for id, si := range ipsec.spiInfo {
+		if !conns[si.connUID] && si.created.Before(since) && !si.retiring {
+			stale[id] = si
+		}
+	}
+	ipsec.RUnlock()
+
+	for id, si := range stale {
+		ipsec.reapSA(id, si)
+	}
+
+	// SAs are journalled before they are known, while being set up, so
+	// only roll back what was unknown at the last reap too
+	suspects := make(map[string]bool)
+	for _, e := range ipsec.journal.outstanding() {
+		if ipsec.known(e) {
+			continue
+		}
+		if ipsec.reapSuspects[e.key()] {
+			ipsec.log.Infof("ipsec: reaping %s %s -> %s 0x%x left by a failed setup", e.Kind, e.Src, e.Dst, e.SPI)
+			ipsec.rollBackEntry(e)
+		} else {
+			suspects[e.key()] = true
+		}
+	}
+	ipsec.reapSuspects = suspects
+
+	if err := ipsec.deleteStrayRules(""); err != nil {
+		ipsec.metrics.iptablesErrors.Inc()
+		ipsec.log.Warnf("ipsec: reaping stray rules failed: %s", err)
+	}
+}
+
+// known returns whether the state or policy of e is of an SA we know of
+func (ipsec *IPSec) known(e journalEntry) bool {
+	ipsec.RLock()
+	defer ipsec.RUnlock()
+	if e.Kind == journalCompIn || e.Kind == journalCompOut {
+		for _, si := range ipsec.spiInfo {
+			if SPI(si.cpi) == e.SPI && si.src.Equal(e.Src) && si.dst.Equal(e.Dst) {
+				return true
+			}
+		}
+		return false
+	}
+	_, found := ipsec.spis[e.SPI]
+	return found
+}
+
+func (ipsec *IPSec) reapSA(id spiID, si spiInfo) {
+	defer ipsec.lockSPI(id)()
+	// It may have been destroyed, or set up afresh, meanwhile
+	ipsec.RLock()
+	current, found := ipsec.spiInfo[id]
+	ipsec.RUnlock()
+	if !found || current.spi != si.spi {
+		return
+	}
+	ipsec.log.Infof("ipsec: reaping SA %s -> %s 0x%x of a connection to %s which has gone", si.src, si.dst, si.spi, si.remotePeer)
+	ipsec.destroySA(id, si, "connection gone")
+}
@@ -0,0 +1,35 @@
+package ipsec
+
+import (
+	"github.com/weaveworks/weave/common"
+)
+
+// StartReconciler starts putting back, every ReconcileInterval until
+// the IPSec is destroyed, the chains and rules which have gone, e.g.
+// flushed by firewalld reloading or docker restarting. Without them,
+// what we send to peers would be dropped, or what should be dropped
+// sent in the clear. Each rule put back is audited. Does nothing if
+// ReconcileInterval is zero.
+func (ipsec *IPSec) StartReconciler() {
+	if ipsec.reconcileInterval == 0 {
+		return
+	}
+	for ipt, rc := range ipsec.reconcilers {
+		name := "iptables"
+		if ipt == ipsec.ip6t {
+			name = "ip6tables"
+		}
+		go rc.Run(ipsec.reconcileInterval, ipsec.stop, func(repaired []common.Rule, err error) {
+			if err != nil {
+				ipsec.metrics.iptablesErrors.Inc()
+				ipsec.log.Warnf("ipsec: putting back %s rules failed: %s", name, err)
+				return
+			}
+			for _, r := range repaired {
+				ipsec.log.Warnf("ipsec: put back missing or misplaced %s rule %s", name, r)
+				ipsec.auditRepaired(name, r)
+			}
+			ipsec.metrics.rulesRepaired.Add(float64(len(repaired)))
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package ipsec
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// Report is the iptables rules, xfrm policies and SAs IPsec believes
+// it owns, each with the peer it is for, where it is for one, so that
+// a support bundle tells which of them weave put in place
+type Report struct {
+	Rules    []common.ReportedRule
+	Policies []ReportedPolicy
+	SAs      []SAStatus
+}
+
+// ReportedPolicy is an xfrm policy of ours
+type ReportedPolicy struct {
+	Peer     string `json:",omitempty"`
+	Dir      string
+	Src      string
+	Dst      string
+	DstPort  int `json:",omitempty"`
+	Priority int
+	Mark     string `json:",omitempty"`
+	SPI      string `json:",omitempty"` // of the SA it sends with, if outbound
+}
+
+// Report returns what IPsec owns, or nil if ipsec is nil
+func (ipsec *IPSec) Report() (*Report, error) {
+	if ipsec == nil {
+		return nil, nil
+	}
+	report := &Report{Rules: ipsec.reconcilers[ipsec.ipt].Report(chainsOwner), SAs: ipsec.Status()}
+	if ipsec.ip6t != nil {
+		for _, rule := range ipsec.reconcilers[ipsec.ip6t].Report(chainsOwner) {
+			rule.Rule = "ip6tables " + rule.Rule
+			report.Rules = append(report.Rules, rule)
+		}
+	}
+
+	// The policies of a connection are between the addresses of its SAs
+	peers := make(map[string]string)
+	for _, si := range ipsec.sas() {
+		peers[si.src.String()+" "+si.dst.String()] = si.remotePeer.String()
+		peers[si.dst.String()+" "+si.src.String()] = si.remotePeer.String()
+	}
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		policies, err := ipsec.xfrm.PolicyList(family)
+		if err != nil {
+			return nil, errors.Wrap(err, "xfrm policy list")
+		}
+		for _, p := range policies {
+			if !ours(&p) {
+				continue
+			}
+			rp := ReportedPolicy{Dir: p.Dir.String(), DstPort: p.DstPort, Priority: p.Priority}
+			if p.Src != nil && p.Dst != nil {
+				rp.Src, rp.Dst = p.Src.String(), p.Dst.String()
+				rp.Peer = peers[p.Src.IP.String()+" "+p.Dst.IP.String()]
+			}
+			if p.Mark != nil {
+				rp.Mark = fmt.Sprintf("0x%x/0x%x", p.Mark.Value, p.Mark.Mask)
+			}
+			if p.Dir == netlink.XFRM_DIR_OUT && len(p.Tmpls) > 0 {
+				rp.SPI = fmt.Sprintf("0x%x", uint32(p.Tmpls[len(p.Tmpls)-1].Spi))
+			}
+			report.Policies = append(report.Policies, rp)
+		}
+	}
+	return report, nil
+}
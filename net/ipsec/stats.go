@@ -0,0 +1,94 @@
+package ipsec
+
+import (
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/weaveworks/mesh"
+)
+
+// sas returns a copy of the SAs currently set up
+func (ipsec *IPSec) sas() []spiInfo {
+	ipsec.RLock()
+	defer ipsec.RUnlock()
+	sas := make([]spiInfo, 0, len(ipsec.spiInfo))
+	for _, si := range ipsec.spiInfo {
+		sas = append(sas, si)
+	}
+	return sas
+}
+
+// saCounters are what the kernel has counted for an SA
+type saCounters struct {
+	bytes, packets uint64
+	// Received packets dropped as replayed, or as too far out of order
+	// for the replay window, and as failing their integrity check
+	replayed, failed uint64
+}
+
+// counters returns what the kernel has counted for the SA si
+func (ipsec *IPSec) counters(si spiInfo) (saCounters, error) {
+	ipsec.xfrmLock.Lock()
+	defer ipsec.xfrmLock.Unlock()
+	sa, err := ipsec.xfrm.StateGet(&netlink.XfrmState{
+		Src:   si.src,
+		Dst:   si.dst,
+		Proto: netlink.XFRM_PROTO_ESP,
+		Spi:   int(si.spi),
+	})
+	if err != nil {
+		return saCounters{}, err
+	}
+	return saCounters{
+		bytes:    sa.Statistics.Bytes,
+		packets:  sa.Statistics.Packets,
+		replayed: uint64(sa.Statistics.Replay) + uint64(sa.Statistics.ReplayWindow),
+		failed:   uint64(sa.Statistics.Failed),
+	}, nil
+}
+
+// traffic returns the bytes and packets the kernel has sent or
+// received with the SA si
+func (ipsec *IPSec) traffic(si spiInfo) (bytes, packets uint64, err error) {
+	c, err := ipsec.counters(si)
+	return c.bytes, c.packets, err
+}
+
+// ConnectionStatus describes the IPsec state of a connection
+type ConnectionStatus struct {
+	InSPI  SPI // 0 until set up
+	OutSPI SPI // 0 until the remote peer has had it set up
+	// When the newer of its SAs was set up. Each connection has SAs
+	// with fresh keys, so this is when the peers last rekeyed.
+	Rekeyed   time.Time
+	EncapPort int  // of the remote peer, if sending ESP in UDP; 0 for plain ESP
+	Tunnel    bool // using tunnel mode SAs
+	Expired   bool // an SA reached its hard limit, so is gone
+}
+
+// Protected returns whether what is sent over the connection in both
+// directions is encrypted
+func (s ConnectionStatus) Protected() bool {
+	return s.InSPI != 0 && s.OutSPI != 0 && !s.Expired
+}
+
+// ConnectionStatus returns the IPsec state of the connection connUID
+// between the peers, over udpPort
+func (ipsec *IPSec) ConnectionStatus(localPeer, remotePeer mesh.PeerName, connUID uint64, udpPort int) ConnectionStatus {
+	ipsec.RLock()
+	defer ipsec.RUnlock()
+	var s ConnectionStatus
+	if in, found := ipsec.spiInfo[getSPIId(remotePeer, localPeer, connUID, udpPort)]; found {
+		s.InSPI, s.Rekeyed, s.Expired = in.spi, in.created, in.expired
+		s.Tunnel = in.mode == netlink.XFRM_MODE_TUNNEL
+	}
+	if out, found := ipsec.spiInfo[getSPIId(localPeer, remotePeer, connUID, udpPort)]; found {
+		s.OutSPI, s.EncapPort = out.spi, out.encapPort
+		s.Expired = s.Expired || out.expired
+		s.Tunnel = out.mode == netlink.XFRM_MODE_TUNNEL
+		if out.created.After(s.Rekeyed) {
+			s.Rekeyed = out.created
+		}
+	}
+	return s
+}
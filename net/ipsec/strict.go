@@ -0,0 +1,204 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// DefaultStrictIngressGrace is how long, by default, strict ingress
+// mode waits before it drops anything, for the other peers of a cluster
+// it is being enabled on to be restarted, and to connect, meanwhile.
+const DefaultStrictIngressGrace = 5 * time.Minute
+
+const (
+	// The policies of strict ingress mode come after those of each peer
+	inStrictExemptPolicyPriority = inPolicyPriority + 1
+	inStrictPolicyPriority       = inPolicyPriority + 2
+)
+
+// StartStrictIngress starts, in strict ingress mode, dropping traffic
+// to the weave data ports, those StrictIngressPort is called with, from
+// any host unless it was decrypted with one of our SAs, rather than
+// only from peers we have set up SAs with. Traffic from the trusted
+// subnets, whose connections are not encrypted, and of pods exempt from
+// encryption is still let in. Nothing is dropped until the grace period
+// is over, so that peers which have yet to connect, e.g. while a
+// cluster is upgraded, are not cut off. Does nothing unless strict
+// ingress mode is on.
+func (ipsec *IPSec) StartStrictIngress() {
+	if !ipsec.strictIngress {
+		return
+	}
+	ipsec.log.Infof("ipsec: strict ingress mode: dropping unencrypted traffic to the data ports in %s", ipsec.strictIngressGrace)
+	go func(stop <-chan struct{}) {
+		select {
+		case <-time.After(ipsec.strictIngressGrace):
+		case <-stop:
+			return
+		}
+		if err := ipsec.enforceStrictIngress(stop); err != nil {
+			ipsec.log.Errorf("ipsec: strict ingress mode: %s", err)
+		}
+	}(ipsec.stop)
+}
+
+// StrictIngressPort has strict ingress mode cover udpPort, a data port
+// of ours, at once if its grace period is over. Does nothing unless
+// strict ingress mode is on.
+func (ipsec *IPSec) StrictIngressPort(udpPort int) error {
+	if !ipsec.strictIngress {
+		return nil
+	}
+	ipsec.protectLock.Lock()
+	defer ipsec.protectLock.Unlock()
+
+	switch {
+	case ipsec.strictPorts[udpPort]:
+		return nil
+	case !ipsec.strictEnforced:
+		ipsec.strictPorts[udpPort] = false
+		return nil
+	}
+	if err := ipsec.addStrictPolicies(udpPort); err != nil {
+		return err
+	}
+	ipsec.strictPorts[udpPort] = true
+	return nil
+}
+
+// enforceStrictIngress installs the policies of strict ingress mode for
+// each data port, unless the IPSec has been destroyed, i.e. stop
+// closed, meanwhile.
+func (ipsec *IPSec) enforceStrictIngress(stop <-chan struct{}) error {
+	ipsec.protectLock.Lock()
+	defer ipsec.protectLock.Unlock()
+
+	select {
+	case <-stop:
+		return nil
+	default:
+	}
+	ipsec.strictEnforced = true
+	for udpPort, added := range ipsec.strictPorts {
+		if added {
+			continue
+		}
+		if err := ipsec.addStrictPolicies(udpPort); err != nil {
+			return err
+		}
+		ipsec.strictPorts[udpPort] = true
+	}
+	return nil
+}
+
+// addStrictPolicies installs the policies of strict ingress mode for
+// udpPort. Like the inbound policies of each peer, Flush removes them.
+// protectLock must be held.
+func (ipsec *IPSec) addStrictPolicies(udpPort int) error {
+	for _, sp := range xfrmStrictPolicies(udpPort, ipsec.trustedSubnets) {
+		if err := ipsec.xfrmPolicyUpdate(sp); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("xfrm policy update (in, %s, %s, %d)", sp.Src, sp.Dst, sp.Priority))
+		}
+	}
+	ipsec.log.Infof("ipsec: strict ingress mode: dropping unencrypted traffic to port %d", udpPort)
+	return nil
+}
+
+// SetTrustedSubnets replaces the trusted subnets, e.g. as they are
+// narrowed while encryption is rolled out, updating the policies of
+// the data ports strict ingress mode already covers: those of the new
+// subnets are added before those of the old ones no longer trusted are
+// deleted, so that no traffic still trusted is dropped meanwhile.
+func (ipsec *IPSec) SetTrustedSubnets(trusted []*net.IPNet) error {
+	ipsec.protectLock.Lock()
+	defer ipsec.protectLock.Unlock()
+
+	old := ipsec.trustedSubnets
+	ipsec.trustedSubnets = trusted
+	for udpPort, added := range ipsec.strictPorts {
+		if !added {
+			continue
+		}
+		if err := ipsec.addStrictPolicies(udpPort); err != nil {
+			return err
+		}
+		kept := make(map[string]bool)
+		for _, sp := range xfrmStrictPolicies(udpPort, trusted) {
+			kept[sp.Src.String()] = true
+		}
+		for _, sp := range xfrmStrictPolicies(udpPort, old) {
+			// Those of a subnet are tagged with trustedMark
+			if len(sp.Tmpls) != 0 || *sp.Mark != *trustedMark.xfrm() || kept[sp.Src.String()] {
+				continue
+			}
+			if err := ipsec.delPolicy(sp); err != nil && err != syscall.ENOENT {
+				return errors.Wrap(err, fmt.Sprintf("xfrm policy del (in, %s, %s, %d)", sp.Src, sp.Dst, sp.Priority))
+			}
+		}
+	}
+	return nil
+}
+
+// xfrmStrictPolicies returns the policies requiring traffic to udpPort
+// from any host to arrive in ESP, in each family, and the ones letting
+// that from the trusted subnets, and of pods exempt from encryption,
+// in unencrypted, which precede them
+func xfrmStrictPolicies(udpPort int, trusted []*net.IPNet) []*netlink.XfrmPolicy {
+	var policies []*netlink.XfrmPolicy
+	for _, any := range []*net.IPNet{
+		{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)},
+		{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)},
+	} {
+		policies = append(policies,
+			&netlink.XfrmPolicy{
+				Src:      any,
+				Dst:      any,
+				Proto:    syscall.IPPROTO_UDP,
+				DstPort:  udpPort,
+				Dir:      netlink.XFRM_DIR_IN,
+				Priority: inStrictExemptPolicyPriority,
+				Mark:     exemptMark.xfrm(),
+			},
+			&netlink.XfrmPolicy{
+				Src:      any,
+				Dst:      any,
+				Proto:    syscall.IPPROTO_UDP,
+				DstPort:  udpPort,
+				Dir:      netlink.XFRM_DIR_IN,
+				Priority: inStrictPolicyPriority,
+				Tmpls: []netlink.XfrmPolicyTmpl{
+					{
+						// Any of our SAs; the addresses, only there for
+						// the family, are not matched in transport mode
+						Src:   any.IP,
+						Dst:   any.IP,
+						Proto: netlink.XFRM_PROTO_ESP,
+						Mode:  netlink.XFRM_MODE_TRANSPORT,
+						Reqid: reqID,
+					},
+				},
+			})
+	}
+	for _, subnet := range trusted {
+		any := &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}
+		if ip4 := subnet.IP.To4(); ip4 != nil {
+			subnet = &net.IPNet{IP: ip4, Mask: subnet.Mask[len(subnet.Mask)-net.IPv4len:]}
+			any = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)}
+		}
+		policies = append(policies, &netlink.XfrmPolicy{
+			Src:      subnet,
+			Dst:      any,
+			Proto:    syscall.IPPROTO_UDP,
+			DstPort:  udpPort,
+			Dir:      netlink.XFRM_DIR_IN,
+			Priority: inStrictExemptPolicyPriority,
+			Mark:     trustedMark.xfrm(),
+		})
+	}
+	return policies
+}
@@ -0,0 +1,126 @@
+package ipsec
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// XfrmClient is what IPSec needs of the kernel's XFRM framework, for
+// its states and policies. New uses one talking netlink unless given
+// another, e.g. a fake in tests. IPSec only calls its methods with
+// xfrmLock held, apart from StateAllocSpi and Monitor.
+type XfrmClient interface {
+	// StateAllocSpi creates a larval state, with an SPI which the
+	// kernel allocates, and returns it
+	StateAllocSpi(sa *netlink.XfrmState) (*netlink.XfrmState, error)
+	StateAdd(sa *netlink.XfrmState) error
+	StateUpdate(sa *netlink.XfrmState) error
+	StateGet(sa *netlink.XfrmState) (*netlink.XfrmState, error)
+	StateDel(sa *netlink.XfrmState) error
+	StateList(family int) ([]netlink.XfrmState, error)
+	// CompStateAdd adds an IPComp state, with cpi, compressing with
+	// compressAlgorithm
+	CompStateAdd(srcIP, dstIP net.IP, cpi uint16, mode netlink.Mode) error
+
+	PolicyUpdate(sp *netlink.XfrmPolicy) error
+	PolicyGet(sp *netlink.XfrmPolicy) (*netlink.XfrmPolicy, error)
+	PolicyDel(sp *netlink.XfrmPolicy) error
+	PolicyList(family int) ([]netlink.XfrmPolicy, error)
+
+	// Monitor sends the messages of the given types to ch until done is
+	// closed, or it fails, with the error sent to errs
+	Monitor(ch chan<- netlink.XfrmMsg, done <-chan struct{}, errs chan<- error, types ...nl.XfrmMsgType) error
+}
+
+// netlinkXfrm is an XfrmClient talking netlink over a handle which
+// keeps its socket open
+type netlinkXfrm struct {
+	h *netlink.Handle
+}
+
+func newNetlinkXfrm() (*netlinkXfrm, error) {
+	h, err := netlink.NewHandle(syscall.NETLINK_XFRM)
+	if err != nil {
+		return nil, err
+	}
+	return &netlinkXfrm{h: h}, nil
+}
+
+// StateAllocSpi uses a fresh socket, as the netlink library only
+// offers this on one
+func (x *netlinkXfrm) StateAllocSpi(sa *netlink.XfrmState) (*netlink.XfrmState, error) {
+	return netlink.XfrmStateAllocSpi(sa)
+}
+
+func (x *netlinkXfrm) StateAdd(sa *netlink.XfrmState) error {
+	return x.h.XfrmStateAdd(sa)
+}
+
+func (x *netlinkXfrm) StateUpdate(sa *netlink.XfrmState) error {
+	return x.h.XfrmStateUpdate(sa)
+}
+
+func (x *netlinkXfrm) StateGet(sa *netlink.XfrmState) (*netlink.XfrmState, error) {
+	return x.h.XfrmStateGet(sa)
+}
+
+func (x *netlinkXfrm) StateDel(sa *netlink.XfrmState) error {
+	return x.h.XfrmStateDel(sa)
+}
+
+func (x *netlinkXfrm) StateList(family int) ([]netlink.XfrmState, error) {
+	return x.h.XfrmStateList(family)
+}
+
+// CompStateAdd makes the request itself, as the netlink library can't
+// express the compression algorithm of a state
+func (x *netlinkXfrm) CompStateAdd(srcIP, dstIP net.IP, cpi uint16, mode netlink.Mode) error {
+	req := nl.NewNetlinkRequest(nl.XFRM_MSG_NEWSA, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+
+	msg := &nl.XfrmUsersaInfo{}
+	msg.Family = uint16(nl.GetIPFamily(dstIP))
+	msg.Id.Daddr.FromIP(dstIP)
+	msg.Id.Spi = nl.Swap32(uint32(cpi))
+	msg.Id.Proto = uint8(netlink.XFRM_PROTO_COMP)
+	msg.Saddr.FromIP(srcIP)
+	msg.Mode = uint8(mode)
+	msg.Reqid = uint32(reqID)
+	// Unlike ESP SAs, they never expire: they are removed along with
+	// the ESP SA they go with
+	msg.Lft.SoftByteLimit = nl.XFRM_INF
+	msg.Lft.HardByteLimit = nl.XFRM_INF
+	msg.Lft.SoftPacketLimit = nl.XFRM_INF
+	msg.Lft.HardPacketLimit = nl.XFRM_INF
+	req.AddData(msg)
+
+	algo := nl.XfrmAlgo{}
+	copy(algo.AlgName[:], compressAlgorithm)
+	req.AddData(nl.NewRtAttr(nl.XFRMA_ALG_COMP, algo.Serialize()))
+
+	_, err := req.Execute(syscall.NETLINK_XFRM, 0)
+	return err
+}
+
+func (x *netlinkXfrm) PolicyUpdate(sp *netlink.XfrmPolicy) error {
+	return x.h.XfrmPolicyUpdate(sp)
+}
+
+func (x *netlinkXfrm) PolicyGet(sp *netlink.XfrmPolicy) (*netlink.XfrmPolicy, error) {
+	return x.h.XfrmPolicyGet(sp)
+}
+
+func (x *netlinkXfrm) PolicyDel(sp *netlink.XfrmPolicy) error {
+	return x.h.XfrmPolicyDel(sp)
+}
+
+func (x *netlinkXfrm) PolicyList(family int) ([]netlink.XfrmPolicy, error) {
+	return x.h.XfrmPolicyList(family)
+}
+
+// Monitor subscribes on a socket of its own
+func (x *netlinkXfrm) Monitor(ch chan<- netlink.XfrmMsg, done <-chan struct{}, errs chan<- error, types ...nl.XfrmMsgType) error {
+	return netlink.XfrmMonitor(ch, done, errs, types...)
+}
@@ -0,0 +1,152 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// MemXfrm is an XfrmClient keeping states and policies in maps, keyed
+// as the kernel identifies them, for tests and for routers simulating
+// fast datapath without the kernel, whose IPsec is then only the
+// control plane: nothing is encrypted
+type MemXfrm struct {
+	sync.Mutex
+	nextSPI  int
+	states   map[string]netlink.XfrmState
+	policies map[string]netlink.XfrmPolicy
+}
+
+func NewMemXfrm() *MemXfrm {
+	return &MemXfrm{
+		nextSPI:  0x1000,
+		states:   make(map[string]netlink.XfrmState),
+		policies: make(map[string]netlink.XfrmPolicy),
+	}
+}
+
+func stateKey(sa *netlink.XfrmState) string {
+	return fmt.Sprintf("%s %d 0x%x", sa.Dst, sa.Proto, sa.Spi)
+}
+
+func policyKey(sp *netlink.XfrmPolicy) string {
+	var mark netlink.XfrmMark
+	if sp.Mark != nil {
+		mark = *sp.Mark
+	}
+	return fmt.Sprintf("%s %s %d %d %d %v %v", sp.Src, sp.Dst, sp.Proto, sp.SrcPort, sp.DstPort, sp.Dir, mark)
+}
+
+func (x *MemXfrm) StateAllocSpi(sa *netlink.XfrmState) (*netlink.XfrmState, error) {
+	x.Lock()
+	defer x.Unlock()
+	larval := *sa
+	larval.Spi = x.nextSPI
+	x.nextSPI++
+	x.states[stateKey(&larval)] = larval
+	return &larval, nil
+}
+
+func (x *MemXfrm) StateAdd(sa *netlink.XfrmState) error {
+	x.Lock()
+	defer x.Unlock()
+	if _, found := x.states[stateKey(sa)]; found {
+		return syscall.EEXIST
+	}
+	x.states[stateKey(sa)] = *sa
+	return nil
+}
+
+func (x *MemXfrm) StateUpdate(sa *netlink.XfrmState) error {
+	x.Lock()
+	defer x.Unlock()
+	if _, found := x.states[stateKey(sa)]; !found {
+		return syscall.ESRCH
+	}
+	x.states[stateKey(sa)] = *sa
+	return nil
+}
+
+func (x *MemXfrm) StateGet(sa *netlink.XfrmState) (*netlink.XfrmState, error) {
+	x.Lock()
+	defer x.Unlock()
+	existing, found := x.states[stateKey(sa)]
+	if !found {
+		return nil, syscall.ESRCH
+	}
+	return &existing, nil
+}
+
+func (x *MemXfrm) StateDel(sa *netlink.XfrmState) error {
+	x.Lock()
+	defer x.Unlock()
+	if _, found := x.states[stateKey(sa)]; !found {
+		return syscall.ESRCH
+	}
+	delete(x.states, stateKey(sa))
+	return nil
+}
+
+func (x *MemXfrm) StateList(family int) ([]netlink.XfrmState, error) {
+	x.Lock()
+	defer x.Unlock()
+	var states []netlink.XfrmState
+	for _, s := range x.states {
+		if nl.GetIPFamily(s.Dst) == family {
+			states = append(states, s)
+		}
+	}
+	return states, nil
+}
+
+func (x *MemXfrm) CompStateAdd(srcIP, dstIP net.IP, cpi uint16, mode netlink.Mode) error {
+	return x.StateAdd(&netlink.XfrmState{Src: srcIP, Dst: dstIP, Proto: netlink.XFRM_PROTO_COMP, Spi: int(cpi), Mode: mode, Reqid: reqID})
+}
+
+func (x *MemXfrm) PolicyUpdate(sp *netlink.XfrmPolicy) error {
+	x.Lock()
+	defer x.Unlock()
+	x.policies[policyKey(sp)] = *sp
+	return nil
+}
+
+func (x *MemXfrm) PolicyGet(sp *netlink.XfrmPolicy) (*netlink.XfrmPolicy, error) {
+	x.Lock()
+	defer x.Unlock()
+	existing, found := x.policies[policyKey(sp)]
+	if !found {
+		return nil, syscall.ENOENT
+	}
+	return &existing, nil
+}
+
+func (x *MemXfrm) PolicyDel(sp *netlink.XfrmPolicy) error {
+	x.Lock()
+	defer x.Unlock()
+	if _, found := x.policies[policyKey(sp)]; !found {
+		return syscall.ENOENT
+	}
+	delete(x.policies, policyKey(sp))
+	return nil
+}
+
+func (x *MemXfrm) PolicyList(family int) ([]netlink.XfrmPolicy, error) {
+	x.Lock()
+	defer x.Unlock()
+	var policies []netlink.XfrmPolicy
+	for _, p := range x.policies {
+		if nl.GetIPFamily(p.Dst.IP) == family {
+			policies = append(policies, p)
+		}
+	}
+	return policies, nil
+}
+
+// Monitor never sends anything
+func (x *MemXfrm) Monitor(ch chan<- netlink.XfrmMsg, done <-chan struct{}, errs chan<- error, types ...nl.XfrmMsgType) error {
+	return nil
+}
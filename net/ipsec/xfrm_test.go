@@ -0,0 +1,237 @@
+package ipsec
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+// outSPIs returns the SPIs of the outbound ESP states, and of the
+// templates of the outbound policies
+func (x *MemXfrm) outSPIs(localIP net.IP) (states, policies []int) {
+	x.Lock()
+	defer x.Unlock()
+	for _, s := range x.states {
+		if s.Src.Equal(localIP) && s.Proto == netlink.XFRM_PROTO_ESP {
+			states = append(states, s.Spi)
+		}
+	}
+	for _, p := range x.policies {
+		if p.Dir == netlink.XFRM_DIR_OUT {
+			policies = append(policies, p.Tmpls[len(p.Tmpls)-1].Spi)
+		}
+	}
+	return
+}
+
+var (
+	fakeLocalPeer  = mesh.PeerName(0xa)
+	fakeRemotePeer = mesh.PeerName(0xb)
+	fakeLocalIP    = net.ParseIP("10.0.0.1").To4()
+	fakeRemoteIP   = net.ParseIP("10.0.0.2").To4()
+)
+
+func initFakeSARemote(t *testing.T, ipsec *IPSec, connUID uint64, spi SPI) error {
+	nonce, err := genNonce()
+	require.NoError(t, err)
+	msg := &msgInitSARemote{nonce, spi, AESGCM, 0}
+	var sessionKey [32]byte
+	return ipsec.InitSARemote(msg.serializeTLV(), MsgVersionTLV, fakeLocalPeer, fakeRemotePeer, connUID, fakeLocalIP, fakeRemoteIP, 6784, &sessionKey,
+		Params{MsgVersion: MsgVersionTLV, Algorithm: AESGCM})
+}
+
+func TestFakeXfrmInitSARemote(t *testing.T) {
+	x := NewMemXfrm()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x})
+	require.NoError(t, err)
+
+	require.NoError(t, initFakeSARemote(t, ipsec, 1, 0x100))
+	states, policies := x.outSPIs(fakeLocalIP)
+	require.Equal(t, []int{0x100}, states)
+	require.Equal(t, []int{0x100}, policies)
+	require.Len(t, ipsec.Status(), 1)
+
+	// A retransmission changes nothing
+	require.NoError(t, initFakeSARemote(t, ipsec, 1, 0x100))
+	states, _ = x.outSPIs(fakeLocalIP)
+	require.Equal(t, []int{0x100}, states)
+	require.Len(t, ipsec.Status(), 1)
+
+	require.NoError(t, ipsec.Destroy(fakeLocalPeer, fakeRemotePeer, 1, fakeLocalIP, fakeRemoteIP, 6784))
+	states, policies = x.outSPIs(fakeLocalIP)
+	require.Empty(t, states)
+	require.Empty(t, policies)
+	require.Empty(t, ipsec.Status())
+}
+
+func TestFakeXfrmRekey(t *testing.T) {
+	x := NewMemXfrm()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x})
+	require.NoError(t, err)
+
+	require.NoError(t, initFakeSARemote(t, ipsec, 1, 0x100))
+	require.NoError(t, initFakeSARemote(t, ipsec, 2, 0x200))
+	states, policies := x.outSPIs(fakeLocalIP)
+	require.Len(t, states, 2)
+	require.Equal(t, []int{0x200}, policies, "policy updated to the new SA")
+
+	// Closing the old connection leaves the policy of the new one
+	require.NoError(t, ipsec.Destroy(fakeLocalPeer, fakeRemotePeer, 1, fakeLocalIP, fakeRemoteIP, 6784))
+	states, policies = x.outSPIs(fakeLocalIP)
+	require.Equal(t, []int{0x200}, states)
+	require.Equal(t, []int{0x200}, policies)
+
+	require.NoError(t, ipsec.Destroy(fakeLocalPeer, fakeRemotePeer, 2, fakeLocalIP, fakeRemoteIP, 6784))
+	states, policies = x.outSPIs(fakeLocalIP)
+	require.Empty(t, states)
+	require.Empty(t, policies)
+
+	// Those we didn't create are left alone
+	foreign := &netlink.XfrmState{Src: fakeLocalIP, Dst: fakeRemoteIP, Proto: netlink.XFRM_PROTO_ESP, Spi: 0x300}
+	require.NoError(t, x.StateAdd(foreign))
+	require.Error(t, ipsec.delState(foreign))
+	states, _ = x.outSPIs(fakeLocalIP)
+	require.Equal(t, []int{0x300}, states)
+}
+
+func TestConnectionStatus(t *testing.T) {
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt})
+	require.NoError(t, err)
+	require.NoError(t, ipsec.Flush(false))
+
+	s := ipsec.ConnectionStatus(fakeLocalPeer, fakeRemotePeer, 1, 6784)
+	require.False(t, s.Protected())
+	require.True(t, s.Rekeyed.IsZero())
+
+	initFakeSALocal(t, ipsec, 1)
+	s = ipsec.ConnectionStatus(fakeLocalPeer, fakeRemotePeer, 1, 6784)
+	require.False(t, s.Protected(), "only inbound")
+	require.True(t, s.InSPI != 0)
+	require.Equal(t, SPI(0), s.OutSPI)
+
+	require.NoError(t, initFakeSARemote(t, ipsec, 1, 0x100))
+	s = ipsec.ConnectionStatus(fakeLocalPeer, fakeRemotePeer, 1, 6784)
+	require.True(t, s.Protected())
+	require.Equal(t, SPI(0x100), s.OutSPI)
+	require.Equal(t, 0, s.EncapPort)
+	require.False(t, s.Tunnel)
+	require.False(t, s.Rekeyed.IsZero())
+
+	// Of another connection
+	require.False(t, ipsec.ConnectionStatus(fakeLocalPeer, fakeRemotePeer, 2, 6784).Protected())
+}
+
+func TestAsymmetricSALimits(t *testing.T) {
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{
+		Xfrm:      x,
+		IPTables:  ipt,
+		Limits:    SALimits{TimeHard: time.Hour},
+		OutLimits: &SALimits{TimeSoft: 50 * time.Minute, TimeHard: time.Hour},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ipsec.Flush(false))
+
+	initFakeSALocal(t, ipsec, 1)
+	require.NoError(t, initFakeSARemote(t, ipsec, 1, 0x100))
+	for _, s := range x.states {
+		if s.Src.Equal(fakeLocalIP) {
+			require.Equal(t, uint64(3000), s.Limits.TimeSoft, "outbound")
+		} else {
+			require.Equal(t, uint64(0), s.Limits.TimeSoft, "inbound")
+		}
+		require.Equal(t, uint64(3600), s.Limits.TimeHard)
+	}
+}
+
+func TestSPIConflict(t *testing.T) {
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt})
+	require.NoError(t, err)
+	require.NoError(t, ipsec.Flush(false))
+
+	// An IKE daemon's SA to the same host
+	foreign := &netlink.XfrmState{Src: fakeLocalIP, Dst: fakeRemoteIP, Proto: netlink.XFRM_PROTO_ESP, Spi: 0x100, Reqid: 1, Mark: &netlink.XfrmMark{Value: 0x1, Mask: 0xff}}
+	require.NoError(t, x.StateAdd(foreign))
+
+	err = initFakeSARemote(t, ipsec, 1, 0x100)
+	require.Error(t, err)
+	conflict, ok := errors.Cause(err).(*SPIConflictError)
+	require.True(t, ok, err.Error())
+	require.Equal(t, 1, conflict.State.Reqid)
+	require.True(t, strings.Contains(err.Error(), "not managed by weave"), err.Error())
+
+	// Other SPIs are fine
+	require.NoError(t, initFakeSARemote(t, ipsec, 2, 0x200))
+}
+
+const benchPeers = 1000
+
+// BenchmarkConnectionMemory sets up encryption, both ways, with each of
+// benchPeers peers; B/op over benchPeers is an upper bound on the
+// memory per peer, including that of the fake kernel.
+func BenchmarkConnectionMemory(b *testing.B) {
+	var sessionKey [32]byte
+	params := Params{MsgVersion: MsgVersionTLV, Algorithm: AESGCM}
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		ipsec, err := newIPSec(logrus.New(), Config{Xfrm: NewMemXfrm(), IPTables: netfilter.NewMockIPTables()})
+		require.NoError(b, err)
+		require.NoError(b, ipsec.Flush(false))
+		b.StartTimer()
+		for p := 0; p < benchPeers; p++ {
+			remotePeer := mesh.PeerName(0x100 + p)
+			remoteIP := net.IPv4(10, 1, byte(p>>8), byte(p)).To4()
+			connUID := uint64(p + 1)
+			require.NoError(b, ipsec.InitSALocal(fakeLocalPeer, remotePeer, connUID, fakeLocalIP, remoteIP, 6784, &sessionKey, params,
+				func([]byte) error { return nil }))
+			nonce, err := genNonce()
+			require.NoError(b, err)
+			msg := &msgInitSARemote{nonce, SPI(0x1000 + p), AESGCM, 0}
+			require.NoError(b, ipsec.InitSARemote(msg.serializeTLV(), MsgVersionTLV, fakeLocalPeer, remotePeer, connUID, fakeLocalIP, remoteIP, 6784, &sessionKey, params))
+		}
+	}
+}
+
+func TestSetTrustedSubnets(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("192.168.0.0/16")
+	_, narrowed, _ := net.ParseCIDR("192.168.1.0/24")
+	x, ipt := NewMemXfrm(), netfilter.NewMockIPTables()
+	ipsec, err := newIPSec(logrus.New(), Config{Xfrm: x, IPTables: ipt, StrictIngress: true, TrustedSubnets: []*net.IPNet{trusted}})
+	require.NoError(t, err)
+	require.NoError(t, ipsec.Flush(false))
+	require.NoError(t, ipsec.enforceStrictIngress(make(chan struct{})))
+	require.NoError(t, ipsec.StrictIngressPort(6784))
+
+	// The sources of the policies letting traffic in unencrypted
+	exempt := func() []string {
+		policies, err := x.PolicyList(netlink.FAMILY_V4)
+		require.NoError(t, err)
+		var srcs []string
+		for _, sp := range policies {
+			if sp.Priority == inStrictExemptPolicyPriority && *sp.Mark == *trustedMark.xfrm() {
+				srcs = append(srcs, sp.Src.String())
+			}
+		}
+		return srcs
+	}
+	require.Equal(t, []string{"192.168.0.0/16"}, exempt())
+
+	require.NoError(t, ipsec.SetTrustedSubnets([]*net.IPNet{narrowed}))
+	require.Equal(t, []string{"192.168.1.0/24"}, exempt())
+	require.NoError(t, ipsec.SetTrustedSubnets([]*net.IPNet{narrowed}), "unchanged")
+	require.Equal(t, []string{"192.168.1.0/24"}, exempt())
+	require.NoError(t, ipsec.SetTrustedSubnets(nil))
+	require.Empty(t, exempt())
+}
@@ -0,0 +1,45 @@
+package net
+
+import (
+	"github.com/weaveworks/weave/common"
+)
+
+// DefaultMSSChain is the MSSChain of the default Instance
+const DefaultMSSChain = "WEAVE-MSS"
+
+// ClampMSS makes TCP connections forwarded to or from the bridge of
+// instance negotiate a maximum segment size which fits the path MTU. With
+// encryption, large segments which do not fit once ESP is added would
+// otherwise be dropped wherever ICMP "fragmentation needed" is
+// filtered, so that small packets get through and large transfers
+// hang.
+func ClampMSS(instance Instance) error {
+	ipt, err := newIPTables()
+	if err != nil {
+		return err
+	}
+	c := MSSOwnedChain(instance)
+	if err := common.Chains.Claim(ipt, chainsOwner, c); err != nil {
+		return err
+	}
+	if err := common.Chains.Flush(ipt, c); err != nil {
+		return err
+	}
+	r := MSSRule(instance)
+	return ipt.Append(r.Table, r.Chain, r.Rulespec...)
+}
+
+// MSSOwnedChain is the MSSChain of instance, with the rules jumping to
+// it of the traffic forwarded to or from its bridge
+func MSSOwnedChain(instance Instance) common.OwnedChain {
+	bridgeName := instance.BridgeName()
+	return common.OwnedChain{Table: "mangle", Name: instance.MSSChain(), Jumps: []common.Jump{
+		{From: "FORWARD", Rulespec: []string{"-i", bridgeName}},
+		{From: "FORWARD", Rulespec: []string{"-o", bridgeName}},
+	}}
+}
+
+// MSSRule is the rule in the MSSChain of instance which ClampMSS adds
+func MSSRule(instance Instance) common.Rule {
+	return common.Rule{Table: "mangle", Chain: instance.MSSChain(), Rulespec: []string{"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--clamp-mss-to-pmtu"}}
+}
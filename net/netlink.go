@@ -0,0 +1,77 @@
+package net
+
+import (
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// The package-level functions of the netlink library open, and close,
+// a fresh socket for every request. A netlink.Handle keeps its sockets
+// open, but its requests and replies are not matched up, so it must
+// only be used by one goroutine at a time.
+type netlinkHandle struct {
+	sync.Mutex
+	handle *netlink.Handle
+}
+
+var netlinkHandles = struct {
+	sync.Mutex
+	byNS map[string]*netlinkHandle
+}{byNS: make(map[string]*netlinkHandle)}
+
+// WithNetlinkHandle calls f with a shared netlink handle for the
+// namespace ns, or our own if ns is netns.None(), while no-one else
+// is using that handle.
+func WithNetlinkHandle(ns netns.NsHandle, f func(h *netlink.Handle) error) error {
+	h, err := getNetlinkHandle(ns)
+	if err != nil {
+		return err
+	}
+	h.Lock()
+	defer h.Unlock()
+	return f(h.handle)
+}
+
+// LinkByName looks up the link called name in ns with its shared
+// handle, returning ErrLinkNotFound where there is none.
+func LinkByName(ns netns.NsHandle, name string) (link netlink.Link, err error) {
+	err = WithNetlinkHandle(ns, func(h *netlink.Handle) (err error) {
+		link, err = h.LinkByName(name)
+		return
+	})
+	return link, linkError(err)
+}
+
+func getNetlinkHandle(ns netns.NsHandle) (*netlinkHandle, error) {
+	key := ns.UniqueId()
+	netlinkHandles.Lock()
+	defer netlinkHandles.Unlock()
+	if h, found := netlinkHandles.byNS[key]; found {
+		return h, nil
+	}
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, err
+	}
+	h := &netlinkHandle{handle: handle}
+	netlinkHandles.byNS[key] = h
+	return h, nil
+}
+
+// ReleaseNetlinkHandle closes the shared handle for ns, if there is
+// one. Its sockets keep the namespace alive, so this must be called
+// before ns is meant to go away.
+func ReleaseNetlinkHandle(ns netns.NsHandle) {
+	key := ns.UniqueId()
+	netlinkHandles.Lock()
+	h, found := netlinkHandles.byNS[key]
+	delete(netlinkHandles.byNS, key)
+	netlinkHandles.Unlock()
+	if found {
+		h.Lock()
+		h.handle.Delete()
+		h.Unlock()
+	}
+}
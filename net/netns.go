@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"runtime"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
@@ -13,6 +15,15 @@ import (
 
 var ErrLinkNotFound = errors.New("Link not found")
 
+// linkError returns ErrLinkNotFound for the error the netlink library
+// returns where there is no such link, which has no type of its own
+func linkError(err error) error {
+	if err != nil && err.Error() == ErrLinkNotFound.Error() {
+		return ErrLinkNotFound
+	}
+	return err
+}
+
 // NB: The following function is unsafe, because:
 //     - It changes a network namespace (netns) of an OS thread which runs
 //       the function. During execution, the Go runtime might clone a new OS thread
@@ -48,15 +59,46 @@ func WithNetNSLinkUnsafe(ns netns.NsHandle, ifName string, work func(link netlin
 	return WithNetNSUnsafe(ns, func() error {
 		link, err := netlink.LinkByName(ifName)
 		if err != nil {
-			if err.Error() == errors.New("Link not found").Error() {
-				return ErrLinkNotFound
-			}
-			return err
+			return linkError(err)
 		}
 		return work(link)
 	})
 }
 
+// ExecInNetNS re-executes this program, with the same arguments and
+// environment, in the network namespace at nsPath, unless it is there
+// already. Go gives no way of moving every thread of a running
+// process into another namespace, but exec from a thread which has
+// been moved takes the whole (new) process with it. It only returns
+// on failure, or if there is nothing to do.
+func ExecInNetNS(nsPath string) error {
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return fmt.Errorf("unable to open network namespace %s: %s", nsPath, err)
+	}
+	current, err := netns.Get()
+	if err != nil {
+		ns.Close()
+		return err
+	}
+	inside := ns.Equal(current)
+	current.Close()
+	if inside {
+		ns.Close()
+		return nil
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	err = netns.Set(ns)
+	// The handle is not close-on-exec
+	ns.Close()
+	if err != nil {
+		return fmt.Errorf("unable to enter network namespace %s: %s", nsPath, err)
+	}
+	return syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+}
+
 var WeaveUtilCmd = "weaveutil"
 
 // A safe version of WithNetNS* which creates a process executing
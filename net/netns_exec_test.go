@@ -0,0 +1,53 @@
+// +build netns
+
+package net
+
+// ExecInNetNS re-executing the test binary in another network
+// namespace. It needs root, so only runs with the netns build tag:
+//
+//     sudo go test -tags netns ./net/
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+)
+
+const execNetNSEnv = "WEAVE_TEST_EXEC_NETNS"
+
+// TestExecInNetNSHelper is the process which ExecInNetNS re-executes;
+// it prints the namespace it ends up in
+func TestExecInNetNSHelper(t *testing.T) {
+	nsPath := os.Getenv(execNetNSEnv)
+	if nsPath == "" {
+		return
+	}
+	require.NoError(t, ExecInNetNS(nsPath))
+	current, err := netns.Get()
+	require.NoError(t, err)
+	fmt.Printf("netns=%s\n", current.UniqueId())
+}
+
+func TestExecInNetNSChild(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	require.NoError(t, err)
+	defer orig.Close()
+	ns, err := netns.New()
+	require.NoError(t, err)
+	defer ns.Close()
+	require.NoError(t, netns.Set(orig))
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestExecInNetNSHelper", "-test.v")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=/proc/%d/fd/%d", execNetNSEnv, os.Getpid(), int(ns)))
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	require.True(t, strings.Contains(string(out), "netns="+ns.UniqueId()), string(out))
+}
@@ -0,0 +1,14 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecInNetNS(t *testing.T) {
+	// Already in the namespace, there is nothing to do
+	require.NoError(t, ExecInNetNS("/proc/self/ns/net"))
+
+	require.Error(t, ExecInNetNS("/var/run/netns/weave-test-missing"))
+}
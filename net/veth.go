@@ -4,14 +4,13 @@ import (
 	"fmt"
 	"net"
 	"strings"
-	"syscall"
 	"time"
 
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 
+	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/common/odp"
 )
 
@@ -120,7 +119,7 @@ func AttachContainer(netNSPath, id, ifName, bridgeName string, mtu int, withMult
 	}
 	defer ns.Close()
 
-	ipt, err := iptables.New()
+	ipt, err := newIPTables()
 	if err != nil {
 		return err
 	}
@@ -205,7 +204,7 @@ func DetachContainer(netNSPath, id, ifName string, cidrs []*net.IPNet) error {
 	}
 	defer ns.Close()
 
-	ipt, err := iptables.New()
+	ipt, err := newIPTables()
 	if err != nil {
 		return err
 	}
@@ -273,38 +272,104 @@ func subnets(addrs []netlink.Addr) map[string]struct{} {
 	return subnets
 }
 
-func addNatRule(ipt *iptables.IPTables, rulespec ...string) error {
-	// Loop until we get an exit code other than "temporarily unavailable"
-	for {
-		if err := ipt.AppendUnique("nat", "WEAVE", rulespec...); err != nil {
-			if ierr, ok := err.(*iptables.Error); ok {
-				if status, ok := ierr.ExitError.Sys().(syscall.WaitStatus); ok {
-					// (magic exit code 4 found in iptables source code; undocumented)
-					if status.ExitStatus() == 4 {
-						continue
-					}
-				}
-			}
-			return err
-		}
-		return nil
+// newIPTables returns what this package's rules are managed with;
+// tests replace it with a mock
+var newIPTables = func() (common.IPTablesBackend, error) {
+	ipt, err := common.NewIPTables()
+	if err != nil {
+		return nil, err
 	}
+	return common.WithDryRun(ipt), nil
 }
 
-func ExposeNAT(ipnet net.IPNet) error {
-	ipt, err := iptables.New()
+// chainsOwner is who holds this package's chains in common.Chains
+const chainsOwner = "bridge"
+
+// DefaultNATChain is the NATChain of the default Instance
+const DefaultNATChain = "WEAVE"
+
+// addNatRule adds to b appending rulespec to chain, unless it is there
+func addNatRule(ipt common.IPTablesBackend, b *common.Batch, chain string, rulespec ...string) error {
+	exists, err := ipt.Exists("nat", chain, rulespec...)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		b.Append("nat", chain, rulespec...)
+	}
+	return nil
+}
+
+func ExposeNAT(chain string, ipnet net.IPNet) error {
+	ipt, err := newIPTables()
 	if err != nil {
 		return err
 	}
 	cidr := ipnet.String()
-	if err := addNatRule(ipt, "-s", cidr, "-d", "224.0.0.0/4", "-j", "RETURN"); err != nil {
+	var b common.Batch
+	if err := addNatRule(ipt, &b, chain, "-s", cidr, "-d", "224.0.0.0/4", "-j", "RETURN"); err != nil {
 		return err
 	}
-	if err := addNatRule(ipt, "-d", cidr, "!", "-s", cidr, "-j", "MASQUERADE"); err != nil {
+	if err := addNatRule(ipt, &b, chain, "-d", cidr, "!", "-s", cidr, "-j", "MASQUERADE"); err != nil {
 		return err
 	}
-	if err := addNatRule(ipt, "-s", cidr, "!", "-d", cidr, "-j", "MASQUERADE"); err != nil {
+	if err := addNatRule(ipt, &b, chain, "-s", cidr, "!", "-d", cidr, "-j", "MASQUERADE"); err != nil {
 		return err
 	}
-	return nil
+	return common.ApplyBatch(ipt, &b)
+}
+
+// DefaultServicesChain is the ServicesChain of the default Instance
+const DefaultServicesChain = "WEAVE-SERVICES"
+
+// ExcludeServiceCIDR stops traffic from containers to ipnet, the
+// range of Kubernetes ClusterIPs, leaving the host untranslated, e.g.
+// before kube-proxy has programmed a new service. Such traffic would
+// otherwise be masqueraded and sent, unencrypted, to the host's
+// default gateway. Translated traffic is unaffected, since by then
+// its destination is the service's endpoint.
+func ExcludeServiceCIDR(instance Instance, ipnet net.IPNet) error {
+	ipt, err := newIPTables()
+	if err != nil {
+		return err
+	}
+	c := ServicesOwnedChain(instance)
+	if err := common.Chains.Claim(ipt, chainsOwner, c); err != nil {
+		return err
+	}
+	var b common.Batch
+	for _, r := range ServiceCIDRRules(instance, ipnet) {
+		switch r.Chain {
+		case instance.ServicesChain():
+			b.ClearChain(r.Table, r.Chain)
+			b.Append(r.Table, r.Chain, r.Rulespec...)
+		case instance.NATChain():
+			exists, err := ipt.Exists(r.Table, r.Chain, r.Rulespec...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				b.Insert(r.Table, r.Chain, 1, r.Rulespec...)
+			}
+		}
+	}
+	return common.ApplyBatch(ipt, &b)
+}
+
+// ServicesOwnedChain is the ServicesChain of instance, with the rule
+// jumping to it, above any other, of the traffic from its bridge
+func ServicesOwnedChain(instance Instance) common.OwnedChain {
+	return common.OwnedChain{Table: "filter", Name: instance.ServicesChain(), Jumps: []common.Jump{
+		{From: "FORWARD", Rulespec: []string{"-i", instance.BridgeName()}, Position: common.Top},
+	}}
+}
+
+// ServiceCIDRRules are the rules ExcludeServiceCIDR adds, other than
+// that jumping to the ServicesChain of instance
+func ServiceCIDRRules(instance Instance, ipnet net.IPNet) []common.Rule {
+	cidr := ipnet.String()
+	return []common.Rule{
+		{Table: "nat", Chain: instance.NATChain(), Rulespec: []string{"-d", cidr, "-j", "RETURN"}, Insert: true},
+		{Table: "filter", Chain: instance.ServicesChain(), Rulespec: []string{"-d", cidr, "-j", "REJECT"}},
+	}
 }
@@ -0,0 +1,48 @@
+package net
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func withMockIPTables() *netfilter.MockIPTables {
+	ipt := netfilter.NewMockIPTables()
+	newIPTables = func() (common.IPTablesBackend, error) { return ipt, nil }
+	return ipt
+}
+
+func TestExposeNAT(t *testing.T) {
+	ipt := withMockIPTables()
+	require.NoError(t, ipt.NewChain("nat", DefaultNATChain))
+	_, cidr, _ := net.ParseCIDR("10.32.0.0/12")
+
+	expected := []string{
+		"-s 10.32.0.0/12 -d 224.0.0.0/4 -j RETURN",
+		"-d 10.32.0.0/12 ! -s 10.32.0.0/12 -j MASQUERADE",
+		"-s 10.32.0.0/12 ! -d 10.32.0.0/12 -j MASQUERADE",
+	}
+	require.NoError(t, ExposeNAT(DefaultNATChain, *cidr))
+	require.Equal(t, expected, ipt.Chains["nat "+DefaultNATChain])
+	// Exposing again adds nothing
+	require.NoError(t, ExposeNAT(DefaultNATChain, *cidr))
+	require.Equal(t, expected, ipt.Chains["nat "+DefaultNATChain])
+}
+
+func TestExcludeServiceCIDR(t *testing.T) {
+	ipt := withMockIPTables()
+	require.NoError(t, ipt.NewChain("nat", DefaultNATChain))
+	require.NoError(t, ipt.Append("nat", DefaultNATChain, "-j", "MASQUERADE"))
+	_, cidr, _ := net.ParseCIDR("10.96.0.0/12")
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, ExcludeServiceCIDR("", *cidr))
+		require.Equal(t, []string{"-d 10.96.0.0/12 -j RETURN", "-j MASQUERADE"}, ipt.Chains["nat "+DefaultNATChain])
+		require.Equal(t, []string{"-d 10.96.0.0/12 -j REJECT"}, ipt.Chains["filter "+DefaultServicesChain])
+		require.Equal(t, []string{"-i weave -j " + DefaultServicesChain}, ipt.Chains["filter FORWARD"])
+	}
+}
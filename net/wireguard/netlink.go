@@ -0,0 +1,180 @@
+package wireguard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// The netlink library doesn't speak generic netlink, nor WireGuard's
+// family of it, so the requests are made here; the numbers are those
+// of linux/genetlink.h and linux/wireguard.h.
+const (
+	genlIDCtrl               = 0x10
+	ctrlCmdGetFamily         = 3
+	ctrlAttrFamilyID         = 1
+	ctrlAttrFamilyName       = 2
+	familyName               = "wireguard"
+	familyVersion            = 1
+	nlaFNested               = 0x8000
+	wgCmdSetDevice           = 1
+	wgDeviceAIfname          = 2
+	wgDeviceAPrivateKey      = 3
+	wgDeviceAFlags           = 5
+	wgDeviceAListenPort      = 6
+	wgDeviceAPeers           = 8
+	wgDeviceFReplacePeers    = 1
+	wgPeerAPublicKey         = 1
+	wgPeerAPresharedKey      = 2
+	wgPeerAFlags             = 3
+	wgPeerAEndpoint          = 4
+	wgPeerAAllowedIPs        = 9
+	wgPeerFRemoveMe          = 1
+	wgPeerFReplaceAllowedIPs = 2
+	wgAllowedIPAFamily       = 1
+	wgAllowedIPAIPAddr       = 2
+	wgAllowedIPACIDRMask     = 3
+)
+
+// device is what to set of the WireGuard device
+type device struct {
+	privateKey   *Key // unchanged if nil
+	port         int  // unchanged if 0
+	replacePeers bool // remove the peers not in peers
+	peers        []devicePeer
+}
+
+// devicePeer is what to set of a peer of the device, identified by
+// its public key
+type devicePeer struct {
+	key          Key
+	remove       bool
+	presharedKey *Key
+	endpoint     *net.UDPAddr
+	allowedIPs   []net.IPNet // replace those of the peer
+}
+
+// genlMsg is the header of generic netlink messages
+type genlMsg struct {
+	cmd     uint8
+	version uint8
+}
+
+func (m *genlMsg) Len() int {
+	return 4
+}
+
+func (m *genlMsg) Serialize() []byte {
+	return []byte{m.cmd, m.version, 0, 0}
+}
+
+var (
+	familyLock sync.Mutex
+	familyID   uint16 // 0 until looked up
+)
+
+// family returns the ID of WireGuard's generic netlink family, which
+// the kernel assigns once the module is loaded
+func family() (uint16, error) {
+	familyLock.Lock()
+	defer familyLock.Unlock()
+	if familyID != 0 {
+		return familyID, nil
+	}
+
+	req := nl.NewNetlinkRequest(genlIDCtrl, 0)
+	req.AddData(&genlMsg{cmd: ctrlCmdGetFamily, version: 1})
+	req.AddData(nl.NewRtAttr(ctrlAttrFamilyName, nl.ZeroTerminated(familyName)))
+	msgs, err := req.Execute(syscall.NETLINK_GENERIC, genlIDCtrl)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range msgs {
+		if len(m) < 4 {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[4:])
+		if err != nil {
+			return 0, err
+		}
+		for _, a := range attrs {
+			if a.Attr.Type == ctrlAttrFamilyID && len(a.Value) >= 2 {
+				familyID = nl.NativeEndian().Uint16(a.Value)
+				return familyID, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no generic netlink family %s", familyName)
+}
+
+// setDevice sets d of the device named name
+func setDevice(name string, d device) error {
+	id, err := family()
+	if err != nil {
+		return err
+	}
+	req := nl.NewNetlinkRequest(int(id), syscall.NLM_F_ACK)
+	req.AddData(&genlMsg{cmd: wgCmdSetDevice, version: familyVersion})
+	for _, a := range d.attrs(name) {
+		req.AddData(a)
+	}
+	_, err = req.Execute(syscall.NETLINK_GENERIC, 0)
+	return err
+}
+
+// attrs returns the attributes of the request setting d of the device
+// named name
+func (d device) attrs(name string) []*nl.RtAttr {
+	attrs := []*nl.RtAttr{nl.NewRtAttr(wgDeviceAIfname, nl.ZeroTerminated(name))}
+	if d.privateKey != nil {
+		attrs = append(attrs, nl.NewRtAttr(wgDeviceAPrivateKey, d.privateKey[:]))
+	}
+	if d.port != 0 {
+		attrs = append(attrs, nl.NewRtAttr(wgDeviceAListenPort, nl.Uint16Attr(uint16(d.port))))
+	}
+	if d.replacePeers {
+		attrs = append(attrs, nl.NewRtAttr(wgDeviceAFlags, nl.Uint32Attr(wgDeviceFReplacePeers)))
+	}
+	if len(d.peers) > 0 {
+		peers := nl.NewRtAttr(wgDeviceAPeers|nlaFNested, nil)
+		for i, p := range d.peers {
+			peer := nl.NewRtAttrChild(peers, i|nlaFNested, nil)
+			nl.NewRtAttrChild(peer, wgPeerAPublicKey, p.key[:])
+			if p.remove {
+				nl.NewRtAttrChild(peer, wgPeerAFlags, nl.Uint32Attr(wgPeerFRemoveMe))
+				continue
+			}
+			if p.presharedKey != nil {
+				nl.NewRtAttrChild(peer, wgPeerAPresharedKey, p.presharedKey[:])
+			}
+			if p.endpoint != nil {
+				nl.NewRtAttrChild(peer, wgPeerAEndpoint, sockaddrIn(p.endpoint))
+			}
+			nl.NewRtAttrChild(peer, wgPeerAFlags, nl.Uint32Attr(wgPeerFReplaceAllowedIPs))
+			allowedIPs := nl.NewRtAttrChild(peer, wgPeerAAllowedIPs|nlaFNested, nil)
+			for j, ipnet := range p.allowedIPs {
+				ones, _ := ipnet.Mask.Size()
+				allowedIP := nl.NewRtAttrChild(allowedIPs, j|nlaFNested, nil)
+				nl.NewRtAttrChild(allowedIP, wgAllowedIPAFamily, nl.Uint16Attr(syscall.AF_INET))
+				nl.NewRtAttrChild(allowedIP, wgAllowedIPAIPAddr, ipnet.IP.To4())
+				nl.NewRtAttrChild(allowedIP, wgAllowedIPACIDRMask, []byte{uint8(ones)})
+			}
+		}
+		attrs = append(attrs, peers)
+	}
+	return attrs
+}
+
+// sockaddrIn returns addr as a struct sockaddr_in, as WireGuard takes
+// endpoints
+func sockaddrIn(addr *net.UDPAddr) []byte {
+	b := make([]byte, syscall.SizeofSockaddrInet4)
+	nl.NativeEndian().PutUint16(b, syscall.AF_INET)
+	binary.BigEndian.PutUint16(b[2:], uint16(addr.Port))
+	copy(b[4:8], addr.IP.To4())
+	return b
+}
@@ -0,0 +1,37 @@
+package wireguard
+
+import (
+	"github.com/weaveworks/weave/common"
+)
+
+// StartReconciler starts putting back, every ReconcileInterval until
+// the WireGuard is flushed with destroy, the chains and rules marking
+// the traffic to encrypt and dropping that arriving unencrypted which
+// have gone, e.g. flushed by firewalld reloading or docker restarting;
+// without them, what we send to peers bypasses the device, and goes in
+// the clear, and what they appear to send unencrypted is let in. Does
+// nothing if ReconcileInterval is zero.
+func (wg *WireGuard) StartReconciler() {
+	if wg.reconcileInterval == 0 {
+		return
+	}
+	go wg.reconciler.Run(wg.reconcileInterval, wg.stop, func(repaired []common.Rule, err error) {
+		if err != nil {
+			wg.log.Warnf("wireguard: putting back iptables rules failed: %s", err)
+			return
+		}
+		for _, r := range repaired {
+			wg.log.Warnf("wireguard: put back missing or misplaced iptables rule %s", r)
+		}
+	})
+}
+
+// Report returns the rules marking the traffic to encrypt, and dropping
+// that arriving unencrypted, which the WireGuard keeps in place, each
+// with the peer it is for; none if wg is nil
+func (wg *WireGuard) Report() []common.ReportedRule {
+	if wg == nil {
+		return nil
+	}
+	return wg.reconciler.Report(chainsOwner)
+}
@@ -0,0 +1,483 @@
+// Package wireguard encrypts fast datapath traffic with WireGuard, as
+// an alternative to IPsec, for kernels which have it built in (5.6 and
+// later).
+//
+// Each peer has a WireGuard device, with a key pair generated at
+// startup, whose public key it advertises in its connection features.
+// The VXLAN traffic to each peer connected with encryption is marked,
+// and routed by its mark into the device, which encrypts it to the
+// peer's key, with a preshared key derived from the connection's
+// session key, so that only peers which know the password can talk
+// to each other, and sends it to the peer's WireGuard port.
+package wireguard
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/net/ipsec"
+)
+
+const (
+	// PublicKeyFeature is the connection feature of peers encrypting
+	// with WireGuard, whose value is their public key
+	PublicKeyFeature = "WireGuardPublicKey"
+	// PortFeature is the connection feature of peers encrypting with
+	// WireGuard, whose value is the UDP port it receives on
+	PortFeature = "WireGuardPort"
+
+	// DefaultPort is the UDP port WireGuard receives on
+	DefaultPort = 51820
+	// DeviceName is the name of the WireGuard device
+	DeviceName = "weave-wg"
+	// DeviceMTU fits VXLAN frames of the largest overlay MTU which
+	// fits, once encrypted, in links with an MTU of 1500
+	DeviceMTU = 1500 - Overhead
+	// Overhead is how many bytes WireGuard adds to each packet: the
+	// outer IPv4 and UDP headers, its own header, and the tag
+	Overhead = 20 + 8 + 16 + 16
+
+	// The routing table into which marked traffic is routed, to the
+	// device, and the priority of the rule doing that
+	routeTable   = 0x7767 // "wg"
+	rulePriority = 0x7767
+
+	tableMangle   = "mangle"
+	tableFilter   = "filter"
+	chainOut      = "WEAVE-WG-OUT"
+	chainIn       = "WEAVE-WG-IN"
+	ruleTagPrefix = "weave-wireguard:"
+
+	// chainsOwner is who holds the chain of a WireGuard in common.Chains
+	chainsOwner = "wireguard"
+)
+
+// instanceChain returns the chain of the rules marking the traffic to
+// encrypt of the weave network instance; chainOut for the default,
+// unnamed, one
+func instanceChain(instance string) common.OwnedChain {
+	name := chainOut
+	if instance != "" {
+		name = "WEAVE-WG-" + strings.ToUpper(instance) + "-OUT"
+	}
+	return common.OwnedChain{Table: tableMangle, Name: name, Jumps: []common.Jump{{From: "OUTPUT"}}}
+}
+
+// instanceInChain returns the chain of the rules dropping the traffic
+// of peers which arrives without having been decrypted by the device,
+// as instanceChain. It is jumped to from the top of INPUT, so that no
+// rule accepting the data port lets that in first.
+func instanceInChain(instance string) common.OwnedChain {
+	name := chainIn
+	if instance != "" {
+		name = "WEAVE-WG-" + strings.ToUpper(instance) + "-IN"
+	}
+	return common.OwnedChain{Table: tableFilter, Name: name, Jumps: []common.Jump{{From: "INPUT", Position: common.Top}}}
+}
+
+// Key is a Curve25519 private, public or preshared key
+type Key [32]byte
+
+// GenerateKey returns a new private key
+func GenerateKey() (Key, error) {
+	var key Key
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return Key{}, err
+	}
+	// As RFC 7748 has it
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+	return key, nil
+}
+
+// PublicKey returns the public key of the private key k
+func (k Key) PublicKey() Key {
+	var pub [32]byte
+	priv := [32]byte(k)
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return Key(pub)
+}
+
+// String returns k in base64, as the wg tool shows it
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParseKey parses a key in base64
+func ParseKey(s string) (Key, error) {
+	var key Key
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != len(key) {
+		return Key{}, fmt.Errorf("invalid WireGuard key %q", s)
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// Remote is what a remote peer advertises of its WireGuard device in
+// its connection features
+type Remote struct {
+	Key  Key // public
+	Port int
+}
+
+// ParseRemote returns what the remote peer advertises in its
+// connection features, if it encrypts with WireGuard
+func ParseRemote(features map[string]string) (Remote, bool, error) {
+	s, found := features[PublicKeyFeature]
+	if !found {
+		return Remote{}, false, nil
+	}
+	key, err := ParseKey(s)
+	if err != nil {
+		return Remote{}, true, err
+	}
+	port, err := strconv.Atoi(features[PortFeature])
+	if err != nil || port <= 0 || port > 65535 {
+		return Remote{}, true, fmt.Errorf("invalid WireGuard port %q", features[PortFeature])
+	}
+	return Remote{key, port}, true, nil
+}
+
+// presharedKey derives the preshared key of a connection from its
+// session key, which both peers share, so that without the password
+// no peer can talk to them even knowing their public keys
+func presharedKey(sessionKey *[32]byte) (Key, error) {
+	var key Key
+	kdf := hkdf.New(sha256.New, sessionKey[:], nil, []byte("weave wireguard"))
+	if _, err := io.ReadFull(kdf, key[:]); err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
+
+// Config holds the settings for WireGuard
+type Config struct {
+	Port int        // UDP port to receive on; DefaultPort if 0
+	Mark ipsec.Mark // of the traffic to encrypt; ipsec.DefaultMark if zero
+	// Use it rather than iptables if not nil, e.g. in tests
+	IPTables common.IPTablesBackend
+	// How often to put back the chain and rules which have gone, e.g.
+	// flushed by firewalld reloading; never if zero
+	ReconcileInterval time.Duration
+	// Name of the weave network, of several on the host, whose chain
+	// this is; that of the default one if empty
+	Instance string
+}
+
+// peer is the connection to a remote peer the device is set up for
+type peer struct {
+	connUID  uint64
+	key      Key
+	localIP  net.IP
+	remoteIP net.IP
+	udpPort  int
+}
+
+// WireGuard sets up the WireGuard device, and the peers of it of the
+// connections encrypted with it
+type WireGuard struct {
+	sync.Mutex
+	log        *logrus.Logger
+	ipt        common.IPTablesBackend
+	privateKey Key
+	port       int
+	mark       ipsec.Mark
+	chain      common.OwnedChain // marking outbound traffic
+	inChain    common.OwnedChain // dropping unencrypted inbound traffic
+	peers      map[mesh.PeerName]peer
+
+	reconciler        *common.Reconciler
+	reconcileInterval time.Duration
+	stop              chan struct{} // closed to stop the reconciler
+}
+
+// New returns a WireGuard with a fresh key pair, and sets up its
+// device, replacing any left behind by a previous run
+func New(log *logrus.Logger, config Config) (*WireGuard, error) {
+	var err error
+	if config.IPTables == nil {
+		if config.IPTables, err = common.NewIPTablesBackend(iptables.ProtocolIPv4); err != nil {
+			return nil, errors.Wrap(err, "iptables new")
+		}
+	}
+	wg := &WireGuard{
+		log:     log,
+		ipt:     config.IPTables,
+		port:    config.Port,
+		mark:    config.Mark,
+		chain:   instanceChain(config.Instance),
+		inChain: instanceInChain(config.Instance),
+		peers:   make(map[mesh.PeerName]peer),
+
+		reconciler:        common.NewReconciler(config.IPTables),
+		reconcileInterval: config.ReconcileInterval,
+		stop:              make(chan struct{}),
+	}
+	if wg.port == 0 {
+		wg.port = DefaultPort
+	}
+	if wg.mark == (ipsec.Mark{}) {
+		wg.mark = ipsec.DefaultMark
+	}
+
+	if wg.privateKey, err = GenerateKey(); err != nil {
+		return nil, errors.Wrap(err, "generate key")
+	}
+	if err := wg.setupDevice(); err != nil {
+		return nil, err
+	}
+	return wg, nil
+}
+
+// setupDevice creates the device, with no peers, and routes the
+// marked traffic into it
+func (wg *WireGuard) setupDevice() error {
+	link, err := netlink.LinkByName(DeviceName)
+	if err != nil {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = DeviceName
+		attrs.MTU = DeviceMTU
+		if err := netlink.LinkAdd(&netlink.GenericLink{LinkAttrs: attrs, LinkType: "wireguard"}); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("create %s; does the kernel have WireGuard (5.6 or later)?", DeviceName))
+		}
+		if link, err = netlink.LinkByName(DeviceName); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("find %s", DeviceName))
+		}
+	}
+	if err := setDevice(DeviceName, device{privateKey: &wg.privateKey, port: wg.port, replacePeers: true}); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("configure %s", DeviceName))
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("set %s up", DeviceName))
+	}
+	// What the device decrypts comes from the peer's address, which is
+	// routed over another interface
+	if err := sysctl(fmt.Sprintf("net/ipv4/conf/%s/rp_filter", DeviceName), "2"); err != nil {
+		return errors.Wrap(err, "loosen rp_filter")
+	}
+
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		Table:     routeTable,
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return errors.Wrap(err, "route to device")
+	}
+	if err := netlink.RuleAdd(wg.rule()); err != nil && !os.IsExist(err) {
+		return errors.Wrap(err, "rule routing marked traffic")
+	}
+
+	return wg.resetChain()
+}
+
+func (wg *WireGuard) rule() *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = syscall.AF_INET
+	rule.Priority = rulePriority
+	rule.Mark = int(wg.mark.Value)
+	rule.Mask = int(wg.mark.Mask)
+	rule.Table = routeTable
+	return rule
+}
+
+// resetChain creates, or empties, the chains of the rules marking the
+// traffic to encrypt and dropping that which arrives unencrypted, and
+// jumps to them
+func (wg *WireGuard) resetChain() error {
+	wg.reconciler.Reset()
+	for _, c := range []common.OwnedChain{wg.chain, wg.inChain} {
+		wg.reconciler.WantOwned(c)
+		if err := common.Chains.Claim(wg.ipt, chainsOwner, c); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("iptables claim chain (%s, %s)", c.Table, c.Name))
+		}
+		if err := common.Chains.Flush(wg.ipt, c); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("iptables clear (%s, %s)", c.Table, c.Name))
+		}
+	}
+	return nil
+}
+
+// AddFeaturesTo adds our public key and port to the connection
+// features
+func (wg *WireGuard) AddFeaturesTo(features map[string]string) {
+	features[PublicKeyFeature] = wg.privateKey.PublicKey().String()
+	features[PortFeature] = strconv.Itoa(wg.port)
+}
+
+// InitPeer sets up the device to encrypt the traffic of the connection
+// connUID to remotePeer, at remoteIP, with the device it advertised in
+// remote, and to accept what the peer sends encrypted. It replaces
+// what was set up for any previous connection to the peer.
+func (wg *WireGuard) InitPeer(remotePeer mesh.PeerName, connUID uint64, localIP, remoteIP net.IP, udpPort int, remote Remote, sessionKey *[32]byte) error {
+	psk, err := presharedKey(sessionKey)
+	if err != nil {
+		return errors.Wrap(err, "derive preshared key")
+	}
+
+	wg.Lock()
+	defer wg.Unlock()
+
+	if old, found := wg.peers[remotePeer]; found {
+		if err := wg.delPeer(remotePeer, old); err != nil {
+			wg.log.Warnf("wireguard: removing previous connection to %s: %s", remotePeer, err)
+		}
+	}
+
+	p := peer{connUID: connUID, key: remote.Key, localIP: localIP, remoteIP: remoteIP, udpPort: udpPort}
+	err = setDevice(DeviceName, device{peers: []devicePeer{{
+		key:          remote.Key,
+		presharedKey: &psk,
+		endpoint:     &net.UDPAddr{IP: remoteIP, Port: remote.Port},
+		allowedIPs:   []net.IPNet{{IP: remoteIP.To4(), Mask: net.CIDRMask(32, 32)}},
+	}}})
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("add peer %s", remotePeer))
+	}
+	if err := wg.addRules(remotePeer, p); err != nil {
+		return err
+	}
+	wg.peers[remotePeer] = p
+	return nil
+}
+
+// peerRules returns the rules of p: marking its outbound traffic and
+// dropping its inbound traffic which is not decrypted
+func (wg *WireGuard) peerRules(remotePeer mesh.PeerName, p peer) []common.Rule {
+	return []common.Rule{
+		{Table: tableMangle, Chain: wg.chain.Name, Rulespec: ruleMarkOutbound(p, remotePeer, wg.mark), Peer: remotePeer.String()},
+		{Table: tableFilter, Chain: wg.inChain.Name, Rulespec: ruleDropInbound(p, remotePeer), Peer: remotePeer.String()},
+	}
+}
+
+// addRules adds the rules of p, and has them put back if they go
+func (wg *WireGuard) addRules(remotePeer mesh.PeerName, p peer) error {
+	for _, r := range wg.peerRules(remotePeer, p) {
+		if err := wg.ipt.AppendUnique(r.Table, r.Chain, r.Rulespec...); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("iptables append (%s, %s)", r.Table, r.Chain))
+		}
+		wg.reconciler.Want(r)
+	}
+	return nil
+}
+
+// delRules deletes the rules of p, which are no longer put back
+func (wg *WireGuard) delRules(remotePeer mesh.PeerName, p peer) {
+	for _, r := range wg.peerRules(remotePeer, p) {
+		wg.reconciler.Unwant(r)
+		if err := wg.ipt.Delete(r.Table, r.Chain, r.Rulespec...); err != nil {
+			wg.log.Warnf("wireguard: iptables delete (%s, %s) of %s: %s", r.Table, r.Chain, remotePeer, err)
+		}
+	}
+}
+
+// Destroy removes what InitPeer set up for the connection connUID to
+// remotePeer, unless a newer connection to it has replaced that
+func (wg *WireGuard) Destroy(remotePeer mesh.PeerName, connUID uint64) error {
+	wg.Lock()
+	defer wg.Unlock()
+	p, found := wg.peers[remotePeer]
+	if !found || p.connUID != connUID {
+		return nil
+	}
+	delete(wg.peers, remotePeer)
+	return wg.delPeer(remotePeer, p)
+}
+
+func (wg *WireGuard) delPeer(remotePeer mesh.PeerName, p peer) error {
+	wg.delRules(remotePeer, p)
+	if err := setDevice(DeviceName, device{peers: []devicePeer{{key: p.key, remove: true}}}); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("remove peer %s", remotePeer))
+	}
+	return nil
+}
+
+// Flush removes all peers, and with destroy, the device, rule, route
+// and chains as well
+func (wg *WireGuard) Flush(destroy bool) error {
+	wg.Lock()
+	defer wg.Unlock()
+	wg.peers = make(map[mesh.PeerName]peer)
+
+	if !destroy {
+		if err := setDevice(DeviceName, device{replacePeers: true}); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("remove peers of %s", DeviceName))
+		}
+		return wg.resetChain()
+	}
+
+	wg.reconciler.Reset()
+	select {
+	case <-wg.stop:
+	default:
+		close(wg.stop)
+	}
+	for _, c := range []common.OwnedChain{wg.chain, wg.inChain} {
+		if err := common.Chains.Release(wg.ipt, chainsOwner, c); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("iptables release chain (%s, %s)", c.Table, c.Name))
+		}
+	}
+	if err := netlink.RuleDel(wg.rule()); err != nil && err != syscall.ENOENT {
+		return errors.Wrap(err, "delete rule")
+	}
+	// Deleting it removes its routes
+	if link, err := netlink.LinkByName(DeviceName); err == nil {
+		if err := netlink.LinkDel(link); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("delete %s", DeviceName))
+		}
+	}
+	return nil
+}
+
+// ruleMarkOutbound returns the rule marking the VXLAN traffic of p,
+// so that it is routed into the device, unless it opted out of
+// encryption
+func ruleMarkOutbound(p peer, remotePeer mesh.PeerName, mark ipsec.Mark) []string {
+	return []string{
+		"-s", p.localIP.String(), "-d", p.remoteIP.String(),
+		"-p", "udp", "--dport", strconv.Itoa(p.udpPort),
+		"-m", "mark", "!", "--mark", ipsec.ExemptMarkStr,
+		"-m", "comment", "--comment", ruleTagPrefix + remotePeer.String(),
+		"-j", "MARK", "--set-xmark", mark.String(),
+	}
+}
+
+// ruleDropInbound returns the rule dropping the VXLAN traffic from p
+// which did not come through the device, i.e. was sent unencrypted,
+// e.g. spoofed by another host on the path
+func ruleDropInbound(p peer, remotePeer mesh.PeerName) []string {
+	return []string{
+		"-s", p.remoteIP.String(),
+		"-p", "udp", "--dport", strconv.Itoa(p.udpPort),
+		"!", "-i", DeviceName,
+		"-m", "comment", "--comment", ruleTagPrefix + remotePeer.String(),
+		"-j", "DROP",
+	}
+}
+
+func sysctl(variable, value string) error {
+	return ioutil.WriteFile("/proc/sys/"+variable, []byte(value), 0644)
+}
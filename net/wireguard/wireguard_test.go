@@ -0,0 +1,147 @@
+package wireguard
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/net/ipsec"
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func TestKeys(t *testing.T) {
+	a, err := GenerateKey()
+	require.NoError(t, err)
+	b, err := GenerateKey()
+	require.NoError(t, err)
+	require.NotEqual(t, a, b)
+	require.Equal(t, a.PublicKey(), a.PublicKey())
+	require.NotEqual(t, a.PublicKey(), b.PublicKey())
+
+	parsed, err := ParseKey(a.PublicKey().String())
+	require.NoError(t, err)
+	require.Equal(t, a.PublicKey(), parsed)
+	_, err = ParseKey("c2hvcnQ=")
+	require.Error(t, err)
+}
+
+func TestParseRemote(t *testing.T) {
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	wg := &WireGuard{privateKey: key, port: 51821}
+	features := make(map[string]string)
+	wg.AddFeaturesTo(features)
+
+	remote, found, err := ParseRemote(features)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, Remote{key.PublicKey(), 51821}, remote)
+
+	_, found, err = ParseRemote(map[string]string{})
+	require.NoError(t, err)
+	require.False(t, found)
+
+	features[PortFeature] = "0"
+	_, found, err = ParseRemote(features)
+	require.Error(t, err)
+}
+
+func TestPresharedKey(t *testing.T) {
+	var sessionKey, other [32]byte
+	other[0] = 1
+	psk, err := presharedKey(&sessionKey)
+	require.NoError(t, err)
+	again, err := presharedKey(&sessionKey)
+	require.NoError(t, err)
+	require.Equal(t, psk, again, "the same on both peers")
+	different, err := presharedKey(&other)
+	require.NoError(t, err)
+	require.NotEqual(t, psk, different)
+	require.NotEqual(t, Key(sessionKey), psk)
+}
+
+func TestDeviceAttrs(t *testing.T) {
+	var key Key
+	key[0] = 0xaa
+	d := device{peers: []devicePeer{{
+		key:        key,
+		endpoint:   &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 51820},
+		allowedIPs: []net.IPNet{{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(32, 32)}},
+	}}}
+	attrs := d.attrs(DeviceName)
+	require.Len(t, attrs, 2)
+
+	peers, err := nl.ParseRouteAttr(attrs[1].Serialize()[syscall.SizeofRtAttr:])
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	peer, err := nl.ParseRouteAttr(peers[0].Value)
+	require.NoError(t, err)
+	values := make(map[uint16][]byte)
+	for _, a := range peer {
+		values[a.Attr.Type&^nlaFNested] = a.Value
+	}
+	require.Equal(t, key[:], values[wgPeerAPublicKey])
+	endpoint := values[wgPeerAEndpoint]
+	require.Equal(t, uint16(syscall.AF_INET), nl.NativeEndian().Uint16(endpoint))
+	require.Equal(t, []byte{0xca, 0x6c}, endpoint[2:4], "port in network order")
+	require.Equal(t, []byte{10, 0, 0, 2}, endpoint[4:8])
+	require.Contains(t, values, uint16(wgPeerAAllowedIPs))
+
+	removal := device{peers: []devicePeer{{key: key, remove: true}}}.attrs(DeviceName)
+	peers, err = nl.ParseRouteAttr(removal[1].Serialize()[syscall.SizeofRtAttr:])
+	require.NoError(t, err)
+	peer, err = nl.ParseRouteAttr(peers[0].Value)
+	require.NoError(t, err)
+	require.Len(t, peer, 2, "only the key and flags")
+}
+
+func TestPeerRules(t *testing.T) {
+	ipt := netfilter.NewMockIPTables()
+	wg := &WireGuard{
+		log:        logrus.New(),
+		ipt:        ipt,
+		mark:       ipsec.DefaultMark,
+		chain:      instanceChain(""),
+		inChain:    instanceInChain(""),
+		reconciler: common.NewReconciler(ipt),
+	}
+	require.NoError(t, wg.resetChain())
+	require.Equal(t, []string{"-j " + chainIn}, ipt.Chains["filter INPUT"])
+	require.Equal(t, []string{"-j " + chainOut}, ipt.Chains["mangle OUTPUT"])
+
+	var remotePeer mesh.PeerName = 0x1234
+	p := peer{localIP: net.ParseIP("10.0.0.1"), remoteIP: net.ParseIP("10.0.0.2"), udpPort: 6784}
+	require.NoError(t, wg.addRules(remotePeer, p))
+	require.Len(t, ipt.Chains["mangle "+chainOut], 1)
+	drop := ipt.Chains["filter "+chainIn]
+	require.Len(t, drop, 1)
+	require.True(t, strings.HasPrefix(drop[0], "-s 10.0.0.2 -p udp --dport 6784 ! -i "+DeviceName+" "), drop[0])
+	require.True(t, strings.HasSuffix(drop[0], " -j DROP"), drop[0])
+
+	// As by a firewall reload
+	ipt.Chains["filter INPUT"] = nil
+	ipt.Chains["filter "+chainIn] = nil
+	repaired, err := wg.reconciler.Reconcile()
+	require.NoError(t, err)
+	require.Len(t, repaired, 2)
+	require.Equal(t, []string{"-j " + chainIn}, ipt.Chains["filter INPUT"])
+	require.Equal(t, drop, ipt.Chains["filter "+chainIn])
+
+	// Nor are the rules of a removed peer put back
+	wg.delRules(remotePeer, p)
+	require.Empty(t, ipt.Chains["mangle "+chainOut])
+	require.Empty(t, ipt.Chains["filter "+chainIn])
+	repaired, err = wg.reconciler.Reconcile()
+	require.NoError(t, err)
+	require.Empty(t, repaired)
+	require.Empty(t, ipt.Chains["filter "+chainIn])
+
+	require.Equal(t, "WEAVE-WG-NET2-IN", instanceInChain("net2").Name)
+}
@@ -112,3 +112,28 @@ func withNormalisedProtoAndPort(npps []extnapi.NetworkPolicyPort, f func(proto,
 		f(proto, port)
 	}
 }
+
+// unsupportedPolicyFeatures lists the parts of policy which we cannot
+// enforce as written, so the user can be told that enforcement of the
+// policy is only partial.
+func unsupportedPolicyFeatures(policy *extnapi.NetworkPolicy) []string {
+	var unsupported []string
+	for i, ingressRule := range policy.Spec.Ingress {
+		for j, peer := range ingressRule.From {
+			if peer.PodSelector != nil && peer.NamespaceSelector != nil {
+				unsupported = append(unsupported, fmt.Sprintf("ingress[%d].from[%d]: podSelector combined with namespaceSelector; only the namespaceSelector is applied", i, j))
+			}
+		}
+		for j, npp := range ingressRule.Ports {
+			if npp.Protocol != nil {
+				if proto := string(*npp.Protocol); proto != string(api.ProtocolTCP) && proto != string(api.ProtocolUDP) {
+					unsupported = append(unsupported, fmt.Sprintf("ingress[%d].ports[%d]: protocol %s", i, j, proto))
+				}
+			}
+			if npp.Port != nil && npp.Port.Type == intstr.String {
+				unsupported = append(unsupported, fmt.Sprintf("ingress[%d].ports[%d]: named port %q is looked up as a service name on the host, not in the pod spec", i, j, npp.Port.StrVal))
+			}
+		}
+	}
+	return unsupported
+}
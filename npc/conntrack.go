@@ -0,0 +1,59 @@
+package npc
+
+import (
+	"net"
+
+	coreapi "k8s.io/client-go/pkg/api/v1"
+	extnapi "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/pkg/labels"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/npc/ipset"
+)
+
+// deleteConntrackFlows removes the conntrack entries of flows to or from
+// podIPs, so that connections let in by rules which have since changed
+// are checked again; otherwise they would carry on under the ESTABLISHED
+// rule for as long as they last. Failure is only logged, since the rules
+// themselves are in place.
+func deleteConntrackFlows(podIPs ...string) {
+	flows := make([]common.ConntrackFlows, 0, len(podIPs))
+	for _, podIP := range podIPs {
+		if ip := net.ParseIP(podIP); ip != nil {
+			flows = append(flows, common.ConntrackEitherWay(ip))
+		}
+	}
+	n, err := common.DeleteConntrackFlows(flows...)
+	if err != nil {
+		log.Errorf("deleting conntrack entries for %v: %s", podIPs, err)
+		return
+	}
+	if n > 0 {
+		log.Infof("deleted %d conntrack entries for %v", n, podIPs)
+	}
+}
+
+// deletePodConntrackFlows does the same for each pod of the namespace
+// which matches, or for all of them if match is nil
+func (ns *ns) deletePodConntrackFlows(match func(pod *coreapi.Pod) bool) {
+	var podIPs []string
+	for _, pod := range ns.pods {
+		if hasIP(pod) && (match == nil || match(pod)) {
+			podIPs = append(podIPs, pod.Status.PodIP)
+		}
+	}
+	deleteConntrackFlows(podIPs...)
+}
+
+// deletePolicyConntrackFlows does it for the pods targeted by policy,
+// whose ingress may have been narrowed by its update or deletion
+func (ns *ns) deletePolicyConntrackFlows(policy *extnapi.NetworkPolicy) error {
+	target, err := newSelectorSpec(&policy.Spec.PodSelector, ns.name, ipset.HashIP)
+	if err != nil {
+		return err
+	}
+	ns.deletePodConntrackFlows(func(pod *coreapi.Pod) bool {
+		return target.selector.Matches(labels.Set(pod.ObjectMeta.Labels))
+	})
+	return nil
+}
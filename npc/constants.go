@@ -2,8 +2,12 @@ package npc
 
 const (
 	TableFilter = "filter"
+	TableMangle = "mangle"
 
 	MainChain    = "WEAVE-NPC"
 	DefaultChain = "WEAVE-NPC-DEFAULT"
 	IngressChain = "WEAVE-NPC-INGRESS"
+
+	EncryptionExemptChain    = "WEAVE-NPC-NOENCRYPT"
+	EncryptionExemptOutChain = "WEAVE-NPC-NOENCRYPT-OUT"
 )
@@ -1,17 +1,20 @@
 package npc
 
 import (
+	"strings"
 	"sync"
 
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/pkg/errors"
 	coreapi "k8s.io/client-go/pkg/api/v1"
 	extnapi "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/pkg/runtime"
 
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/npc/ipset"
 )
 
+var log = common.SubsystemLog("npc")
+
 type NetworkPolicyController interface {
 	AddNamespace(ns *coreapi.Namespace) error
 	UpdateNamespace(oldObj, newObj *coreapi.Namespace) error
@@ -29,18 +32,34 @@ type NetworkPolicyController interface {
 type controller struct {
 	sync.Mutex
 
-	ipt *iptables.IPTables
+	ipt common.IPTablesBackend
 	ips ipset.Interface
 
 	nss         map[string]*ns // ns name -> ns struct
 	nsSelectors *selectorSet   // selector string -> nsSelector
+
+	exemptions *encryptionExemptions
+
+	recorder EventRecorder
 }
 
-func New(ipt *iptables.IPTables, ips ipset.Interface) NetworkPolicyController {
+// EventRecorder is the part of client-go's record.EventRecorder we use
+// to tell users how their network policies have been programmed.
+type EventRecorder interface {
+	Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{})
+}
+
+// fastdpPort is the UDP port of the fastdp VXLAN traffic between
+// hosts, which is exempted from encryption for annotated pods.
+//
+// recorder may be nil, in which case no events are recorded.
+func New(ipt common.IPTablesBackend, ips ipset.Interface, fastdpPort int, recorder EventRecorder) NetworkPolicyController {
 	c := &controller{
-		ipt: ipt,
-		ips: ips,
-		nss: make(map[string]*ns)}
+		ipt:        ipt,
+		ips:        ips,
+		nss:        make(map[string]*ns),
+		exemptions: newEncryptionExemptions(ipt, fastdpPort),
+		recorder:   recorder}
 
 	c.nsSelectors = newSelectorSet(ips, c.onNewNsSelector)
 
@@ -86,9 +105,12 @@ func (npc *controller) AddPod(obj *coreapi.Pod) error {
 	npc.Lock()
 	defer npc.Unlock()
 
-	common.Log.Debugf("EVENT AddPod %s", js(obj))
+	log.Debugf("EVENT AddPod %s", js(obj))
 	return npc.withNS(obj.ObjectMeta.Namespace, func(ns *ns) error {
-		return errors.Wrap(ns.addPod(obj), "add pod")
+		if err := ns.addPod(obj); err != nil {
+			return errors.Wrap(err, "add pod")
+		}
+		return errors.Wrap(npc.exemptions.update(nil, nil, obj, ns.namespace), "add pod encryption exemption")
 	})
 }
 
@@ -96,9 +118,12 @@ func (npc *controller) UpdatePod(oldObj, newObj *coreapi.Pod) error {
 	npc.Lock()
 	defer npc.Unlock()
 
-	common.Log.Debugf("EVENT UpdatePod %s %s", js(oldObj), js(newObj))
+	log.Debugf("EVENT UpdatePod %s %s", js(oldObj), js(newObj))
 	return npc.withNS(oldObj.ObjectMeta.Namespace, func(ns *ns) error {
-		return errors.Wrap(ns.updatePod(oldObj, newObj), "update pod")
+		if err := ns.updatePod(oldObj, newObj); err != nil {
+			return errors.Wrap(err, "update pod")
+		}
+		return errors.Wrap(npc.exemptions.update(oldObj, ns.namespace, newObj, ns.namespace), "update pod encryption exemption")
 	})
 }
 
@@ -106,9 +131,12 @@ func (npc *controller) DeletePod(obj *coreapi.Pod) error {
 	npc.Lock()
 	defer npc.Unlock()
 
-	common.Log.Debugf("EVENT DeletePod %s", js(obj))
+	log.Debugf("EVENT DeletePod %s", js(obj))
 	return npc.withNS(obj.ObjectMeta.Namespace, func(ns *ns) error {
-		return errors.Wrap(ns.deletePod(obj), "delete pod")
+		if err := ns.deletePod(obj); err != nil {
+			return errors.Wrap(err, "delete pod")
+		}
+		return errors.Wrap(npc.exemptions.update(obj, ns.namespace, nil, nil), "delete pod encryption exemption")
 	})
 }
 
@@ -116,9 +144,11 @@ func (npc *controller) AddNetworkPolicy(obj *extnapi.NetworkPolicy) error {
 	npc.Lock()
 	defer npc.Unlock()
 
-	common.Log.Infof("EVENT AddNetworkPolicy %s", js(obj))
+	log.Infof("EVENT AddNetworkPolicy %s", js(obj))
 	return npc.withNS(obj.ObjectMeta.Namespace, func(ns *ns) error {
-		return errors.Wrap(ns.addNetworkPolicy(obj), "add network policy")
+		err := ns.addNetworkPolicy(obj)
+		npc.reportPolicy(ns, obj, err)
+		return errors.Wrap(err, "add network policy")
 	})
 }
 
@@ -126,9 +156,11 @@ func (npc *controller) UpdateNetworkPolicy(oldObj, newObj *extnapi.NetworkPolicy
 	npc.Lock()
 	defer npc.Unlock()
 
-	common.Log.Infof("EVENT UpdateNetworkPolicy %s %s", js(oldObj), js(newObj))
+	log.Infof("EVENT UpdateNetworkPolicy %s %s", js(oldObj), js(newObj))
 	return npc.withNS(oldObj.ObjectMeta.Namespace, func(ns *ns) error {
-		return errors.Wrap(ns.updateNetworkPolicy(oldObj, newObj), "update network policy")
+		err := ns.updateNetworkPolicy(oldObj, newObj)
+		npc.reportPolicy(ns, newObj, err)
+		return errors.Wrap(err, "update network policy")
 	})
 }
 
@@ -136,7 +168,7 @@ func (npc *controller) DeleteNetworkPolicy(obj *extnapi.NetworkPolicy) error {
 	npc.Lock()
 	defer npc.Unlock()
 
-	common.Log.Infof("EVENT DeleteNetworkPolicy %s", js(obj))
+	log.Infof("EVENT DeleteNetworkPolicy %s", js(obj))
 	return npc.withNS(obj.ObjectMeta.Namespace, func(ns *ns) error {
 		return errors.Wrap(ns.deleteNetworkPolicy(obj), "delete network policy")
 	})
@@ -146,9 +178,12 @@ func (npc *controller) AddNamespace(obj *coreapi.Namespace) error {
 	npc.Lock()
 	defer npc.Unlock()
 
-	common.Log.Infof("EVENT AddNamespace %s", js(obj))
+	log.Infof("EVENT AddNamespace %s", js(obj))
 	return npc.withNS(obj.ObjectMeta.Name, func(ns *ns) error {
-		return errors.Wrap(ns.addNamespace(obj), "add namespace")
+		if err := ns.addNamespace(obj); err != nil {
+			return errors.Wrap(err, "add namespace")
+		}
+		return errors.Wrap(npc.updateExemptions(ns, nil, obj), "add namespace encryption exemptions")
 	})
 }
 
@@ -156,9 +191,12 @@ func (npc *controller) UpdateNamespace(oldObj, newObj *coreapi.Namespace) error
 	npc.Lock()
 	defer npc.Unlock()
 
-	common.Log.Infof("EVENT UpdateNamespace %s %s", js(oldObj), js(newObj))
+	log.Infof("EVENT UpdateNamespace %s %s", js(oldObj), js(newObj))
 	return npc.withNS(oldObj.ObjectMeta.Name, func(ns *ns) error {
-		return errors.Wrap(ns.updateNamespace(oldObj, newObj), "update namespace")
+		if err := ns.updateNamespace(oldObj, newObj); err != nil {
+			return errors.Wrap(err, "update namespace")
+		}
+		return errors.Wrap(npc.updateExemptions(ns, oldObj, newObj), "update namespace encryption exemptions")
 	})
 }
 
@@ -166,8 +204,44 @@ func (npc *controller) DeleteNamespace(obj *coreapi.Namespace) error {
 	npc.Lock()
 	defer npc.Unlock()
 
-	common.Log.Infof("EVENT DeleteNamespace %s", js(obj))
+	log.Infof("EVENT DeleteNamespace %s", js(obj))
 	return npc.withNS(obj.ObjectMeta.Name, func(ns *ns) error {
-		return errors.Wrap(ns.deleteNamespace(obj), "delete namespace")
+		if err := ns.deleteNamespace(obj); err != nil {
+			return errors.Wrap(err, "delete namespace")
+		}
+		return errors.Wrap(npc.updateExemptions(ns, obj, nil), "delete namespace encryption exemptions")
 	})
 }
+
+// updateExemptions re-evaluates the encryption exemption of the pods
+// in ns, which may inherit it from the namespace.
+func (npc *controller) updateExemptions(ns *ns, oldObj, newObj *coreapi.Namespace) error {
+	for _, pod := range ns.pods {
+		if err := npc.exemptions.update(pod, oldObj, pod, newObj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportPolicy records an event on the policy saying whether, and how
+// completely, it has been programmed
+func (npc *controller) reportPolicy(ns *ns, obj *extnapi.NetworkPolicy, err error) {
+	if npc.recorder == nil {
+		return
+	}
+	if err != nil {
+		npc.recorder.Eventf(obj, coreapi.EventTypeWarning, "PolicyFailed", "Failed to program policy: %v", err)
+		return
+	}
+	rules, nsSelectors, podSelectors, err := ns.analysePolicy(obj)
+	if err != nil {
+		return
+	}
+	if unsupported := unsupportedPolicyFeatures(obj); len(unsupported) > 0 {
+		npc.recorder.Eventf(obj, coreapi.EventTypeWarning, "PolicyPartiallyEnforced",
+			"Policy uses features weave-npc cannot enforce: %s", strings.Join(unsupported, "; "))
+	}
+	npc.recorder.Eventf(obj, coreapi.EventTypeNormal, "PolicyAccepted",
+		"Programmed %d iptables rules and %d ipsets", len(rules), len(nsSelectors)+len(podSelectors))
+}
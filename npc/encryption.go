@@ -0,0 +1,140 @@
+package npc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+	coreapi "k8s.io/client-go/pkg/api/v1"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/net/ipsec"
+)
+
+// Traffic of pods annotated with EncryptionAnnotation: "disabled",
+// or in a namespace so annotated (unless the pod says "enabled"), is
+// sent between hosts without IPsec encryption.
+const (
+	EncryptionAnnotation = "weave.works/encryption"
+	encryptionDisabled   = "disabled"
+	encryptionEnabled    = "enabled"
+)
+
+// Offsets, from the start of the outer UDP header, of the source and
+// destination addresses of the IPv4 packet inside a VXLAN frame:
+// UDP (8) + VXLAN (8) + Ethernet (14) + 12 or 16.
+const (
+	vxlanInnerSrcOffset = 42
+	vxlanInnerDstOffset = 46
+)
+
+func isEncryptionExempt(pod *coreapi.Pod, namespace *coreapi.Namespace) bool {
+	if !hasIP(pod) {
+		return false
+	}
+	if value, found := pod.ObjectMeta.Annotations[EncryptionAnnotation]; found {
+		return value == encryptionDisabled
+	}
+	return namespace != nil && namespace.ObjectMeta.Annotations[EncryptionAnnotation] == encryptionDisabled
+}
+
+// encryptionExemptions maintains rules which set ipsec.ExemptMarkStr
+// on VXLAN packets of exempt pods; the ipsec package then neither
+// encrypts them nor drops them for not being encrypted. Arriving
+// packets are marked, in EncryptionExemptChain, only by their inner
+// destination: their inner source is whatever the sender, anyone who
+// can reach the fastdp port, puts there. Leaving packets are marked
+// only where both their inner source, in EncryptionExemptOutChain, and
+// their inner destination are exempt, so that they are sent in the
+// clear just when the receiving host takes them so; traffic between
+// an exempt pod and one which is not stays encrypted.
+type encryptionExemptions struct {
+	ipt  common.IPTablesBackend
+	port string         // UDP port of the fastdp VXLAN traffic
+	ips  map[string]int // pod IP -> number of exempt pods having it
+}
+
+func newEncryptionExemptions(ipt common.IPTablesBackend, port int) *encryptionExemptions {
+	return &encryptionExemptions{
+		ipt:  ipt,
+		port: strconv.Itoa(port),
+		ips:  make(map[string]int)}
+}
+
+// update reconciles the rules after a pod, or the namespace it lives
+// in, changes; a nil pod stands for one which doesn't exist.
+func (e *encryptionExemptions) update(oldPod *coreapi.Pod, oldNs *coreapi.Namespace, newPod *coreapi.Pod, newNs *coreapi.Namespace) error {
+	oldExempt := oldPod != nil && isEncryptionExempt(oldPod, oldNs)
+	newExempt := newPod != nil && isEncryptionExempt(newPod, newNs)
+	if oldExempt && newExempt && oldPod.Status.PodIP == newPod.Status.PodIP {
+		return nil
+	}
+	if oldExempt {
+		if err := e.del(oldPod.Status.PodIP); err != nil {
+			return err
+		}
+	}
+	if newExempt {
+		if err := e.add(newPod.Status.PodIP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encryptionExemptions) add(ip string) error {
+	e.ips[ip]++
+	if e.ips[ip] > 1 {
+		return nil
+	}
+	if net.ParseIP(ip).To4() == nil {
+		log.Warnf("Pod IP %s is not IPv4; its traffic stays encrypted", ip)
+		return nil
+	}
+	var b common.Batch
+	for _, rule := range e.rules(ip) {
+		b.Append(rule.Table, rule.Chain, rule.Rulespec...)
+	}
+	if err := common.ApplyBatch(e.ipt, &b); err != nil {
+		return errors.Wrapf(err, "iptables append exemption of %s", ip)
+	}
+	return nil
+}
+
+func (e *encryptionExemptions) del(ip string) error {
+	e.ips[ip]--
+	if e.ips[ip] > 0 {
+		return nil
+	}
+	delete(e.ips, ip)
+	var b common.Batch
+	for _, rule := range e.rules(ip) {
+		b.Delete(rule.Table, rule.Chain, rule.Rulespec...)
+	}
+	if err := common.ApplyBatch(e.ipt, &b); err != nil {
+		return errors.Wrapf(err, "iptables delete exemption of %s", ip)
+	}
+	return nil
+}
+
+// rules returns the rules exempting the pod IP ip; none where it isn't
+// IPv4, as the inner addresses matched are those of IPv4 packets
+func (e *encryptionExemptions) rules(ip string) []common.Rule {
+	ip4 := net.ParseIP(ip).To4()
+	if ip4 == nil {
+		return nil
+	}
+	match := func(offset int) []string {
+		return []string{
+			"-p", "udp", "--dport", e.port,
+			"-m", "u32", "--u32", fmt.Sprintf("0>>22&0x3C@%d=0x%08x", offset, binary.BigEndian.Uint32(ip4))}
+	}
+	return []common.Rule{
+		{Table: TableMangle, Chain: EncryptionExemptChain,
+			Rulespec: append(match(vxlanInnerDstOffset), "-j", "MARK", "--set-xmark", ipsec.ExemptMarkStr)},
+		{Table: TableMangle, Chain: EncryptionExemptOutChain,
+			Rulespec: append(match(vxlanInnerSrcOffset), "-j", EncryptionExemptChain)},
+	}
+}
@@ -0,0 +1,78 @@
+package npc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	coreapi "k8s.io/client-go/pkg/api/v1"
+
+	"github.com/weaveworks/weave/testing/netfilter"
+)
+
+func exemptPod(ip string) *coreapi.Pod {
+	return &coreapi.Pod{
+		ObjectMeta: coreapi.ObjectMeta{Annotations: map[string]string{EncryptionAnnotation: encryptionDisabled}},
+		Status:     coreapi.PodStatus{PodIP: ip}}
+}
+
+func newExemptionsIPTables(t *testing.T) *netfilter.MockIPTables {
+	ipt := netfilter.NewMockIPTables()
+	require.NoError(t, ipt.NewChain(TableMangle, EncryptionExemptChain))
+	require.NoError(t, ipt.NewChain(TableMangle, EncryptionExemptOutChain))
+	return ipt
+}
+
+func TestEncryptionExemptions(t *testing.T) {
+	ipt := newExemptionsIPTables(t)
+	e := newEncryptionExemptions(ipt, 6784)
+
+	pod := exemptPod("10.32.0.5")
+	require.NoError(t, e.update(nil, nil, pod, nil))
+	// Arriving traffic is exempt only by its inner destination, not by
+	// the inner source, which a sender may forge
+	require.Equal(t, []string{
+		"-p udp --dport 6784 -m u32 --u32 0>>22&0x3C@46=0x0a200005 -j MARK --set-xmark 0x40000/0x40000",
+	}, ipt.Chains["mangle "+EncryptionExemptChain])
+	require.Equal(t, []string{
+		"-p udp --dport 6784 -m u32 --u32 0>>22&0x3C@42=0x0a200005 -j " + EncryptionExemptChain,
+	}, ipt.Chains["mangle "+EncryptionExemptOutChain])
+
+	// A second pod with the same IP, e.g. one being replaced, keeps
+	// the rules in place until both have gone
+	require.NoError(t, e.update(nil, nil, exemptPod("10.32.0.5"), nil))
+	require.Len(t, ipt.Chains["mangle "+EncryptionExemptChain], 1)
+	require.NoError(t, e.update(pod, nil, nil, nil))
+	require.Len(t, ipt.Chains["mangle "+EncryptionExemptChain], 1)
+	require.NoError(t, e.update(pod, nil, nil, nil))
+	require.Empty(t, ipt.Chains["mangle "+EncryptionExemptChain])
+	require.Empty(t, ipt.Chains["mangle "+EncryptionExemptOutChain])
+}
+
+func TestEncryptionExemptionsNamespace(t *testing.T) {
+	ipt := newExemptionsIPTables(t)
+	e := newEncryptionExemptions(ipt, 6784)
+
+	ns := &coreapi.Namespace{ObjectMeta: coreapi.ObjectMeta{Annotations: map[string]string{EncryptionAnnotation: encryptionDisabled}}}
+	pod := &coreapi.Pod{Status: coreapi.PodStatus{PodIP: "10.32.0.6"}}
+	optedIn := &coreapi.Pod{
+		ObjectMeta: coreapi.ObjectMeta{Annotations: map[string]string{EncryptionAnnotation: encryptionEnabled}},
+		Status:     coreapi.PodStatus{PodIP: "10.32.0.7"}}
+
+	require.NoError(t, e.update(nil, nil, pod, ns))
+	require.NoError(t, e.update(nil, nil, optedIn, ns))
+	require.Len(t, ipt.Chains["mangle "+EncryptionExemptChain], 1)
+
+	require.NoError(t, e.update(pod, ns, pod, nil))
+	require.Empty(t, ipt.Chains["mangle "+EncryptionExemptChain])
+}
+
+func TestEncryptionExemptionsIPv6(t *testing.T) {
+	ipt := newExemptionsIPTables(t)
+	e := newEncryptionExemptions(ipt, 6784)
+
+	pod := exemptPod("fd00::5")
+	require.NoError(t, e.update(nil, nil, pod, nil))
+	require.Empty(t, ipt.Chains["mangle "+EncryptionExemptChain])
+	require.Empty(t, ipt.Chains["mangle "+EncryptionExemptOutChain])
+	require.NoError(t, e.update(pod, nil, nil, nil))
+}
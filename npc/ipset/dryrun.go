@@ -0,0 +1,48 @@
+package ipset
+
+import (
+	"github.com/weaveworks/weave/common"
+)
+
+// dryRun is an Interface which changes nothing, but logs each change
+// it is asked for
+type dryRun struct{}
+
+// NewDryRun returns an Interface which logs the changes it is asked
+// for rather than make them, for a dry run of common.DryRun's rules
+func NewDryRun() Interface {
+	return dryRun{}
+}
+
+func (dryRun) would(args ...interface{}) error {
+	common.Log.Infoln(append([]interface{}{"Dry run: would ipset"}, args...)...)
+	return nil
+}
+
+func (d dryRun) Create(ipsetName Name, ipsetType Type) error {
+	return d.would("create", ipsetName, ipsetType)
+}
+
+func (d dryRun) AddEntry(ipsetName Name, entry string) error {
+	return d.would("add", ipsetName, entry)
+}
+
+func (d dryRun) DelEntry(ipsetName Name, entry string) error {
+	return d.would("del", ipsetName, entry)
+}
+
+func (d dryRun) Flush(ipsetName Name) error {
+	return d.would("flush", ipsetName)
+}
+
+func (d dryRun) Destroy(ipsetName Name) error {
+	return d.would("destroy", ipsetName)
+}
+
+func (d dryRun) FlushAll() error {
+	return d.would("flush")
+}
+
+func (d dryRun) DestroyAll() error {
+	return d.would("destroy")
+}
@@ -1,9 +1,7 @@
 package ipset
 
 import (
-	"os/exec"
-
-	"github.com/pkg/errors"
+	"github.com/weaveworks/weave/common"
 )
 
 type Name string
@@ -28,6 +26,7 @@ type Interface interface {
 
 type ipset struct {
 	refCount
+	sets common.IPSets
 }
 
 func New() Interface {
@@ -35,48 +34,41 @@ func New() Interface {
 }
 
 func (i *ipset) Create(ipsetName Name, ipsetType Type) error {
-	return doExec("create", string(ipsetName), string(ipsetType))
+	return i.sets.Create(string(ipsetName), string(ipsetType))
 }
 
 func (i *ipset) AddEntry(ipsetName Name, entry string) error {
 	if i.inc(ipsetName, entry) > 1 { // already in the set
 		return nil
 	}
-	return doExec("add", string(ipsetName), entry)
+	return i.sets.Add(string(ipsetName), entry)
 }
 
 func (i *ipset) DelEntry(ipsetName Name, entry string) error {
 	if i.dec(ipsetName, entry) > 0 { // still needed
 		return nil
 	}
-	return doExec("del", string(ipsetName), entry)
+	return i.sets.Del(string(ipsetName), entry)
 }
 
 func (i *ipset) Flush(ipsetName Name) error {
 	i.removeSet(ipsetName)
-	return doExec("flush", string(ipsetName))
+	return i.sets.Flush(string(ipsetName))
 }
 
 func (i *ipset) FlushAll() error {
 	i.refCount = newRefCount()
-	return doExec("flush")
+	return i.sets.Flush("")
 }
 
 func (i *ipset) Destroy(ipsetName Name) error {
 	i.removeSet(ipsetName)
-	return doExec("destroy", string(ipsetName))
+	return i.sets.Destroy(string(ipsetName))
 }
 
 func (i *ipset) DestroyAll() error {
 	i.refCount = newRefCount()
-	return doExec("destroy")
-}
-
-func doExec(args ...string) error {
-	if output, err := exec.Command("ipset", args...).CombinedOutput(); err != nil {
-		return errors.Wrapf(err, "ipset %v failed: %s", args, output)
-	}
-	return nil
+	return i.sets.Destroy("")
 }
 
 // Reference-counting
@@ -0,0 +1,240 @@
+package ipset
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// nftSets is an Interface keeping ipsets as sets of an nftables table,
+// which rules of the same table match with @<name>. nftables has no
+// sets of sets, so a list:set is kept as a set of the addresses in its
+// members, updated as they change.
+type nftSets struct {
+	table string // family and name, e.g. "ip weave-filter"
+	refCount
+	types map[Name]Type
+	lists map[Name]map[Name]struct{} // members of each list:set
+	// In how many members of each list:set each address is
+	listRefs refCount
+}
+
+// NewNFTables returns an Interface keeping ipsets as sets of table, as
+// family and name, e.g. "ip weave-filter"
+func NewNFTables(table string) Interface {
+	return &nftSets{
+		table:    table,
+		refCount: newRefCount(),
+		types:    make(map[Name]Type),
+		lists:    make(map[Name]map[Name]struct{}),
+		listRefs: newRefCount(),
+	}
+}
+
+func (s *nftSets) Create(ipsetName Name, ipsetType Type) error {
+	if ipsetType != HashIP && ipsetType != ListSet {
+		return fmt.Errorf("ipset type %s is not supported with nftables", ipsetType)
+	}
+	if err := s.doNFT(fmt.Sprintf("add table %s\ncreate set %s %s { type %s; }\n", s.table, s.table, ipsetName, s.addrType())); err != nil {
+		return err
+	}
+	s.types[ipsetName] = ipsetType
+	if ipsetType == ListSet {
+		s.lists[ipsetName] = make(map[Name]struct{})
+	}
+	return nil
+}
+
+func (s *nftSets) AddEntry(ipsetName Name, entry string) error {
+	if s.inc(ipsetName, entry) > 1 { // already in the set
+		return nil
+	}
+	if s.types[ipsetName] == ListSet {
+		member := Name(entry)
+		s.lists[ipsetName][member] = struct{}{}
+		return s.addToList(ipsetName, s.addrs(member))
+	}
+	if err := s.element("add", ipsetName, entry); err != nil {
+		return err
+	}
+	for list, members := range s.lists {
+		if _, found := members[ipsetName]; found {
+			if err := s.addToList(list, []string{entry}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *nftSets) DelEntry(ipsetName Name, entry string) error {
+	if s.dec(ipsetName, entry) > 0 { // still needed
+		return nil
+	}
+	if s.types[ipsetName] == ListSet {
+		member := Name(entry)
+		delete(s.lists[ipsetName], member)
+		return s.delFromList(ipsetName, s.addrs(member))
+	}
+	if err := s.element("delete", ipsetName, entry); err != nil {
+		return err
+	}
+	for list, members := range s.lists {
+		if _, found := members[ipsetName]; found {
+			if err := s.delFromList(list, []string{entry}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *nftSets) Flush(ipsetName Name) error {
+	if err := s.forget(ipsetName); err != nil {
+		return err
+	}
+	return s.doNFT(fmt.Sprintf("flush set %s %s\n", s.table, ipsetName))
+}
+
+func (s *nftSets) Destroy(ipsetName Name) error {
+	if err := s.forget(ipsetName); err != nil {
+		return err
+	}
+	delete(s.types, ipsetName)
+	delete(s.lists, ipsetName)
+	return s.doNFT(fmt.Sprintf("delete set %s %s\n", s.table, ipsetName))
+}
+
+func (s *nftSets) FlushAll() error {
+	names, err := s.sets()
+	if err != nil {
+		return err
+	}
+	s.refCount = newRefCount()
+	s.listRefs = newRefCount()
+	for list := range s.lists {
+		s.lists[list] = make(map[Name]struct{})
+	}
+	script := ""
+	for _, name := range names {
+		script += fmt.Sprintf("flush set %s %s\n", s.table, name)
+	}
+	return s.doNFT(script)
+}
+
+func (s *nftSets) DestroyAll() error {
+	names, err := s.sets()
+	if err != nil {
+		return err
+	}
+	s.refCount = newRefCount()
+	s.listRefs = newRefCount()
+	s.types = make(map[Name]Type)
+	s.lists = make(map[Name]map[Name]struct{})
+	script := ""
+	for _, name := range names {
+		script += fmt.Sprintf("delete set %s %s\n", s.table, name)
+	}
+	return s.doNFT(script)
+}
+
+// forget removes the entries of ipsetName, and if it is in any
+// list:set its addresses from them
+func (s *nftSets) forget(ipsetName Name) error {
+	if s.types[ipsetName] == ListSet {
+		s.lists[ipsetName] = make(map[Name]struct{})
+		s.listRefs.removeSet(ipsetName)
+	} else {
+		addrs := s.addrs(ipsetName)
+		for list, members := range s.lists {
+			if _, found := members[ipsetName]; found {
+				if err := s.delFromList(list, addrs); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	s.removeSet(ipsetName)
+	return nil
+}
+
+// addrs returns the addresses in the hash:ip set ipsetName
+func (s *nftSets) addrs(ipsetName Name) []string {
+	var addrs []string
+	for k, n := range s.ref {
+		if k.ipsetName == ipsetName && n > 0 {
+			addrs = append(addrs, k.entry)
+		}
+	}
+	return addrs
+}
+
+// addToList adds addrs, of a member, to list, if not there from
+// another member already
+func (s *nftSets) addToList(list Name, addrs []string) error {
+	for _, addr := range addrs {
+		if s.listRefs.inc(list, addr) == 1 {
+			if err := s.element("add", list, addr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// delFromList removes addrs, of a member, from list, unless another
+// member has them too
+func (s *nftSets) delFromList(list Name, addrs []string) error {
+	for _, addr := range addrs {
+		if s.listRefs.dec(list, addr) == 0 {
+			if err := s.element("delete", list, addr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *nftSets) element(op string, ipsetName Name, addr string) error {
+	return s.doNFT(fmt.Sprintf("%s element %s %s { %s }\n", op, s.table, ipsetName, addr))
+}
+
+func (s *nftSets) addrType() string {
+	if strings.HasPrefix(s.table, "ip6 ") {
+		return "ipv6_addr"
+	}
+	return "ipv4_addr"
+}
+
+var nftSetRE = regexp.MustCompile(`(?m)^\s*set (\S+) \{`)
+
+// sets returns the names of the sets in the table
+func (s *nftSets) sets() ([]Name, error) {
+	output, err := exec.Command("nft", "list", "table", strings.Fields(s.table)[0], strings.Fields(s.table)[1]).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "No such file or directory") {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "nft list table %s failed: %s", s.table, output)
+	}
+	var names []Name
+	for _, m := range nftSetRE.FindAllStringSubmatch(string(output), -1) {
+		names = append(names, Name(m[1]))
+	}
+	return names, nil
+}
+
+func (s *nftSets) doNFT(script string) error {
+	if script == "" {
+		return nil
+	}
+	cmd := exec.Command("nft", "-f", "/dev/stdin")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "nft %q failed: %s", script, output)
+	}
+	return nil
+}
@@ -95,6 +95,9 @@ func Start(addr string) error {
 	if err := prometheus.Register(blockedConnections); err != nil {
 		return err
 	}
+	if err := prometheus.Register(common.NetfilterMetrics); err != nil {
+		return err
+	}
 
 	http.Handle("/metrics", promhttp.Handler())
 
@@ -3,7 +3,6 @@ package npc
 import (
 	"encoding/json"
 
-	"github.com/coreos/go-iptables/iptables"
 	"k8s.io/client-go/pkg/api/unversioned"
 	coreapi "k8s.io/client-go/pkg/api/v1"
 	extnapi "k8s.io/client-go/pkg/apis/extensions/v1beta1"
@@ -15,8 +14,8 @@ import (
 )
 
 type ns struct {
-	ipt *iptables.IPTables // interface to iptables
-	ips ipset.Interface    // interface to ipset
+	ipt common.IPTablesBackend // interface to iptables
+	ips ipset.Interface        // interface to ipset
 
 	name      string                               // k8s Namespace name
 	namespace *coreapi.Namespace                   // k8s Namespace object
@@ -31,7 +30,7 @@ type ns struct {
 	rules        *ruleSet
 }
 
-func newNS(name string, ipt *iptables.IPTables, ips ipset.Interface, nsSelectors *selectorSet) (*ns, error) {
+func newNS(name string, ipt common.IPTablesBackend, ips ipset.Interface, nsSelectors *selectorSet) (*ns, error) {
 	allPods, err := newSelectorSpec(&unversioned.LabelSelector{}, name, ipset.HashIP)
 	if err != nil {
 		return nil, err
@@ -199,7 +198,7 @@ func (ns *ns) updateNetworkPolicy(oldObj, newObj *extnapi.NetworkPolicy) error {
 		return err
 	}
 
-	return nil
+	return ns.deletePolicyConntrackFlows(oldObj)
 }
 
 func (ns *ns) deleteNetworkPolicy(obj *extnapi.NetworkPolicy) error {
@@ -222,7 +221,7 @@ func (ns *ns) deleteNetworkPolicy(obj *extnapi.NetworkPolicy) error {
 		return err
 	}
 
-	return nil
+	return ns.deletePolicyConntrackFlows(obj)
 }
 
 func bypassRule(nsIpsetName ipset.Name) []string {
@@ -261,7 +260,11 @@ func (ns *ns) updateNamespace(oldObj, newObj *coreapi.Namespace) error {
 			return ns.ensureBypassRule(ns.allPods.ipsetName)
 		}
 		if newDefaultDeny {
-			return ns.deleteBypassRule(ns.allPods.ipsetName)
+			if err := ns.deleteBypassRule(ns.allPods.ipsetName); err != nil {
+				return err
+			}
+			ns.deletePodConntrackFlows(nil)
+			return nil
 		}
 	}
 
@@ -277,6 +280,7 @@ func (ns *ns) updateNamespace(oldObj, newObj *coreapi.Namespace) error {
 				if err := selector.delEntry(string(ns.allPods.ipsetName)); err != nil {
 					return err
 				}
+				ns.deletePodConntrackFlows(nil)
 			}
 			if newMatch {
 				if err := selector.addEntry(string(ns.allPods.ipsetName)); err != nil {
@@ -327,7 +331,7 @@ func isDefaultDeny(namespace *coreapi.Namespace) bool {
 
 	var nnp NamespaceNetworkPolicy
 	if err := json.Unmarshal([]byte(nnpJSON), &nnp); err != nil {
-		common.Log.Warn("Ignoring network policy annotation: unmarshal failed:", err)
+		log.Warn("Ignoring network policy annotation: unmarshal failed:", err)
 		// If we can't understand the annotation, behave as if it isn't present
 		return false
 	}
@@ -3,7 +3,6 @@ package npc
 import (
 	"strings"
 
-	"github.com/coreos/go-iptables/iptables"
 	"k8s.io/client-go/pkg/types"
 
 	"github.com/weaveworks/weave/common"
@@ -35,41 +34,57 @@ func newRuleSpec(proto *string, srcHost *selectorSpec, dstHost *selectorSpec, ds
 }
 
 type ruleSet struct {
-	ipt   *iptables.IPTables
+	ipt   common.IPTablesBackend
 	users map[string]map[types.UID]struct{}
 }
 
-func newRuleSet(ipt *iptables.IPTables) *ruleSet {
+func newRuleSet(ipt common.IPTablesBackend) *ruleSet {
 	return &ruleSet{ipt, make(map[string]map[types.UID]struct{})}
 }
 
 func (rs *ruleSet) deprovision(user types.UID, current, desired map[string]*ruleSpec) error {
+	var b common.Batch
+	var deleted []string
 	for key, spec := range current {
 		if _, found := desired[key]; !found {
 			delete(rs.users[key], user)
 			if len(rs.users[key]) == 0 {
-				common.Log.Infof("deleting rule: %v", spec.args)
-				if err := rs.ipt.Delete(TableFilter, IngressChain, spec.args...); err != nil {
-					return err
-				}
-				delete(rs.users, key)
+				log.Infof("deleting rule: %v", spec.args)
+				b.Delete(TableFilter, IngressChain, spec.args...)
+				deleted = append(deleted, key)
 			}
 		}
 	}
+	if err := common.ApplyBatch(rs.ipt, &b); err != nil {
+		return err
+	}
+	for _, key := range deleted {
+		delete(rs.users, key)
+	}
 
 	return nil
 }
 
 func (rs *ruleSet) provision(user types.UID, current, desired map[string]*ruleSpec) error {
+	var b common.Batch
+	var added []string
 	for key, spec := range desired {
 		if _, found := current[key]; !found {
 			if _, found := rs.users[key]; !found {
-				common.Log.Infof("adding rule: %v", spec.args)
-				if err := rs.ipt.Append(TableFilter, IngressChain, spec.args...); err != nil {
-					return err
-				}
-				rs.users[key] = make(map[types.UID]struct{})
+				log.Infof("adding rule: %v", spec.args)
+				b.Append(TableFilter, IngressChain, spec.args...)
+				added = append(added, key)
 			}
+		}
+	}
+	if err := common.ApplyBatch(rs.ipt, &b); err != nil {
+		return err
+	}
+	for _, key := range added {
+		rs.users[key] = make(map[types.UID]struct{})
+	}
+	for key := range desired {
+		if _, found := current[key]; !found {
 			rs.users[key][user] = struct{}{}
 		}
 	}
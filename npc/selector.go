@@ -5,7 +5,6 @@ import (
 	"k8s.io/client-go/pkg/labels"
 	"k8s.io/client-go/pkg/types"
 
-	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/npc/ipset"
 )
 
@@ -43,13 +42,21 @@ func (s *selector) matches(labelMap map[string]string) bool {
 }
 
 func (s *selector) addEntry(entry string) error {
-	common.Log.Infof("adding entry %s to %s", entry, s.spec.ipsetName)
+	log.Infof("adding entry %s to %s", entry, s.spec.ipsetName)
 	return s.ips.AddEntry(s.spec.ipsetName, entry)
 }
 
 func (s *selector) delEntry(entry string) error {
-	common.Log.Infof("deleting entry %s from %s", entry, s.spec.ipsetName)
-	return s.ips.DelEntry(s.spec.ipsetName, entry)
+	log.Infof("deleting entry %s from %s", entry, s.spec.ipsetName)
+	if err := s.ips.DelEntry(s.spec.ipsetName, entry); err != nil {
+		return err
+	}
+	// A pod which no longer matches may have connections that were only
+	// allowed because it did
+	if s.spec.ipsetType == ipset.HashIP {
+		deleteConntrackFlows(entry)
+	}
+	return nil
 }
 
 type selectorFn func(selector *selector) error
@@ -96,7 +103,7 @@ func (ss *selectorSet) deprovision(user types.UID, current, desired map[string]*
 		if _, found := desired[key]; !found {
 			delete(ss.users[key], user)
 			if len(ss.users[key]) == 0 {
-				common.Log.Infof("destroying ipset: %#v", spec)
+				log.Infof("destroying ipset: %#v", spec)
 				if err := ss.ips.Destroy(spec.ipsetName); err != nil {
 					return err
 				}
@@ -112,7 +119,7 @@ func (ss *selectorSet) provision(user types.UID, current, desired map[string]*se
 	for key, spec := range desired {
 		if _, found := current[key]; !found {
 			if _, found := ss.users[key]; !found {
-				common.Log.Infof("creating ipset: %#v", spec)
+				log.Infof("creating ipset: %#v", spec)
 				if err := ss.ips.Create(spec.ipsetName, spec.ipsetType); err != nil {
 					return err
 				}
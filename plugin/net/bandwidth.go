@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// How long packets may queue in the shaper before being dropped
+const shaperLatencyMillis = 25
+
+// BandwidthEntry is the "bandwidth" runtime config that the kubelet
+// passes, from the kubernetes.io/ingress-bandwidth and
+// kubernetes.io/egress-bandwidth pod annotations, to plugins which
+// declare that capability. Rates are in bits per second and bursts in
+// bits.
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
+
+func (bw *BandwidthEntry) isZero() bool {
+	return bw == nil || (bw.IngressRate == 0 && bw.EgressRate == 0)
+}
+
+// setupBandwidth rate-limits the pod's interface ifName. We shape
+// traffic as it leaves each end of the veth: the pod's egress on its
+// own end and its ingress on the host's end, so no ingress qdisc or
+// intermediate device is needed.
+func setupBandwidth(ns netns.NsHandle, ifName string, bw *BandwidthEntry) error {
+	var hostIndex int
+	if err := weavenet.WithNetNSLinkUnsafe(ns, ifName, func(link netlink.Link) error {
+		hostIndex = link.Attrs().ParentIndex
+		if bw.EgressRate > 0 {
+			return createTBF(link.Attrs().Index, bw.EgressRate, bw.EgressBurst)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to limit egress bandwidth: %s", err)
+	}
+	if bw.IngressRate > 0 {
+		link, err := netlink.LinkByIndex(hostIndex)
+		if err != nil {
+			return fmt.Errorf("failed to find host end of %q: %s", ifName, err)
+		}
+		if err := createTBF(link.Attrs().Index, bw.IngressRate, bw.IngressBurst); err != nil {
+			return fmt.Errorf("failed to limit ingress bandwidth: %s", err)
+		}
+	}
+	return nil
+}
+
+// createTBF installs a token bucket filter as the root qdisc of the
+// link, computing its parameters the same way tc(8) does.
+func createTBF(linkIndex int, rateInBits, burstInBits uint64) error {
+	if burstInBits == 0 {
+		// Allow a second's worth of traffic
+		burstInBits = rateInBits
+	}
+	rate := rateInBits / 8
+	burst := burstInBits / 8
+	if rate == 0 {
+		return fmt.Errorf("rate %d bits/s is too low", rateInBits)
+	}
+	bufferUsec := float64(burst) * netlink.TIME_UNITS_PER_SEC / float64(rate)
+	latencyUsec := netlink.TIME_UNITS_PER_SEC * shaperLatencyMillis / 1000.0
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rate,
+		Buffer: uint32(bufferUsec * netlink.TickInUsec()),
+		Limit:  uint32(float64(rate)*latencyUsec/netlink.TIME_UNITS_PER_SEC) + uint32(burst),
+	}
+	return netlink.QdiscReplace(qdisc)
+}
@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -22,6 +23,11 @@ var (
 	mask32      = net.IPv4Mask(0xff, 0xff, 0xff, 0xff)
 )
 
+// The interface name a runtime gives the pod's primary network; any
+// other name means a meta-plugin such as Multus is attaching us as an
+// additional network.
+const primaryIfName = "eth0"
+
 type CNIPlugin struct {
 	weave *weaveapi.Client
 }
@@ -30,6 +36,18 @@ func NewCNIPlugin(weave *weaveapi.Client) *CNIPlugin {
 	return &CNIPlugin{weave: weave}
 }
 
+// DefaultConfig returns the network configuration which `weave
+// setup-cni` and weaver's --setup-cni install where there is none
+func DefaultConfig() ([]byte, error) {
+	conf := map[string]interface{}{
+		"name":         "weave",
+		"type":         "weave-net",
+		"capabilities": map[string]bool{"bandwidth": true},
+	}
+	data, err := json.MarshalIndent(conf, "", "    ")
+	return append(data, '\n'), err
+}
+
 func loadNetConf(bytes []byte) (*NetConf, error) {
 	n := &NetConf{
 		BrName: weavenet.WeaveBridgeName,
@@ -66,13 +84,18 @@ func (c *CNIPlugin) CmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("IP Masquerading functionality not supported")
 	}
 
+	secondary := conf.isSecondary(args.IfName)
+	if secondary {
+		args = attachmentArgs(args)
+	}
+
 	result, err := c.getIP(conf.IPAM.Type, args)
 	if err != nil {
 		return fmt.Errorf("unable to allocate IP address: %s", err)
 	}
 
 	// If config says nothing about routes or gateway, default one will be via the bridge
-	if result.IP4.Routes == nil && result.IP4.Gateway == nil {
+	if result.IP4.Gateway == nil && (result.IP4.Routes == nil || secondary) {
 		bridgeIP, err := weavenet.FindBridgeIP(conf.BrName, &result.IP4.IP)
 		if err == weavenet.ErrBridgeNoIP {
 			bridgeArgs := *args
@@ -84,7 +107,7 @@ func (c *CNIPlugin) CmdAdd(args *skel.CmdArgs) error {
 			if err := assignBridgeIP(conf.BrName, bridgeIPResult.IP4.IP); err != nil {
 				return fmt.Errorf("unable to assign IP address to bridge: %s", err)
 			}
-			if err := weavenet.ExposeNAT(bridgeIPResult.IP4.IP); err != nil {
+			if err := weavenet.ExposeNAT(weavenet.DefaultNATChain, bridgeIPResult.IP4.IP); err != nil {
 				return fmt.Errorf("unable to create NAT rules: %s", err)
 			}
 			bridgeIP = bridgeIPResult.IP4.IP.IP
@@ -94,6 +117,13 @@ func (c *CNIPlugin) CmdAdd(args *skel.CmdArgs) error {
 		result.IP4.Gateway = bridgeIP
 	}
 
+	// As a secondary network we must leave the pod's default route
+	// alone, so only route the weave subnet via the bridge
+	if secondary && result.IP4.Routes == nil {
+		subnet := net.IPNet{IP: result.IP4.IP.IP.Mask(result.IP4.IP.Mask), Mask: result.IP4.IP.Mask}
+		result.IP4.Routes = []types.Route{{Dst: subnet}}
+	}
+
 	ns, err := netns.GetFromPath(args.Netns)
 	if err != nil {
 		return fmt.Errorf("error accessing namespace %q: %s", args.Netns, err)
@@ -101,6 +131,11 @@ func (c *CNIPlugin) CmdAdd(args *skel.CmdArgs) error {
 	defer ns.Close()
 
 	id := args.ContainerID
+	if secondary {
+		// Each attachment needs its own veth, so derive a distinct
+		// name stem from the container and interface names
+		id = fmt.Sprintf("%x", sha256.Sum256([]byte(args.ContainerID)))
+	}
 	if len(id) < 5 {
 		data := make([]byte, 5)
 		_, err := rand.Reader.Read(data)
@@ -118,6 +153,11 @@ func (c *CNIPlugin) CmdAdd(args *skel.CmdArgs) error {
 	}); err != nil {
 		return fmt.Errorf("error setting up routes: %s", err)
 	}
+	if bw := conf.RuntimeConfig.Bandwidth; !bw.isZero() {
+		if err := setupBandwidth(ns, args.IfName, bw); err != nil {
+			return err
+		}
+	}
 
 	result.DNS = conf.DNS
 	return result.Print()
@@ -174,6 +214,10 @@ func (c *CNIPlugin) CmdDel(args *skel.CmdArgs) error {
 		return fmt.Errorf("error removing interface %q: %s", args.IfName, err)
 	}
 
+	if conf.isSecondary(args.IfName) {
+		args = attachmentArgs(args)
+	}
+
 	// Default IPAM is Weave's own
 	if conf.IPAM.Type == "" {
 		err = ipamplugin.NewIpam(c.weave).Release(args)
@@ -186,10 +230,35 @@ func (c *CNIPlugin) CmdDel(args *skel.CmdArgs) error {
 	return nil
 }
 
+// attachmentArgs returns a copy of args whose ContainerID identifies
+// this particular attachment, so that IP addresses allocated for a
+// secondary network are tracked and released independently of those
+// of the pod's other interfaces.
+func attachmentArgs(args *skel.CmdArgs) *skel.CmdArgs {
+	attachment := *args
+	attachment.ContainerID = args.ContainerID + "-" + args.IfName
+	return &attachment
+}
+
 type NetConf struct {
 	types.NetConf
 	BrName string `json:"bridge"`
 	IsGW   bool   `json:"isGateway"`
 	IPMasq bool   `json:"ipMasq"`
 	MTU    int    `json:"mtu"`
+	// Secondary forces treating this network as an additional
+	// attachment (e.g. from a Multus NetworkAttachmentDefinition);
+	// otherwise that is inferred from the interface name.
+	Secondary *bool `json:"secondary,omitempty"`
+
+	RuntimeConfig struct {
+		Bandwidth *BandwidthEntry `json:"bandwidth,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+}
+
+func (conf *NetConf) isSecondary(ifName string) bool {
+	if conf.Secondary != nil {
+		return *conf.Secondary
+	}
+	return ifName != "" && ifName != primaryIfName
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	kubeErrors "k8s.io/client-go/pkg/api/errors"
+	api "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	configGroup    = "weave.works"
+	configVersion  = "v1alpha1"
+	configResource = "weavenetconfigs"
+)
+
+// WeaveNetConfig is the cluster-wide configuration custom resource,
+// see weavenetconfig-crd.yaml. We only read it, so rather than
+// generate a typed client we decode the raw REST response.
+type WeaveNetConfig struct {
+	api.ObjectMeta `json:"metadata,omitempty"`
+	Spec           WeaveNetConfigSpec `json:"spec"`
+}
+
+type WeaveNetConfigSpec struct {
+	IPAllocRange   string   `json:"ipallocRange,omitempty"`
+	ServiceCIDR    string   `json:"serviceCIDR,omitempty"`
+	Encryption     *bool    `json:"encryption,omitempty"`
+	MTU            int      `json:"mtu,omitempty"`
+	TrustedSubnets []string `json:"trustedSubnets,omitempty"`
+	RekeyInterval  string   `json:"rekeyInterval,omitempty"`
+}
+
+// getWeaveNetConfig returns nil, without error, if there is no
+// WeaveNetConfig of that name.
+func getWeaveNetConfig(name string) (*WeaveNetConfig, error) {
+	var config *WeaveNetConfig
+	err := withClient(func(c *kubernetes.Clientset) error {
+		body, err := c.Core().RESTClient().Get().
+			AbsPath("/apis", configGroup, configVersion, configResource, name).
+			DoRaw()
+		switch {
+		case kubeErrors.IsNotFound(err):
+			config = nil
+			return nil
+		case err != nil:
+			return err
+		}
+		config = &WeaveNetConfig{}
+		return json.Unmarshal(body, config)
+	})
+	return config, err
+}
+
+func (spec *WeaveNetConfigSpec) validate() error {
+	if spec.IPAllocRange != "" {
+		if _, _, err := net.ParseCIDR(spec.IPAllocRange); err != nil {
+			return fmt.Errorf("invalid ipallocRange: %s", err)
+		}
+	}
+	if spec.ServiceCIDR != "" {
+		if _, _, err := net.ParseCIDR(spec.ServiceCIDR); err != nil {
+			return fmt.Errorf("invalid serviceCIDR: %s", err)
+		}
+	}
+	if spec.MTU != 0 && (spec.MTU < 576 || spec.MTU > 65535) {
+		return fmt.Errorf("invalid mtu %d", spec.MTU)
+	}
+	for _, subnet := range spec.TrustedSubnets {
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			return fmt.Errorf("invalid trustedSubnets: %s", err)
+		}
+	}
+	if spec.RekeyInterval != "" {
+		if _, err := time.ParseDuration(spec.RekeyInterval); err != nil {
+			return fmt.Errorf("invalid rekeyInterval: %s", err)
+		}
+	}
+	return nil
+}
+
+// shellVars returns the settings in spec as the environment variables
+// understood by launch.sh; unset fields are left out so the defaults
+// from the DaemonSet still apply.
+func (spec *WeaveNetConfigSpec) shellVars() [][2]string {
+	var vars [][2]string
+	add := func(name, value string) {
+		vars = append(vars, [2]string{name, value})
+	}
+	if spec.IPAllocRange != "" {
+		add("IPALLOC_RANGE", spec.IPAllocRange)
+	}
+	if spec.ServiceCIDR != "" {
+		add("WEAVE_SERVICE_CIDR", spec.ServiceCIDR)
+	}
+	if spec.Encryption != nil {
+		if *spec.Encryption {
+			add("WEAVE_ENCRYPTION", "1")
+		} else {
+			add("WEAVE_ENCRYPTION", "0")
+		}
+	}
+	if spec.MTU != 0 {
+		add("WEAVE_MTU", fmt.Sprint(spec.MTU))
+	}
+	if len(spec.TrustedSubnets) > 0 {
+		add("WEAVE_TRUSTED_SUBNETS", strings.Join(spec.TrustedSubnets, ","))
+	}
+	if spec.RekeyInterval != "" {
+		add("WEAVE_REKEY_INTERVAL", spec.RekeyInterval)
+	}
+	return vars
+}
+
+func printShellVars(w io.Writer, vars [][2]string) {
+	for _, v := range vars {
+		fmt.Fprintf(w, "%s='%s'\n", v[0], strings.Replace(v[1], "'", `'\''`, -1))
+	}
+}
+
+func runConfig(name string, watch bool) error {
+	if watch {
+		return waitForChange("WeaveNetConfig "+name, func() (string, error) {
+			config, err := getWeaveNetConfig(name)
+			if err != nil || config == nil {
+				return "", err
+			}
+			return config.ResourceVersion, nil
+		})
+	}
+
+	config, err := getWeaveNetConfig(name)
+	if err != nil || config == nil {
+		return err
+	}
+	if err := config.Spec.validate(); err != nil {
+		return err
+	}
+	printShellVars(os.Stdout, config.Spec.shellVars())
+	return nil
+}
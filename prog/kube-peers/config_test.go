@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeaveNetConfigShellVars(t *testing.T) {
+	var config WeaveNetConfig
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"metadata": {"name": "weave-net", "resourceVersion": "42"},
+		"spec": {
+			"ipallocRange": "10.40.0.0/16",
+			"serviceCIDR": "10.96.0.0/12",
+			"encryption": false,
+			"trustedSubnets": ["10.0.1.0/24", "10.0.2.0/24"],
+			"rekeyInterval": "1h"
+		}
+	}`), &config))
+	require.Equal(t, "42", config.ResourceVersion)
+	require.NoError(t, config.Spec.validate())
+
+	var buf bytes.Buffer
+	printShellVars(&buf, config.Spec.shellVars())
+	require.Equal(t, `IPALLOC_RANGE='10.40.0.0/16'
+WEAVE_SERVICE_CIDR='10.96.0.0/12'
+WEAVE_ENCRYPTION='0'
+WEAVE_TRUSTED_SUBNETS='10.0.1.0/24,10.0.2.0/24'
+WEAVE_REKEY_INTERVAL='1h'
+`, buf.String())
+
+	buf.Reset()
+	printShellVars(&buf, [][2]string{{"X", "it's"}})
+	require.Equal(t, `X='it'\''s'`+"\n", buf.String())
+}
+
+func TestWeaveNetConfigValidate(t *testing.T) {
+	for _, spec := range []WeaveNetConfigSpec{
+		{IPAllocRange: "10.40.0.0"},
+		{ServiceCIDR: "10.96.0.0"},
+		{MTU: 100},
+		{TrustedSubnets: []string{"bogus"}},
+		{RekeyInterval: "soon"},
+	} {
+		require.Error(t, spec.validate(), "%+v", spec)
+	}
+	require.NoError(t, (&WeaveNetConfigSpec{}).validate())
+}
@@ -1,55 +1,137 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"time"
 
 	"k8s.io/client-go/kubernetes"
 	api "k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
 )
 
-func getKubePeers() ([]string, error) {
+// withClient calls f with a client for the APIServer, retrying once
+// against the fallback address if that fails.
+func withClient(f func(c *kubernetes.Clientset) error) error {
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	c, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	nodeList, err := c.Nodes().List(api.ListOptions{})
-	if err != nil {
+	if err = f(c); err != nil {
 		// Fallback for cases (e.g. from kube-up.sh) where kube-proxy is not running on master
 		config.Host = "http://localhost:8080"
 		log.Print("error contacting APIServer: ", err, "; trying with fallback: ", config.Host)
 		c, err = kubernetes.NewForConfig(config)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		nodeList, err = c.Nodes().List(api.ListOptions{})
+		err = f(c)
 	}
+	return err
+}
+
+const pollInterval = 30 * time.Second
 
+// waitForChange polls getVersion until the version it reports differs
+// from the first one seen; errors are logged and polling continues.
+func waitForChange(what string, getVersion func() (string, error)) error {
+	version, err := getVersion()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	addresses := make([]string, 0, len(nodeList.Items))
-	for _, peer := range nodeList.Items {
-		for _, addr := range peer.Status.Addresses {
-			if addr.Type == "InternalIP" {
-				addresses = append(addresses, addr.Address)
-			}
+	for range time.Tick(pollInterval) {
+		newVersion, err := getVersion()
+		if err != nil {
+			log.Printf("error checking %s: %v", what, err)
+			continue
+		}
+		if newVersion != version {
+			log.Printf("%s changed", what)
+			return nil
 		}
 	}
-	return addresses, nil
+	return nil
+}
+
+func getKubeNodes() ([]api.Node, error) {
+	var nodes []api.Node
+	err := withClient(func(c *kubernetes.Clientset) error {
+		nodeList, err := c.Nodes().List(api.ListOptions{})
+		if err != nil {
+			return err
+		}
+		nodes = nodeList.Items
+		return nil
+	})
+	return nodes, err
+}
+
+func nodeAddress(node api.Node) string {
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == "InternalIP" {
+			return addr.Address
+		}
+	}
+	return ""
 }
 
 func main() {
-	peers, err := getKubePeers()
+	var (
+		zoneAware    bool
+		zoneGateways int
+		nodeName     string
+		configName   string
+		watchConfig  bool
+		namespace    string
+		publish      bool
+		httpAddr     string
+		serviceCIDR  bool
+	)
+	flag.BoolVar(&zoneAware, "zone-aware", false, "only list peers in our own zone, plus gateway peers of other zones")
+	flag.IntVar(&zoneGateways, "zone-gateways", 2, "number of gateway peers per zone when --zone-aware is set")
+	flag.StringVar(&nodeName, "node-name", os.Getenv("HOSTNAME"), "name of the Kubernetes node we are running on")
+	flag.StringVar(&configName, "config", "", "print the settings from the named WeaveNetConfig as shell variable assignments, instead of listing peers")
+	flag.BoolVar(&watchConfig, "watch-config", false, "with --config, wait until the WeaveNetConfig changes and then exit")
+	flag.StringVar(&namespace, "namespace", ourNamespace(), "namespace of our WeaveStatus")
+	flag.BoolVar(&publish, "publish-status", false, "keep publishing the status of the weave router at --http-addr as our node's WeaveStatus in --namespace")
+	flag.StringVar(&httpAddr, "http-addr", "127.0.0.1:6784", "address of the weave router's HTTP API")
+	flag.BoolVar(&serviceCIDR, "service-cidr", false, "print the cluster's service CIDR, if it can be discovered, instead of listing peers")
+	flag.Parse()
+
+	switch {
+	case publish:
+		publishStatus(httpAddr, namespace, nodeName)
+		return
+	case serviceCIDR:
+		cidr, err := discoverServiceCIDR()
+		if err != nil {
+			log.Fatalf("Could not discover service CIDR: %v", err)
+		}
+		fmt.Println(cidr)
+		return
+	case configName != "":
+		if err := runConfig(configName, watchConfig); err != nil {
+			log.Fatalf("Could not get config %q: %v", configName, err)
+		}
+		return
+	}
+
+	nodes, err := getKubeNodes()
 	if err != nil {
 		log.Fatalf("Could not get peers: %v", err)
 	}
-	for _, addr := range peers {
-		fmt.Println(addr)
+	if zoneAware {
+		nodes = zonePeers(nodes, nodeName, zoneGateways)
+	}
+	for _, node := range nodes {
+		if addr := nodeAddress(node); addr != "" {
+			fmt.Println(addr)
+		}
 	}
 }
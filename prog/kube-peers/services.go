@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+	api "k8s.io/client-go/pkg/api/v1"
+)
+
+const serviceRangeFlag = "--service-cluster-ip-range"
+
+// Kubernetes doesn't publish the service CIDR through its API, so we
+// look for it on the command lines of any apiservers running as pods,
+// as kubeadm and similar installers do. The kubeadm label is tried
+// first, then the name, which static pods are given by later tools.
+func discoverServiceCIDR() (string, error) {
+	var cidr string
+	err := withClient(func(c *kubernetes.Clientset) error {
+		pods, err := c.Core().Pods("kube-system").List(api.ListOptions{LabelSelector: "component=kube-apiserver"})
+		if err != nil {
+			return err
+		}
+		if len(pods.Items) == 0 {
+			if pods, err = c.Core().Pods("kube-system").List(api.ListOptions{}); err != nil {
+				return err
+			}
+		}
+		cidr = serviceCIDRFromPods(pods.Items)
+		return nil
+	})
+	return cidr, err
+}
+
+func serviceCIDRFromPods(pods []api.Pod) string {
+	for _, pod := range pods {
+		if !strings.HasPrefix(pod.Name, "kube-apiserver") && pod.Labels["component"] != "kube-apiserver" {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			if cidr := serviceCIDRFromArgs(append(container.Command, container.Args...)); cidr != "" {
+				return cidr
+			}
+		}
+	}
+	return ""
+}
+
+func serviceCIDRFromArgs(args []string) string {
+	for i, arg := range args {
+		var value string
+		switch {
+		case strings.HasPrefix(arg, serviceRangeFlag+"="):
+			value = strings.TrimPrefix(arg, serviceRangeFlag+"=")
+		case arg == serviceRangeFlag && i+1 < len(args):
+			value = args[i+1]
+		default:
+			continue
+		}
+		if _, _, err := net.ParseCIDR(value); err == nil {
+			return value
+		}
+	}
+	return ""
+}
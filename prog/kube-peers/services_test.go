@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestServiceCIDRFromPods(t *testing.T) {
+	apiserver := func(name string, command ...string) api.Pod {
+		pod := api.Pod{}
+		pod.Name = name
+		pod.Spec.Containers = []api.Container{{Command: command}}
+		return pod
+	}
+	require.Equal(t, "10.96.0.0/12", serviceCIDRFromPods([]api.Pod{
+		apiserver("kube-dns-1234", "--service-cluster-ip-range=10.0.0.0/8"),
+		apiserver("kube-apiserver-master", "kube-apiserver", "--secure-port=6443", "--service-cluster-ip-range=10.96.0.0/12"),
+	}))
+	require.Equal(t, "10.100.0.0/16", serviceCIDRFromPods([]api.Pod{
+		apiserver("kube-apiserver-master", "/hyperkube", "apiserver", "--service-cluster-ip-range", "10.100.0.0/16"),
+	}))
+	require.Equal(t, "", serviceCIDRFromPods([]api.Pod{
+		apiserver("kube-apiserver-master", "kube-apiserver", "--service-cluster-ip-range=bogus"),
+	}))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	kubeErrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/unversioned"
+	api "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	statusResource = "weavestatuses"
+
+	serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// ourNamespace is the namespace of the pod we are running in, or
+// kube-system if that is unknown.
+func ourNamespace() string {
+	if ns, err := ioutil.ReadFile(serviceAccountNamespace); err == nil {
+		return strings.TrimSpace(string(ns))
+	}
+	return "kube-system"
+}
+
+// WeaveStatus is the custom resource, see weavestatus-crd.yaml, in
+// which each node publishes a summary of its weave router's state.
+type WeaveStatus struct {
+	unversioned.TypeMeta `json:",inline"`
+	api.ObjectMeta       `json:"metadata,omitempty"`
+	Status               WeaveStatusStatus `json:"status"`
+}
+
+type WeaveStatusStatus struct {
+	Version     string                 `json:"version,omitempty"`
+	PeerName    string                 `json:"peerName,omitempty"`
+	Encryption  bool                   `json:"encryption"`
+	Connections map[string]int         `json:"connections,omitempty"` // by state
+	IPAM        *WeaveStatusIPAMStatus `json:"ipam,omitempty"`
+	Errors      []string               `json:"errors,omitempty"`
+	LastUpdate  unversioned.Time       `json:"lastUpdate"`
+}
+
+type WeaveStatusIPAMStatus struct {
+	Range       string `json:"range"`
+	RangeNumIPs int    `json:"rangeNumIPs"`
+	OwnedIPs    int    `json:"ownedIPs"`
+	ActiveIPs   int    `json:"activeIPs"`
+}
+
+// The parts of weaver's /report which we summarise
+type weaveReport struct {
+	Version string
+	Router  struct {
+		Name        string
+		Encryption  bool
+		Connections []struct {
+			Address string
+			State   string
+			Info    string
+		}
+	}
+	IPAM *struct {
+		Range       string
+		RangeNumIPs int
+		ActiveIPs   int
+		Entries     []struct {
+			Size uint32
+			Peer string
+		}
+	}
+}
+
+func getWeaveReport(httpAddr string) (*weaveReport, error) {
+	req, err := http.NewRequest("GET", "http://"+httpAddr+"/report", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	report := &weaveReport{}
+	return report, json.NewDecoder(resp.Body).Decode(report)
+}
+
+func makeWeaveStatus(report *weaveReport) WeaveStatusStatus {
+	status := WeaveStatusStatus{
+		Version:     report.Version,
+		PeerName:    report.Router.Name,
+		Encryption:  report.Router.Encryption,
+		Connections: make(map[string]int),
+	}
+	for _, conn := range report.Router.Connections {
+		status.Connections[conn.State]++
+		if conn.State == "failed" {
+			status.Errors = append(status.Errors, fmt.Sprintf("connection to %s failed: %s", conn.Address, conn.Info))
+		}
+	}
+	if ipam := report.IPAM; ipam != nil {
+		status.IPAM = &WeaveStatusIPAMStatus{
+			Range:       ipam.Range,
+			RangeNumIPs: ipam.RangeNumIPs,
+			ActiveIPs:   ipam.ActiveIPs,
+		}
+		for _, entry := range ipam.Entries {
+			if entry.Peer == report.Router.Name {
+				status.IPAM.OwnedIPs += int(entry.Size)
+			}
+		}
+	}
+	return status
+}
+
+// putWeaveStatus creates or replaces the WeaveStatus of our node
+func putWeaveStatus(namespace, nodeName string, status WeaveStatusStatus) error {
+	return withClient(func(c *kubernetes.Clientset) error {
+		rc := c.Core().RESTClient()
+		path := []string{"/apis", configGroup, configVersion, "namespaces", namespace, statusResource}
+		obj := WeaveStatus{
+			TypeMeta: unversioned.TypeMeta{Kind: "WeaveStatus", APIVersion: configGroup + "/" + configVersion},
+			Status:   status,
+		}
+		obj.Name, obj.Namespace = nodeName, namespace
+
+		body, err := rc.Get().AbsPath(append(path, nodeName)...).DoRaw()
+		switch {
+		case kubeErrors.IsNotFound(err):
+			data, err := json.Marshal(obj)
+			if err != nil {
+				return err
+			}
+			_, err = rc.Post().AbsPath(path...).Body(data).DoRaw()
+			return err
+		case err != nil:
+			return err
+		}
+
+		var current WeaveStatus
+		if err := json.Unmarshal(body, &current); err != nil {
+			return err
+		}
+		obj.ResourceVersion = current.ResourceVersion
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		_, err = rc.Put().AbsPath(append(path, nodeName)...).Body(data).DoRaw()
+		return err
+	})
+}
+
+// publishStatus periodically summarises the report of the weave router
+// at httpAddr into our node's WeaveStatus, so the health of the whole
+// cluster can be seen with `kubectl get weavestatuses -o yaml`.
+func publishStatus(httpAddr, namespace, nodeName string) {
+	for ; ; time.Sleep(pollInterval) {
+		var status WeaveStatusStatus
+		if report, err := getWeaveReport(httpAddr); err != nil {
+			status.Errors = []string{fmt.Sprintf("unable to get weave report: %v", err)}
+		} else {
+			status = makeWeaveStatus(report)
+		}
+		status.LastUpdate = unversioned.Now()
+		if err := putWeaveStatus(namespace, nodeName, status); err != nil {
+			log.Print("error publishing WeaveStatus: ", err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeWeaveStatus(t *testing.T) {
+	var report weaveReport
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"Version": "1.9.0",
+		"Router": {
+			"Name": "aa:bb:cc:dd:ee:ff",
+			"Encryption": true,
+			"Connections": [
+				{"Address": "10.0.0.2:6783", "State": "established", "Info": "encrypted fastdp"},
+				{"Address": "10.0.0.3:6783", "State": "established", "Info": "encrypted fastdp"},
+				{"Address": "10.0.0.4:6783", "State": "failed", "Info": "connection refused"}
+			]
+		},
+		"IPAM": {
+			"Range": "10.32.0.0/12",
+			"RangeNumIPs": 1048576,
+			"ActiveIPs": 3,
+			"Entries": [
+				{"Token": "10.32.0.0", "Size": 524288, "Peer": "aa:bb:cc:dd:ee:ff"},
+				{"Token": "10.40.0.0", "Size": 524288, "Peer": "11:22:33:44:55:66"}
+			]
+		}
+	}`), &report))
+
+	status := makeWeaveStatus(&report)
+	require.Equal(t, "aa:bb:cc:dd:ee:ff", status.PeerName)
+	require.True(t, status.Encryption)
+	require.Equal(t, map[string]int{"established": 2, "failed": 1}, status.Connections)
+	require.Equal(t, []string{"connection to 10.0.0.4:6783 failed: connection refused"}, status.Errors)
+	require.Equal(t, &WeaveStatusIPAMStatus{
+		Range:       "10.32.0.0/12",
+		RangeNumIPs: 1048576,
+		OwnedIPs:    524288,
+		ActiveIPs:   3,
+	}, status.IPAM)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+
+	api "k8s.io/client-go/pkg/api/v1"
+)
+
+// Node labels holding the availability zone of a node, in order of
+// preference.
+var zoneLabels = []string{
+	"topology.kubernetes.io/zone",
+	"failure-domain.beta.kubernetes.io/zone",
+}
+
+func nodeZone(node api.Node) string {
+	for _, label := range zoneLabels {
+		if zone, found := node.ObjectMeta.Labels[label]; found {
+			return zone
+		}
+	}
+	return ""
+}
+
+// zonePeers picks the subset of nodes that the node called ourName
+// should connect to: every node in its own zone and, if ourName is
+// one of its zone's gateways, the gateways of every other zone. The
+// gateways of a zone are the first numGateways of its nodes, ordered
+// by name, so all nodes agree on them without any coordination.
+//
+// If we cannot determine our zone, or the cluster spans just one
+// zone, all nodes are returned.
+func zonePeers(nodes []api.Node, ourName string, numGateways int) []api.Node {
+	byZone := make(map[string][]api.Node)
+	ourZone, foundUs := "", false
+	for _, node := range nodes {
+		zone := nodeZone(node)
+		byZone[zone] = append(byZone[zone], node)
+		if node.ObjectMeta.Name == ourName {
+			ourZone, foundUs = zone, true
+		}
+	}
+	if !foundUs || ourZone == "" || len(byZone) < 2 {
+		return nodes
+	}
+
+	for _, zoneNodes := range byZone {
+		sort.Sort(nodesByName(zoneNodes))
+	}
+
+	isGateway := false
+	for _, node := range gateways(byZone[ourZone], numGateways) {
+		if node.ObjectMeta.Name == ourName {
+			isGateway = true
+		}
+	}
+
+	peers := append([]api.Node{}, byZone[ourZone]...)
+	if isGateway {
+		for zone, zoneNodes := range byZone {
+			if zone != ourZone {
+				peers = append(peers, gateways(zoneNodes, numGateways)...)
+			}
+		}
+	}
+	return peers
+}
+
+func gateways(zoneNodes []api.Node, numGateways int) []api.Node {
+	if numGateways < 1 {
+		numGateways = 1
+	}
+	if len(zoneNodes) < numGateways {
+		return zoneNodes
+	}
+	return zoneNodes[:numGateways]
+}
+
+type nodesByName []api.Node
+
+func (n nodesByName) Len() int           { return len(n) }
+func (n nodesByName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nodesByName) Less(i, j int) bool { return n[i].ObjectMeta.Name < n[j].ObjectMeta.Name }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "k8s.io/client-go/pkg/api/v1"
+)
+
+func node(name, zone string) api.Node {
+	n := api.Node{}
+	n.ObjectMeta.Name = name
+	if zone != "" {
+		n.ObjectMeta.Labels = map[string]string{"topology.kubernetes.io/zone": zone}
+	}
+	return n
+}
+
+func names(nodes []api.Node) []string {
+	var res []string
+	for _, n := range nodes {
+		res = append(res, n.ObjectMeta.Name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestZonePeers(t *testing.T) {
+	nodes := []api.Node{
+		node("a1", "a"), node("a2", "a"), node("a3", "a"),
+		node("b1", "b"), node("b2", "b"), node("b3", "b"),
+		node("c1", "c"),
+	}
+
+	// A gateway connects to its own zone and the gateways of others
+	require.Equal(t, []string{"a1", "a2", "a3", "b1", "b2", "c1"}, names(zonePeers(nodes, "a1", 2)))
+	// Everyone else stays within their zone
+	require.Equal(t, []string{"a1", "a2", "a3"}, names(zonePeers(nodes, "a3", 2)))
+	require.Equal(t, []string{"a1", "b1", "b2", "b3", "c1"}, names(zonePeers(nodes, "b1", 1)))
+
+	// Unknown node, or no zone information: connect to all
+	require.Len(t, zonePeers(nodes, "z9", 2), len(nodes))
+	flat := []api.Node{node("x", ""), node("y", "")}
+	require.Len(t, zonePeers(flat, "x", 1), 2)
+}
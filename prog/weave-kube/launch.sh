@@ -2,12 +2,57 @@
 
 set -e
 
+# Settings from the cluster-wide WeaveNetConfig, if one is named,
+# override those from the environment
+if [ -n "$WEAVE_CONFIG" ]; then
+    if ! CONFIG_VARS=$(/home/weave/kube-peers --config=$WEAVE_CONFIG); then
+        echo "Failed to get WeaveNetConfig $WEAVE_CONFIG" >&2
+        exit 1
+    fi
+    eval "$CONFIG_VARS"
+    [ -z "$WEAVE_MTU" ] || export WEAVE_MTU
+    case "$WEAVE_ENCRYPTION" in
+        1)
+            if [ -z "$WEAVE_PASSWORD" ]; then
+                echo "WeaveNetConfig $WEAVE_CONFIG requires encryption but WEAVE_PASSWORD is not set" >&2
+                exit 1
+            fi
+            ;;
+        0)
+            unset WEAVE_PASSWORD
+            ;;
+    esac
+    if [ -n "$WEAVE_TRUSTED_SUBNETS" ]; then
+        EXTRA_ARGS="$EXTRA_ARGS --trusted-subnets=$WEAVE_TRUSTED_SUBNETS"
+    fi
+fi
+
 # Default if not supplied - same as weave net default
 IPALLOC_RANGE=${IPALLOC_RANGE:-10.32.0.0/12}
 HTTP_ADDR=${WEAVE_HTTP_ADDR:-127.0.0.1:6784}
 STATUS_ADDR=${WEAVE_STATUS_ADDR:-0.0.0.0:6782}
 HOST_ROOT=${HOST_ROOT:-/host}
 
+# Traffic to ClusterIPs which kube-proxy hasn't translated must not
+# be masqueraded out of the host
+if [ -z "$WEAVE_SERVICE_CIDR" ]; then
+    WEAVE_SERVICE_CIDR=$(/home/weave/kube-peers --service-cidr 2>/dev/null) || true
+fi
+if [ -n "$WEAVE_SERVICE_CIDR" ]; then
+    EXTRA_ARGS="$EXTRA_ARGS --service-cidr=$WEAVE_SERVICE_CIDR"
+fi
+
+# weave-npc must be given the same --netfilter-backend
+if [ -n "$WEAVE_NETFILTER_BACKEND" ]; then
+    EXTRA_ARGS="$EXTRA_ARGS --netfilter-backend=$WEAVE_NETFILTER_BACKEND"
+fi
+
+# Fast datapath encryption replaces each connection's SAs, with fresh
+# keys, once they are this old
+if [ -n "$WEAVE_REKEY_INTERVAL" ]; then
+    EXTRA_ARGS="$EXTRA_ARGS --ipsec-sa-time-hard=$WEAVE_REKEY_INTERVAL"
+fi
+
 # Check if the IP range overlaps anything existing on the host
 /usr/bin/weaveutil netcheck $IPALLOC_RANGE weave
 
@@ -23,7 +68,12 @@ else
     fi
 fi
 
-# Explicitly create the bridge so we can pass --expect-npc
+# Explicitly create the bridge so we can pass --expect-npc. Unlike the
+# CNI plugin and the bridge's address, which weaver sets up itself as
+# retried setup tasks, this stays here: weaver opens the datapath as
+# it starts, before any setup task runs, and creating it, with its
+# fallbacks to a plain bridge and the rules steering traffic through
+# weave-npc, is the weave script's create_bridge.
 WEAVE_NPC_OPTS="--expect-npc"
 if [ "${EXPECT_NPC}" = "0" ]; then
     WEAVE_NPC_OPTS=""
@@ -66,6 +116,18 @@ if [ -z "$IPALLOC_INIT" ]; then
     IPALLOC_INIT="consensus=$(peer_count $KUBE_PEERS)"
 fi
 
+# With zone-aware topology we only connect to peers in our own zone
+# plus a few gateways elsewhere; the consensus count above still
+# needs to cover the whole cluster.
+if [ "${WEAVE_ZONE_AWARE}" = "1" ]; then
+    if ! KUBE_PEERS=$(/home/weave/kube-peers --zone-aware --zone-gateways=${WEAVE_ZONE_GATEWAYS:-2}) || [ -z "$KUBE_PEERS" ]; then
+        echo Failed to get zone-aware peers >&2
+        exit 1
+    fi
+    # Peer discovery would otherwise connect us to every peer anyway
+    EXTRA_ARGS="$EXTRA_ARGS --no-discovery"
+fi
+
 post_start_actions() {
     # Wait for weave process to become responsive
     while true ; do
@@ -73,28 +135,33 @@ post_start_actions() {
         sleep 1
     done
 
-    # Install CNI plugin binary to typical CNI bin location
-    # with fall-back to CNI directory used by kube-up on GCI OS
-    if ! mkdir -p $HOST_ROOT/opt/cni/bin ; then
-        if mkdir -p $HOST_ROOT/home/kubernetes/bin ; then
-            export WEAVE_CNI_PLUGIN_DIR=$HOST_ROOT/home/kubernetes/bin
-        else
-            echo "Failed to install the Weave CNI plugin" >&2
-            exit 1
-        fi
+    if [ "${WEAVE_PUBLISH_STATUS}" = "1" ]; then
+        /home/weave/kube-peers --publish-status --http-addr=$HTTP_ADDR &
     fi
-    mkdir -p $HOST_ROOT/etc/cni/net.d
-    /home/weave/weave --local setup-cni
-
-    # Expose the weave network so host processes can communicate with pods
-    /home/weave/weave --local expose $WEAVE_EXPOSE_IP
 }
 
 post_start_actions &
 
+# Restart, by terminating weaver (which takes over our pid), when the
+# command given exits successfully, i.e. when what it watches changes
+restart_on_change() {
+    (
+        if /home/weave/kube-peers "$@"; then
+            echo "Restarting to pick up changes" >&2
+            kill $$
+        fi
+    ) &
+}
+
+if [ -n "$WEAVE_CONFIG" ]; then
+    restart_on_change --config=$WEAVE_CONFIG --watch-config
+fi
+
 exec /home/weave/weaver $EXTRA_ARGS --port=6783 $BRIDGE_OPTIONS \
      --http-addr=$HTTP_ADDR --status-addr=$STATUS_ADDR --docker-api='' --no-dns \
      --ipalloc-range=$IPALLOC_RANGE $NICKNAME_ARG \
      --ipalloc-init $IPALLOC_INIT \
+     --setup-cni --host-root=$HOST_ROOT \
+     --expose --expose-cidrs=$WEAVE_EXPOSE_IP \
      "$@" \
      $KUBE_PEERS
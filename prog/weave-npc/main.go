@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -8,6 +9,7 @@ import (
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/spf13/cobra"
 	"k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	coreapi "k8s.io/client-go/pkg/api/v1"
 	extnapi "k8s.io/client-go/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/pkg/fields"
@@ -15,6 +17,7 @@ import (
 	"k8s.io/client-go/pkg/util/wait"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/npc"
@@ -24,59 +27,103 @@ import (
 )
 
 var (
-	version     = "unreleased"
-	metricsAddr string
-	logLevel    string
-	allowMcast  bool
+	version      = "unreleased"
+	metricsAddr  string
+	logLevel     string
+	logLevelAddr string
+	allowMcast   bool
+	fastdpPort   int
+	netfilterStr string
+	iptablesMode string
+	dryRun       bool
 )
 
+// bridgeName is that of the bridge weave's script steers traffic to
+// the pods from into MainChain
+const bridgeName = "weave"
+
 func handleError(err error) { common.CheckFatal(err) }
 
-func makeController(getter cache.Getter, resource string,
-	objType runtime.Object, handlers cache.ResourceEventHandlerFuncs) *cache.Controller {
-	listWatch := cache.NewListWatchFromClient(getter, resource, "", fields.Everything())
-	_, controller := cache.NewInformer(listWatch, objType, 0, handlers)
-	return controller
+// Pods which have finished can't send or receive traffic, so there is
+// no need for the apiserver to send them to us; one which finishes is
+// seen as deleted.
+var livePods = fields.ParseSelectorOrDie("status.phase!=Succeeded,status.phase!=Failed")
+
+func makeInformer(getter cache.Getter, resource string, selector fields.Selector,
+	objType runtime.Object, handlers cache.ResourceEventHandlerFuncs) cache.SharedIndexInformer {
+	listWatch := cache.NewListWatchFromClient(getter, resource, "", selector)
+	informer := cache.NewSharedIndexInformer(listWatch, objType, 0, cache.Indexers{})
+	handleError(informer.AddEventHandler(handlers))
+	return informer
 }
 
-func resetIPTables(ipt *iptables.IPTables) error {
-	// Flush chains first so there are no refs to extant ipsets
-	if err := ipt.ClearChain(npc.TableFilter, npc.IngressChain); err != nil {
-		return err
+// runInformers starts each informer once the previous ones have
+// synced, so that e.g. pods are only processed once we know about all
+// namespaces, and policies once all pods are in their ipsets.
+func runInformers(informers ...cache.SharedIndexInformer) {
+	for _, informer := range informers {
+		go informer.Run(wait.NeverStop)
+		if !cache.WaitForCacheSync(wait.NeverStop, informer.HasSynced) {
+			common.Log.Fatal("Failed to sync informer caches")
+		}
 	}
+}
 
-	if err := ipt.ClearChain(npc.TableFilter, npc.DefaultChain); err != nil {
-		return err
-	}
+func resetIPTables(ipt common.IPTablesBackend) error {
+	var b common.Batch
 
-	if err := ipt.ClearChain(npc.TableFilter, npc.MainChain); err != nil {
-		return err
+	// Flush chains first so there are no refs to extant ipsets
+	b.ClearChain(npc.TableFilter, npc.IngressChain)
+	b.ClearChain(npc.TableFilter, npc.DefaultChain)
+	b.ClearChain(npc.TableFilter, npc.MainChain)
+
+	// Exempt pods' traffic is marked before weave's IPsec rules see it:
+	// arriving by its inner destination, which the sender can't forge
+	// its way past, and leaving by its inner source and destination
+	exemptIn := common.OwnedChain{Table: npc.TableMangle, Name: npc.EncryptionExemptChain, Jumps: []common.Jump{
+		{From: "INPUT", Position: common.Top},
+	}}
+	exemptOut := common.OwnedChain{Table: npc.TableMangle, Name: npc.EncryptionExemptOutChain, Jumps: []common.Jump{
+		{From: "OUTPUT", Position: common.Top},
+	}}
+	for _, c := range []common.OwnedChain{exemptIn, exemptOut} {
+		if err := common.Chains.Claim(ipt, "npc", c); err != nil {
+			return err
+		}
 	}
+	b.ClearChain(npc.TableMangle, npc.EncryptionExemptOutChain)
+	b.ClearChain(npc.TableMangle, npc.EncryptionExemptChain)
 
 	// Configure main chain static rules
-	if err := ipt.Append(npc.TableFilter, npc.MainChain,
-		"-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
-		return err
-	}
+	b.Append(npc.TableFilter, npc.MainChain,
+		"-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
 
 	if allowMcast {
-		if err := ipt.Append(npc.TableFilter, npc.MainChain,
-			"-d", "224.0.0.0/4", "-j", "ACCEPT"); err != nil {
-			return err
-		}
-	}
-
-	if err := ipt.Append(npc.TableFilter, npc.MainChain,
-		"-m", "state", "--state", "NEW", "-j", string(npc.DefaultChain)); err != nil {
-		return err
+		b.Append(npc.TableFilter, npc.MainChain,
+			"-d", "224.0.0.0/4", "-j", "ACCEPT")
 	}
 
-	if err := ipt.Append(npc.TableFilter, npc.MainChain,
-		"-m", "state", "--state", "NEW", "-j", string(npc.IngressChain)); err != nil {
-		return err
+	b.Append(npc.TableFilter, npc.MainChain,
+		"-m", "state", "--state", "NEW", "-j", string(npc.DefaultChain))
+
+	b.Append(npc.TableFilter, npc.MainChain,
+		"-m", "state", "--state", "NEW", "-j", string(npc.IngressChain))
+
+	if common.NetfilterNFTablesChosen() {
+		// weave's script steers traffic into MainChain with iptables,
+		// whose chains ours are not, so it only accepts it, and the
+		// steering is done here as it would have been
+		b.ClearChain(npc.TableFilter, "FORWARD")
+		for _, rulespec := range [][]string{
+			{"-o", bridgeName, "-j", npc.MainChain},
+			{"-o", bridgeName, "-m", "state", "--state", "NEW", "-j", "NFLOG", "--nflog-group", "86"},
+			{"-o", bridgeName, "-j", "DROP"},
+		} {
+			b.Append(npc.TableFilter, "FORWARD", rulespec...)
+		}
 	}
 
-	return nil
+	return common.ApplyBatch(ipt, &b)
 }
 
 func resetIPSets(ips ipset.Interface) error {
@@ -101,6 +148,15 @@ func root(cmd *cobra.Command, args []string) {
 		common.Log.Fatalf("Failed to start metrics: %v", err)
 	}
 
+	if logLevelAddr != "" {
+		go func() {
+			common.Log.Infof("Serving /log-level on %s", logLevelAddr)
+			if err := http.ListenAndServe(logLevelAddr, common.LogLevelHTTPHandler()); err != nil {
+				common.Log.Fatalf("Failed to bind log level server: %v", err)
+			}
+		}()
+	}
+
 	if err := ulogd.Start(); err != nil {
 		common.Log.Fatalf("Failed to start ulogd: %v", err)
 	}
@@ -111,17 +167,38 @@ func root(cmd *cobra.Command, args []string) {
 	client, err := kubernetes.NewForConfig(config)
 	handleError(err)
 
-	ipt, err := iptables.New()
+	mode, err := common.SetIPTablesMode(iptablesMode)
+	handleError(err)
+	if mode != "" {
+		common.Log.Infof("Running iptables-%s", mode)
+	}
+	netfilter, err := common.SetNetfilterBackend(netfilterStr)
+	handleError(err)
+	common.Log.Infof("Managing rules with %s", netfilter)
+	common.SetDryRun(dryRun)
+
+	ipt, err := common.NewIPTablesBackend(iptables.ProtocolIPv4)
 	handleError(err)
 
 	ips := ipset.New()
+	if nft, ok := ipt.(*common.NFTables); ok {
+		// Sets must be in the table of the rules matching them
+		ips = ipset.NewNFTables(nft.Table(npc.TableFilter))
+	}
+	if dryRun {
+		ips = ipset.NewDryRun()
+	}
 
 	handleError(resetIPTables(ipt))
 	handleError(resetIPSets(ips))
 
-	npc := npc.New(ipt, ips)
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: client.Core().Events("")})
+	recorder := broadcaster.NewRecorder(coreapi.EventSource{Component: "weave-npc", Host: os.Getenv("HOSTNAME")})
+
+	npc := npc.New(ipt, ips, fastdpPort, recorder)
 
-	nsController := makeController(client.Core().RESTClient(), "namespaces", &coreapi.Namespace{},
+	nsInformer := makeInformer(client.Core().RESTClient(), "namespaces", fields.Everything(), &coreapi.Namespace{},
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				handleError(npc.AddNamespace(obj.(*coreapi.Namespace)))
@@ -141,7 +218,7 @@ func root(cmd *cobra.Command, args []string) {
 				handleError(npc.UpdateNamespace(old.(*coreapi.Namespace), new.(*coreapi.Namespace)))
 			}})
 
-	podController := makeController(client.Core().RESTClient(), "pods", &coreapi.Pod{},
+	podInformer := makeInformer(client.Core().RESTClient(), "pods", livePods, &coreapi.Pod{},
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				handleError(npc.AddPod(obj.(*coreapi.Pod)))
@@ -161,7 +238,7 @@ func root(cmd *cobra.Command, args []string) {
 				handleError(npc.UpdatePod(old.(*coreapi.Pod), new.(*coreapi.Pod)))
 			}})
 
-	npController := makeController(client.Extensions().RESTClient(), "networkpolicies", &extnapi.NetworkPolicy{},
+	npInformer := makeInformer(client.Extensions().RESTClient(), "networkpolicies", fields.Everything(), &extnapi.NetworkPolicy{},
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				handleError(npc.AddNetworkPolicy(obj.(*extnapi.NetworkPolicy)))
@@ -181,13 +258,17 @@ func root(cmd *cobra.Command, args []string) {
 				handleError(npc.UpdateNetworkPolicy(old.(*extnapi.NetworkPolicy), new.(*extnapi.NetworkPolicy)))
 			}})
 
-	go nsController.Run(wait.NeverStop)
-	go podController.Run(wait.NeverStop)
-	go npController.Run(wait.NeverStop)
+	runInformers(nsInformer, podInformer, npInformer)
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-	common.Log.Fatalf("Exiting: %v", <-signals)
+	sig := <-signals
+	if dryRun {
+		for _, line := range common.DryRunDiff() {
+			common.Log.Infof("Dry run diff: %s", line)
+		}
+	}
+	common.Log.Fatalf("Exiting: %v", sig)
 }
 
 func main() {
@@ -198,7 +279,12 @@ func main() {
 
 	rootCmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", ":6781", "metrics server bind address")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "debug", "logging level (debug, info, warning, error)")
+	rootCmd.PersistentFlags().StringVar(&logLevelAddr, "log-level-addr", "", "address on which to serve the runtime log level API (disabled if empty)")
 	rootCmd.PersistentFlags().BoolVar(&allowMcast, "allow-mcast", true, "allow all multicast traffic")
+	rootCmd.PersistentFlags().IntVar(&fastdpPort, "fastdp-port", 6784, "UDP port of weave's fastdp traffic, for encryption exemptions")
+	rootCmd.PersistentFlags().StringVar(&netfilterStr, "netfilter-backend", common.NetfilterIPTables, "how to manage rules: iptables with ipsets, nftables with sets (in tables of its own), firewalld with ipsets (as direct rules, which survive firewalld reloading), or auto, which picks nftables where nft is installed and the iptables binary is missing or is the nft shim; must match weave's WEAVE_NETFILTER_BACKEND")
+	rootCmd.PersistentFlags().StringVar(&iptablesMode, "iptables-mode", common.IPTablesModeAuto, "which variant of iptables to run: legacy, nft, or auto, which picks the one with weave's rules, else that with more rules, where both are installed")
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "netfilter-dry-run", false, "log the changes to rules and ipsets which would be made, and on exit what they would do to the rules, without making them")
 
 	handleError(rootCmd.Execute())
 }
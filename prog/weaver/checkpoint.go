@@ -1,6 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -8,17 +14,45 @@ import (
 	"github.com/weaveworks/go-checkpoint"
 )
 
-var checker *checkpoint.Checker
+var checkSource string
+var nextCheckAt func() time.Time
 var newVersion atomic.Value
 var success atomic.Value
 
 const (
-	updateCheckPeriod = 6 * time.Hour
+	updateCheckPeriod  = 6 * time.Hour
+	updateCheckTimeout = 30 * time.Second
+
+	// Values of --version-check, other than a URL or a file
+	versionCheckCheckpoint = "checkpoint"
+	versionCheckNone       = "none"
 )
 
-func checkForUpdates(dockerVersion string, network string) {
+// parseVersionCheck validates --version-check, which says where to look
+// for new versions: the Weaveworks checkpoint service, nowhere (for
+// air-gapped hosts), an internal mirror serving the same JSON at an
+// http(s) URL, or a file with that JSON in it.
+func parseVersionCheck(source string) (string, error) {
+	switch {
+	case checkpoint.IsCheckDisabled():
+		return versionCheckNone, nil
+	case source == versionCheckCheckpoint || source == versionCheckNone:
+		return source, nil
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		return source, nil
+	case strings.HasPrefix(source, "/"):
+		return source, nil
+	}
+	return "", fmt.Errorf("invalid --version-check %q: must be checkpoint, none, an http(s) URL or an absolute path", source)
+}
+
+func checkForUpdates(source, dockerVersion string, network string) {
 	newVersion.Store("")
 	success.Store(true)
+	checkSource = source
+	if source == versionCheckNone {
+		return
+	}
 
 	handleResponse := func(r *checkpoint.CheckResponse, err error) {
 		if err != nil {
@@ -26,6 +60,7 @@ func checkForUpdates(dockerVersion string, network string) {
 			Log.Printf("Error checking version: %v", err)
 			return
 		}
+		success.Store(true)
 		if r.Outdated {
 			newVersion.Store(r.CurrentVersion)
 			Log.Printf("Weave version %s is available; please update at %s",
@@ -55,6 +90,14 @@ func checkForUpdates(dockerVersion string, network string) {
 		flags["network"] = network
 	}
 
+	if source != versionCheckCheckpoint {
+		next := &atomic.Value{}
+		next.Store(time.Now())
+		nextCheckAt = func() time.Time { return next.Load().(time.Time) }
+		go checkUpdateMetadata(source, next, handleResponse)
+		return
+	}
+
 	// Start background version checking
 	params := checkpoint.CheckParams{
 		Product:       "weave-net",
@@ -62,5 +105,118 @@ func checkForUpdates(dockerVersion string, network string) {
 		SignatureFile: "",
 		Flags:         flags,
 	}
-	checker = checkpoint.CheckInterval(&params, updateCheckPeriod, handleResponse)
+	checker := checkpoint.CheckInterval(&params, updateCheckPeriod, handleResponse)
+	nextCheckAt = checker.NextCheckAt
+}
+
+// checkUpdateMetadata periodically reads the response the checkpoint
+// service would give from source instead. Since that can't tailor it
+// to us, it works out itself whether we are outdated.
+func checkUpdateMetadata(source string, next *atomic.Value, handleResponse func(*checkpoint.CheckResponse, error)) {
+	for {
+		r, err := readUpdateMetadata(source)
+		if err == nil && !r.Outdated {
+			r.Outdated = versionNewer(r.CurrentVersion, version)
+		}
+		next.Store(time.Now().Add(updateCheckPeriod))
+		handleResponse(r, err)
+		time.Sleep(updateCheckPeriod)
+	}
+}
+
+func readUpdateMetadata(source string) (*checkpoint.CheckResponse, error) {
+	var data []byte
+	if strings.HasPrefix(source, "/") {
+		var err error
+		if data, err = ioutil.ReadFile(source); err != nil {
+			return nil, err
+		}
+	} else {
+		client := http.Client{Timeout: updateCheckTimeout}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected response from %s: %s", source, resp.Status)
+		}
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	var r checkpoint.CheckResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("unable to parse update metadata from %s: %s", source, err)
+	}
+	return &r, nil
+}
+
+// versionNewer reports whether release a is later than b, comparing
+// the dot-separated numbers of each, then their pre-release suffixes,
+// as semver does: a release is later than its own pre-releases, e.g.
+// 1.9.0 than 1.9.0-rc1. Anything else, like an "unreleased" build, is
+// never outdated.
+func versionNewer(a, b string) bool {
+	parse := func(v string) (nums []int, pre string) {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.Index(v, "+"); i >= 0 {
+			v = v[:i]
+		}
+		if i := strings.Index(v, "-"); i >= 0 {
+			v, pre = v[:i], v[i+1:]
+		}
+		for _, part := range strings.Split(v, ".") {
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, ""
+			}
+			nums = append(nums, n)
+		}
+		return nums, pre
+	}
+	an, apre := parse(a)
+	bn, bpre := parse(b)
+	if an == nil || bn == nil {
+		return false
+	}
+	for i := 0; i < len(an) && i < len(bn); i++ {
+		if an[i] != bn[i] {
+			return an[i] > bn[i]
+		}
+	}
+	if len(an) != len(bn) {
+		return len(an) > len(bn)
+	}
+	switch {
+	case apre == bpre:
+		return false
+	case apre == "":
+		return true
+	case bpre == "":
+		return false
+	}
+	return preReleaseNewer(strings.Split(apre, "."), strings.Split(bpre, "."))
+}
+
+// preReleaseNewer compares the dot-separated fields of two pre-release
+// suffixes: numerically where both are numbers, which sort before the
+// rest, and otherwise as strings; of two otherwise equal, the longer is
+// later.
+func preReleaseNewer(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		an, aerr := strconv.Atoi(a[i])
+		bn, berr := strconv.Atoi(b[i])
+		switch {
+		case aerr == nil && berr == nil:
+			return an > bn
+		case aerr == nil || berr == nil:
+			return berr == nil
+		}
+		return a[i] > b[i]
+	}
+	return len(a) > len(b)
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionNewer(t *testing.T) {
+	require.True(t, versionNewer("1.9.1", "1.9.0"))
+	require.True(t, versionNewer("1.10.0", "1.9.4"))
+	require.True(t, versionNewer("v2.0", "1.9.4"))
+	require.True(t, versionNewer("1.9.0.1", "1.9.0"))
+	require.False(t, versionNewer("1.9.0", "1.9.0"))
+	require.True(t, versionNewer("1.9.0", "1.9.0-rc1"))
+	require.False(t, versionNewer("1.9.0-rc1", "1.9.0"))
+	require.True(t, versionNewer("1.9.0-rc2", "1.9.0-rc1"))
+	require.True(t, versionNewer("1.9.0-rc.10", "1.9.0-rc.9"))
+	require.True(t, versionNewer("1.9.0-rc", "1.9.0-beta.2"))
+	require.True(t, versionNewer("1.9.0-rc.1", "1.9.0-rc"))
+	require.False(t, versionNewer("1.9.0+build2", "1.9.0+build1"))
+	require.True(t, versionNewer("1.9.1-rc1", "1.9.0"))
+	require.False(t, versionNewer("1.8.2", "1.9.0"))
+	require.False(t, versionNewer("1.9.0", "unreleased"))
+}
+
+func TestReadUpdateMetadataFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weave-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "update.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"current_version": "1.9.1"}`), 0644))
+
+	r, err := readUpdateMetadata(path)
+	require.NoError(t, err)
+	require.Equal(t, "1.9.1", r.CurrentVersion)
+
+	_, err = parseVersionCheck("mirror.example.com")
+	require.Error(t, err)
+}
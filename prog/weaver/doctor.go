@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// bridgeDoctor periodically checks the host plumbing for the weave
+// bridge, since NetworkManager and other agents regularly break it,
+// and keeps the results of the last check for `weave report`.
+type bridgeDoctor struct {
+	sync.Mutex
+	doctor    weavenet.BridgeDoctor
+	diagnose  func() []weavenet.Divergence // doctor.Check, unless faked
+	lastCheck time.Time
+	found     []weavenet.Divergence
+}
+
+type BridgeDoctorStatus struct {
+	LastCheck   time.Time
+	Divergences []weavenet.Divergence `json:"Divergences,omitempty"`
+}
+
+func newBridgeDoctor(doctor weavenet.BridgeDoctor) *bridgeDoctor {
+	d := &bridgeDoctor{doctor: doctor}
+	d.diagnose = d.doctor.Check
+	return d
+}
+
+func (d *bridgeDoctor) start(interval time.Duration) {
+	go func() {
+		for {
+			d.check()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (d *bridgeDoctor) check() {
+	found := d.diagnose()
+	d.Lock()
+	previous := make(map[weavenet.Divergence]bool, len(d.found))
+	for _, div := range d.found {
+		previous[div] = true
+	}
+	d.lastCheck = time.Now()
+	d.found = found
+	d.Unlock()
+	// Only log what's new, or an unrepairable problem would be logged
+	// on every check
+	for _, div := range found {
+		switch {
+		case div.Repaired:
+			Log.Warningf("Bridge doctor: %s: %s; repaired", div.Check, div.Problem)
+		case !previous[div]:
+			Log.Errorf("Bridge doctor: %s: %s", div.Check, div.Problem)
+		}
+	}
+}
+
+func (d *bridgeDoctor) Status() *BridgeDoctorStatus {
+	if d == nil {
+		return nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.lastCheck.IsZero() {
+		return nil
+	}
+	return &BridgeDoctorStatus{LastCheck: d.lastCheck, Divergences: append([]weavenet.Divergence(nil), d.found...)}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+func TestBridgeDoctorStatus(t *testing.T) {
+	var nilDoctor *bridgeDoctor
+	require.Nil(t, nilDoctor.Status())
+
+	var divergences []weavenet.Divergence
+	d := newBridgeDoctor(weavenet.BridgeDoctor{})
+	d.diagnose = func() []weavenet.Divergence { return divergences }
+	require.Nil(t, d.Status(), "before the first check")
+
+	d.check()
+	status := d.Status()
+	require.NotNil(t, status)
+	require.False(t, status.LastCheck.IsZero())
+	require.Empty(t, status.Divergences)
+
+	divergences = []weavenet.Divergence{{Check: "sysctl", Problem: "IP forwarding is disabled"}}
+	d.check()
+	status = d.Status()
+	require.Equal(t, divergences, status.Divergences)
+	// The status is a copy, which later checks leave alone
+	status.Divergences[0].Problem = "changed"
+	require.Equal(t, "IP forwarding is disabled", d.Status().Divergences[0].Problem)
+}
+
+func TestBridgeDoctorLogsChanges(t *testing.T) {
+	var out bytes.Buffer
+	origOut := Log.Out
+	Log.Out = &out
+	defer func() { Log.Out = origOut }()
+
+	var divergences []weavenet.Divergence
+	d := newBridgeDoctor(weavenet.BridgeDoctor{})
+	d.diagnose = func() []weavenet.Divergence { return divergences }
+	logged := func() int {
+		n := strings.Count(out.String(), "Bridge doctor:")
+		out.Reset()
+		return n
+	}
+
+	unrepairable := weavenet.Divergence{Check: "sysctl", Problem: "IP forwarding is disabled"}
+	repaired := weavenet.Divergence{Check: "bridge", Problem: `"weave" is down`, Repaired: true}
+	divergences = []weavenet.Divergence{unrepairable, repaired}
+	d.check()
+	require.Equal(t, 2, logged())
+	// A problem which persists is logged once, a repair each time
+	d.check()
+	require.Equal(t, 1, logged())
+	divergences = nil
+	d.check()
+	require.Equal(t, 0, logged())
+	divergences = []weavenet.Divergence{unrepairable}
+	d.check()
+	require.Equal(t, 1, logged(), "a problem which comes back")
+}
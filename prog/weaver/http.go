@@ -12,15 +12,38 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/weaveworks/mesh"
 
-	"github.com/weaveworks/go-checkpoint"
+	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/ipam"
 	"github.com/weaveworks/weave/nameserver"
 	"github.com/weaveworks/weave/net/address"
+	"github.com/weaveworks/weave/net/ipsec"
+	"github.com/weaveworks/weave/net/wireguard"
 	weave "github.com/weaveworks/weave/router"
 )
 
 var allConnectionStates = []string{"established", "pending", "retrying", "failed", "connecting"}
 
+var allEncryptionStates = []string{"encrypted", "unencrypted"}
+
+// connectionEncryptionCounts counts established connections by whether
+// they are encrypted. With a password, connections to peers in
+// TrustedSubnets are not, which is how encryption is rolled out a few
+// peers at a time, so it matters which state each is in.
+func connectionEncryptionCounts(conns []mesh.LocalConnectionStatus) map[string]int {
+	counts := make(map[string]int)
+	for _, conn := range conns {
+		if conn.State != "established" {
+			continue
+		}
+		if encrypted, _ := conn.Attrs["encrypted"].(bool); encrypted {
+			counts["encrypted"]++
+		} else {
+			counts["unencrypted"]++
+		}
+	}
+	return counts
+}
+
 var rootTemplate = template.New("root").Funcs(map[string]interface{}{
 	"countDNSEntries": countDNSEntries,
 	"printList": func(list []string) string {
@@ -91,6 +114,12 @@ var rootTemplate = template.New("root").Funcs(map[string]interface{}{
 		}
 		return printCounts(counts, allConnectionStates)
 	},
+	"printAge": func(t time.Time) string {
+		return (time.Since(t) / time.Second * time.Second).String()
+	},
+	"printEncryptionCounts": func(conns []mesh.LocalConnectionStatus) string {
+		return printCounts(connectionEncryptionCounts(conns), allEncryptionStates)
+	},
 	"printPeerConnectionCounts": func(peers []mesh.PeerStatus) string {
 		counts := make(map[string]int)
 		for _, peer := range peers {
@@ -165,7 +194,7 @@ var statusTemplate = defTemplate("status", `\
 {{.Router.ProtocolMinVersion}}..{{.Router.ProtocolMaxVersion}}\
 {{end}}
            Name: {{.Router.Name}}({{.Router.NickName}})
-     Encryption: {{printState .Router.Encryption}}
+     Encryption: {{printState .Router.Encryption}}{{if .Router.Encryption}}{{with printEncryptionCounts .Router.Connections}} ({{.}} connections){{end}}{{end}}
   PeerDiscovery: {{printState .Router.PeerDiscovery}}
         Targets: {{len .Router.Targets}}
     Connections: {{len .Router.Connections}}{{with printConnectionCounts .Router.Connections}} ({{.}}){{end}}
@@ -202,6 +231,20 @@ var statusTemplate = defTemplate("status", `\
             TTL: {{.DNS.TTL}}
         Entries: {{countDNSEntries .DNS.Entries}}
 {{end}}\
+{{if .Setup}}\
+
+        Service: setup
+{{range .Setup}}\
+{{printf "%15v" .Name}}: {{.State}}{{if .LastError}} after {{.Attempts}} attempts - {{.LastError}}{{end}}
+{{end}}\
+{{end}}\
+{{if .BridgeDoctor}}{{if .BridgeDoctor.Divergences}}\
+
+        Service: bridge-doctor
+{{range .BridgeDoctor.Divergences}}\
+{{printf "%15v" .Check}}: {{.Problem}}{{if .Repaired}} (repaired){{end}}
+{{end}}\
+{{end}}{{end}}\
 `)
 
 var targetsTemplate = defTemplate("targetsTemplate", `\
@@ -211,7 +254,7 @@ var targetsTemplate = defTemplate("targetsTemplate", `\
 
 var connectionsTemplate = defTemplate("connectionsTemplate", `\
 {{range .Router.Connections}}\
-{{if .Outbound}}->{{else}}<-{{end}} {{printf "%-21v" .Address}} {{printf "%-11v" .State}} {{.Info}} {{range $key,$element := .Attrs}}{{if ne $key "name"}}{{$key}}={{$element}}{{end}}{{end}}
+{{if .Outbound}}->{{else}}<-{{end}} {{printf "%-21v" .Address}} {{printf "%-11v" .State}} {{.Info}}{{range $key,$element := .Attrs}}{{if ne $key "name"}} {{$key}}={{$element}}{{end}}{{end}}
 {{end}}\
 `)
 
@@ -238,8 +281,15 @@ var dnsEntriesTemplate = defTemplate("dnsEntries", `\
 
 var ipamTemplate = defTemplate("ipamTemplate", `{{printIPAMRanges .Router .IPAM}}`)
 
+var ipsecTemplate = defTemplate("ipsecTemplate", `\
+{{range .IPSec}}\
+{{printf "%-3v" .Direction}} {{.Peer}} {{printf "%-15v" .Src}} -> {{printf "%-15v" .Dst}} spi=0x{{printf "%08x" .SPI}} {{printf "%-17v" .Algorithm}} {{printAge .Established}} bytes={{.Bytes}} packets={{.Packets}}{{if .Offloaded}} offloaded{{end}}
+{{end}}\
+`)
+
 type VersionCheck struct {
 	Enabled     bool
+	Source      string `json:"Source,omitempty"`
 	Success     bool
 	NewVersion  string
 	NextCheckAt time.Time
@@ -247,14 +297,15 @@ type VersionCheck struct {
 
 func versionCheck() *VersionCheck {
 	v := &VersionCheck{}
-	if checkpoint.IsCheckDisabled() {
+	if checkSource == "" || checkSource == versionCheckNone {
 		return v
 	}
 
 	v.Enabled = true
+	v.Source = checkSource
 	v.Success = success.Load().(bool)
 	v.NewVersion = newVersion.Load().(string)
-	v.NextCheckAt = checker.NextCheckAt()
+	v.NextCheckAt = nextCheckAt()
 
 	return v
 }
@@ -264,7 +315,7 @@ func (v *VersionCheck) String() string {
 	case !v.Enabled:
 		return "version check update disabled"
 	case !v.Success:
-		return fmt.Sprintf("failed to check latest version - see logs; next check at %s", v.NextCheckAt.Format("2006/01/02 15:04:05"))
+		return fmt.Sprintf("failed to check latest version from %s - see logs; next check at %s", v.Source, v.NextCheckAt.Format("2006/01/02 15:04:05"))
 	case v.NewVersion != "":
 		return fmt.Sprintf("version %s available - please upgrade!", v.NewVersion)
 	default:
@@ -278,17 +329,25 @@ type WeaveStatus struct {
 	Router       *weave.NetworkRouterStatus `json:"Router,omitempty"`
 	IPAM         *ipam.Status               `json:"IPAM,omitempty"`
 	DNS          *nameserver.Status         `json:"DNS,omitempty"`
+	Setup        []SetupTaskStatus          `json:"Setup,omitempty"`
+	Startup      []StartupStepStatus        `json:"Startup,omitempty"`
+	BridgeDoctor *BridgeDoctorStatus        `json:"BridgeDoctor,omitempty"`
+	IPSec        []ipsec.SAStatus           `json:"IPSec,omitempty"`
 }
 
 // Read-only functions, suitable for exposing on an unprotected socket
-func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) {
+func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, setup setupTasks, startup *startupStages, doctor *bridgeDoctor, ipSec *ipsec.IPSec) {
 	status := func() WeaveStatus {
 		return WeaveStatus{
 			version,
 			versionCheck(),
 			weave.NewNetworkRouterStatus(router),
 			ipam.NewStatus(allocator, defaultSubnet),
-			nameserver.NewStatus(ns, dnsserver)}
+			nameserver.NewStatus(ns, dnsserver),
+			setup.Status(),
+			startup.Status(),
+			doctor.Status(),
+			ipSec.Status()}
 	}
 	muxRouter.Methods("GET").Path("/report").Headers("Accept", "application/json").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -337,4 +396,45 @@ func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRout
 	defHandler("/status/peers", peersTemplate)
 	defHandler("/status/dns", dnsEntriesTemplate)
 	defHandler("/status/ipam", ipamTemplate)
+	defHandler("/status/ipsec", ipsecTemplate)
+}
+
+// NetfilterReport is every chain, iptables rule, xfrm policy and SA
+// weave believes it owns, each with the part of weave which owns it
+// or the peer it is for, for support bundles and for finding out who
+// put a rule in place
+type NetfilterReport struct {
+	Chains   []common.ReportedChain
+	Rules    []common.ReportedRule
+	Policies []ipsec.ReportedPolicy `json:",omitempty"`
+	SAs      []ipsec.SAStatus       `json:",omitempty"`
+}
+
+// handleNetfilterReport serves the NetfilterReport, in JSON, on
+// /report/netfilter
+func handleNetfilterReport(muxRouter *mux.Router, bridgeRules *common.Reconciler, ipSec *ipsec.IPSec, wg *wireguard.WireGuard) {
+	muxRouter.Methods("GET").Path("/report/netfilter").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Those of --service-cidr and --ipsec-clamp-mss, in the
+			// chains net holds as "bridge"
+			report := NetfilterReport{Chains: common.Chains.Report(), Rules: bridgeRules.Report("bridge")}
+			ipsecReport, err := ipSec.Report()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if ipsecReport != nil {
+				report.Rules = append(report.Rules, ipsecReport.Rules...)
+				report.Policies, report.SAs = ipsecReport.Policies, ipsecReport.SAs
+			}
+			report.Rules = append(report.Rules, wg.Report()...)
+			json, err := json.MarshalIndent(report, "", "    ")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				Log.Error("Error during netfilter report marshalling: ", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(json)
+		})
 }
@@ -25,6 +25,8 @@ import (
 	"github.com/weaveworks/weave/nameserver"
 	weavenet "github.com/weaveworks/weave/net"
 	"github.com/weaveworks/weave/net/address"
+	"github.com/weaveworks/weave/net/ipsec"
+	"github.com/weaveworks/weave/net/wireguard"
 	weave "github.com/weaveworks/weave/router"
 )
 
@@ -142,7 +144,40 @@ func main() {
 		datapathName       string
 		trustedSubnetStr   string
 		dbPrefix           string
+		dbBackend          string
+		dbKV               db.KVConfig
 		isAWSVPC           bool
+		setupCNI           bool
+		hostRoot           string
+		cniPluginSource    string
+		expose             bool
+		exposeCIDRsStr     string
+		serviceCIDRStr     string
+		instanceName       string
+		netnsPath          string
+		doctorInterval     time.Duration
+		simulate           bool
+		gossipLimits       weave.GossipLimits
+		versionCheckStr    string
+		ipsecConfig        ipsec.Config
+		ipsecAlgorithmsStr string
+		ipsecReplayWindow  int
+		ipsecAuditSpec     string
+		ipsecJournal       string
+		ipsecMarkStr       string
+		ipsecJumpPosStr    string
+		ipsecKeySourceSpec string
+		ipsecCompressStr   string
+		ipsecInLimitsStr   string
+		ipsecOutLimitsStr  string
+		ipsecNoTrackStr    string
+		ipsecClampMSS      bool
+		encryptionStr      string
+		wireguardPort      int
+		netfilterStr       string
+		iptablesModeStr    string
+		reconcileInterval  time.Duration
+		netfilterDryRun    bool
 
 		defaultDockerHost = "unix:///var/run/docker.sock"
 	)
@@ -183,7 +218,63 @@ func main() {
 	mflag.StringVar(&datapathName, []string{"-datapath"}, "", "ODP datapath name")
 	mflag.StringVar(&trustedSubnetStr, []string{"-trusted-subnets"}, "", "comma-separated list of trusted subnets in CIDR notation")
 	mflag.StringVar(&dbPrefix, []string{"-db-prefix"}, "/weavedb/weave", "pathname/prefix of filename to store data")
+	mflag.StringVar(&dbBackend, []string{"-db-backend"}, db.BoltBackend, "where to store data: bolt or json (files under --db-prefix), consul or etcd (a key/value store at --db-kv-addr)")
+	mflag.StringVar(&dbKV.Addr, []string{"-db-kv-addr"}, "", "address of the Consul or etcd server, with --db-backend=consul or etcd")
+	mflag.StringVar(&dbKV.Prefix, []string{"-db-kv-prefix"}, "", "key prefix under which to store data in Consul or etcd (default weave/<hostname>)")
+	mflag.StringVar(&dbKV.Token, []string{"-db-kv-token"}, "", "Consul ACL token (default $WEAVE_DB_KV_TOKEN)")
+	mflag.StringVar(&dbKV.Username, []string{"-db-kv-user"}, "", "etcd user to authenticate as, with the password in $WEAVE_DB_KV_PASSWORD")
+	mflag.StringVar(&dbKV.CAFile, []string{"-db-kv-ca"}, "", "PEM file of the CA certificates to verify the Consul or etcd server with, over TLS")
+	mflag.StringVar(&dbKV.CertFile, []string{"-db-kv-cert"}, "", "PEM file of the client certificate to present to the Consul or etcd server, over TLS")
+	mflag.StringVar(&dbKV.KeyFile, []string{"-db-kv-key"}, "", "PEM file of the key of --db-kv-cert")
 	mflag.BoolVar(&isAWSVPC, []string{"-awsvpc"}, false, "use AWS VPC for routing")
+	mflag.BoolVar(&setupCNI, []string{"-setup-cni"}, false, "install the CNI plugin and its default configuration on the host")
+	mflag.StringVar(&hostRoot, []string{"-host-root"}, "", "where the host's root filesystem is mounted, for --setup-cni")
+	mflag.StringVar(&cniPluginSource, []string{"-cni-plugin-source"}, "/usr/bin/weaveutil", "CNI plugin binary to install with --setup-cni")
+	mflag.BoolVar(&expose, []string{"-expose"}, false, "give the weave bridge an address allocated by IPAM, like 'weave expose'")
+	mflag.StringVar(&exposeCIDRsStr, []string{"-expose-cidrs"}, "", "comma-separated list of addresses, in CIDR notation, to give the bridge with --expose instead of one in the default subnet")
+	mflag.StringVar(&instanceName, []string{"-instance"}, "", "name of this weave network, when running several on one host; determines the bridge, datapath and iptables chain names, including those of encryption, which each network then keeps to its own (give each a different --ipsec-mark)")
+	mflag.StringVar(&netnsPath, []string{"-netns"}, "", "path of a network namespace, e.g. /var/run/netns/<name>, in which to run instead of the current one")
+	mflag.DurationVar(&doctorInterval, []string{"-bridge-doctor-interval"}, time.Minute, "how often to check, and where safe repair, the bridge, veths, sysctls and addresses weave set up on the host (0 to disable)")
+	mflag.BoolVar(&simulate, []string{"-simulate"}, false, "run without touching the kernel, with the datapath, firewall rules and IPsec security associations held in memory, for testing as an unprivileged process; requires --name")
+	mflag.StringVar(&versionCheckStr, []string{"-version-check"}, versionCheckCheckpoint, "where to check for new versions: checkpoint (the Weaveworks service), none, the http(s) URL of a mirror, or the absolute path of a file with the same JSON in it")
+	mflag.Float64Var(&gossipLimits.Rate, []string{"-gossip-rate-limit"}, 200, "IPAM and DNS gossip messages each processes per second, beyond which they are queued (0 for no limit)")
+	mflag.IntVar(&gossipLimits.Burst, []string{"-gossip-burst"}, 400, "IPAM and DNS gossip messages each may process at once beyond --gossip-rate-limit")
+	mflag.IntVar(&gossipLimits.Queue, []string{"-gossip-queue"}, 1000, "IPAM and DNS gossip messages each queues before dropping the oldest")
+	mflag.StringVar(&encryptionStr, []string{"-fastdp-encryption"}, "ipsec", "how to encrypt fast datapath traffic when a password is set: ipsec, or wireguard (needs Linux 5.6 or later, and is only used with peers which also set this)")
+	mflag.IntVar(&wireguardPort, []string{"-wireguard-port"}, wireguard.DefaultPort, "with --fastdp-encryption wireguard, UDP port on which WireGuard receives")
+	mflag.StringVar(&netfilterStr, []string{"-netfilter-backend"}, common.NetfilterIPTables, "how fast datapath encryption manages its firewall rules: iptables, nftables (in tables of its own, with nft), firewalld (as direct rules, with firewall-cmd, which survive firewalld reloading), or auto, which picks nftables where nft is installed and the iptables binary is missing or is the nft shim")
+	mflag.StringVar(&iptablesModeStr, []string{"-iptables-mode"}, common.IPTablesModeAuto, "which variant of iptables to run: legacy, nft, or auto, which picks the one with weave's rules, else that with more rules, where both are installed")
+	mflag.DurationVar(&reconcileInterval, []string{"-netfilter-reconcile-interval"}, 30*time.Second, "how often to put back the iptables rules of fast datapath encryption, IPsec or WireGuard, --service-cidr and --ipsec-clamp-mss which have gone, e.g. flushed by a firewall reload (0 to disable)")
+	mflag.BoolVar(&netfilterDryRun, []string{"-netfilter-dry-run"}, false, "log the changes to iptables rules which would be made, and on exit what they would do to the rules, without making them")
+	mflag.StringVar(&ipsecAlgorithmsStr, []string{"-ipsec-algorithms"}, "", "with fast datapath encryption, comma-separated list of algorithms to use, most preferred first, out of aes-gcm (always supported) and chacha20-poly1305 (faster without AES-NI; needs Linux 4.2 or later); by default, chacha20-poly1305 is preferred where the CPU has no AES instructions, and otherwise only used with peers which have none")
+	mflag.IntVar(&ipsecConfig.EncapPort, []string{"-ipsec-encap-port"}, 0, "with fast datapath encryption, UDP port on which to receive ESP encapsulated in UDP, used with peers which also set this, to get through NAT and firewalls which drop ESP (0 to disable)")
+	mflag.BoolVar(&ipsecConfig.Offload, []string{"-ipsec-offload"}, false, "with fast datapath encryption, offload security associations to the network interface's hardware where it supports that (falls back to software otherwise)")
+	mflag.StringVar(&ipsecMarkStr, []string{"-ipsec-mark"}, ipsec.DefaultMark.String(), "with fast datapath encryption, firewall mark, as value/mask, with which traffic to encrypt is marked and its IPsec policies selected; change it if other software on the host uses the same bits")
+	mflag.StringVar(&ipsecJumpPosStr, []string{"-ipsec-jump-position"}, "bottom", "with fast datapath encryption, where in mangle OUTPUT the rule jumping to the chain marking traffic to encrypt goes, and is kept: top, bottom, or after:<regexp>, just after the last rule matching it as iptables -S prints it, e.g. of other software which must see the traffic first")
+	mflag.BoolVar(&ipsecClampMSS, []string{"-ipsec-clamp-mss"}, false, "with fast datapath encryption, clamp the MSS of TCP connections through the weave bridge to the path MTU, so that large transfers don't hang where ICMP needed for path MTU discovery is blocked")
+	mflag.StringVar(&ipsecCompressStr, []string{"-ipsec-compress-subnets"}, "", "with fast datapath encryption, comma-separated list of subnets in CIDR notation, e.g. across a WAN, of peers from which to have traffic compressed with IPComp (deflate), where they support it; peers in --trusted-subnets are not encrypted, so not compressed either")
+	mflag.BoolVar(&ipsecConfig.StrictIngress, []string{"-ipsec-strict-ingress"}, false, "with fast datapath encryption, drop unencrypted traffic to the data port from any host, not only from peers connected with encryption; peers in --trusted-subnets are still let in")
+	mflag.DurationVar(&ipsecConfig.StrictIngressGrace, []string{"-ipsec-strict-ingress-grace"}, ipsec.DefaultStrictIngressGrace, "with --ipsec-strict-ingress, how long after starting to wait before dropping anything, so that peers not yet restarted with encryption, while enabling it across a cluster, are not cut off (0 to drop at once)")
+	mflag.BoolVar(&ipsecConfig.TunnelMode, []string{"-ipsec-tunnel-mode"}, false, "with fast datapath encryption, use tunnel rather than transport mode security associations, encapsulating the whole overlay packet, with peers which also set this")
+	mflag.BoolVar(&ipsecConfig.ConnMark, []string{"-ipsec-connmark"}, false, "with fast datapath encryption, save the mark of traffic to encrypt to its conntrack entry, so that only the first packet of each flow goes through the iptables rules of every connection")
+	mflag.StringVar(&ipsecNoTrackStr, []string{"-ipsec-notrack"}, "", "with fast datapath encryption, comma-separated list of the traffic to exempt from conntrack, with rules in the raw table, so that on busy hosts it doesn't fill the conntrack table, past which packets are dropped: data-port, the overlay traffic of the data port of each connection (not with --ipsec-connmark), and esp, including ESP in UDP to and from --ipsec-encap-port")
+	mflag.BoolVar(&ipsecConfig.FIPS, []string{"-ipsec-fips"}, false, "with fast datapath encryption, only allow FIPS 140-2 approved algorithms, i.e. aes-gcm, and refuse to start unless the kernel supports them")
+	mflag.StringVar(&ipsecKeySourceSpec, []string{"-ipsec-key-source"}, "", "with fast datapath encryption, take the session keys of security associations from exec:<path>, a program run with the names of the two peers which prints their key, e.g. fetched from a key management system, rather than from the handshake; all peers must set this")
+	mflag.StringVar(&ipsecJournal, []string{"-ipsec-journal"}, "", "with fast datapath encryption, file recording the kernel state created, to clean up after a crash (default under --db-prefix; none with --db-backend=consul or etcd)")
+	mflag.StringVar(&ipsecAuditSpec, []string{"-ipsec-audit"}, "", "with fast datapath encryption, where to record when security associations are created, rekeyed, expired and destroyed: file:<path> to append JSON lines to a file, or syslog")
+	mflag.IntVar(&ipsecReplayWindow, []string{"-ipsec-replay-window"}, ipsec.DefaultReplayWindow, fmt.Sprintf("with fast datapath encryption, number of packets by which ESP may arrive out of order before being dropped as replayed (at most %d); raise it on links which reorder a lot, e.g. bonded or multipath", ipsec.MaxReplayWindow))
+	mflag.Float64Var(&ipsecConfig.LimitsJitter, []string{"-ipsec-sa-jitter"}, 0, "with fast datapath encryption, fraction, from 0 to 1, by which to reduce the --ipsec-sa-* limits at random for each security association, so that those set up together are not all replaced together")
+	mflag.DurationVar(&ipsecConfig.RekeyOverlap, []string{"-ipsec-rekey-overlap"}, ipsec.DefaultRekeyOverlap, "with fast datapath encryption, how long to keep accepting traffic with the inbound security association of a closed connection, while the peer switches to that of a new one (0 to remove it at once)")
+	mflag.DurationVar(&ipsecConfig.DeadPeerTimeout, []string{"-ipsec-dead-peer-timeout"}, ipsec.DefaultDeadPeerTimeout, fmt.Sprintf("with fast datapath encryption, close a connection, and remove its security associations, when nothing has been received over it for this long (at least %s; 0 to only rely on heartbeats)", 2*weave.SlowHeartbeat))
+	mflag.DurationVar(&ipsecConfig.Limits.TimeSoft, []string{"-ipsec-sa-time-soft"}, 0, "with fast datapath encryption, age at which the kernel notifies that a security association should be replaced (0 for no limit)")
+	mflag.DurationVar(&ipsecConfig.Limits.TimeHard, []string{"-ipsec-sa-time-hard"}, 0, "with fast datapath encryption, age at which a security association expires and its connection is re-established with fresh keys (0 for no limit)")
+	mflag.Uint64Var(&ipsecConfig.Limits.ByteSoft, []string{"-ipsec-sa-bytes-soft"}, 0, "as --ipsec-sa-time-soft, but bytes sent or received")
+	mflag.Uint64Var(&ipsecConfig.Limits.ByteHard, []string{"-ipsec-sa-bytes-hard"}, 0, "as --ipsec-sa-time-hard, but bytes sent or received")
+	mflag.Uint64Var(&ipsecConfig.Limits.PacketSoft, []string{"-ipsec-sa-packets-soft"}, 0, "as --ipsec-sa-time-soft, but packets sent or received")
+	mflag.Uint64Var(&ipsecConfig.Limits.PacketHard, []string{"-ipsec-sa-packets-hard"}, 0, "as --ipsec-sa-time-hard, but packets sent or received")
+	mflag.StringVar(&ipsecInLimitsStr, []string{"-ipsec-sa-inbound-limits"}, "", "with fast datapath encryption, comma-separated list of limits of inbound security associations, e.g. time-hard=2h, out of time-soft, time-hard, bytes-soft, bytes-hard, packets-soft and packets-hard, overriding those of the --ipsec-sa-* options")
+	mflag.StringVar(&ipsecOutLimitsStr, []string{"-ipsec-sa-outbound-limits"}, "", "as --ipsec-sa-inbound-limits, but of outbound security associations; e.g. with a lower time-hard than inbound, this peer's outbound security associations expire first, so it drives the rekeying of its connections")
+	mflag.StringVar(&serviceCIDRStr, []string{"-service-cidr"}, "", "Kubernetes service CIDR; traffic from containers to it which kube-proxy didn't translate is rejected instead of masqueraded")
 
 	// crude way of detecting that we probably have been started in a
 	// container, with `weave launch` --> suppress misleading paths in
@@ -207,6 +298,102 @@ func main() {
 		os.Exit(0)
 	}
 
+	if simulate {
+		switch {
+		case routerName == "":
+			Log.Fatal("--simulate requires --name, since there is no bridge to take it from")
+		case datapathName != "" || ifaceName != "" || isAWSVPC:
+			Log.Fatal("--simulate is not compatible with --datapath, --iface or --awsvpc")
+		case setupCNI || expose || serviceCIDRStr != "" || netnsPath != "" || ipsecClampMSS:
+			Log.Fatal("--simulate is not compatible with options which set up the host")
+		case encryptionStr != "ipsec":
+			Log.Fatal("--simulate only simulates --fastdp-encryption ipsec")
+		}
+	}
+
+	if netnsPath != "" {
+		// Before we start anything which cares which namespace it is in
+		checkFatal(weavenet.ExecInNetNS(netnsPath))
+	}
+
+	versionCheckSource, err := parseVersionCheck(versionCheckStr)
+	checkFatal(err)
+
+	checkFatal(checkSALimits(ipsecConfig.Limits))
+	ipsecConfig.InLimits, err = parseSALimits("--ipsec-sa-inbound-limits", ipsecInLimitsStr, ipsecConfig.Limits)
+	checkFatal(err)
+	ipsecConfig.OutLimits, err = parseSALimits("--ipsec-sa-outbound-limits", ipsecOutLimitsStr, ipsecConfig.Limits)
+	checkFatal(err)
+	if ipsecConfig.LimitsJitter < 0 || ipsecConfig.LimitsJitter >= 1 {
+		Log.Fatalf("--ipsec-sa-jitter must be at least 0 and less than 1")
+	}
+	if ipsecConfig.DeadPeerTimeout != 0 && ipsecConfig.DeadPeerTimeout < 2*weave.SlowHeartbeat {
+		Log.Fatalf("--ipsec-dead-peer-timeout must be 0 or at least %s", 2*weave.SlowHeartbeat)
+	}
+	if ipsecConfig.RekeyOverlap < 0 {
+		Log.Fatalf("--ipsec-rekey-overlap must not be negative")
+	}
+	if ipsecConfig.StrictIngressGrace < 0 {
+		Log.Fatalf("--ipsec-strict-ingress-grace must not be negative")
+	}
+	if ipsecReplayWindow < 1 || ipsecReplayWindow > ipsec.MaxReplayWindow {
+		Log.Fatalf("--ipsec-replay-window must be between 1 and %d", ipsec.MaxReplayWindow)
+	}
+	ipsecConfig.ReplayWindow = uint32(ipsecReplayWindow)
+	ipsecConfig.Algorithms, err = ipsec.ParseAlgorithms(ipsecAlgorithmsStr)
+	checkFatal(err)
+	// The journal is of this boot's kernel state, so is kept on the host
+	// even where our data is kept off it, and only if asked for there
+	ipsecConfig.Journal = ipsecJournal
+	if ipsecJournal == "" && !db.IsKV(dbBackend) {
+		ipsecConfig.Journal = dbPrefix + ipsec.JournalFileName
+	}
+	ipsecConfig.Audit, err = ipsec.NewAuditSink(ipsecAuditSpec)
+	checkFatal(err)
+	ipsecConfig.ReconcileInterval = reconcileInterval
+	ipsecConfig.Mark, err = ipsec.ParseMark(ipsecMarkStr)
+	checkFatal(err)
+	ipsecConfig.JumpPosition, err = common.ParsePosition(ipsecJumpPosStr)
+	checkFatal(err)
+	ipsecConfig.KeySource, err = ipsec.NewKeySource(ipsecKeySourceSpec)
+	checkFatal(err)
+	ipsecConfig.CompressSubnets = parseSubnets("IPsec compress", ipsecCompressStr)
+	ipsecConfig.NoTrack, err = ipsec.ParseNoTrack(ipsecNoTrackStr)
+	checkFatal(err)
+	var wireguardConfig *wireguard.Config
+	switch encryptionStr {
+	case "ipsec":
+	case "wireguard":
+		if wireguardPort < 1 || wireguardPort > 65535 {
+			Log.Fatalf("--wireguard-port must be between 1 and 65535")
+		}
+		wireguardConfig = &wireguard.Config{Port: wireguardPort, Mark: ipsecConfig.Mark, ReconcileInterval: reconcileInterval}
+	default:
+		Log.Fatalf("--fastdp-encryption must be ipsec or wireguard, not %q", encryptionStr)
+	}
+	iptablesMode, err := common.SetIPTablesMode(iptablesModeStr)
+	checkFatal(err)
+	if iptablesMode != "" {
+		Log.Infof("Running iptables-%s", iptablesMode)
+	}
+	var netfilter string
+	if simulate {
+		netfilter = common.SimulateNetfilter()
+	} else {
+		netfilter, err = common.SetNetfilterBackend(netfilterStr)
+		checkFatal(err)
+	}
+	Log.Infof("Managing the firewall rules of encryption with %s", netfilter)
+	common.SetDryRun(netfilterDryRun)
+
+	instance, err := weavenet.ParseInstance(instanceName)
+	checkFatal(err)
+	bridgeName := instance.BridgeName()
+	ipsecConfig.Instance = string(instance)
+	if wireguardConfig != nil {
+		wireguardConfig.Instance = string(instance)
+	}
+
 	Log.Println("Command line options:", options())
 
 	if prof != "" {
@@ -225,17 +412,12 @@ func main() {
 	}
 
 	config.Password = determinePassword(password)
-
-	overlay, bridge := createOverlay(datapathName, ifaceName, isAWSVPC, config.Host, config.Port, bufSzMB, config.Password != nil)
-	networkConfig.Bridge = bridge
-
-	if bridge != nil {
-		if err := weavenet.DetectHairpin("vethwe-bridge", Log); err != nil {
-			Log.Errorf("DetectHairpin failed: %s", err)
-		}
+	if dbKV.Token == "" {
+		dbKV.Token = os.Getenv("WEAVE_DB_KV_TOKEN")
 	}
+	dbKV.Password = os.Getenv("WEAVE_DB_KV_PASSWORD")
 
-	name := peerName(routerName)
+	name := peerName(routerName, bridgeName)
 
 	if nickName == "" {
 		var err error
@@ -243,42 +425,80 @@ func main() {
 		checkFatal(err)
 	}
 
-	config.TrustedSubnets = parseTrustedSubnets(trustedSubnetStr)
+	config.TrustedSubnets = parseSubnets("trusted", trustedSubnetStr)
+	ipsecConfig.TrustedSubnets = config.TrustedSubnets
 	config.PeerDiscovery = !noDiscovery
 
 	if isAWSVPC && len(config.Password) > 0 {
 		Log.Fatalf("--awsvpc mode is not compatible with the --password option")
 	}
 
-	db, err := db.NewBoltDB(dbPrefix + db.FileName)
-	checkFatal(err)
-	defer db.Close()
+	var (
+		overlay         weave.NetworkOverlay
+		bridge          weave.Bridge
+		fastdp          *weave.FastDatapath
+		simDatapath     *weave.SimDatapath
+		database        db.ClosableDB
+		dockerCli       *docker.Client
+		dockerVersion   = "none"
+		allContainerIDs []string
+		preClaims       []ipam.PreClaim
+	)
+	startup := newStartupStages()
+	startup.stage(
+		startupStep{"datapath", func() {
+			if simulate {
+				overlay, fastdp, simDatapath = createSimOverlay(config.Host, config.Port, config.Password != nil, ipsecConfig)
+				bridge = fastdp.Bridge()
+				return
+			}
+			overlay, bridge, fastdp = createOverlay(datapathName, ifaceName, isAWSVPC, config.Host, config.Port, bufSzMB, config.Password != nil, ipsecConfig, wireguardConfig)
+			if bridge != nil {
+				if err := weavenet.DetectHairpin(instance.BridgePortName(), Log); err != nil {
+					Log.Errorf("DetectHairpin failed: %s", err)
+				}
+			}
+		}},
+		startupStep{"db", func() {
+			var err error
+			database, err = db.Open(dbBackend, dbPrefix, dbKV)
+			checkFatal(err)
+		}},
+		startupStep{"docker", func() {
+			if dockerAPI == "" {
+				return
+			}
+			dc, err := docker.NewClient(dockerAPI)
+			if err != nil {
+				Log.Fatal("Unable to start docker client: ", err)
+			} else {
+				Log.Info(dc.Info())
+			}
+			dockerCli = dc
+			dockerVersion = dockerCli.DockerVersion()
+			if ipamConfig.Enabled() && !simulate {
+				allContainerIDs, err = dockerCli.AllContainerIDs()
+				checkFatal(err)
+				preClaims, err = findExistingAddresses(dockerCli, allContainerIDs, bridgeName)
+				checkFatal(err)
+			}
+		}})
+	defer database.Close()
+	networkConfig.Bridge = bridge
+	networkConfig.GossipLimits = gossipLimits
 
-	router := weave.NewNetworkRouter(config, networkConfig, name, nickName, overlay, db)
+	router := weave.NewNetworkRouter(config, networkConfig, name, nickName, overlay, database)
 	Log.Println("Our name is", router.Ourself)
 
 	if peers, err = router.InitialPeers(resume, peers); err != nil {
 		Log.Fatal("Unable to get initial peer set: ", err)
 	}
 
-	var dockerCli *docker.Client
-	dockerVersion := "none"
-	if dockerAPI != "" {
-		dc, err := docker.NewClient(dockerAPI)
-		if err != nil {
-			Log.Fatal("Unable to start docker client: ", err)
-		} else {
-			Log.Info(dc.Info())
-		}
-		dockerCli = dc
-		dockerVersion = dockerCli.DockerVersion()
-	}
-
 	network := ""
 	if isAWSVPC {
 		network = "awsvpc"
 	}
-	checkForUpdates(dockerVersion, network)
+	checkForUpdates(versionCheckSource, dockerVersion, network)
 
 	observeContainers := func(o docker.ContainerObserver) {
 		if dockerCli != nil {
@@ -295,40 +515,99 @@ func main() {
 		allocator     *ipam.Allocator
 		defaultSubnet address.CIDR
 		trackerName   string
+		ns            *nameserver.Nameserver
+		dnsserver     *nameserver.DNSServer
 	)
-	if ipamConfig.Enabled() {
-		var t tracker.LocalRangeTracker
-		if isAWSVPC {
-			Log.Infoln("Creating AWSVPC LocalRangeTracker")
-			t, err = tracker.NewAWSVPCTracker()
+	startup.stage(
+		startupStep{"ipam", func() {
+			if !ipamConfig.Enabled() {
+				return
+			}
+			var t tracker.LocalRangeTracker
+			if isAWSVPC {
+				Log.Infoln("Creating AWSVPC LocalRangeTracker")
+				var err error
+				t, err = tracker.NewAWSVPCTracker()
+				if err != nil {
+					Log.Fatalf("Cannot create AWSVPC LocalRangeTracker: %s", err)
+				}
+				trackerName = "awsvpc"
+			}
+			var onFree func(address.Address)
+			if !simulate {
+				conntrack := weavenet.NewConntrackDeleter()
+				onFree = func(addr address.Address) { conntrack.Delete(addr.IP4()) }
+			}
+			allocator, defaultSubnet = createAllocator(router, ipamConfig, preClaims, database, t, isKnownPeer, onFree)
+			observeContainers(allocator)
+			allocator.PruneOwned(allContainerIDs)
+		}},
+		startupStep{"dns", func() {
+			if noDNS {
+				return
+			}
+			ns, dnsserver = createDNSServer(dnsConfig, router, isKnownPeer)
+			observeContainers(ns)
+			ns.Start()
+			dnsserver.ActivateAndServe()
+		}})
+	if ns != nil {
+		defer ns.Stop()
+		defer dnsserver.Stop()
+	}
+
+	var setup setupTasks
+	var bridgeRules *common.Reconciler
+	if reconcileInterval > 0 && (serviceCIDRStr != "" || ipsecClampMSS) {
+		ipt, err := common.NewIPTables()
+		checkFatal(err)
+		bridgeRules = common.NewReconciler(common.WithDryRun(ipt))
+		go bridgeRules.Run(reconcileInterval, nil, func(repaired []common.Rule, err error) {
 			if err != nil {
-				Log.Fatalf("Cannot create AWSVPC LocalRangeTracker: %s", err)
+				Log.Warnf("Putting back iptables rules failed: %s", err)
+				return
+			}
+			for _, r := range repaired {
+				Log.Warnf("Put back missing or misplaced iptables rule %s", r)
 			}
-			trackerName = "awsvpc"
+		})
+	}
+	if setupCNI {
+		setup.add("cni", func() error { return installCNIPlugin(hostRoot, cniPluginSource) })
+	}
+	if serviceCIDRStr != "" {
+		_, serviceCIDR, err := net.ParseCIDR(serviceCIDRStr)
+		if err != nil {
+			Log.Fatalf("Unable to parse --service-cidr: %s", err)
 		}
-		var allContainerIDs []string
-		if dockerCli != nil {
-			allContainerIDs, err = dockerCli.AllContainerIDs()
-			checkFatal(err)
+		if ipamConfig.IPRangeCIDR != "" {
+			if _, ipRange, err := net.ParseCIDR(ipamConfig.IPRangeCIDR); err == nil && (ipRange.Contains(serviceCIDR.IP) || serviceCIDR.Contains(ipRange.IP)) {
+				Log.Fatalf("IP address allocation range %s overlaps with service CIDR %s", ipRange, serviceCIDR)
+			}
 		}
-		preClaims, err := findExistingAddresses(dockerCli, allContainerIDs, weavenet.WeaveBridgeName)
-		checkFatal(err)
-		allocator, defaultSubnet = createAllocator(router, ipamConfig, preClaims, db, t, isKnownPeer)
-		observeContainers(allocator)
-		allocator.PruneOwned(allContainerIDs)
+		setup.add("services", keepRules(bridgeRules, weavenet.ServicesOwnedChain(instance), weavenet.ServiceCIDRRules(instance, *serviceCIDR),
+			func() error { return weavenet.ExcludeServiceCIDR(instance, *serviceCIDR) }))
 	}
-
-	var (
-		ns        *nameserver.Nameserver
-		dnsserver *nameserver.DNSServer
-	)
-	if !noDNS {
-		ns, dnsserver = createDNSServer(dnsConfig, router.Router, isKnownPeer)
-		observeContainers(ns)
-		ns.Start()
-		defer ns.Stop()
-		dnsserver.ActivateAndServe()
-		defer dnsserver.Stop()
+	if ipsecClampMSS && fastdp != nil && fastdp.IPSec() != nil {
+		setup.add("mss-clamp", keepRules(bridgeRules, weavenet.MSSOwnedChain(instance), []common.Rule{weavenet.MSSRule(instance)},
+			func() error { return weavenet.ClampMSS(instance) }))
+	}
+	var doctor *bridgeDoctor
+	if doctorInterval > 0 && (datapathName != "" || ifaceName != "") {
+		doctor = newBridgeDoctor(weavenet.BridgeDoctor{Instance: instance})
+	}
+	if expose {
+		if allocator == nil {
+			Log.Fatal("--expose requires IP address allocation")
+		}
+		exposeCIDRs, err := parseCIDRs(exposeCIDRsStr)
+		checkFatal(err)
+		setup.add("expose", func() error {
+			return exposeBridge(bridgeName, instance.NATChain(), allocator, defaultSubnet, exposeCIDRs)
+		})
+		if doctor != nil {
+			doctor.doctor.ExpectedAddrs = func() []*net.IPNet { return exposedAddrs(allocator, defaultSubnet, exposeCIDRs) }
+		}
 	}
 
 	router.Start()
@@ -340,6 +619,16 @@ func main() {
 	// The weave script always waits for a status call to succeed,
 	// so there is no point in doing "weave launch --http-addr ''".
 	// This is here to support stand-alone use of weaver.
+	var ipSec *ipsec.IPSec
+	var wg *wireguard.WireGuard
+	if fastdp != nil {
+		ipSec = fastdp.IPSec()
+		wg = fastdp.WireGuard()
+	}
+	if ipSec != nil {
+		router.OnTrustedSubnetsChange(ipSec.SetTrustedSubnets)
+	}
+
 	if httpAddr != "" {
 		muxRouter := mux.NewRouter()
 		if allocator != nil {
@@ -349,8 +638,16 @@ func main() {
 			ns.HandleHTTP(muxRouter, dockerCli)
 		}
 		router.HandleHTTP(muxRouter)
-		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver)
-		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, allocator, ns, dnsserver))
+		if fastdp != nil {
+			fastdp.HandleHTTP(muxRouter)
+		}
+		if simDatapath != nil {
+			handleSimulationHTTP(muxRouter, simDatapath)
+		}
+		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, setup, startup, doctor, ipSec)
+		handleNetfilterReport(muxRouter, bridgeRules, ipSec, wg)
+		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, allocator, ns, dnsserver, ipSec))
+		muxRouter.PathPrefix("/log-level").Handler(common.LogLevelHTTPHandler())
 		http.Handle("/", common.LoggingHTTPHandler(muxRouter))
 		Log.Println("Listening for HTTP control messages on", httpAddr)
 		go listenAndServeHTTP(httpAddr, nil)
@@ -358,15 +655,26 @@ func main() {
 
 	if statusAddr != "" {
 		muxRouter := mux.NewRouter()
-		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver)
-		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, allocator, ns, dnsserver))
+		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, setup, startup, doctor, ipSec)
+		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, allocator, ns, dnsserver, ipSec))
 		statusMux := http.NewServeMux()
 		statusMux.Handle("/", muxRouter)
 		Log.Println("Listening for metrics requests on", statusAddr)
 		go listenAndServeHTTP(statusAddr, statusMux)
 	}
 
+	// The CNI plugin talks to our HTTP API, so only install it now
+	setup.start()
+	if doctor != nil {
+		doctor.start(doctorInterval)
+	}
+
 	signals.SignalHandlerLoop(common.Log, router)
+	if netfilterDryRun {
+		for _, line := range common.DryRunDiff() {
+			Log.Infof("Dry run diff: %s", line)
+		}
+	}
 }
 
 func options() map[string]string {
@@ -374,7 +682,7 @@ func options() map[string]string {
 	mflag.Visit(func(f *mflag.Flag) {
 		value := f.Value.String()
 		name := canonicalName(f)
-		if name == "password" {
+		if name == "password" || name == "db-kv-token" {
 			value = "<elided>"
 		}
 		options[name] = value
@@ -409,9 +717,43 @@ func (nopPacketLogging) LogPacket(string, weave.PacketKey) {
 func (nopPacketLogging) LogForwardPacket(string, weave.ForwardPacketKey) {
 }
 
-func createOverlay(datapathName string, ifaceName string, isAWSVPC bool, host string, port int, bufSzMB int, enableEncryption bool) (weave.NetworkOverlay, weave.Bridge) {
+// checkSALimits rejects soft limits which could never be reached
+// before their hard limit
+func checkSALimits(limits ipsec.SALimits) error {
+	switch {
+	case limits.TimeHard > 0 && limits.TimeSoft > limits.TimeHard:
+		return fmt.Errorf("--ipsec-sa-time-soft must not be more than --ipsec-sa-time-hard")
+	case limits.ByteHard > 0 && limits.ByteSoft > limits.ByteHard:
+		return fmt.Errorf("--ipsec-sa-bytes-soft must not be more than --ipsec-sa-bytes-hard")
+	case limits.PacketHard > 0 && limits.PacketSoft > limits.PacketHard:
+		return fmt.Errorf("--ipsec-sa-packets-soft must not be more than --ipsec-sa-packets-hard")
+	}
+	return nil
+}
+
+// parseSALimits parses the limits given with flag, overriding those of
+// limits; nil if none are given
+func parseSALimits(flag, s string, limits ipsec.SALimits) (*ipsec.SALimits, error) {
+	if s == "" {
+		return nil, nil
+	}
+	limits, err := ipsec.ParseSALimits(s, limits)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", flag, err)
+	}
+	switch {
+	case limits.TimeHard > 0 && limits.TimeSoft > limits.TimeHard,
+		limits.ByteHard > 0 && limits.ByteSoft > limits.ByteHard,
+		limits.PacketHard > 0 && limits.PacketSoft > limits.PacketHard:
+		return nil, fmt.Errorf("%s: soft limits must not be more than hard limits", flag)
+	}
+	return &limits, nil
+}
+
+func createOverlay(datapathName string, ifaceName string, isAWSVPC bool, host string, port int, bufSzMB int, enableEncryption bool, ipsecConfig ipsec.Config, wireguardConfig *wireguard.Config) (weave.NetworkOverlay, weave.Bridge, *weave.FastDatapath) {
 	overlay := weave.NewOverlaySwitch()
 	var bridge weave.Bridge
+	var fastdp *weave.FastDatapath
 	var ignoreSleeve bool
 
 	switch {
@@ -426,7 +768,7 @@ func createOverlay(datapathName string, ifaceName string, isAWSVPC bool, host st
 	case datapathName != "":
 		iface, err := weavenet.EnsureInterface(datapathName)
 		checkFatal(err)
-		fastdp, err := weave.NewFastDatapath(iface, port, enableEncryption)
+		fastdp, err = newFastDatapath(iface, port, enableEncryption, ipsecConfig, wireguardConfig)
 		checkFatal(err)
 		bridge = fastdp.Bridge()
 		overlay.Add("fastdp", fastdp.Overlay())
@@ -445,10 +787,38 @@ func createOverlay(datapathName string, ifaceName string, isAWSVPC bool, host st
 		overlay.SetCompatOverlay(sleeve)
 	}
 
-	return overlay, bridge
+	return overlay, bridge, fastdp
 }
 
-func createAllocator(router *weave.NetworkRouter, config ipamConfig, preClaims []ipam.PreClaim, db db.DB, track tracker.LocalRangeTracker, isKnownPeer func(mesh.PeerName) bool) (*ipam.Allocator, address.CIDR) {
+// newFastDatapath returns a fast datapath on iface, trying again while
+// another process holds the xtables lock, and, where the kernel lacks
+// a module encryption needs, without encryption, so that encrypted
+// connections use sleeve
+func newFastDatapath(iface *net.Interface, port int, enableEncryption bool, ipsecConfig ipsec.Config, wireguardConfig *wireguard.Config) (*weave.FastDatapath, error) {
+	for attempt := 1; ; attempt++ {
+		fastdp, err := weave.NewFastDatapath(iface, port, enableEncryption, ipsecConfig, wireguardConfig)
+		switch {
+		case err == nil:
+			return fastdp, nil
+		case common.IsLockContention(err) && attempt < 3:
+			Log.Warningf("Setting up fast datapath: %s; trying again", err)
+			time.Sleep(time.Duration(attempt) * 5 * time.Second)
+		case enableEncryption && common.IsModuleMissing(err):
+			module := "a kernel module"
+			if e, ok := common.AsNetfilterError(err); ok && e.Module != "" {
+				module = e.Module
+			}
+			Log.Warningf("Fast datapath encryption needs %s, which is missing (%s); encrypted connections will use sleeve", module, err)
+			enableEncryption = false
+		case common.IsPermissionDenied(err):
+			return nil, fmt.Errorf("%s; weave must run as root, or with CAP_NET_ADMIN", err)
+		default:
+			return nil, err
+		}
+	}
+}
+
+func createAllocator(router *weave.NetworkRouter, config ipamConfig, preClaims []ipam.PreClaim, db db.DB, track tracker.LocalRangeTracker, isKnownPeer func(mesh.PeerName) bool, onFree func(address.Address)) (*ipam.Allocator, address.CIDR) {
 	ipRange, err := ipam.ParseCIDRSubnet(config.IPRangeCIDR)
 	checkFatal(err)
 	defaultSubnet := ipRange
@@ -472,24 +842,30 @@ func createAllocator(router *weave.NetworkRouter, config ipamConfig, preClaims [
 		Db:          db,
 		IsKnownPeer: isKnownPeer,
 		Tracker:     track,
+		OnFree:      onFree,
 	}
 
 	allocator := ipam.NewAllocator(c)
 
-	allocator.SetInterfaces(router.NewGossip("IPallocation", allocator))
+	allocator.SetInterfaces(router.NewLimitedGossip("IPallocation", allocator))
 	allocator.Start()
 	router.Peers.OnGC(func(peer *mesh.Peer) { allocator.PeerGone(peer.Name) })
 
 	return allocator, defaultSubnet
 }
 
-func createDNSServer(config dnsConfig, router *mesh.Router, isKnownPeer func(mesh.PeerName) bool) (*nameserver.Nameserver, *nameserver.DNSServer) {
+func createDNSServer(config dnsConfig, router *weave.NetworkRouter, isKnownPeer func(mesh.PeerName) bool) (*nameserver.Nameserver, *nameserver.DNSServer) {
 	ns := nameserver.New(router.Ourself.Peer.Name, config.Domain, isKnownPeer)
 	router.Peers.OnGC(func(peer *mesh.Peer) { ns.PeerGone(peer.Name) })
-	ns.SetGossip(router.NewGossip("nameserver", ns))
+	ns.SetGossip(router.NewLimitedGossip("nameserver", ns))
 	upstream := nameserver.NewUpstream(config.ResolvConf, config.EffectiveListenAddress)
-	dnsserver, err := nameserver.NewDNSServer(ns, config.Domain, config.ListenAddress,
-		upstream, uint32(config.TTL), config.ClientTimeout)
+	dnsserver, err := nameserver.NewDNSServerWithConfig(ns, nameserver.DNSServerConfig{
+		Domain:        config.Domain,
+		ListenAddress: config.ListenAddress,
+		Upstream:      upstream,
+		TTL:           uint32(config.TTL),
+		ClientTimeout: config.ClientTimeout,
+	})
 	if err != nil {
 		Log.Fatal("Unable to start dns server: ", err)
 	}
@@ -534,11 +910,11 @@ func determinePassword(password string) []byte {
 	return []byte(password)
 }
 
-func peerName(routerName string) mesh.PeerName {
+func peerName(routerName, bridgeName string) mesh.PeerName {
 	if routerName == "" {
-		iface, err := net.InterfaceByName(weavenet.WeaveBridgeName)
+		iface, err := net.InterfaceByName(bridgeName)
 		if err != nil {
-			Log.Fatalf("Unable to find bridge %q", weavenet.WeaveBridgeName)
+			Log.Fatalf("Unable to find bridge %q", bridgeName)
 		}
 		routerName = iface.HardwareAddr.String()
 	}
@@ -547,21 +923,21 @@ func peerName(routerName string) mesh.PeerName {
 	return name
 }
 
-func parseTrustedSubnets(trustedSubnetStr string) []*net.IPNet {
-	trustedSubnets := []*net.IPNet{}
-	if trustedSubnetStr == "" {
-		return trustedSubnets
+func parseSubnets(what, subnetsStr string) []*net.IPNet {
+	subnets := []*net.IPNet{}
+	if subnetsStr == "" {
+		return subnets
 	}
 
-	for _, subnetStr := range strings.Split(trustedSubnetStr, ",") {
+	for _, subnetStr := range strings.Split(subnetsStr, ",") {
 		_, subnet, err := net.ParseCIDR(subnetStr)
 		if err != nil {
-			Log.Fatal("Unable to parse trusted subnets: ", err)
+			Log.Fatalf("Unable to parse %s subnets: %s", what, err)
 		}
-		trustedSubnets = append(trustedSubnets, subnet)
+		subnets = append(subnets, subnet)
 	}
 
-	return trustedSubnets
+	return subnets
 }
 
 func parsePeerNames(s string) ([]mesh.PeerName, error) {
@@ -581,6 +957,23 @@ func parsePeerNames(s string) ([]mesh.PeerName, error) {
 	return peerNames, nil
 }
 
+func parseCIDRs(s string) ([]address.CIDR, error) {
+	cidrs := []address.CIDR{}
+	if s == "" {
+		return cidrs, nil
+	}
+
+	for _, cidrStr := range strings.Split(s, ",") {
+		cidr, err := address.ParseCIDR(cidrStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing CIDRs: %s", err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+
+	return cidrs, nil
+}
+
 func listenAndServeHTTP(httpAddr string, handler http.Handler) {
 	protocol := "tcp"
 	if strings.HasPrefix(httpAddr, "/") {
@@ -7,16 +7,22 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/ipam"
 	"github.com/weaveworks/weave/nameserver"
 	"github.com/weaveworks/weave/net/address"
+	"github.com/weaveworks/weave/net/ipsec"
 	weave "github.com/weaveworks/weave/router"
 )
 
-func metricsHandler(router *weave.NetworkRouter, allocator *ipam.Allocator, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) http.Handler {
+func metricsHandler(router *weave.NetworkRouter, allocator *ipam.Allocator, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, ipSec *ipsec.IPSec) http.Handler {
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(prometheus.NewProcessCollector(os.Getpid(), ""))
 	reg.MustRegister(newMetrics(router, allocator, ns, dnsserver))
+	reg.MustRegister(common.NetfilterMetrics)
+	if ipSec != nil {
+		reg.MustRegister(ipSec)
+	}
 	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
 }
 
@@ -54,6 +60,16 @@ var metrics = []metric{
 				ch <- intGauge(desc, counts[state], state)
 			}
 		}},
+	{desc("weave_connections_encryption", "Number of established peer-to-peer connections, by whether they are encrypted.", "encryption"),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			if !s.Router.Encryption {
+				return
+			}
+			counts := connectionEncryptionCounts(s.Router.Connections)
+			for _, state := range allEncryptionStates {
+				ch <- intGauge(desc, counts[state], state)
+			}
+		}},
 	{desc("weave_connection_terminations_total", "Number of peer-to-peer connections terminated."),
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
 			ch <- uint64Counter(desc, uint64(s.Router.TerminationCount))
@@ -76,6 +92,20 @@ var metrics = []metric{
 				ch <- intGauge(desc, countDNSEntriesForPeer(s.Router.Name, s.DNS.Entries))
 			}
 		}},
+	{desc("weave_gossip_messages_total", "Number of gossip messages received, by channel and what became of them.", "channel", "outcome"),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			for _, gossip := range s.Router.Gossip {
+				ch <- uint64Counter(desc, gossip.Processed, gossip.Channel, "processed")
+				ch <- uint64Counter(desc, gossip.Delayed, gossip.Channel, "delayed")
+				ch <- uint64Counter(desc, gossip.Dropped, gossip.Channel, "dropped")
+			}
+		}},
+	{desc("weave_gossip_queued", "Number of gossip messages waiting to be processed.", "channel"),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			for _, gossip := range s.Router.Gossip {
+				ch <- intGauge(desc, gossip.Queued, gossip.Channel)
+			}
+		}},
 	{desc("weave_flows", "Number of FastDP flows."),
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
 			if metrics := fastDPMetrics(s); metrics != nil {
@@ -109,7 +139,8 @@ func (m *collector) Collect(ch chan<- prometheus.Metric) {
 	status := WeaveStatus{"", nil,
 		weave.NewNetworkRouterStatus(m.router),
 		ipam.NewStatus(m.allocator, address.CIDR{}),
-		nameserver.NewStatus(m.ns, m.dnsserver)}
+		nameserver.NewStatus(m.ns, m.dnsserver),
+		nil, nil, nil, nil}
 
 	for _, metric := range metrics {
 		metric.Collect(status, metric.Desc, ch)
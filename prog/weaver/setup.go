@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/ipam"
+	weavenet "github.com/weaveworks/weave/net"
+	"github.com/weaveworks/weave/net/address"
+	netplugin "github.com/weaveworks/weave/plugin/net"
+)
+
+const (
+	setupRetryMin = 1 * time.Second
+	setupRetryMax = 1 * time.Minute
+
+	cniConfName = "10-weave.conf"
+	exposeIdent = "weave:expose"
+)
+
+// A setupTask is a piece of host plumbing which weaver does itself,
+// instead of leaving it to a shell script running alongside, so that
+// failures are retried and visible in `weave status`.
+type setupTask struct {
+	sync.Mutex
+	name     string
+	run      func() error
+	done     bool
+	attempts int
+	lastErr  error
+}
+
+type SetupTaskStatus struct {
+	Name      string
+	State     string
+	Attempts  int
+	LastError string `json:"LastError,omitempty"`
+}
+
+type setupTasks []*setupTask
+
+func (tasks *setupTasks) add(name string, run func() error) {
+	*tasks = append(*tasks, &setupTask{name: name, run: run})
+}
+
+// start runs each task in the background, retrying with exponential
+// backoff until it succeeds
+func (tasks setupTasks) start() {
+	for _, task := range tasks {
+		go task.loop()
+	}
+}
+
+func (task *setupTask) loop() {
+	for delay := setupRetryMin; ; delay *= 2 {
+		err := task.run()
+		task.Lock()
+		task.attempts++
+		task.lastErr = err
+		task.done = err == nil
+		task.Unlock()
+		if err == nil {
+			Log.Infof("Setup %s: done", task.name)
+			return
+		}
+		if delay > setupRetryMax {
+			delay = setupRetryMax
+		}
+		Log.Errorf("Setup %s: %s; retrying in %s", task.name, err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// keepRules returns run, followed, once it succeeds, by having rc, if
+// not nil, keep the chain and rules it adds in place
+func keepRules(rc *common.Reconciler, chain common.OwnedChain, rules []common.Rule, run func() error) func() error {
+	return func() error {
+		if err := run(); err != nil {
+			return err
+		}
+		if rc != nil {
+			rc.WantOwned(chain)
+			rc.Want(rules...)
+		}
+		return nil
+	}
+}
+
+func (tasks setupTasks) Status() []SetupTaskStatus {
+	var status []SetupTaskStatus
+	for _, task := range tasks {
+		task.Lock()
+		s := SetupTaskStatus{Name: task.name, State: "pending", Attempts: task.attempts}
+		switch {
+		case task.done:
+			s.State = "done"
+		case task.lastErr != nil:
+			s.State = "retrying"
+			s.LastError = task.lastErr.Error()
+		}
+		task.Unlock()
+		status = append(status, s)
+	}
+	return status
+}
+
+// installCNIPlugin does the same as `weave setup-cni`: it copies our
+// CNI plugin binary, which is weaveutil, into the host's CNI plugin
+// directory under the names the plugin answers to, and writes a
+// default network configuration if there is none.
+func installCNIPlugin(hostRoot, source string) error {
+	pluginDir := filepath.Join(hostRoot, "opt/cni/bin")
+	if err := os.MkdirAll(pluginDir, 0755); err != nil {
+		// Fall back to the directory used by kube-up on GCI OS
+		pluginDir = filepath.Join(hostRoot, "home/kubernetes/bin")
+		if err := os.MkdirAll(pluginDir, 0755); err != nil {
+			return fmt.Errorf("unable to create CNI plugin directory: %s", err)
+		}
+	}
+	// Versioned, like the weave script does, so upgrades don't overwrite
+	// a binary which is in use
+	pluginName := "weave-plugin-" + version
+	pluginPath := filepath.Join(pluginDir, pluginName)
+	// Replaced where it differs, e.g. after a failed or interrupted
+	// install, or one of a build of the same version
+	if same, err := sameContents(source, pluginPath); err != nil {
+		return err
+	} else if !same {
+		if err := copyFile(source, pluginPath, 0755); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{"weave-net", "weave-ipam"} {
+		if err := ensureSymlink(pluginName, filepath.Join(pluginDir, name)); err != nil {
+			return err
+		}
+	}
+
+	confDir := filepath.Join(hostRoot, "etc/cni/net.d")
+	if err := os.MkdirAll(confDir, 0755); err != nil {
+		return err
+	}
+	confPath := filepath.Join(confDir, cniConfName)
+	if _, err := os.Stat(confPath); os.IsNotExist(err) {
+		conf, err := netplugin.DefaultConfig()
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(confPath, conf, 0644)
+	}
+	return nil
+}
+
+// sameContents returns whether the file dst exists and is a copy of
+// src
+func sameContents(src, dst string) (bool, error) {
+	want, err := ioutil.ReadFile(src)
+	if err != nil {
+		return false, err
+	}
+	have, err := ioutil.ReadFile(dst)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(want, have), nil
+}
+
+// copyFile copies src to dst via a temporary file, so that nothing
+// ever sees a partially written dst
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// ensureSymlink atomically makes path a symlink to target, replacing
+// any (legacy) copy of the plugin there
+func ensureSymlink(target, path string) error {
+	if current, err := os.Readlink(path); err == nil && current == target {
+		return nil
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// exposeBridge does the same as `weave expose`: it gives the weave
+// bridge an address in each of cidrs, or in the default subnet if
+// there are none, and masquerades traffic between those subnets and
+// the outside, so the host can talk to containers.
+func exposeBridge(bridgeName, natChain string, allocator *ipam.Allocator, defaultSubnet address.CIDR, cidrs []address.CIDR) error {
+	var addrs []address.CIDR
+	if len(cidrs) == 0 {
+		existing, err := allocator.Lookup(exposeIdent, defaultSubnet.Range())
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			addrs = existing
+		} else {
+			addr, err := allocator.Allocate(exposeIdent, defaultSubnet, false, func() bool { return false })
+			if err != nil {
+				return err
+			}
+			addrs = []address.CIDR{address.MakeCIDR(defaultSubnet, addr)}
+		}
+	} else {
+		for _, cidr := range cidrs {
+			if err := allocator.Claim(exposeIdent, cidr, false, true, func() bool { return false }); err != nil {
+				return err
+			}
+		}
+		addrs = cidrs
+	}
+
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return fmt.Errorf("unable to find bridge %q: %s", bridgeName, err)
+	}
+	existing, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, cidr := range addrs {
+		ipnet := &net.IPNet{IP: cidr.Addr.IP4(), Mask: net.CIDRMask(cidr.PrefixLen, 32)}
+		if !hasAddr(existing, ipnet) {
+			if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ipnet}); err != nil {
+				return fmt.Errorf("unable to add %s to bridge: %s", cidr, err)
+			}
+		}
+		if err := weavenet.ExposeNAT(natChain, *ipnet); err != nil {
+			return fmt.Errorf("unable to create NAT rules for %s: %s", cidr, err)
+		}
+	}
+	return nil
+}
+
+// exposedAddrs returns the addresses exposeBridge has given the bridge,
+// or will give it, without allocating any
+func exposedAddrs(allocator *ipam.Allocator, defaultSubnet address.CIDR, cidrs []address.CIDR) []*net.IPNet {
+	if len(cidrs) == 0 {
+		cidrs, _ = allocator.Lookup(exposeIdent, defaultSubnet.Range())
+	}
+	var addrs []*net.IPNet
+	for _, cidr := range cidrs {
+		addrs = append(addrs, &net.IPNet{IP: cidr.Addr.IP4(), Mask: net.CIDRMask(cidr.PrefixLen, 32)})
+	}
+	return addrs
+}
+
+func hasAddr(addrs []netlink.Addr, ipnet *net.IPNet) bool {
+	for _, addr := range addrs {
+		if addr.IPNet.String() == ipnet.String() {
+			return true
+		}
+	}
+	return false
+}
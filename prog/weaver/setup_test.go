@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	netplugin "github.com/weaveworks/weave/plugin/net"
+)
+
+func TestInstallCNIPlugin(t *testing.T) {
+	hostRoot, err := ioutil.TempDir("", "weave-setup")
+	require.NoError(t, err)
+	defer os.RemoveAll(hostRoot)
+	source := filepath.Join(hostRoot, "weaveutil")
+	require.NoError(t, ioutil.WriteFile(source, []byte("plugin v1"), 0755))
+
+	pluginDir := filepath.Join(hostRoot, "opt/cni/bin")
+	pluginPath := filepath.Join(pluginDir, "weave-plugin-"+version)
+	confPath := filepath.Join(hostRoot, "etc/cni/net.d", cniConfName)
+
+	require.NoError(t, installCNIPlugin(hostRoot, source))
+	contents, err := ioutil.ReadFile(pluginPath)
+	require.NoError(t, err)
+	require.Equal(t, "plugin v1", string(contents))
+	for _, name := range []string{"weave-net", "weave-ipam"} {
+		target, err := os.Readlink(filepath.Join(pluginDir, name))
+		require.NoError(t, err)
+		require.Equal(t, "weave-plugin-"+version, target)
+	}
+	_, err = os.Stat(confPath)
+	require.NoError(t, err)
+
+	// A plugin which differs, e.g. left by an interrupted install, is
+	// replaced; a configuration of the user's is left alone
+	require.NoError(t, ioutil.WriteFile(pluginPath, []byte("plugin v"), 0755))
+	require.NoError(t, ioutil.WriteFile(confPath, []byte("{}"), 0644))
+	require.NoError(t, installCNIPlugin(hostRoot, source))
+	contents, err = ioutil.ReadFile(pluginPath)
+	require.NoError(t, err)
+	require.Equal(t, "plugin v1", string(contents))
+	contents, err = ioutil.ReadFile(confPath)
+	require.NoError(t, err)
+	require.Equal(t, "{}", string(contents))
+
+	// Legacy copies of the plugin give way to symlinks
+	require.NoError(t, os.Remove(filepath.Join(pluginDir, "weave-net")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(pluginDir, "weave-net"), []byte("plugin v0"), 0755))
+	require.NoError(t, installCNIPlugin(hostRoot, source))
+	target, err := os.Readlink(filepath.Join(pluginDir, "weave-net"))
+	require.NoError(t, err)
+	require.Equal(t, "weave-plugin-"+version, target)
+}
+
+func TestCNIConfig(t *testing.T) {
+	data, err := netplugin.DefaultConfig()
+	require.NoError(t, err)
+	var conf map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &conf))
+	require.Equal(t, "weave-net", conf["type"])
+	require.Equal(t, map[string]interface{}{"bandwidth": true}, conf["capabilities"])
+}
+
+func TestSetupTasksStatus(t *testing.T) {
+	var tasks setupTasks
+	tasks.add("ok", func() error { return nil })
+	tasks.add("failing", func() error { return errors.New("no bridge") })
+	tasks[0].done, tasks[0].attempts = true, 1
+	tasks[1].lastErr, tasks[1].attempts = errors.New("no bridge"), 2
+	tasks.add("waiting", func() error { return nil })
+
+	require.Equal(t, []SetupTaskStatus{
+		{Name: "ok", State: "done", Attempts: 1},
+		{Name: "failing", State: "retrying", Attempts: 2, LastError: "no bridge"},
+		{Name: "waiting", State: "pending"},
+	}, tasks.Status())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/weaveworks/weave/net/ipsec"
+	weave "github.com/weaveworks/weave/router"
+)
+
+// createSimOverlay is createOverlay for --simulate: a fast datapath
+// over a SimDatapath, with sleeve to fall back to
+func createSimOverlay(host string, port int, enableEncryption bool, ipsecConfig ipsec.Config) (weave.NetworkOverlay, *weave.FastDatapath, *weave.SimDatapath) {
+	fastdp, dp, err := weave.NewSimFastDatapath(port, enableEncryption, ipsecConfig)
+	checkFatal(err)
+	overlay := weave.NewOverlaySwitch()
+	overlay.Add("fastdp", fastdp.Overlay())
+	sleeve := weave.NewSleeveOverlay(host, port)
+	overlay.Add("sleeve", sleeve)
+	overlay.SetCompatOverlay(sleeve)
+	return overlay, fastdp, dp
+}
+
+// simNetwork is where simulated containers send and receive frames
+type simNetwork interface {
+	Send(frame []byte) error
+	Received() [][]byte
+}
+
+// handleSimulationHTTP lets simulated containers talk over the
+// network of a router started with --simulate: POST a raw ethernet
+// frame to /simulate/frame to send it, and GET /simulate/frames for a
+// JSON list of the (base64 encoded) frames delivered since last time.
+func handleSimulationHTTP(muxRouter *mux.Router, bridge simNetwork) {
+	muxRouter.Methods("POST").Path("/simulate/frame").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		frame, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := bridge.Send(frame); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+	})
+
+	muxRouter.Methods("GET").Path("/simulate/frames").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(bridge.Received()); err != nil {
+			Log.Error("Error encoding simulated frames: ", err)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// startupStages runs the steps of weaver's startup, in stages which
+// depend on those before; the steps within a stage are independent of
+// each other, so they run in parallel. How long each took is kept for
+// `weave report`, since that is how long containers are cut off from
+// the network while weave restarts.
+type startupStages struct {
+	sync.Mutex
+	start   time.Time
+	current int
+	steps   []StartupStepStatus
+}
+
+type StartupStepStatus struct {
+	Name     string
+	Stage    int
+	Started  time.Duration // since weaver started
+	Duration time.Duration
+}
+
+type startupStep struct {
+	name string
+	run  func()
+}
+
+func newStartupStages() *startupStages {
+	return &startupStages{start: time.Now()}
+}
+
+// stage runs steps concurrently, returning when all have finished.
+// Steps report failure through checkFatal and the like.
+func (stages *startupStages) stage(steps ...startupStep) {
+	stages.Lock()
+	stages.current++
+	stageNum := stages.current
+	stages.Unlock()
+
+	var wg sync.WaitGroup
+	for _, step := range steps {
+		wg.Add(1)
+		go func(step startupStep) {
+			defer wg.Done()
+			started := time.Now()
+			step.run()
+			status := StartupStepStatus{Name: step.name, Stage: stageNum, Started: started.Sub(stages.start), Duration: time.Since(started)}
+			Log.Debugf("Startup %s: took %s", step.name, status.Duration)
+			stages.Lock()
+			stages.steps = append(stages.steps, status)
+			stages.Unlock()
+		}(step)
+	}
+	wg.Wait()
+}
+
+func (stages *startupStages) Status() []StartupStepStatus {
+	stages.Lock()
+	defer stages.Unlock()
+	return append([]StartupStepStatus(nil), stages.steps...)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartupStages(t *testing.T) {
+	stages := newStartupStages()
+
+	// The steps of a stage run at once: each waits for the other
+	var wg sync.WaitGroup
+	wg.Add(2)
+	both := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(both)
+	}()
+	rendezvous := func() {
+		wg.Done()
+		select {
+		case <-both:
+		case <-time.After(5 * time.Second):
+			t.Error("steps of a stage ran one after the other")
+		}
+	}
+	var firstDone bool
+	stages.stage(
+		startupStep{"a", rendezvous},
+		startupStep{"b", func() {
+			rendezvous()
+			time.Sleep(10 * time.Millisecond)
+			firstDone = true
+		}},
+	)
+	// A stage only starts once the one before has finished
+	stages.stage(startupStep{"c", func() {
+		require.True(t, firstDone)
+	}})
+
+	status := stages.Status()
+	require.Len(t, status, 3)
+	byName := make(map[string]StartupStepStatus)
+	for _, s := range status {
+		byName[s.Name] = s
+	}
+	require.Equal(t, 1, byName["a"].Stage)
+	require.Equal(t, 1, byName["b"].Stage)
+	require.Equal(t, 2, byName["c"].Stage)
+	require.True(t, byName["b"].Duration >= 10*time.Millisecond)
+	require.True(t, byName["c"].Started >= byName["b"].Started+byName["b"].Duration)
+}
@@ -24,3 +24,15 @@ func cniIPAM(args []string) error {
 	cni.PluginMain(i.CmdAdd, i.CmdDel)
 	return nil
 }
+
+func cniConfig(args []string) error {
+	if len(args) > 0 {
+		cmdUsage("cni-config", "")
+	}
+	conf, err := netplugin.DefaultConfig()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(conf)
+	return err
+}
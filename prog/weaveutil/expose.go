@@ -1,12 +1,19 @@
 package main
 
 import (
+	"strings"
+
 	weavenet "github.com/weaveworks/weave/net"
 )
 
 func exposeNAT(args []string) error {
+	chain := weavenet.DefaultNATChain
+	if len(args) > 0 && strings.HasPrefix(args[0], "--chain=") {
+		chain = strings.TrimPrefix(args[0], "--chain=")
+		args = args[1:]
+	}
 	if len(args) < 1 {
-		cmdUsage("expose-nat", "<cidr>...")
+		cmdUsage("expose-nat", "[--chain=<chain>] <cidr>...")
 	}
 
 	cidrs, err := parseCIDRs(args)
@@ -15,7 +22,7 @@ func exposeNAT(args []string) error {
 	}
 
 	for _, cidr := range cidrs {
-		if err := weavenet.ExposeNAT(*cidr); err != nil {
+		if err := weavenet.ExposeNAT(chain, *cidr); err != nil {
 			return err
 		}
 	}
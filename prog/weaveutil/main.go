@@ -34,6 +34,7 @@ func init() {
 		"list-netdevs":           listNetDevs,
 		"cni-net":                cniNet,
 		"cni-ipam":               cniIPAM,
+		"cni-config":             cniConfig,
 		"expose-nat":             exposeNAT,
 		"bridge-ip":              bridgeIP,
 		"unique-id":              uniqueID,
@@ -21,7 +21,7 @@ var (
 	weaveEntrypoint     = "/home/weave/weaver"
 	weaveContainerName  = "/weave"
 
-	Log = common.Log
+	Log = common.SubsystemLog("proxy")
 )
 
 func callWeave(args ...string) ([]byte, []byte, error) {
@@ -17,6 +17,7 @@ import (
 
 	docker "github.com/fsouza/go-dockerclient"
 	weaveapi "github.com/weaveworks/weave/api"
+	"github.com/weaveworks/weave/common"
 	weavedocker "github.com/weaveworks/weave/common/docker"
 	weavenet "github.com/weaveworks/weave/net"
 	"github.com/weaveworks/weave/net/address"
@@ -299,7 +300,10 @@ func (proxy *Proxy) ListenAndServeStatus(socket string) {
 	if err != nil {
 		Log.Fatalf("ListenAndServeStatus failed: %s", err)
 	}
-	handler := http.HandlerFunc(proxy.StatusHTTP)
+	handler := http.NewServeMux()
+	handler.HandleFunc("/", proxy.StatusHTTP)
+	handler.Handle("/log-level", common.LogLevelHTTPHandler())
+	handler.Handle("/log-level/", common.LogLevelHTTPHandler())
 	if err := (&http.Server{Handler: handler}).Serve(listener); err != nil {
 		Log.Fatalf("ListenAndServeStatus failed: %s", err)
 	}
@@ -0,0 +1,113 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Overlay control messages were originally sent as
+//
+//	index (1 byte) | tag (1 byte) | body
+//
+// where index identifies the forwarder within the overlay switch.
+// Peers which advertise controlFramingFeature are instead sent framed
+// messages:
+//
+//	0x80|version (1) | index (1) | tag (1) | body length (2) | body | extensions
+//
+// The extensions are a sequence of fields, each
+//
+//	type (1) | length (2) | value
+//
+// which receivers skip if they don't know the type, so later versions
+// can add to a message without breaking older peers. Legacy messages
+// are told apart by their first byte, since no switch has anything
+// like 128 overlays.
+const (
+	controlFramingFeature = "ControlFraming"
+	controlFrameMarker    = 0x80
+	controlFrameVersion   = 1
+	controlFrameHeaderLen = 5
+	controlFieldHeaderLen = 3
+)
+
+var controlFramingVersion = strconv.Itoa(controlFrameVersion)
+
+type controlFrame struct {
+	index byte
+	tag   byte
+	body  []byte
+}
+
+func encodeControlFrame(index, tag byte, body []byte) ([]byte, error) {
+	if len(body) > math.MaxUint16 {
+		return nil, fmt.Errorf("control message body too long: %d bytes", len(body))
+	}
+	b := make([]byte, controlFrameHeaderLen+len(body))
+	b[0] = controlFrameMarker | controlFrameVersion
+	b[1] = index
+	b[2] = tag
+	binary.BigEndian.PutUint16(b[3:], uint16(len(body)))
+	copy(b[controlFrameHeaderLen:], body)
+	return b, nil
+}
+
+func encodeLegacyControlFrame(index, tag byte, body []byte) []byte {
+	b := make([]byte, len(body)+2)
+	b[0] = index
+	b[1] = tag
+	copy(b[2:], body)
+	return b
+}
+
+// decodeControlFrame accepts both legacy and framed messages. Frames
+// of a later version than ours are decoded as far as we understand
+// them.
+func decodeControlFrame(b []byte) (*controlFrame, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty control message")
+	}
+	if b[0]&controlFrameMarker == 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("truncated control message")
+		}
+		return &controlFrame{index: b[0], tag: b[1], body: b[2:]}, nil
+	}
+	if b[0]&^controlFrameMarker == 0 {
+		return nil, fmt.Errorf("invalid control message version 0")
+	}
+	if len(b) < controlFrameHeaderLen {
+		return nil, fmt.Errorf("truncated control message header")
+	}
+	bodyLen := int(binary.BigEndian.Uint16(b[3:]))
+	if len(b) < controlFrameHeaderLen+bodyLen {
+		return nil, fmt.Errorf("truncated control message body: %d of %d bytes", len(b)-controlFrameHeaderLen, bodyLen)
+	}
+	frame := &controlFrame{
+		index: b[1],
+		tag:   b[2],
+		body:  b[controlFrameHeaderLen : controlFrameHeaderLen+bodyLen],
+	}
+	if err := checkControlFields(b[controlFrameHeaderLen+bodyLen:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// No extension fields are defined yet, so we only check that they are
+// well-formed.
+func checkControlFields(b []byte) error {
+	for len(b) > 0 {
+		if len(b) < controlFieldHeaderLen {
+			return fmt.Errorf("truncated control message field header")
+		}
+		fieldLen := int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < controlFieldHeaderLen+fieldLen {
+			return fmt.Errorf("truncated control message field %d", b[0])
+		}
+		b = b[controlFieldHeaderLen+fieldLen:]
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlFrameRoundTrip(t *testing.T) {
+	for _, body := range [][]byte{{}, []byte("hello"), make([]byte, math.MaxUint16)} {
+		b, err := encodeControlFrame(3, 7, body)
+		require.NoError(t, err)
+		frame, err := decodeControlFrame(b)
+		require.NoError(t, err)
+		require.Equal(t, &controlFrame{index: 3, tag: 7, body: body}, frame)
+
+		frame, err = decodeControlFrame(encodeLegacyControlFrame(3, 7, body))
+		require.NoError(t, err)
+		require.Equal(t, &controlFrame{index: 3, tag: 7, body: body}, frame)
+	}
+
+	_, err := encodeControlFrame(3, 7, make([]byte, math.MaxUint16+1))
+	require.Error(t, err, "oversized body")
+}
+
+func TestDecodeControlFrame(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		in    []byte
+		frame *controlFrame
+		err   bool
+	}{
+		{name: "empty", in: []byte{}, err: true},
+		{name: "legacy truncated", in: []byte{3}, err: true},
+		{name: "legacy no body", in: []byte{3, 7}, frame: &controlFrame{index: 3, tag: 7, body: []byte{}}},
+		{name: "version 0", in: []byte{0x80, 3, 7, 0, 0}, err: true},
+		{name: "truncated header", in: []byte{0x81, 3, 7, 0}, err: true},
+		{name: "length beyond end", in: []byte{0x81, 3, 7, 0, 3, 'a', 'b'}, err: true},
+		{name: "length of 0xffff", in: []byte{0x81, 3, 7, 0xff, 0xff, 'a'}, err: true},
+		{name: "body", in: []byte{0x81, 3, 7, 0, 2, 'a', 'b'}, frame: &controlFrame{index: 3, tag: 7, body: []byte("ab")}},
+		{name: "later version", in: []byte{0x82, 3, 7, 0, 1, 'a'}, frame: &controlFrame{index: 3, tag: 7, body: []byte("a")}},
+		{name: "unknown field", in: []byte{0x82, 3, 7, 0, 1, 'a', 9, 0, 2, 'x', 'y'}, frame: &controlFrame{index: 3, tag: 7, body: []byte("a")}},
+		{name: "empty field", in: []byte{0x82, 3, 7, 0, 0, 9, 0, 0}, frame: &controlFrame{index: 3, tag: 7, body: []byte{}}},
+		{name: "truncated field header", in: []byte{0x82, 3, 7, 0, 1, 'a', 9, 0}, err: true},
+		{name: "field length beyond end", in: []byte{0x82, 3, 7, 0, 1, 'a', 9, 0, 3, 'x', 'y'}, err: true},
+	} {
+		frame, err := decodeControlFrame(tc.in)
+		if tc.err {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.frame, frame, tc.name)
+	}
+}
+
+func TestCheckControlFields(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		err  bool
+	}{
+		{name: "none", in: nil},
+		{name: "one", in: []byte{1, 0, 1, 'x'}},
+		{name: "two", in: []byte{1, 0, 1, 'x', 2, 0, 0}},
+		{name: "truncated second header", in: []byte{1, 0, 1, 'x', 2, 0}, err: true},
+		{name: "oversized length", in: []byte{1, 0xff, 0xff, 'x'}, err: true},
+		{name: "trailing byte", in: []byte{1, 0, 0, 2}, err: true},
+	} {
+		err := checkControlFields(tc.in)
+		if tc.err {
+			require.Error(t, err, tc.name)
+		} else {
+			require.NoError(t, err, tc.name)
+		}
+	}
+}
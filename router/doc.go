@@ -0,0 +1,7 @@
+// Package router is weave's overlay: the NetworkRouter, which captures
+// and forwards frames between the bridge and other peers, and the
+// sleeve and fastdp overlays it sends them over.
+//
+// Unlike ipam and nameserver it is not meant to be embedded outside
+// weaver; its API changes whenever the overlays need it to.
+package router
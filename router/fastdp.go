@@ -4,19 +4,27 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 	"github.com/weaveworks/go-odp/odp"
 	"github.com/weaveworks/mesh"
 
+	"github.com/weaveworks/weave/common"
+	weavenet "github.com/weaveworks/weave/net"
 	"github.com/weaveworks/weave/net/ipsec"
+	"github.com/weaveworks/weave/net/wireguard"
 )
 
+var odpLog = common.SubsystemLog("odp")
+
 // The virtual bridge accepts packets from ODP vports and the router
 // port (i.e. InjectPacket).  We need a map key to index those
 // possibilities:
@@ -34,8 +42,8 @@ type missHandler func(fks odp.FlowKeys, lock *fastDatapathLock) FlowOp
 type FastDatapath struct {
 	lock             sync.Mutex // guards state and synchronises use of dpif
 	iface            *net.Interface
-	dpif             *odp.Dpif
-	dp               odp.DatapathHandle
+	dpif             io.Closer
+	dp               odpDatapath
 	deleteFlowsCount uint64
 	missCount        uint64
 	missHandlers     map[odp.VportID]missHandler
@@ -43,6 +51,7 @@ type FastDatapath struct {
 	peers            *mesh.Peers
 	overlayConsumer  OverlayConsumer
 	ipsec            *ipsec.IPSec
+	wireguard        *wireguard.WireGuard // instead of ipsec, if not nil
 
 	// Bridge state: How to send to the given bridge port
 	sendToPort map[bridgePortID]bridgeSender
@@ -65,16 +74,55 @@ type FastDatapath struct {
 
 	// forwarders by remote peer
 	forwarders map[mesh.PeerName]*fastDatapathForwarder
-}
 
-func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool) (*FastDatapath, error) {
-	var ipSec *ipsec.IPSec
+	// connUIDs of the forwarders which have not been stopped
+	connections map[uint64]bool
+
+	// Which traffic to mirror, as a *fastDatapathMirror
+	mirror atomic.Value
+}
 
+// NewFastDatapath returns a fast datapath on iface, which if
+// encryption is enabled sets up IPsec according to ipsecConfig, or, if
+// wireguardConfig is not nil, WireGuard according to that instead.
+func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool, ipsecConfig ipsec.Config, wireguardConfig *wireguard.Config) (*FastDatapath, error) {
 	dpif, err := odp.NewDpif()
 	if err != nil {
 		return nil, err
 	}
 
+	dp, err := dpif.LookupDatapath(iface.Name)
+	if err != nil {
+		dpif.Close()
+		return nil, err
+	}
+
+	return newFastDatapath(dpif, dp, iface, port, encryptionEnabled, ipsecConfig, wireguardConfig)
+}
+
+// odpDatapath is what a FastDatapath does with its ODP datapath: an
+// odp.DatapathHandle, or a SimDatapath when simulating one
+type odpDatapath interface {
+	CreateFlow(flow odp.FlowSpec) error
+	DeleteFlow(fks odp.FlowKeys) error
+	ClearFlow(flow odp.FlowSpec) error
+	EnumerateFlows() ([]odp.FlowInfo, error)
+	Execute(packet []byte, fks odp.FlowKeys, actions []odp.Action) error
+	CreateVport(spec odp.VportSpec) (odp.VportID, error)
+	LookupVport(id odp.VportID) (odp.Vport, error)
+	DeleteVport(id odp.VportID) error
+	EnumerateVports() ([]odp.Vport, error)
+	ConsumeMisses(consumer odp.MissConsumer) (odp.Cancelable, error)
+	ConsumeVportEvents(consumer odp.VportEventsConsumer) (odp.Cancelable, error)
+}
+
+// newFastDatapath returns a fast datapath over dp, closing dpif when
+// it is closed, or at once if it fails
+func newFastDatapath(dpif io.Closer, dp odpDatapath, iface *net.Interface, port int, encryptionEnabled bool, ipsecConfig ipsec.Config, wireguardConfig *wireguard.Config) (*FastDatapath, error) {
+	var ipSec *ipsec.IPSec
+	var wg *wireguard.WireGuard
+	var err error
+
 	success := false
 	defer func() {
 		if !success {
@@ -82,14 +130,14 @@ func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool) (*F
 		}
 	}()
 
-	dp, err := dpif.LookupDatapath(iface.Name)
-	if err != nil {
-		return nil, err
-	}
-
-	if encryptionEnabled {
+	if encryptionEnabled && wireguardConfig != nil {
 		var err error
-		if ipSec, err = ipsec.New(log); err != nil {
+		if wg, err = wireguard.New(common.SubsystemLog("wireguard"), *wireguardConfig); err != nil {
+			return nil, errors.Wrap(err, "wireguard new")
+		}
+	} else if encryptionEnabled {
+		var err error
+		if ipSec, err = ipsec.New(common.SubsystemLog("ipsec"), ipsecConfig); err != nil {
 			return nil, errors.Wrap(err, "ipsec new")
 		}
 		if err := ipSec.Flush(false); err != nil {
@@ -103,13 +151,16 @@ func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool) (*F
 		dp:            dp,
 		missHandlers:  make(map[odp.VportID]missHandler),
 		ipsec:         ipSec,
+		wireguard:     wg,
 		sendToPort:    nil,
 		sendToMAC:     make(map[MAC]bridgeSender),
 		seenMACs:      make(map[MAC]struct{}),
 		vxlanUDPPorts: make(map[int]odp.VportID),
 		vxlanVportIDs: make(map[odp.VportID]struct{}),
 		forwarders:    make(map[mesh.PeerName]*fastDatapathForwarder),
+		connections:   make(map[uint64]bool),
 	}
+	fastdp.mirror.Store((*fastDatapathMirror)(nil))
 
 	// This delete happens asynchronously in the kernel, meaning that
 	// we can sometimes fail to recreate the vxlan vport with EADDRINUSE -
@@ -158,6 +209,17 @@ func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool) (*F
 		fastdp.makeBridgeVport(vport)
 	}
 
+	if ipSec != nil {
+		ipSec.StartReaper(fastdp.liveConnections)
+		ipSec.StartDeadPeerDetection(fastdp.deadPeer)
+		ipSec.StartConsistencyCheck(fastdp.inconsistentIPSec)
+		ipSec.StartStrictIngress()
+		ipSec.StartReconciler()
+	}
+	if wg != nil {
+		wg.StartReconciler()
+	}
+
 	success = true
 	go fastdp.run()
 	return fastdp, nil
@@ -273,27 +335,32 @@ func (fastdp *FastDatapath) bridge(ingress bridgePortID, key PacketKey, lock *fa
 		fastdp.seenMACs[key.SrcMAC] = struct{}{}
 	}
 
+	mirror := fastdp.mirrorMACs(key)
+
 	// If we know about the destination MAC, deliver it to the
 	// associated port.
 	if sender := fastdp.sendToMAC[key.DstMAC]; sender != nil {
-		return NewMultiFlowOp(false, odpEthernetFlowKey(key), sender(key, lock))
+		return NewMultiFlowOp(false, odpEthernetFlowKey(key), withMirror(mirror, sender(key, lock)))
 	}
 
 	// Otherwise, it might be a real broadcast, or it might
 	// be for a MAC we don't know about yet.  Either way, we'll
 	// broadcast it.
 	mfop := NewMultiFlowOp(false)
+	if mirror != nil {
+		mfop.Add(mirror)
+	}
 
 	if (key.DstMAC[0] & 1) == 0 {
 		// Not a real broadcast, so don't create a flow rule.
 		// If we did, we'd need to delete the flows every time
 		// we learned a new MAC address, or have a more
 		// complicated selective invalidation scheme.
-		log.Debug("fastdp: unknown dst", ingress, key)
+		odpLog.Debug("fastdp: unknown dst", ingress, key)
 		mfop.Add(vetoFlowCreationFlowOp{})
 	} else {
 		// A real broadcast
-		log.Debug("fastdp: broadcast", ingress, key)
+		odpLog.Debug("fastdp: broadcast", ingress, key)
 		mfop.Add(odpEthernetFlowKey(key))
 	}
 
@@ -321,14 +388,14 @@ func (fastdp *FastDatapath) Overlay() NetworkOverlay {
 }
 
 func (fastdp fastDatapathOverlay) InvalidateRoutes() {
-	log.Debug("InvalidateRoutes")
+	odpLog.Debug("InvalidateRoutes")
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
 	checkWarn(fastdp.deleteFlows())
 }
 
 func (fastdp fastDatapathOverlay) InvalidateShortIDs() {
-	log.Debug("InvalidateShortIDs")
+	odpLog.Debug("InvalidateShortIDs")
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
 	checkWarn(fastdp.deleteFlows())
@@ -337,19 +404,42 @@ func (fastdp fastDatapathOverlay) InvalidateShortIDs() {
 func (fastdp fastDatapathOverlay) Stop() {
 	if fastdp.ipsec != nil {
 		if err := fastdp.ipsec.Flush(true); err != nil {
-			log.Errorf("ipsec flush failed: %s", err)
+			odpLog.Errorf("ipsec flush failed: %s", err)
 		}
 	}
+	if fastdp.wireguard != nil {
+		if err := fastdp.wireguard.Flush(true); err != nil {
+			odpLog.Errorf("wireguard flush failed: %s", err)
+		}
+	}
+}
+
+// IPSec returns the IPsec state of the datapath, or nil if encryption
+// is not enabled
+func (fastdp *FastDatapath) IPSec() *ipsec.IPSec {
+	return fastdp.ipsec
+}
+
+// WireGuard returns the WireGuard state of the datapath, or nil if it
+// does not encrypt with WireGuard
+func (fastdp *FastDatapath) WireGuard() *wireguard.WireGuard {
+	return fastdp.wireguard
 }
 
-func (fastDatapathOverlay) AddFeaturesTo(features map[string]string) {
-	// Nothing needed.  Fast datapath support is indicated through
-	// OverlaySwitch.
+func (fastdp fastDatapathOverlay) AddFeaturesTo(features map[string]string) {
+	// Fast datapath support is indicated through OverlaySwitch
+	if fastdp.ipsec != nil {
+		fastdp.ipsec.AddFeaturesTo(features)
+	}
+	if fastdp.wireguard != nil {
+		fastdp.wireguard.AddFeaturesTo(features)
+	}
 }
 
 type FastDPStatus struct {
 	Vports []VportStatus
 	Flows  []FlowStatus
+	Mirror *MirrorConfig `json:"Mirror,omitempty"`
 }
 
 type FlowStatus odp.FlowInfo
@@ -411,6 +501,7 @@ func (fastdp fastDatapathOverlay) Diagnostics() interface{} {
 	return FastDPStatus{
 		vportStatuses,
 		flowStatuses,
+		fastdp.Mirror(),
 	}
 }
 
@@ -452,7 +543,7 @@ func (fastdp *FastDatapath) getVxlanVportIDHarder(udpPort int, retries int, dura
 		if err == nil || err != odp.NetlinkError(syscall.EADDRINUSE) {
 			return vxlanVportID, err
 		}
-		log.Warning("Address already in use creating vxlan vport ", udpPort, " - retrying")
+		odpLog.Warning("Address already in use creating vxlan vport ", udpPort, " - retrying")
 		time.Sleep(duration)
 	}
 	return 0, err
@@ -477,21 +568,34 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 	// to bypass the kernel bug which makes the vxlan creation to complete
 	// successfully regardless whether there were any errors when binding
 	// to the given UDP port.
-	if link, err := netlink.LinkByName(name); err == nil {
+	var link netlink.Link
+	if _, simulated := fastdp.dp.(*SimDatapath); !simulated {
+		link, err = weavenet.LinkByName(netns.None(), name)
+	}
+	if err != nil && err != weavenet.ErrLinkNotFound {
+		odpLog.Warningf("Unable to check vxlan netdev %s: %s", name, err)
+	}
+	if link != nil {
 		if link.Attrs().Flags&net.FlagUp == 0 {
 			// The netdev interface is down, so most likely bringing it up
 			// has failed due to the UDP port being in use.
 			if err := fastdp.dp.DeleteVport(vxlanVportID); err != nil {
-				log.Warning("Unable to remove vxlan vport %d: %s", vxlanVportID, err)
+				odpLog.Warning("Unable to remove vxlan vport %d: %s", vxlanVportID, err)
 			}
 			return 0, odp.NetlinkError(syscall.EADDRINUSE)
 		}
 	}
 
+	if fastdp.ipsec != nil {
+		if err := fastdp.ipsec.StrictIngressPort(udpPort); err != nil {
+			odpLog.Errorf("ipsec: strict ingress on vxlan port %d failed: %s", udpPort, err)
+		}
+	}
+
 	fastdp.vxlanUDPPorts[udpPort] = vxlanVportID
 	fastdp.vxlanVportIDs[vxlanVportID] = struct{}{}
 	fastdp.missHandlers[vxlanVportID] = func(fks odp.FlowKeys, lock *fastDatapathLock) FlowOp {
-		log.Debug("ODP miss: ", fks, " on port ", vxlanVportID)
+		odpLog.Debug("ODP miss: ", fks, " on port ", vxlanVportID)
 		tunnel := fks[odp.OVS_KEY_ATTR_TUNNEL].(odp.TunnelFlowKey)
 		tunKey := tunnel.Key()
 
@@ -531,7 +635,7 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 		tunnelFlowKey.SetIpv4Src(tunKey.Ipv4Src)
 		tunnelFlowKey.SetIpv4Dst(tunKey.Ipv4Dst)
 
-		return NewMultiFlowOp(false, odpFlowKey(tunnelFlowKey), consumer(key))
+		return NewMultiFlowOp(false, odpFlowKey(tunnelFlowKey), withMirror(fastdp.mirrorPeers(srcPeer, dstPeer), consumer(key)))
 	}
 
 	return vxlanVportID, nil
@@ -570,9 +674,21 @@ type fastDatapathForwarder struct {
 	vxlanVportID   odp.VportID
 
 	sessionKey                 *[32]byte
+	ipsecParams                ipsec.Params
+	wireguardRemote            wireguard.Remote
 	isEncrypted                bool
 	isOutboundIPSecEstablished bool
-
+	// The InitSARemote message we sent, kept to retransmit until the
+	// remote peer acknowledges it, if it does that
+	initSARemoteTag      byte
+	initSARemoteMsg      []byte
+	initSARemoteAttempts int
+	initSARemoteTimer    *time.Timer
+	initSARemoteAcked    bool
+
+	// The timers run their functions on goroutines of their own as
+	// they fire, so a forwarder needs none of its own while idle,
+	// which adds up with 1000+ peers
 	lock              sync.RWMutex
 	confirmed         bool
 	remoteAddr        *net.UDPAddr
@@ -580,7 +696,6 @@ type fastDatapathForwarder struct {
 	heartbeatTimer    *time.Timer
 	heartbeatTimeout  *time.Timer
 	ackedHeartbeat    bool
-	stopChan          chan struct{}
 	stopped           bool
 
 	establishedChan chan struct{}
@@ -588,6 +703,12 @@ type fastDatapathForwarder struct {
 }
 
 func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	// Without encryption set up, e.g. as the kernel lacks a module it
+	// needs, encrypted connections are left to sleeve
+	if params.SessionKey != nil && fastdp.ipsec == nil && fastdp.wireguard == nil {
+		return nil, fmt.Errorf("fast datapath encryption is not set up")
+	}
+
 	vxlanVportID := fastdp.mainVxlanVportID
 	vxlanUDPPort := fastdp.mainVxlanUDPPort
 
@@ -614,6 +735,13 @@ func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectio
 		return nil, err
 	}
 
+	var wireguardRemote wireguard.Remote
+	if fastdp.wireguard != nil && params.SessionKey != nil {
+		if wireguardRemote, err = parseWireGuardRemote(params.Features); err != nil {
+			return nil, err
+		}
+	}
+
 	fwd := &fastDatapathForwarder{
 		fastdp:         fastdp.FastDatapath,
 		remotePeer:     params.RemotePeer,
@@ -623,13 +751,21 @@ func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectio
 		vxlanVportID:   vxlanVportID,
 		sessionKey:     params.SessionKey,
 
+		wireguardRemote: wireguardRemote,
+
 		remoteAddr:        remoteAddr,
 		heartbeatInterval: FastHeartbeat,
-		stopChan:          make(chan struct{}),
 
 		establishedChan: make(chan struct{}),
 		errorChan:       make(chan error, 1),
 	}
+	fastdp.lock.Lock()
+	fastdp.connections[fwd.connUID] = true
+	fastdp.lock.Unlock()
+
+	if fastdp.ipsec != nil {
+		fwd.ipsecParams = fastdp.ipsec.Negotiate(params.Features, remoteAddr.IP)
+	}
 
 	return fwd, nil
 }
@@ -653,42 +789,62 @@ func (fwd *fastDatapathForwarder) Confirm() {
 	defer fwd.lock.Unlock()
 
 	if fwd.confirmed {
-		log.Fatal(fwd.logPrefix(), "already confirmed")
+		odpLog.Fatal(fwd.logPrefix(), "already confirmed")
 	}
 
-	if fwd.fastdp.ipsec != nil && fwd.sessionKey != nil {
+	if fwd.fastdp.wireguard != nil && fwd.sessionKey != nil {
+		if err := fwd.initWireGuard(); err != nil {
+			odpLog.Error(fwd.logPrefix(), "wireguard init peer failed: ", err)
+			fwd.handleError(err)
+			return
+		}
+	} else if fwd.fastdp.ipsec != nil && fwd.sessionKey != nil {
 		fwd.isEncrypted = true
-		log.Info("Setting up IPsec between ", fwd.fastdp.localPeer, " and ", fwd.remotePeer)
+		odpLog.Info("Setting up IPsec between ", fwd.fastdp.localPeer, " and ", fwd.remotePeer, " (", fwd.ipsecParams, ")")
 		err := fwd.fastdp.ipsec.InitSALocal(
 			fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
 			net.IP(fwd.localIP[:]), fwd.remoteAddr.IP,
 			fwd.remoteAddr.Port,
 			fwd.sessionKey,
+			fwd.ipsecParams,
 			func(msg []byte) error {
-				return fwd.sendControlMsg(FastDatapathCryptoInitSARemote, msg)
+				fwd.initSARemoteTag = FastDatapathCryptoInitSARemote
+				if fwd.ipsecParams.MsgVersion == ipsec.MsgVersionTLV {
+					fwd.initSARemoteTag = FastDatapathCryptoInitSARemoteTLV
+				}
+				fwd.initSARemoteMsg = msg
+				fwd.initSARemoteAttempts = 1
+				if fwd.ipsecParams.Ack {
+					fwd.initSARemoteTimer = time.AfterFunc(InitSARemoteRetryInterval, fwd.retryInitSARemote)
+				}
+				return fwd.sendControlMsg(fwd.initSARemoteTag, msg)
 			},
 		)
 		if err != nil {
-			log.Error(fwd.logPrefix(), "ipsec init SA local failed: ", err)
+			odpLog.Error(fwd.logPrefix(), "ipsec init SA local failed: ", err)
 			fwd.handleError(err)
 			return
 		}
+		fwd.checkIPSecMTU()
 	}
 
-	log.Debug(fwd.logPrefix(), "confirmed")
+	odpLog.Debug(fwd.logPrefix(), "confirmed")
 	fwd.fastdp.addForwarder(fwd.remotePeer.Name, fwd)
 	fwd.confirmed = true
 
 	if fwd.remoteAddr != nil && (!fwd.isEncrypted || fwd.isOutboundIPSecEstablished) {
-		// have the goroutine send a heartbeat straight away
-		fwd.heartbeatTimer = time.NewTimer(0)
+		// send a heartbeat straight away
+		fwd.heartbeatTimer = time.AfterFunc(0, fwd.heartbeat)
 	} else {
 		// we'll reset the timer when we learn the remote ip
-		fwd.heartbeatTimer = time.NewTimer(MaxDuration)
+		fwd.heartbeatTimer = time.AfterFunc(MaxDuration, fwd.heartbeat)
 	}
 
-	fwd.heartbeatTimeout = time.NewTimer(HeartbeatTimeout)
-	go fwd.doHeartbeats()
+	fwd.heartbeatTimeout = time.AfterFunc(HeartbeatTimeout, func() {
+		fwd.lock.Lock()
+		defer fwd.lock.Unlock()
+		fwd.handleError(fmt.Errorf("timed out waiting for vxlan heartbeat"))
+	})
 }
 
 func (fwd *fastDatapathForwarder) EstablishedChannel() <-chan struct{} {
@@ -699,28 +855,21 @@ func (fwd *fastDatapathForwarder) ErrorChannel() <-chan error {
 	return fwd.errorChan
 }
 
-func (fwd *fastDatapathForwarder) doHeartbeats() {
-	var err error
-
-	for err == nil {
-		select {
-		case <-fwd.heartbeatTimer.C:
-			if fwd.confirmed {
-				fwd.sendHeartbeat()
-			}
-			fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
-
-		case <-fwd.heartbeatTimeout.C:
-			err = fmt.Errorf("timed out waiting for vxlan heartbeat")
-
-		case <-fwd.stopChan:
-			return
-		}
+// heartbeat sends a heartbeat, when heartbeatTimer fires, and sets it
+// for the next
+func (fwd *fastDatapathForwarder) heartbeat() {
+	fwd.lock.RLock()
+	stopped, interval := fwd.stopped, fwd.heartbeatInterval
+	fwd.lock.RUnlock()
+	if stopped {
+		return
 	}
-
-	fwd.lock.Lock()
-	defer fwd.lock.Unlock()
-	fwd.handleError(err)
+	fwd.sendHeartbeat()
+	fwd.lock.RLock()
+	if !fwd.stopped {
+		fwd.heartbeatTimer.Reset(interval)
+	}
+	fwd.lock.RUnlock()
 }
 
 // Handle an error which leads to notifying the listener and
@@ -735,16 +884,48 @@ func (fwd *fastDatapathForwarder) handleError(err error) {
 	default:
 	}
 
-	// stop the heartbeat goroutine
-	if !fwd.stopped {
-		fwd.stopped = true
-		close(fwd.stopChan)
+	fwd.stopTimers()
+}
+
+// stopTimers stops the heartbeats and retransmissions of the forwarder
+// for good; the caller holds its lock
+func (fwd *fastDatapathForwarder) stopTimers() {
+	if fwd.stopped {
+		return
+	}
+	fwd.stopped = true
+	for _, timer := range []*time.Timer{fwd.heartbeatTimer, fwd.heartbeatTimeout, fwd.initSARemoteTimer} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// retryInitSARemote retransmits the unacknowledged InitSARemote
+// message, when initSARemoteTimer fires, until there have been
+// InitSARemoteAttempts, after which the connection is given up on:
+// without the remote peer's outbound SA, none of its traffic would get
+// through.
+func (fwd *fastDatapathForwarder) retryInitSARemote() {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	if fwd.initSARemoteAcked || fwd.stopped {
+		return
+	}
+	if fwd.initSARemoteAttempts >= InitSARemoteAttempts {
+		fwd.handleError(fmt.Errorf("IPsec InitSARemote not acknowledged after %d attempts", fwd.initSARemoteAttempts))
+		return
 	}
+	fwd.initSARemoteAttempts++
+	odpLog.Info(fwd.logPrefix(), "IPSec init SA remote not acknowledged; retransmitting (attempt ", fwd.initSARemoteAttempts, ")")
+	fwd.initSARemoteTimer.Reset(InitSARemoteRetryInterval)
+	fwd.handleError(fwd.sendControlMsg(fwd.initSARemoteTag, fwd.initSARemoteMsg))
 }
 
 func (fwd *fastDatapathForwarder) sendHeartbeat() {
 	fwd.lock.RLock()
-	log.Debug(fwd.logPrefix(), "sendHeartbeat")
+	odpLog.Debug(fwd.logPrefix(), "sendHeartbeat")
 
 	// the heartbeat payload consists of the 64-bit connection uid
 	// followed by the 16-bit packet size.
@@ -769,17 +950,29 @@ func (fwd *fastDatapathForwarder) sendHeartbeat() {
 const (
 	FastDatapathHeartbeatAck = iota
 	FastDatapathCryptoInitSARemote
+	// Sent instead of FastDatapathCryptoInitSARemote to peers which
+	// understand ipsec.MsgVersionTLV
+	FastDatapathCryptoInitSARemoteTLV
+	// Acknowledges either of the above, to peers with ipsec.AckFeature
+	FastDatapathCryptoInitSARemoteAck
+)
+
+const (
+	// How long to wait for FastDatapathCryptoInitSARemoteAck before
+	// retransmitting, and how many times to send in all
+	InitSARemoteRetryInterval = 2 * time.Second
+	InitSARemoteAttempts      = 5
 )
 
 func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender *net.UDPAddr) {
 	fwd.lock.Lock()
 	defer fwd.lock.Unlock()
 
-	log.Debug(fwd.logPrefix(), "handleVxlanSpecialPacket")
+	odpLog.Debug(fwd.logPrefix(), "handleVxlanSpecialPacket")
 
 	// the only special packet type is a heartbeat
 	if len(frame) < EthernetOverhead+10 {
-		log.Warning(fwd.logPrefix(), "short vxlan special packet: ", len(frame), " bytes")
+		odpLog.Warning(fwd.logPrefix(), "short vxlan special packet: ", len(frame), " bytes")
 		return
 	}
 
@@ -795,7 +988,19 @@ func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender
 			fwd.heartbeatTimer.Reset(0)
 		}
 	} else if !udpAddrsEqual(fwd.remoteAddr, sender) {
-		log.Info(fwd.logPrefix(), "Peer IP address changed to ", sender)
+		if fwd.isEncrypted {
+			// The SAs, policies and rules protecting the connection are
+			// for the addresses it was set up with, so what we sent to
+			// the new one would go unencrypted. Rather than move them
+			// over, which would restart the sequence numbers of the
+			// outbound SA under the same key, have the connection
+			// re-established, and IPsec set up for the addresses now in
+			// use.
+			odpLog.Info(fwd.logPrefix(), "Peer IP address changed to ", sender, "; re-establishing encrypted connection")
+			fwd.handleError(fmt.Errorf("peer IP address of encrypted connection changed to %s", sender))
+			return
+		}
+		odpLog.Info(fwd.logPrefix(), "Peer IP address changed to ", sender)
 		fwd.remoteAddr = sender
 	}
 
@@ -819,19 +1024,26 @@ func (fwd *fastDatapathForwarder) ControlMessage(tag byte, msg []byte) {
 	case FastDatapathHeartbeatAck:
 		fwd.handleHeartbeatAck()
 	case FastDatapathCryptoInitSARemote:
-		fwd.handleCryptoInitSARemote(msg)
+		fwd.handleCryptoInitSARemote(msg, ipsec.MsgVersionLegacy)
+	case FastDatapathCryptoInitSARemoteTLV:
+		fwd.handleCryptoInitSARemote(msg, ipsec.MsgVersionTLV)
+	case FastDatapathCryptoInitSARemoteAck:
+		fwd.handleCryptoInitSARemoteAck()
 
 	default:
-		log.Info(fwd.logPrefix(), "Ignoring unknown control message: ", tag)
+		odpLog.Info(fwd.logPrefix(), "Ignoring unknown control message: ", tag)
 	}
 }
 
 func (fwd *fastDatapathForwarder) Attrs() map[string]interface{} {
-	return map[string]interface{}{"name": "fastdp", "mtu": fwd.fastdp.iface.MTU}
+	attrs := map[string]interface{}{"name": "fastdp", "mtu": fwd.fastdp.iface.MTU}
+	fwd.ipsecAttrs(attrs)
+	fwd.wireguardAttrs(attrs)
+	return attrs
 }
 
 func (fwd *fastDatapathForwarder) handleHeartbeatAck() {
-	log.Debug(fwd.logPrefix(), "handleHeartbeatAck")
+	odpLog.Debug(fwd.logPrefix(), "handleHeartbeatAck")
 
 	if fwd.heartbeatInterval != SlowHeartbeat {
 		close(fwd.establishedChan)
@@ -842,26 +1054,42 @@ func (fwd *fastDatapathForwarder) handleHeartbeatAck() {
 	}
 }
 
-func (fwd *fastDatapathForwarder) handleCryptoInitSARemote(msg []byte) {
-	log.Info(fwd.logPrefix(), "IPSec init SA remote")
+func (fwd *fastDatapathForwarder) handleCryptoInitSARemote(msg []byte, msgVersion int) {
+	odpLog.Info(fwd.logPrefix(), "IPSec init SA remote")
 	err := fwd.fastdp.ipsec.InitSARemote(
-		msg,
+		msg, msgVersion,
 		fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
 		net.IP(fwd.localIP[:]), fwd.remoteAddr.IP, fwd.remoteAddr.Port,
 		fwd.sessionKey,
+		fwd.ipsecParams,
 	)
 	if err != nil {
-		log.Warning(fwd.logPrefix(), "IPSec init SA remote failed: ", err)
+		odpLog.Warning(fwd.logPrefix(), "IPSec init SA remote failed: ", err)
 		fwd.handleError(err)
 		return
 	}
 
+	if fwd.ipsecParams.Ack {
+		if err := fwd.sendControlMsg(FastDatapathCryptoInitSARemoteAck, nil); err != nil {
+			fwd.handleError(err)
+			return
+		}
+	}
+
 	if !fwd.isOutboundIPSecEstablished {
 		fwd.isOutboundIPSecEstablished = true
 		fwd.heartbeatTimer.Reset(0)
 	}
 }
 
+func (fwd *fastDatapathForwarder) handleCryptoInitSARemoteAck() {
+	odpLog.Debug(fwd.logPrefix(), "IPSec init SA remote acknowledged")
+	fwd.initSARemoteAcked = true
+	if fwd.initSARemoteTimer != nil {
+		fwd.initSARemoteTimer.Stop()
+	}
+}
+
 func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 	if !key.SrcPeer.HasShortID || !key.DstPeer.HasShortID {
 		return nil
@@ -880,7 +1108,7 @@ func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 
 	remoteIP, err := ipv4Bytes(fwd.remoteAddr.IP)
 	if err != nil {
-		log.Error(err)
+		odpLog.Error(err)
 		return DiscardingFlowOp{}
 	}
 
@@ -892,7 +1120,7 @@ func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 	sta.SetTtl(64)
 	sta.SetDf(true)
 	sta.SetCsum(false)
-	return fwd.fastdp.odpActions(sta, odp.NewOutputAction(fwd.vxlanVportID))
+	return withMirror(fwd.fastdp.mirrorPeers(key.SrcPeer, key.DstPeer), fwd.fastdp.odpActions(sta, odp.NewOutputAction(fwd.vxlanVportID)))
 }
 
 func tunnelIDFor(key ForwardPacketKey) (tunnelID [8]byte) {
@@ -911,23 +1139,24 @@ func (fwd *fastDatapathForwarder) Stop() {
 	defer fwd.lock.Unlock()
 	fwd.sendControlMsg = func(byte, []byte) error { return nil }
 
-	if fwd.isEncrypted {
+	if fwd.isEncrypted && fwd.fastdp.wireguard != nil {
+		odpLog.Info("Removing WireGuard peer ", fwd.remotePeer)
+		if err := fwd.fastdp.wireguard.Destroy(fwd.remotePeer.Name, fwd.connUID); err != nil {
+			odpLog.Errorf("wireguard destroy failed: %s", err)
+		}
+	} else if fwd.isEncrypted {
 		localIP := net.IP(fwd.localIP[:])
-		log.Info("Destroying IPsec between ", fwd.fastdp.localPeer, " and ", fwd.remotePeer)
+		odpLog.Info("Destroying IPsec between ", fwd.fastdp.localPeer, " and ", fwd.remotePeer)
 		err := fwd.fastdp.ipsec.Destroy(
 			fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
 			localIP, fwd.remoteAddr.IP, fwd.remoteAddr.Port,
 		)
 		if err != nil {
-			log.Errorf("ipsec destroy failed: %s", err)
+			odpLog.Errorf("ipsec destroy failed: %s", err)
 		}
 	}
 
-	// stop the heartbeat goroutine
-	if !fwd.stopped {
-		fwd.stopped = true
-		close(fwd.stopChan)
-	}
+	fwd.stopTimers()
 }
 
 func (fastdp *FastDatapath) addForwarder(peer mesh.PeerName, fwd *fastDatapathForwarder) {
@@ -945,6 +1174,19 @@ func (fastdp *FastDatapath) removeForwarder(peer mesh.PeerName, fwd *fastDatapat
 	if fastdp.forwarders[peer] == fwd {
 		delete(fastdp.forwarders, peer)
 	}
+	delete(fastdp.connections, fwd.connUID)
+}
+
+// liveConnections returns the connUIDs of the forwarders which have not
+// been stopped, for reaping the IPsec state of any others
+func (fastdp *FastDatapath) liveConnections() map[uint64]bool {
+	fastdp.lock.Lock()
+	defer fastdp.lock.Unlock()
+	live := make(map[uint64]bool, len(fastdp.connections))
+	for connUID := range fastdp.connections {
+		live[connUID] = true
+	}
+	return live
 }
 
 func (fastdp *FastDatapath) deleteFlows() error {
@@ -1022,7 +1264,7 @@ func (fastdp *FastDatapath) expireFlows() {
 
 	for _, flow := range flows {
 		if flow.Used == 0 {
-			log.Debug("Expiring flow ", flow.FlowSpec)
+			odpLog.Debug("Expiring flow ", flow.FlowSpec)
 			err = fastdp.dp.DeleteFlow(flow.FlowKeys)
 		} else {
 			fastdp.touchFlow(flow.FlowKeys, &lock)
@@ -1030,7 +1272,7 @@ func (fastdp *FastDatapath) expireFlows() {
 		}
 
 		if err != nil && !odp.IsNoSuchFlowError(err) {
-			log.Warn(err)
+			odpLog.Warn(err)
 		}
 	}
 }
@@ -1056,10 +1298,10 @@ func (fastdp *FastDatapath) touchFlow(fks odp.FlowKeys, lock *fastDatapathLock)
 
 func (fastdp *FastDatapath) Error(err error, stopped bool) {
 	if stopped {
-		log.Fatal("Error while listeniing on ODP datapath: ", err)
+		odpLog.Fatal("Error while listeniing on ODP datapath: ", err)
 	}
 
-	log.Error("Error while listening on ODP datapath: ", err)
+	odpLog.Error("Error while listening on ODP datapath: ", err)
 }
 
 func (fastdp *FastDatapath) Miss(packet []byte, fks odp.FlowKeys) error {
@@ -1072,7 +1314,7 @@ func (fastdp *FastDatapath) Miss(packet []byte, fks odp.FlowKeys) error {
 
 	handler := fastdp.getMissHandler(ingress)
 	if handler == nil {
-		log.Debug("ODP miss (no handler): ", fks, " on port ", ingress)
+		odpLog.Debug("ODP miss (no handler): ", fks, " on port ", ingress)
 		return nil
 	}
 
@@ -1091,7 +1333,7 @@ func (fastdp *FastDatapath) getMissHandler(ingress odp.VportID) missHandler {
 	if handler == nil {
 		vport, err := fastdp.dp.LookupVport(ingress)
 		if err != nil {
-			log.Error(err)
+			odpLog.Error(err)
 			return nil
 		}
 
@@ -1222,7 +1464,7 @@ func (fastdp *FastDatapath) send(fops FlowOp, frame []byte, lock *fastDatapathLo
 	}
 
 	if fastdp.isHairpinFlow(&flow) {
-		log.Error("Vetoed installation of hairpin flow ", flow)
+		odpLog.Error("Vetoed installation of hairpin flow ", flow)
 		return
 	}
 
@@ -1245,7 +1487,7 @@ func (fastdp *FastDatapath) send(fops FlowOp, frame []byte, lock *fastDatapathLo
 		// to handle one packet like that, but it would be bad
 		// to introduce a stale flow.
 		if lock.deleteFlowsCount == fastdp.deleteFlowsCount {
-			log.Debug("Creating ODP flow ", flow)
+			odpLog.Debug("Creating ODP flow ", flow)
 			checkWarn(fastdp.dp.CreateFlow(flow))
 		}
 	}
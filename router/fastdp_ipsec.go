@@ -0,0 +1,185 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/ipsec"
+)
+
+// The outer IPv4 and UDP headers, and the VXLAN header, of packets
+// sent over fast datapath
+const vxlanOverhead = UDPOverhead + 8
+
+// checkIPSecMTU warns if frames of the overlay MTU would not fit in
+// the MTU of the interface over which the peer is reached once
+// encapsulated in VXLAN and encrypted, in which case the heartbeats
+// are dropped and the connection falls back to sleeve, and suggests
+// an MTU which would fit.
+func (fwd *fastDatapathForwarder) checkIPSecMTU() {
+	remoteIP := fwd.remoteAddr.IP
+	linkMTU, err := ipsec.LinkMTU(remoteIP)
+	if err != nil {
+		odpLog.Debug(fwd.logPrefix(), "unable to find the MTU of the path to ", remoteIP, ": ", err)
+		return
+	}
+	overhead := EthernetOverhead + vxlanOverhead + fwd.ipsecParams.Overhead(remoteIP)
+	if mtu := fwd.fastdp.iface.MTU; mtu+overhead > linkMTU {
+		odpLog.Warning(fwd.logPrefix(), "MTU ", mtu, " is too large for encrypted fast datapath over a link with MTU ", linkMTU,
+			" (", overhead, " bytes overhead); set WEAVE_MTU to at most ", (linkMTU-overhead)&^3)
+	}
+}
+
+// ipsecAttrs adds to attrs, for the connection status, whether the
+// connection is protected by IPsec in both directions, the SPIs of its
+// SAs, when it was last rekeyed, and how ESP is sent, if it is
+// encrypted
+func (fwd *fastDatapathForwarder) ipsecAttrs(attrs map[string]interface{}) {
+	fwd.lock.RLock()
+	encrypted, connUID, remoteAddr := fwd.isEncrypted, fwd.connUID, fwd.remoteAddr
+	fwd.lock.RUnlock()
+	if !encrypted || remoteAddr == nil || fwd.fastdp.ipsec == nil {
+		return
+	}
+
+	s := fwd.fastdp.ipsec.ConnectionStatus(fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, connUID, remoteAddr.Port)
+	spi := func(spi ipsec.SPI) string {
+		if spi == 0 {
+			return "none"
+		}
+		return fmt.Sprintf("0x%x", uint32(spi))
+	}
+	attrs["ipsec"] = s.Protected()
+	attrs["ipsec-spi-in"] = spi(s.InSPI)
+	attrs["ipsec-spi-out"] = spi(s.OutSPI)
+	if !s.Rekeyed.IsZero() {
+		attrs["ipsec-rekeyed"] = s.Rekeyed.UTC().Format(time.RFC3339)
+	}
+	encap := "esp"
+	if s.EncapPort != 0 {
+		encap = fmt.Sprintf("udp:%d", s.EncapPort)
+	}
+	if s.Tunnel {
+		encap += "-tunnel"
+	}
+	attrs["ipsec-encap"] = encap
+}
+
+// Rekey replaces the IPsec SAs of the fast datapath connection to peer
+// with ones with fresh keys, e.g. after a suspected key compromise.
+// As with SAs reaching their hard limits, the connection is closed, so
+// that it is re-established, with fresh keys; the old inbound SA is
+// kept for the rekey overlap.
+func (fastdp *FastDatapath) Rekey(peer mesh.PeerName) error {
+	fastdp.lock.Lock()
+	fwd, found := fastdp.forwarders[peer]
+	fastdp.lock.Unlock()
+	if !found {
+		return fmt.Errorf("no fast datapath connection to %s", peer)
+	}
+
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	if !fwd.isEncrypted {
+		return fmt.Errorf("connection to %s is not encrypted", peer)
+	}
+	odpLog.Info(fwd.logPrefix(), "IPSec rekey requested")
+	fwd.handleError(fmt.Errorf("IPsec rekey requested"))
+	return nil
+}
+
+// FlushIPSec removes all the IPsec state with peer at once, including
+// any inbound SA kept for the rekey overlap, and closes the connection
+// to it, if any, to be re-established with fresh keys. It recovers a
+// connection whose IPsec state is broken without disturbing those to
+// other peers.
+func (fastdp *FastDatapath) FlushIPSec(peer mesh.PeerName) error {
+	fastdp.lock.Lock()
+	fwd, found := fastdp.forwarders[peer]
+	fastdp.lock.Unlock()
+	if found {
+		// Stop it first, so that it no longer forwards once its policy
+		// and rules are gone
+		fwd.Stop()
+		fwd.lock.Lock()
+		fwd.handleError(fmt.Errorf("IPsec flushed"))
+		fwd.lock.Unlock()
+	}
+	return fastdp.ipsec.FlushPeer(fastdp.localPeer.Name, peer)
+}
+
+// deadPeer closes the connection connUID to peer, which IPsec dead peer
+// detection found to have gone, if it is still up
+func (fastdp *FastDatapath) deadPeer(peer mesh.PeerName, connUID uint64) {
+	fastdp.closeConnection(peer, connUID, fmt.Errorf("no IPsec traffic received from peer"))
+}
+
+// inconsistentIPSec closes the connection connUID to peer, whose IPsec
+// state was found incomplete, if it is still up, to be re-established
+// with a fresh handshake
+func (fastdp *FastDatapath) inconsistentIPSec(peer mesh.PeerName, connUID uint64) {
+	fastdp.closeConnection(peer, connUID, fmt.Errorf("IPsec state incomplete"))
+}
+
+func (fastdp *FastDatapath) closeConnection(peer mesh.PeerName, connUID uint64, err error) {
+	fastdp.lock.Lock()
+	fwd, found := fastdp.forwarders[peer]
+	fastdp.lock.Unlock()
+	if !found || fwd.connUID != connUID {
+		return
+	}
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	fwd.handleError(err)
+}
+
+// handleIPSecHTTP lets a peer's connection be rekeyed with a POST to
+// /ipsec/rekey, giving the peer's name, and, with flush=true, its
+// IPsec state be flushed.
+func (fastdp *FastDatapath) handleIPSecHTTP(muxRouter *mux.Router) {
+	muxRouter.Methods("POST").Path("/ipsec/rekey").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fastdp.ipsec == nil {
+			http.Error(w, "encryption is not enabled", http.StatusBadRequest)
+			return
+		}
+		peer, err := mesh.PeerNameFromUserInput(r.FormValue("peer"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid peer: %s", err), http.StatusBadRequest)
+			return
+		}
+		rekey := fastdp.Rekey
+		if r.FormValue("flush") == "true" {
+			rekey = fastdp.FlushIPSec
+		}
+		if err := rekey(peer); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+	})
+	muxRouter.Methods("GET").Path("/ipsec/flush-plan").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fastdp.ipsec == nil {
+			http.Error(w, "encryption is not enabled", http.StatusBadRequest)
+			return
+		}
+		plan, err := fastdp.ipsec.Plan(r.FormValue("destroy") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, p := range plan.Policies {
+			fmt.Fprintf(w, "xfrm policy %s %s -> %s priority %d\n", p.Dir, p.Src, p.Dst, p.Priority)
+		}
+		for _, s := range plan.States {
+			fmt.Fprintf(w, "xfrm state %s -> %s proto %s spi 0x%x\n", s.Src, s.Dst, s.Proto, s.Spi)
+		}
+		for _, rule := range plan.Rules {
+			fmt.Fprintf(w, "rule %s\n", rule)
+		}
+		for _, chain := range plan.Chains {
+			fmt.Fprintf(w, "chain %s\n", chain)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/weaveworks/go-odp/odp"
+	"github.com/weaveworks/mesh"
+)
+
+const defaultMirrorPort = 4789 // the IANA VXLAN port
+
+// mirrorSample returns a number in [0, n), the flow being mirrored if
+// it is 0; tests replace it
+var mirrorSample = rand.Intn
+
+// A MirrorConfig says which traffic fast datapath copies to a
+// collector, for IDS and traffic analysis integrations. Copies are
+// of frames as they are in the datapath, i.e. decrypted, sent in
+// VXLAN to the collector. So that traffic between peers is not
+// unwittingly sent in cleartext, a router with encryption enabled
+// refuses to mirror unless Cleartext is set.
+type MirrorConfig struct {
+	Collector  *net.UDPAddr
+	VNI        uint32
+	MACs       []net.HardwareAddr `json:"MACs,omitempty"`       // local containers whose traffic is mirrored
+	Peers      []mesh.PeerName    `json:"Peers,omitempty"`      // peers whose traffic to or from us is mirrored
+	SampleRate int                `json:"SampleRate,omitempty"` // mirror one in this many flows, chosen as each is created; 0 for all
+	Cleartext  bool               `json:"Cleartext,omitempty"`  // mirror even though encrypted traffic is among that copied
+}
+
+type fastDatapathMirror struct {
+	config  MirrorConfig
+	macs    map[MAC]struct{}
+	peers   map[mesh.PeerName]struct{}
+	actions []odp.Action
+}
+
+// SetMirror starts mirroring the traffic selected by config, replacing
+// any previous mirror, or stops mirroring if config is nil.
+func (fastdp *FastDatapath) SetMirror(config *MirrorConfig) error {
+	var mirror *fastDatapathMirror
+	if config != nil {
+		if (fastdp.ipsec != nil || fastdp.wireguard != nil) && !config.Cleartext {
+			return fmt.Errorf("encryption is enabled, and the mirrored copies would be sent to %s unencrypted; set cleartext to mirror anyway", config.Collector)
+		}
+		var err error
+		if mirror, err = fastdp.makeMirror(*config); err != nil {
+			return err
+		}
+	}
+	fastdp.mirror.Store(mirror)
+
+	// Existing flows were created under the old configuration
+	fastdp.lock.Lock()
+	defer fastdp.lock.Unlock()
+	return fastdp.deleteFlows()
+}
+
+func (fastdp *FastDatapath) makeMirror(config MirrorConfig) (*fastDatapathMirror, error) {
+	collectorIP, err := ipv4Bytes(config.Collector.IP)
+	if err != nil {
+		return nil, err
+	}
+	// Find the address we would send to the collector from
+	conn, err := net.DialUDP("udp4", nil, config.Collector)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach mirror collector %s: %s", config.Collector, err)
+	}
+	localIP, err := ipv4Bytes(conn.LocalAddr().(*net.UDPAddr).IP)
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	vxlanVportID, err := fastdp.getVxlanVportID(config.Collector.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	var tunnelID [8]byte
+	binary.BigEndian.PutUint64(tunnelID[:], uint64(config.VNI))
+	var sta odp.SetTunnelAction
+	sta.SetTunnelId(tunnelID)
+	sta.SetIpv4Src(localIP)
+	sta.SetIpv4Dst(collectorIP)
+	sta.SetTos(0)
+	sta.SetTtl(64)
+	sta.SetDf(false)
+	sta.SetCsum(false)
+
+	mirror := &fastDatapathMirror{
+		config:  config,
+		macs:    make(map[MAC]struct{}),
+		peers:   make(map[mesh.PeerName]struct{}),
+		actions: []odp.Action{sta, odp.NewOutputAction(vxlanVportID)},
+	}
+	for _, mac := range config.MACs {
+		var m MAC
+		copy(m[:], mac)
+		mirror.macs[m] = struct{}{}
+	}
+	for _, peer := range config.Peers {
+		mirror.peers[peer] = struct{}{}
+	}
+	return mirror, nil
+}
+
+func (fastdp *FastDatapath) Mirror() *MirrorConfig {
+	if mirror := fastdp.mirror.Load().(*fastDatapathMirror); mirror != nil {
+		config := mirror.config
+		return &config
+	}
+	return nil
+}
+
+// mirrorMACs returns a FlowOp mirroring frames to or from a selected
+// container, or nil if key is not selected
+func (fastdp *FastDatapath) mirrorMACs(key PacketKey) FlowOp {
+	return fastdp.mirrorIf(func(mirror *fastDatapathMirror) bool {
+		_, src := mirror.macs[key.SrcMAC]
+		_, dst := mirror.macs[key.DstMAC]
+		return src || dst
+	})
+}
+
+// mirrorPeers returns a FlowOp mirroring frames between us and a
+// selected peer, or nil if neither peer is selected
+func (fastdp *FastDatapath) mirrorPeers(srcPeer, dstPeer *mesh.Peer) FlowOp {
+	return fastdp.mirrorIf(func(mirror *fastDatapathMirror) bool {
+		_, src := mirror.peers[srcPeer.Name]
+		_, dst := mirror.peers[dstPeer.Name]
+		return src || dst
+	})
+}
+
+func (fastdp *FastDatapath) mirrorIf(selected func(*fastDatapathMirror) bool) FlowOp {
+	mirror := fastdp.mirror.Load().(*fastDatapathMirror)
+	if mirror == nil || !selected(mirror) {
+		return nil
+	}
+	if mirror.config.SampleRate > 1 && mirrorSample(mirror.config.SampleRate) != 0 {
+		return nil
+	}
+	return fastdp.odpActions(mirror.actions...)
+}
+
+// withMirror adds mirror, if there is one, to fop
+func withMirror(mirror FlowOp, fop FlowOp) FlowOp {
+	if mirror == nil {
+		return fop
+	}
+	return NewMultiFlowOp(false, mirror, fop)
+}
+
+// HandleHTTP lets the mirror be set with a PUT to /mirror, giving the
+// collector, as IP[:port], and optionally a vni, sample rate, cleartext
+// and any number of mac and peer parameters, and removed with a
+// DELETE. It also handles /ipsec/rekey.
+func (fastdp *FastDatapath) HandleHTTP(muxRouter *mux.Router) {
+	fastdp.handleIPSecHTTP(muxRouter)
+
+	muxRouter.Methods("PUT").Path("/mirror").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, err := parseMirrorConfig(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fastdp.SetMirror(config); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	muxRouter.Methods("DELETE").Path("/mirror").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := fastdp.SetMirror(nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func parseMirrorConfig(r *http.Request) (*MirrorConfig, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("unable to parse form: %s", err)
+	}
+	collector := r.FormValue("collector")
+	if collector == "" {
+		return nil, fmt.Errorf("collector must be given")
+	}
+	if !strings.Contains(collector, ":") {
+		collector = fmt.Sprintf("%s:%d", collector, defaultMirrorPort)
+	}
+	addr, err := net.ResolveUDPAddr("udp4", collector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid collector: %s", err)
+	}
+	config := &MirrorConfig{Collector: addr}
+	if vni := r.FormValue("vni"); vni != "" {
+		n, err := strconv.ParseUint(vni, 10, 24)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vni: %s", err)
+		}
+		config.VNI = uint32(n)
+	}
+	if rate := r.FormValue("sample"); rate != "" {
+		if config.SampleRate, err = strconv.Atoi(rate); err != nil || config.SampleRate < 1 {
+			return nil, fmt.Errorf("invalid sample rate %q", rate)
+		}
+	}
+	if cleartext := r.FormValue("cleartext"); cleartext != "" {
+		if config.Cleartext, err = strconv.ParseBool(cleartext); err != nil {
+			return nil, fmt.Errorf("invalid cleartext %q", cleartext)
+		}
+	}
+	for _, s := range r.Form["mac"] {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return nil, err
+		}
+		config.MACs = append(config.MACs, mac)
+	}
+	for _, s := range r.Form["peer"] {
+		peer, err := mesh.PeerNameFromUserInput(s)
+		if err != nil {
+			return nil, err
+		}
+		config.Peers = append(config.Peers, peer)
+	}
+	if len(config.MACs) == 0 && len(config.Peers) == 0 {
+		return nil, fmt.Errorf("at least one mac or peer must be given")
+	}
+	return config, nil
+}
@@ -0,0 +1,106 @@
+package router
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/ipsec"
+)
+
+func TestParseMirrorConfig(t *testing.T) {
+	mac, _ := net.ParseMAC("7a:c4:8b:a1:e6:ad")
+	peer, _ := mesh.PeerNameFromUserInput("00:00:00:00:00:02")
+	for _, tc := range []struct {
+		name   string
+		form   string
+		config *MirrorConfig
+	}{
+		{name: "no collector", form: "mac=7a:c4:8b:a1:e6:ad"},
+		{name: "invalid collector", form: "collector=10.0.0.9:vxlan&mac=7a:c4:8b:a1:e6:ad"},
+		{name: "no mac or peer", form: "collector=10.0.0.9"},
+		{name: "default port", form: "collector=10.0.0.9&mac=7a:c4:8b:a1:e6:ad",
+			config: &MirrorConfig{Collector: &net.UDPAddr{IP: net.ParseIP("10.0.0.9"), Port: defaultMirrorPort}, MACs: []net.HardwareAddr{mac}}},
+		{name: "everything", form: "collector=10.0.0.9:8472&vni=42&sample=10&cleartext=true&mac=7a:c4:8b:a1:e6:ad&peer=00:00:00:00:00:02",
+			config: &MirrorConfig{Collector: &net.UDPAddr{IP: net.ParseIP("10.0.0.9"), Port: 8472}, VNI: 42, SampleRate: 10, Cleartext: true,
+				MACs: []net.HardwareAddr{mac}, Peers: []mesh.PeerName{peer}}},
+		{name: "vni beyond 24 bits", form: "collector=10.0.0.9&vni=16777216&mac=7a:c4:8b:a1:e6:ad"},
+		{name: "invalid vni", form: "collector=10.0.0.9&vni=x&mac=7a:c4:8b:a1:e6:ad"},
+		{name: "sample of 0", form: "collector=10.0.0.9&sample=0&mac=7a:c4:8b:a1:e6:ad"},
+		{name: "invalid sample", form: "collector=10.0.0.9&sample=x&mac=7a:c4:8b:a1:e6:ad"},
+		{name: "invalid cleartext", form: "collector=10.0.0.9&cleartext=x&mac=7a:c4:8b:a1:e6:ad"},
+		{name: "invalid mac", form: "collector=10.0.0.9&mac=7a:c4"},
+		{name: "invalid peer", form: "collector=10.0.0.9&peer=host2"},
+	} {
+		r := httptest.NewRequest("PUT", "/mirror", strings.NewReader(tc.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		config, err := parseMirrorConfig(r)
+		if tc.config == nil {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.config.Collector.String(), config.Collector.String(), tc.name)
+		config.Collector = tc.config.Collector
+		require.Equal(t, tc.config, config, tc.name)
+	}
+}
+
+func TestMirrorSampling(t *testing.T) {
+	defer func(sample func(int) int) { mirrorSample = sample }(mirrorSample)
+	var draws []int
+	mirrorSample = func(n int) int {
+		draws = append(draws, n)
+		return len(draws) % n
+	}
+
+	src, _ := mesh.PeerNameFromUserInput("00:00:00:00:00:01")
+	dst, _ := mesh.PeerNameFromUserInput("00:00:00:00:00:02")
+	other, _ := mesh.PeerNameFromUserInput("00:00:00:00:00:03")
+	var selected MAC
+	copy(selected[:], []byte{0x7a, 0xc4, 0x8b, 0xa1, 0xe6, 0xad})
+
+	fastdp := &FastDatapath{}
+	fastdp.mirror.Store((*fastDatapathMirror)(nil))
+	require.Nil(t, fastdp.mirrorPeers(&mesh.Peer{Name: src}, &mesh.Peer{Name: dst}), "no mirror")
+
+	mirror := &fastDatapathMirror{
+		macs:  map[MAC]struct{}{selected: {}},
+		peers: map[mesh.PeerName]struct{}{dst: {}},
+	}
+	fastdp.mirror.Store(mirror)
+	require.NotNil(t, fastdp.mirrorPeers(&mesh.Peer{Name: src}, &mesh.Peer{Name: dst}))
+	require.NotNil(t, fastdp.mirrorPeers(&mesh.Peer{Name: dst}, &mesh.Peer{Name: src}))
+	require.Nil(t, fastdp.mirrorPeers(&mesh.Peer{Name: src}, &mesh.Peer{Name: other}))
+	require.NotNil(t, fastdp.mirrorMACs(PacketKey{SrcMAC: selected}))
+	require.Nil(t, fastdp.mirrorMACs(PacketKey{}))
+	require.Empty(t, draws, "sampled without a sample rate")
+
+	// Of a rate of 3, only the flows drawing 0 are mirrored, and only
+	// those selected are drawn for
+	mirror.config.SampleRate = 3
+	var mirrored int
+	for i := 0; i < 9; i++ {
+		if fastdp.mirrorPeers(&mesh.Peer{Name: src}, &mesh.Peer{Name: dst}) != nil {
+			mirrored++
+		}
+		require.Nil(t, fastdp.mirrorPeers(&mesh.Peer{Name: src}, &mesh.Peer{Name: other}))
+	}
+	require.Equal(t, 3, mirrored)
+	require.Len(t, draws, 9)
+	for _, n := range draws {
+		require.Equal(t, 3, n)
+	}
+}
+
+func TestMirrorRefusedWithEncryption(t *testing.T) {
+	fastdp := &FastDatapath{ipsec: &ipsec.IPSec{}}
+	fastdp.mirror.Store((*fastDatapathMirror)(nil))
+	err := fastdp.SetMirror(&MirrorConfig{Collector: &net.UDPAddr{IP: net.ParseIP("10.0.0.9"), Port: defaultMirrorPort}})
+	require.Error(t, err)
+	require.Nil(t, fastdp.Mirror())
+}
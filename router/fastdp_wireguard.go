@@ -0,0 +1,72 @@
+package router
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/weaveworks/weave/net/ipsec"
+	"github.com/weaveworks/weave/net/wireguard"
+)
+
+// parseWireGuardRemote returns what the remote peer advertises of its
+// WireGuard device, failing the connection if it doesn't encrypt with
+// WireGuard, so that it falls back to sleeve
+func parseWireGuardRemote(features map[string]string) (wireguard.Remote, error) {
+	remote, found, err := wireguard.ParseRemote(features)
+	switch {
+	case err != nil:
+		return wireguard.Remote{}, err
+	case !found:
+		return wireguard.Remote{}, fmt.Errorf("remote peer does not encrypt fast datapath with WireGuard")
+	}
+	return remote, nil
+}
+
+// initWireGuard sets up the WireGuard device to encrypt the
+// connection. Unlike with IPsec there is nothing to hear back from
+// the remote peer, so heartbeats start at once, and get through once
+// it has set up its side too.
+func (fwd *fastDatapathForwarder) initWireGuard() error {
+	fwd.isEncrypted = true
+	odpLog.Info("Setting up WireGuard between ", fwd.fastdp.localPeer, " and ", fwd.remotePeer)
+	err := fwd.fastdp.wireguard.InitPeer(
+		fwd.remotePeer.Name, fwd.connUID,
+		net.IP(fwd.localIP[:]), fwd.remoteAddr.IP,
+		fwd.remoteAddr.Port,
+		fwd.wireguardRemote,
+		fwd.sessionKey,
+	)
+	if err != nil {
+		return err
+	}
+	fwd.isOutboundIPSecEstablished = true
+	fwd.checkWireGuardMTU()
+	return nil
+}
+
+// checkWireGuardMTU warns, as checkIPSecMTU, if frames of the overlay
+// MTU would not fit in the WireGuard device once encapsulated in VXLAN
+func (fwd *fastDatapathForwarder) checkWireGuardMTU() {
+	linkMTU, err := ipsec.LinkMTU(fwd.remoteAddr.IP)
+	if err != nil || linkMTU-wireguard.Overhead > wireguard.DeviceMTU {
+		linkMTU = wireguard.DeviceMTU + wireguard.Overhead
+	}
+	overhead := EthernetOverhead + vxlanOverhead + wireguard.Overhead
+	if mtu := fwd.fastdp.iface.MTU; mtu+overhead > linkMTU {
+		odpLog.Warning(fwd.logPrefix(), "MTU ", mtu, " is too large for fast datapath encrypted with WireGuard over a link with MTU ", linkMTU,
+			" (", overhead, " bytes overhead); set WEAVE_MTU to at most ", (linkMTU-overhead)&^3)
+	}
+}
+
+// wireguardAttrs adds to attrs, for the connection status, the public
+// key of the remote peer's WireGuard device, if the connection is
+// encrypted with it, as `wg show` lists its peers by
+func (fwd *fastDatapathForwarder) wireguardAttrs(attrs map[string]interface{}) {
+	fwd.lock.RLock()
+	defer fwd.lock.RUnlock()
+	if !fwd.isEncrypted || fwd.fastdp.wireguard == nil {
+		return
+	}
+	attrs["wireguard"] = true
+	attrs["wireguard-peer-key"] = fwd.wireguardRemote.Key.String()
+}
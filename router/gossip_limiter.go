@@ -0,0 +1,185 @@
+package router
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// GossipLimits bound how fast a gossip channel processes what it
+// receives, so that a storm of updates, e.g. from peers churning,
+// slows convergence instead of growing memory without bound or
+// starving the datapath of CPU.
+type GossipLimits struct {
+	Rate  float64 // messages processed per second; 0 for no limit
+	Burst int     // messages which may be processed at once beyond Rate
+	Queue int     // messages held back before the oldest are dropped
+}
+
+type GossipChannelStatus struct {
+	Channel   string
+	Processed uint64
+	Delayed   uint64
+	Dropped   uint64
+	Queued    int
+}
+
+// gossipLimiter sits between mesh and a Gossiper. Broadcast and
+// periodic gossip beyond the rate limit is queued and processed later,
+// without being propagated further at that point; this is safe because
+// gossip converges from full state exchanged periodically anyway, which
+// is also why dropping it when the queue is full only costs time.
+// Unicasts are requests which expect a reply, so are never held back.
+type gossipLimiter struct {
+	sync.Mutex
+	gossiper mesh.Gossiper
+	channel  string
+	limits   GossipLimits
+	tokens   float64
+	last     time.Time
+	queue    []queuedGossip
+	wake     chan struct{}
+	status   GossipChannelStatus
+}
+
+type queuedGossip struct {
+	broadcast bool
+	sender    mesh.PeerName
+	msg       []byte
+}
+
+func newGossipLimiter(channel string, gossiper mesh.Gossiper, limits GossipLimits) *gossipLimiter {
+	if limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	if limits.Queue < 1 {
+		limits.Queue = 1
+	}
+	limiter := &gossipLimiter{
+		gossiper: gossiper,
+		channel:  channel,
+		limits:   limits,
+		tokens:   float64(limits.Burst),
+		last:     time.Now(),
+		wake:     make(chan struct{}, 1),
+		status:   GossipChannelStatus{Channel: channel},
+	}
+	if limits.Rate > 0 {
+		go limiter.drain()
+	}
+	return limiter
+}
+
+func (l *gossipLimiter) Gossip() mesh.GossipData {
+	return l.gossiper.Gossip()
+}
+
+func (l *gossipLimiter) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	l.Lock()
+	l.take()
+	l.status.Processed++
+	l.Unlock()
+	return l.gossiper.OnGossipUnicast(sender, msg)
+}
+
+func (l *gossipLimiter) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	if !l.admit(queuedGossip{broadcast: true, sender: sender, msg: msg}) {
+		return nil, nil
+	}
+	return l.gossiper.OnGossipBroadcast(sender, msg)
+}
+
+func (l *gossipLimiter) OnGossip(msg []byte) (mesh.GossipData, error) {
+	if !l.admit(queuedGossip{msg: msg}) {
+		return nil, nil
+	}
+	return l.gossiper.OnGossip(msg)
+}
+
+// admit returns whether g can be processed now, and queues it if not
+func (l *gossipLimiter) admit(g queuedGossip) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.limits.Rate <= 0 || (len(l.queue) == 0 && l.take()) {
+		l.status.Processed++
+		return true
+	}
+	l.status.Delayed++
+	for _, queued := range l.queue {
+		if queued.broadcast == g.broadcast && queued.sender == g.sender && bytes.Equal(queued.msg, g.msg) {
+			// Merge with the identical message already waiting
+			l.status.Dropped++
+			return false
+		}
+	}
+	if len(l.queue) >= l.limits.Queue {
+		l.queue = l.queue[1:]
+		l.status.Dropped++
+	}
+	// mesh may reuse msg once we return
+	g.msg = append([]byte(nil), g.msg...)
+	l.queue = append(l.queue, g)
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+	return false
+}
+
+// take uses up a token, if there is one, refilling first for the time
+// since the last call. Must be called with the lock held.
+func (l *gossipLimiter) take() bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.limits.Rate
+	if max := float64(l.limits.Burst); l.tokens > max {
+		l.tokens = max
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func (l *gossipLimiter) drain() {
+	for range l.wake {
+		for {
+			l.Lock()
+			if len(l.queue) == 0 {
+				l.Unlock()
+				break
+			}
+			if !l.take() {
+				wait := time.Duration((1 - l.tokens) / l.limits.Rate * float64(time.Second))
+				l.Unlock()
+				time.Sleep(wait)
+				continue
+			}
+			g := l.queue[0]
+			l.queue = l.queue[1:]
+			l.status.Processed++
+			l.Unlock()
+
+			var err error
+			if g.broadcast {
+				_, err = l.gossiper.OnGossipBroadcast(g.sender, g.msg)
+			} else {
+				_, err = l.gossiper.OnGossip(g.msg)
+			}
+			if err != nil {
+				log.Warnf("Processing delayed %s gossip: %s", l.channel, err)
+			}
+		}
+	}
+}
+
+func (l *gossipLimiter) Status() GossipChannelStatus {
+	l.Lock()
+	defer l.Unlock()
+	status := l.status
+	status.Queued = len(l.queue)
+	return status
+}
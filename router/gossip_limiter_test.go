@@ -0,0 +1,77 @@
+package router
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+type countingGossiper struct {
+	sync.Mutex
+	received [][]byte
+}
+
+func (g *countingGossiper) Gossip() mesh.GossipData {
+	return nil
+}
+
+func (g *countingGossiper) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+func (g *countingGossiper) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	return g.OnGossip(msg)
+}
+
+func (g *countingGossiper) OnGossip(msg []byte) (mesh.GossipData, error) {
+	g.Lock()
+	defer g.Unlock()
+	g.received = append(g.received, msg)
+	return nil, nil
+}
+
+func (g *countingGossiper) count() int {
+	g.Lock()
+	defer g.Unlock()
+	return len(g.received)
+}
+
+func TestGossipLimiter(t *testing.T) {
+	gossiper := &countingGossiper{}
+	limiter := newGossipLimiter("test", gossiper, GossipLimits{Rate: 10, Burst: 2, Queue: 3})
+
+	for i := byte(0); i < 8; i++ {
+		limiter.OnGossip([]byte{i})
+	}
+	limiter.OnGossipBroadcast(mesh.UnknownPeerName, []byte{7})
+	// Identical to one already queued, so merged with it
+	limiter.OnGossip([]byte{7})
+
+	status := limiter.Status()
+	require.Equal(t, uint64(2), status.Processed)
+	require.Equal(t, uint64(8), status.Delayed)
+	require.Equal(t, uint64(5), status.Dropped)
+	require.Equal(t, 3, status.Queued)
+
+	// The queue drains at the rate limit
+	for deadline := time.Now().Add(2 * time.Second); gossiper.count() < 5 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	gossiper.Lock()
+	require.Equal(t, [][]byte{{0}, {1}, {6}, {7}, {7}}, gossiper.received)
+	gossiper.Unlock()
+	require.Equal(t, 0, limiter.Status().Queued)
+}
+
+func TestGossipLimiterUnlimited(t *testing.T) {
+	gossiper := &countingGossiper{}
+	limiter := newGossipLimiter("test", gossiper, GossipLimits{})
+	for i := 0; i < 100; i++ {
+		limiter.OnGossip([]byte{1})
+	}
+	require.Equal(t, 100, gossiper.count())
+	require.Equal(t, uint64(0), limiter.Status().Delayed)
+}
@@ -2,9 +2,11 @@ package router
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/weaveworks/mesh"
 	"github.com/weaveworks/weave/common"
 )
 
@@ -26,4 +28,36 @@ func (router *NetworkRouter) HandleHTTP(muxRouter *mux.Router) {
 		router.ForgetConnections(r.Form["peer"])
 	})
 
+	// The trusted subnets are replaced with those given as subnet
+	// parameters, none meaning no subnet is trusted
+	muxRouter.Methods("PUT").Path("/trusted-subnets").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprint("unable to parse form: ", err), http.StatusBadRequest)
+			return
+		}
+		var subnets []*net.IPNet
+		for _, s := range r.Form["subnet"] {
+			_, subnet, err := net.ParseCIDR(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid subnet: %s", err), http.StatusBadRequest)
+				return
+			}
+			subnets = append(subnets, subnet)
+		}
+		if err := router.SetTrustedSubnets(subnets); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	muxRouter.Methods("POST").Path("/encrypt").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, err := mesh.PeerNameFromUserInput(r.FormValue("peer"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid peer: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := router.EncryptPeer(peer); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})
+
 }
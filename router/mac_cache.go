@@ -8,14 +8,24 @@ import (
 	"github.com/weaveworks/mesh"
 )
 
+// The cache is split into shards, by MAC, each with its own lock, so
+// that with many peers (and hence many MACs) the packet path isn't
+// serialised on one lock while expiry or a peer going away scans the
+// table.
+const macCacheShards = 16
+
 type MacCacheEntry struct {
 	lastSeen time.Time
 	peer     *mesh.Peer
 }
 
-type MacCache struct {
+type macCacheShard struct {
 	sync.RWMutex
-	table       map[uint64]*MacCacheEntry
+	table map[uint64]MacCacheEntry
+}
+
+type MacCache struct {
+	shards      [macCacheShards]macCacheShard
 	maxAge      time.Duration
 	expiryTimer *time.Timer
 	onExpiry    func(net.HardwareAddr, *mesh.Peer)
@@ -23,31 +33,39 @@ type MacCache struct {
 
 func NewMacCache(maxAge time.Duration, onExpiry func(net.HardwareAddr, *mesh.Peer)) *MacCache {
 	cache := &MacCache{
-		table:    make(map[uint64]*MacCacheEntry),
 		maxAge:   maxAge,
 		onExpiry: onExpiry}
+	for i := range cache.shards {
+		cache.shards[i].table = make(map[uint64]MacCacheEntry)
+	}
 	cache.setExpiryTimer()
 	return cache
 }
 
+func (cache *MacCache) shard(key uint64) *macCacheShard {
+	// The low bits of a MAC are the most random
+	return &cache.shards[key%macCacheShards]
+}
+
 func (cache *MacCache) add(mac net.HardwareAddr, peer *mesh.Peer, force bool) (bool, *mesh.Peer) {
 	key := macint(mac)
+	shard := cache.shard(key)
 	now := time.Now()
 
-	cache.RLock()
-	entry, found := cache.table[key]
+	shard.RLock()
+	entry, found := shard.table[key]
 	if found && entry.peer == peer && now.Before(entry.lastSeen.Add(cache.maxAge/10)) {
-		cache.RUnlock()
+		shard.RUnlock()
 		return false, nil
 	}
-	cache.RUnlock()
+	shard.RUnlock()
 
-	cache.Lock()
-	defer cache.Unlock()
+	shard.Lock()
+	defer shard.Unlock()
 
-	entry, found = cache.table[key]
+	entry, found = shard.table[key]
 	if !found {
-		cache.table[key] = &MacCacheEntry{lastSeen: now, peer: peer}
+		shard.table[key] = MacCacheEntry{lastSeen: now, peer: peer}
 		return true, nil
 	}
 
@@ -62,6 +80,7 @@ func (cache *MacCache) add(mac net.HardwareAddr, peer *mesh.Peer, force bool) (b
 	if now.After(entry.lastSeen.Add(cache.maxAge / 10)) {
 		entry.lastSeen = now
 	}
+	shard.table[key] = entry
 
 	return false, nil
 }
@@ -76,9 +95,10 @@ func (cache *MacCache) AddForced(mac net.HardwareAddr, peer *mesh.Peer) (bool, *
 
 func (cache *MacCache) Lookup(mac net.HardwareAddr) *mesh.Peer {
 	key := macint(mac)
-	cache.RLock()
-	defer cache.RUnlock()
-	entry, found := cache.table[key]
+	shard := cache.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+	entry, found := shard.table[key]
 	if !found {
 		return nil
 	}
@@ -87,30 +107,48 @@ func (cache *MacCache) Lookup(mac net.HardwareAddr) *mesh.Peer {
 
 func (cache *MacCache) Delete(peer *mesh.Peer) bool {
 	found := false
-	cache.Lock()
-	defer cache.Unlock()
-	for key, entry := range cache.table {
-		if entry.peer == peer {
-			delete(cache.table, key)
-			found = true
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.Lock()
+		for key, entry := range shard.table {
+			if entry.peer == peer {
+				delete(shard.table, key)
+				found = true
+			}
 		}
+		shard.Unlock()
 	}
 	return found
 }
 
+// forEach calls f on every entry, holding the lock of its shard
+func (cache *MacCache) forEach(f func(net.HardwareAddr, MacCacheEntry)) {
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.RLock()
+		for key, entry := range shard.table {
+			f(intmac(key), entry)
+		}
+		shard.RUnlock()
+	}
+}
+
 func (cache *MacCache) setExpiryTimer() {
 	cache.expiryTimer = time.AfterFunc(cache.maxAge/10, func() { cache.expire() })
 }
 
 func (cache *MacCache) expire() {
 	now := time.Now()
-	cache.Lock()
-	defer cache.Unlock()
-	for key, entry := range cache.table {
-		if now.After(entry.lastSeen.Add(cache.maxAge)) {
-			delete(cache.table, key)
-			cache.onExpiry(intmac(key), entry.peer)
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.Lock()
+		for key, entry := range shard.table {
+			if now.After(entry.lastSeen.Add(cache.maxAge)) {
+				delete(shard.table, key)
+				cache.onExpiry(intmac(key), entry.peer)
+			}
 		}
+		shard.Unlock()
 	}
 	cache.setExpiryTimer()
 }
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	benchPeers       = 1000
+	benchMACsPerPeer = 10
+)
+
+func makePeers(n int) []*mesh.Peer {
+	peers := make([]*mesh.Peer, n)
+	for i := range peers {
+		peers[i] = &mesh.Peer{Name: mesh.PeerName(i + 1)}
+	}
+	return peers
+}
+
+func testMAC(peer, i int) net.HardwareAddr {
+	return intmac(uint64(peer)<<16 | uint64(i))
+}
+
+func TestMacCache(t *testing.T) {
+	var expired []net.HardwareAddr
+	cache := NewMacCache(time.Hour, func(mac net.HardwareAddr, _ *mesh.Peer) { expired = append(expired, mac) })
+	peers := makePeers(2)
+	for i := 0; i < 100; i++ {
+		isNew, conflict := cache.Add(testMAC(0, i), peers[0])
+		require.True(t, isNew)
+		require.Nil(t, conflict)
+	}
+	isNew, conflict := cache.Add(testMAC(0, 1), peers[1])
+	require.False(t, isNew)
+	require.Equal(t, peers[0], conflict)
+	_, conflict = cache.AddForced(testMAC(0, 1), peers[1])
+	require.Nil(t, conflict)
+	require.Equal(t, peers[1], cache.Lookup(testMAC(0, 1)))
+	require.Nil(t, cache.Lookup(testMAC(1, 1)))
+
+	require.True(t, cache.Delete(peers[1]))
+	require.Nil(t, cache.Lookup(testMAC(0, 1)))
+	require.Len(t, NewMACStatusSlice(cache), 99)
+
+	cache.maxAge = 0
+	cache.expire()
+	require.Len(t, expired, 99)
+	require.Len(t, NewMACStatusSlice(cache), 0)
+}
+
+func fillMacCache(peers []*mesh.Peer) *MacCache {
+	cache := NewMacCache(time.Hour, func(net.HardwareAddr, *mesh.Peer) {})
+	for p, peer := range peers {
+		for i := 0; i < benchMACsPerPeer; i++ {
+			cache.Add(testMAC(p, i), peer)
+		}
+	}
+	return cache
+}
+
+// BenchmarkMacCacheMemory fills a cache with benchMACsPerPeer MACs for
+// each of benchPeers peers; B/op over the number of MACs is an upper
+// bound on the memory per MAC.
+func BenchmarkMacCacheMemory(b *testing.B) {
+	peers := makePeers(benchPeers)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		fillMacCache(peers).expiryTimer.Stop()
+	}
+}
+
+func BenchmarkMacCacheLookup(b *testing.B) {
+	peers := makePeers(benchPeers)
+	cache := fillMacCache(peers)
+	defer cache.expiryTimer.Stop()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			p := i % benchPeers
+			// Mostly lookups, as on the packet path, with a refresh of
+			// the source MAC
+			cache.Lookup(testMAC(p, i%benchMACsPerPeer))
+			cache.Add(testMAC(p, 0), peers[p])
+		}
+	})
+}
+
+func BenchmarkMacCacheDeletePeer(b *testing.B) {
+	peers := makePeers(benchPeers)
+	cache := fillMacCache(peers)
+	defer cache.expiryTimer.Stop()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cache.Delete(peers[n%benchPeers])
+	}
+}
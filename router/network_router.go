@@ -5,6 +5,7 @@ import (
 	"math"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/weaveworks/mesh"
@@ -37,6 +38,7 @@ type NetworkConfig struct {
 	BufSz         int
 	PacketLogging PacketLogging
 	Bridge        Bridge
+	GossipLimits  GossipLimits
 }
 
 type PacketLogging interface {
@@ -49,6 +51,15 @@ type NetworkRouter struct {
 	NetworkConfig
 	Macs *MacCache
 	db   db.DB
+
+	gossipLimitersLock sync.Mutex
+	gossipLimiters     []*gossipLimiter
+
+	trustLock      sync.Mutex
+	trustedSubnets []*net.IPNet // as set, before encryptedPeers are taken out
+	trusted        []*net.IPNet // as applied, with encryptedPeers taken out
+	encryptedPeers map[mesh.PeerName]net.IP
+	trustCallbacks []func([]*net.IPNet) error
 }
 
 func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, name mesh.PeerName, nickName string, overlay NetworkOverlay, db db.DB) *NetworkRouter {
@@ -59,7 +70,17 @@ func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, name mesh
 		networkConfig.Bridge = NullBridge{}
 	}
 
-	router := &NetworkRouter{Router: mesh.NewRouter(config, name, nickName, overlay, common.LogLogger()), NetworkConfig: networkConfig, db: db}
+	// Mesh reads its trusted subnets, unlocked, as each connection is
+	// made, so they could not be changed at runtime. Instead mesh
+	// trusts no one, and the overlay switch leaves connections
+	// unencrypted according to our trusted subnets.
+	trustedSubnets := config.TrustedSubnets
+	config.TrustedSubnets = nil
+	router := &NetworkRouter{Router: mesh.NewRouter(config, name, nickName, overlay, common.LogLogger()), NetworkConfig: networkConfig, db: db,
+		trustedSubnets: trustedSubnets, trusted: trustedSubnets, encryptedPeers: make(map[mesh.PeerName]net.IP)}
+	if osw, ok := overlay.(*OverlaySwitch); ok {
+		osw.trust = router
+	}
 	router.Peers.OnInvalidateShortIDs(overlay.InvalidateShortIDs)
 	router.Routes.OnChange(overlay.InvalidateRoutes)
 	router.Macs = NewMacCache(macMaxAge,
@@ -70,6 +91,16 @@ func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, name mesh
 	return router
 }
 
+// NewLimitedGossip is like NewGossip, but the channel processes what
+// it receives within the router's GossipLimits.
+func (router *NetworkRouter) NewLimitedGossip(channel string, gossiper mesh.Gossiper) mesh.Gossip {
+	limiter := newGossipLimiter(channel, gossiper, router.GossipLimits)
+	router.gossipLimitersLock.Lock()
+	router.gossipLimiters = append(router.gossipLimiters, limiter)
+	router.gossipLimitersLock.Unlock()
+	return router.NewGossip(channel, limiter)
+}
+
 // Start listening for TCP connections, locally captured packets, and
 // forwarded packets.
 func (router *NetworkRouter) Start() {
@@ -1,6 +1,9 @@
 package router
 
 import (
+	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/weaveworks/mesh"
@@ -11,6 +14,7 @@ type NetworkRouterStatus struct {
 	Interface    string
 	CaptureStats map[string]int
 	MACs         []MACStatus
+	Gossip       []GossipChannelStatus `json:"Gossip,omitempty"`
 }
 
 type MACStatus struct {
@@ -21,25 +25,47 @@ type MACStatus struct {
 }
 
 func NewNetworkRouterStatus(router *NetworkRouter) *NetworkRouterStatus {
-	return &NetworkRouterStatus{
+	status := &NetworkRouterStatus{
 		mesh.NewStatus(router.Router),
 		router.Bridge.String(),
 		router.Bridge.Stats(),
-		NewMACStatusSlice(router.Macs)}
+		NewMACStatusSlice(router.Macs),
+		newGossipStatusSlice(router)}
+	// mesh, which trusts no one, knows neither the trusted subnets nor
+	// which connections they left unencrypted
+	status.TrustedSubnets = []string{}
+	for _, subnet := range router.currentTrustedSubnets() {
+		status.TrustedSubnets = append(status.TrustedSubnets, subnet.String())
+	}
+	if router.Password != nil {
+		for i, conn := range status.Connections {
+			if encrypted, found := conn.Attrs["encrypted"].(bool); found && !encrypted && strings.HasPrefix(conn.Info, "encrypted ") {
+				status.Connections[i].Info = fmt.Sprintf("%-11v %v", "unencrypted", strings.TrimSpace(strings.TrimPrefix(conn.Info, "encrypted ")))
+			}
+		}
+	}
+	return status
 }
 
-func NewMACStatusSlice(cache *MacCache) []MACStatus {
-	cache.RLock()
-	defer cache.RUnlock()
+func newGossipStatusSlice(router *NetworkRouter) []GossipChannelStatus {
+	router.gossipLimitersLock.Lock()
+	defer router.gossipLimitersLock.Unlock()
+	var slice []GossipChannelStatus
+	for _, limiter := range router.gossipLimiters {
+		slice = append(slice, limiter.Status())
+	}
+	return slice
+}
 
+func NewMACStatusSlice(cache *MacCache) []MACStatus {
 	var slice []MACStatus
-	for key, entry := range cache.table {
+	cache.forEach(func(mac net.HardwareAddr, entry MacCacheEntry) {
 		slice = append(slice, MACStatus{
-			intmac(key).String(),
+			mac.String(),
 			entry.peer.Name.String(),
 			entry.peer.NickName,
 			entry.lastSeen})
-	}
+	})
 
 	return slice
 }
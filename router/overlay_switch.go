@@ -2,6 +2,7 @@ package router
 
 import (
 	"fmt"
+	"net"
 	"strings"
 	"sync"
 
@@ -18,6 +19,9 @@ type OverlaySwitch struct {
 	overlays      map[string]NetworkOverlay
 	overlayNames  []string
 	compatOverlay NetworkOverlay
+
+	// decides which connections to leave unencrypted, if set
+	trust *NetworkRouter
 }
 
 func NewOverlaySwitch() *OverlaySwitch {
@@ -40,6 +44,13 @@ func (osw *OverlaySwitch) SetCompatOverlay(overlay NetworkOverlay) {
 
 func (osw *OverlaySwitch) AddFeaturesTo(features map[string]string) {
 	features["Overlays"] = strings.Join(osw.overlayNames, " ")
+	features[controlFramingFeature] = controlFramingVersion
+	if osw.trust != nil {
+		osw.trust.addTrustFeatureTo(features)
+	}
+	for _, overlay := range osw.overlays {
+		overlay.AddFeaturesTo(features)
+	}
 }
 
 func (osw *OverlaySwitch) Diagnostics() interface{} {
@@ -127,6 +138,8 @@ func (osw *OverlaySwitch) commonOverlays(params mesh.OverlayConnectionParams) ([
 
 type overlaySwitchForwarder struct {
 	remotePeer *mesh.Peer
+	remoteIP   net.IP
+	encrypted  bool
 
 	lock sync.Mutex
 
@@ -178,6 +191,10 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 		return nil, err
 	}
 
+	if params.SessionKey != nil && osw.trust != nil && osw.trust.trustsConnection(params) {
+		params.SessionKey = nil
+	}
+
 	// channel to carry events from the subforwarder monitors to
 	// the main goroutine
 	eventsChan := make(chan subForwarderEvent)
@@ -187,6 +204,7 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 
 	fwd := &overlaySwitchForwarder{
 		remotePeer: params.RemotePeer,
+		encrypted:  params.SessionKey != nil,
 
 		best:       -1,
 		forwarders: make([]subForwarder, len(overlays)),
@@ -195,16 +213,23 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 		establishedChan: make(chan struct{}),
 		errorChan:       make(chan error, 1),
 	}
+	if params.RemoteAddr != nil {
+		fwd.remoteIP = params.RemoteAddr.IP
+	}
 
 	origSendControlMessage := params.SendControlMessage
+	_, framed := params.Features[controlFramingFeature]
 	for i, overlay := range overlays {
 		// Prefix control messages to indicate the relevant forwarder
-		index := i
+		index := byte(i)
 		params.SendControlMessage = func(tag byte, msg []byte) error {
-			xmsg := make([]byte, len(msg)+2)
-			xmsg[0] = byte(index)
-			xmsg[1] = tag
-			copy(xmsg[2:], msg)
+			if !framed {
+				return origSendControlMessage(mesh.ProtocolOverlayControlMsg, encodeLegacyControlFrame(index, tag, msg))
+			}
+			xmsg, err := encodeControlFrame(index, tag, msg)
+			if err != nil {
+				return err
+			}
 			return origSendControlMessage(mesh.ProtocolOverlayControlMsg, xmsg)
 		}
 
@@ -415,6 +440,15 @@ func (fwd *overlaySwitchForwarder) ErrorChannel() <-chan error {
 	return fwd.errorChan
 }
 
+// restart has the connection shut down with err, for it to be made
+// again, unless it is failing already
+func (fwd *overlaySwitchForwarder) restart(err error) {
+	select {
+	case fwd.errorChan <- err:
+	default:
+	}
+}
+
 func (fwd *overlaySwitchForwarder) Stop() {
 	fwd.lock.Lock()
 	defer fwd.lock.Unlock()
@@ -422,11 +456,19 @@ func (fwd *overlaySwitchForwarder) Stop() {
 }
 
 func (fwd *overlaySwitchForwarder) ControlMessage(tag byte, msg []byte) {
+	frame, err := decodeControlFrame(msg)
+	if err != nil {
+		log.Warning(fwd.logPrefix(), "Ignoring malformed control message: ", err)
+		return
+	}
+	var subFwd OverlayForwarder
 	fwd.lock.Lock()
-	subFwd := fwd.forwarders[msg[0]].fwd
+	if int(frame.index) < len(fwd.forwarders) {
+		subFwd = fwd.forwarders[frame.index].fwd
+	}
 	fwd.lock.Unlock()
 	if subFwd != nil {
-		subFwd.ControlMessage(msg[1], msg[2:])
+		subFwd.ControlMessage(frame.tag, frame.body)
 	}
 }
 
@@ -440,7 +482,9 @@ func (fwd *overlaySwitchForwarder) Attrs() map[string]interface{} {
 	fwd.lock.Unlock()
 
 	if best != nil {
-		return best.Attrs()
+		attrs := best.Attrs()
+		attrs["encrypted"] = fwd.encrypted
+		return attrs
 	}
 
 	return nil
@@ -0,0 +1,357 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/weaveworks/go-odp/odp"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/net/ipsec"
+)
+
+const (
+	// The vport of the simulated containers
+	simContainersVport = odp.VportID(1)
+	// Of the simulated datapath's interface, as of weave's bridge
+	simDatapathMTU = 1376
+	vxlanHeaderLen = 8
+	// Frames delivered but not collected beyond this are dropped, so
+	// an idle simulation doesn't grow without bound
+	simMaxDelivered = 1024
+)
+
+// SimDatapath is an ODP datapath which lives entirely in memory, for
+// a FastDatapath in routers run as ordinary unprivileged processes, so
+// that fast datapath connections, heartbeats and IPsec negotiation can
+// be tried out and tested without the kernel. It has one vport, of
+// the simulated containers, which send frames with Send and collect
+// those delivered to them with Received; its vxlan vports encapsulate
+// frames in userspace, over UDP sockets of their own.
+//
+// No flow is ever matched: each packet is handed to the miss consumer,
+// as if it were the first of its flow, and the flows created are only
+// kept to be listed.
+type SimDatapath struct {
+	sync.Mutex
+	nextID     odp.VportID
+	vports     map[odp.VportID]*simVport
+	flows      []odp.FlowInfo
+	misses     odp.MissConsumer
+	delivered  [][]byte // dropped beyond simMaxDelivered
+	quit       chan struct{}
+	closedOnce sync.Once
+}
+
+type simVport struct {
+	odp.Vport
+	udpPort int
+	conn    *net.UDPConn // receiving on udpPort; nil if it couldn't be bound
+}
+
+type simCancelable struct{}
+
+func (simCancelable) Cancel() error {
+	return nil
+}
+
+func NewSimDatapath() *SimDatapath {
+	d := &SimDatapath{
+		nextID: simContainersVport + 1,
+		vports: make(map[odp.VportID]*simVport),
+		quit:   make(chan struct{}),
+	}
+	d.vports[simContainersVport] = &simVport{Vport: odp.Vport{ID: simContainersVport, Spec: odp.NewInternalVportSpec("sim")}}
+	return d
+}
+
+// NewSimFastDatapath returns a FastDatapath over a new SimDatapath,
+// with vxlan on port+1, as NewFastDatapath. Encrypted connections use
+// IPsec, with a MemXfrm in place of the kernel's XFRM framework unless
+// ipsecConfig gives another; WireGuard is not simulated.
+func NewSimFastDatapath(port int, encryptionEnabled bool, ipsecConfig ipsec.Config) (*FastDatapath, *SimDatapath, error) {
+	if ipsecConfig.Xfrm == nil {
+		ipsecConfig.Xfrm = ipsec.NewMemXfrm()
+	}
+	if ipsecConfig.Conntrack == nil {
+		ipsecConfig.Conntrack = func(...common.ConntrackFlows) (uint, error) { return 0, nil }
+	}
+	dp := NewSimDatapath()
+	iface := &net.Interface{Name: "weave-sim", MTU: simDatapathMTU}
+	fastdp, err := newFastDatapath(dp, dp, iface, port, encryptionEnabled, ipsecConfig, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fastdp, dp, nil
+}
+
+func (d *SimDatapath) CreateFlow(flow odp.FlowSpec) error {
+	d.Lock()
+	defer d.Unlock()
+	for i, f := range d.flows {
+		if reflect.DeepEqual(f.FlowKeys, flow.FlowKeys) {
+			d.flows[i] = odp.FlowInfo{FlowSpec: flow}
+			return nil
+		}
+	}
+	d.flows = append(d.flows, odp.FlowInfo{FlowSpec: flow})
+	return nil
+}
+
+func (d *SimDatapath) DeleteFlow(fks odp.FlowKeys) error {
+	d.Lock()
+	defer d.Unlock()
+	for i, f := range d.flows {
+		if reflect.DeepEqual(f.FlowKeys, fks) {
+			d.flows = append(d.flows[:i:i], d.flows[i+1:]...)
+			return nil
+		}
+	}
+	return odp.NetlinkError(syscall.ENOENT)
+}
+
+func (d *SimDatapath) ClearFlow(flow odp.FlowSpec) error {
+	d.Lock()
+	defer d.Unlock()
+	for i, f := range d.flows {
+		if reflect.DeepEqual(f.FlowKeys, flow.FlowKeys) {
+			d.flows[i] = odp.FlowInfo{FlowSpec: f.FlowSpec}
+			return nil
+		}
+	}
+	return odp.NetlinkError(syscall.ENOENT)
+}
+
+func (d *SimDatapath) EnumerateFlows() ([]odp.FlowInfo, error) {
+	d.Lock()
+	defer d.Unlock()
+	return append([]odp.FlowInfo(nil), d.flows...), nil
+}
+
+// Execute carries out the output and set tunnel actions on packet;
+// there are no others FastDatapath uses
+func (d *SimDatapath) Execute(packet []byte, fks odp.FlowKeys, actions []odp.Action) error {
+	var tunnel *odp.TunnelAttrs
+	for _, action := range actions {
+		switch a := action.(type) {
+		case odp.SetTunnelAction:
+			attrs := a.TunnelAttrs
+			tunnel = &attrs
+		case odp.OutputAction:
+			if err := d.output(a.VportID(), tunnel, packet); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("simulated datapath: unsupported action %s", action)
+		}
+	}
+	return nil
+}
+
+func (d *SimDatapath) output(id odp.VportID, tunnel *odp.TunnelAttrs, packet []byte) error {
+	d.Lock()
+	defer d.Unlock()
+	vport, found := d.vports[id]
+	if !found {
+		return odp.NetlinkError(syscall.ENODEV)
+	}
+	if id == simContainersVport {
+		if len(d.delivered) < simMaxDelivered {
+			d.delivered = append(d.delivered, append([]byte(nil), packet...))
+		}
+		return nil
+	}
+	if tunnel == nil {
+		return fmt.Errorf("simulated datapath: output to vxlan vport %d without a tunnel", id)
+	}
+	// Send from the vport's own socket, or, where another process has
+	// its port, e.g. that of the remote peer, from any we have
+	conn := vport.conn
+	for _, v := range d.vports {
+		if conn == nil {
+			conn = v.conn
+		}
+	}
+	if conn == nil {
+		return fmt.Errorf("simulated datapath: no vxlan socket to send from")
+	}
+	buf := make([]byte, vxlanHeaderLen+len(packet))
+	buf[0] = 0x08 // VNI present
+	copy(buf[4:7], tunnel.TunnelId[5:])
+	copy(buf[vxlanHeaderLen:], packet)
+	_, err := conn.WriteToUDP(buf, &net.UDPAddr{IP: net.IP(tunnel.Ipv4Dst[:]), Port: vport.udpPort})
+	return err
+}
+
+// CreateVport creates the vxlan vports FastDatapath asks for, which
+// weave names after their UDP port
+func (d *SimDatapath) CreateVport(spec odp.VportSpec) (odp.VportID, error) {
+	var udpPort int
+	if _, err := fmt.Sscanf(spec.Name(), "vxlan-%d", &udpPort); err != nil || spec.TypeName() != "vxlan" {
+		return 0, fmt.Errorf("simulated datapath: cannot create %s vport %q", spec.TypeName(), spec.Name())
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: udpPort})
+	if err != nil {
+		odpLog.Debugf("Simulated datapath: not receiving on vxlan port %d: %s", udpPort, err)
+		conn = nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	id := d.nextID
+	d.nextID++
+	vport := &simVport{Vport: odp.Vport{ID: id, Spec: spec}, udpPort: udpPort, conn: conn}
+	d.vports[id] = vport
+	if conn != nil {
+		go d.receive(vport)
+	}
+	return id, nil
+}
+
+// receive hands the frames arriving on vport's socket to the miss
+// consumer, as the kernel does those of a vxlan vport
+func (d *SimDatapath) receive(vport *simVport) {
+	buf := make([]byte, 65536)
+	for {
+		n, sender, err := vport.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.quit:
+			default:
+				d.Lock()
+				_, found := d.vports[vport.ID]
+				d.Unlock()
+				if found {
+					odpLog.Errorf("Simulated datapath: receiving on vxlan port %d: %s", vport.udpPort, err)
+				}
+			}
+			return
+		}
+		if n < vxlanHeaderLen+EthernetOverhead || buf[0]&0x08 == 0 {
+			continue
+		}
+		ipv4Src := sender.IP.To4()
+		if ipv4Src == nil {
+			continue
+		}
+
+		var tunnel odp.TunnelFlowKey
+		var tunnelID [8]byte
+		copy(tunnelID[5:], buf[4:7])
+		var src [4]byte
+		copy(src[:], ipv4Src)
+		tunnel.SetTunnelId(tunnelID)
+		tunnel.SetIpv4Src(src)
+		frame := append([]byte(nil), buf[vxlanHeaderLen:n]...)
+		if err := d.miss(vport.ID, frame, tunnel); err != nil {
+			odpLog.Debug("Simulated datapath: ", err)
+		}
+	}
+}
+
+func (d *SimDatapath) miss(ingress odp.VportID, frame []byte, tunnel odp.FlowKey) error {
+	d.Lock()
+	consumer := d.misses
+	d.Unlock()
+	if consumer == nil {
+		return fmt.Errorf("simulated datapath: nothing is consuming misses")
+	}
+
+	var dst, src [6]byte
+	copy(dst[:], frame[0:6])
+	copy(src[:], frame[6:12])
+	eth := odp.NewEthernetFlowKey()
+	eth.SetEthSrc(src)
+	eth.SetEthDst(dst)
+	flow := odp.NewFlowSpec()
+	flow.AddKey(odp.NewInPortFlowKey(ingress))
+	flow.AddKey(eth)
+	if tunnel != nil {
+		flow.AddKey(tunnel)
+	}
+	return consumer.Miss(frame, flow.FlowKeys)
+}
+
+func (d *SimDatapath) LookupVport(id odp.VportID) (odp.Vport, error) {
+	d.Lock()
+	defer d.Unlock()
+	vport, found := d.vports[id]
+	if !found {
+		return odp.Vport{}, odp.NetlinkError(syscall.ENODEV)
+	}
+	return vport.Vport, nil
+}
+
+func (d *SimDatapath) DeleteVport(id odp.VportID) error {
+	d.Lock()
+	defer d.Unlock()
+	vport, found := d.vports[id]
+	if !found || id == simContainersVport {
+		return odp.NetlinkError(syscall.ENODEV)
+	}
+	delete(d.vports, id)
+	if vport.conn != nil {
+		vport.conn.Close()
+	}
+	return nil
+}
+
+func (d *SimDatapath) EnumerateVports() ([]odp.Vport, error) {
+	d.Lock()
+	defer d.Unlock()
+	vports := make([]odp.Vport, 0, len(d.vports))
+	for _, vport := range d.vports {
+		vports = append(vports, vport.Vport)
+	}
+	return vports, nil
+}
+
+func (d *SimDatapath) ConsumeMisses(consumer odp.MissConsumer) (odp.Cancelable, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.misses != nil {
+		return nil, fmt.Errorf("simulated datapath: already consuming misses")
+	}
+	d.misses = consumer
+	return simCancelable{}, nil
+}
+
+// ConsumeVportEvents never sends any: the only vports made after the
+// datapath are those its consumer asks for
+func (d *SimDatapath) ConsumeVportEvents(consumer odp.VportEventsConsumer) (odp.Cancelable, error) {
+	return simCancelable{}, nil
+}
+
+// Send hands the datapath a frame from a simulated container
+func (d *SimDatapath) Send(frame []byte) error {
+	if len(frame) < EthernetOverhead {
+		return fmt.Errorf("frame of %d bytes is too short", len(frame))
+	}
+	return d.miss(simContainersVport, append([]byte(nil), frame...), nil)
+}
+
+// Received returns, and forgets, the frames delivered to the simulated
+// containers so far.
+func (d *SimDatapath) Received() [][]byte {
+	d.Lock()
+	defer d.Unlock()
+	frames := d.delivered
+	d.delivered = nil
+	return frames
+}
+
+// Close closes the sockets of the vxlan vports
+func (d *SimDatapath) Close() error {
+	d.closedOnce.Do(func() { close(d.quit) })
+	d.Lock()
+	defer d.Unlock()
+	for _, vport := range d.vports {
+		if vport.conn != nil {
+			vport.conn.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/go-odp/odp"
+)
+
+func simFrame(src, dst byte) []byte {
+	frame := make([]byte, 60)
+	frame[5] = dst
+	frame[11] = src
+	frame[12], frame[13] = 0x08, 0x06 // ARP
+	return frame
+}
+
+type simMiss struct {
+	frame []byte
+	fks   odp.FlowKeys
+}
+
+type simMissConsumer chan simMiss
+
+func (c simMissConsumer) Miss(packet []byte, fks odp.FlowKeys) error {
+	c <- simMiss{packet, fks}
+	return nil
+}
+
+func (c simMissConsumer) Error(err error, stopped bool) {}
+
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func vxlanVport(t *testing.T, d *SimDatapath, port int) odp.VportID {
+	id, err := d.CreateVport(odp.NewVxlanVportSpec(fmt.Sprintf("vxlan-%d", port), uint16(port)))
+	require.NoError(t, err)
+	return id
+}
+
+func TestSimDatapathContainers(t *testing.T) {
+	d := NewSimDatapath()
+	defer d.Close()
+	require.Error(t, d.Send(simFrame(1, 2)), "send before consuming misses")
+
+	misses := make(simMissConsumer, 1)
+	_, err := d.ConsumeMisses(misses)
+	require.NoError(t, err)
+	require.NoError(t, d.Send(simFrame(1, 2)))
+	miss := <-misses
+	require.Equal(t, simFrame(1, 2), miss.frame)
+	require.Equal(t, simContainersVport, miss.fks[odp.OVS_KEY_ATTR_IN_PORT].(odp.InPortFlowKey).VportID())
+	require.Equal(t, PacketKey{SrcMAC: MAC{0, 0, 0, 0, 0, 1}, DstMAC: MAC{0, 0, 0, 0, 0, 2}}, flowKeysToPacketKey(miss.fks))
+
+	require.NoError(t, d.Execute(simFrame(2, 1), nil, []odp.Action{odp.NewOutputAction(simContainersVport)}))
+	require.Equal(t, [][]byte{simFrame(2, 1)}, d.Received())
+	require.Empty(t, d.Received())
+
+	vports, err := d.EnumerateVports()
+	require.NoError(t, err)
+	require.Len(t, vports, 1)
+	require.Equal(t, "internal", vports[0].Spec.TypeName())
+}
+
+func TestSimDatapathVxlan(t *testing.T) {
+	port1, port2 := freeUDPPort(t), freeUDPPort(t)
+	d1, d2 := NewSimDatapath(), NewSimDatapath()
+	defer d1.Close()
+	defer d2.Close()
+	misses := make(simMissConsumer, 1)
+	_, err := d1.ConsumeMisses(misses)
+	require.NoError(t, err)
+
+	vport1 := vxlanVport(t, d1, port1)
+	vxlanVport(t, d2, port2)
+	// d2's vport to d1's port can't bind it, so sends from port2
+	toD1 := vxlanVport(t, d2, port1)
+
+	var sta odp.SetTunnelAction
+	sta.SetTunnelId([8]byte{5: 0x12, 6: 0x34, 7: 0x56})
+	sta.SetIpv4Src([4]byte{127, 0, 0, 1})
+	sta.SetIpv4Dst([4]byte{127, 0, 0, 1})
+	require.NoError(t, d2.Execute(simFrame(3, 4), nil, []odp.Action{sta, odp.NewOutputAction(toD1)}))
+
+	select {
+	case miss := <-misses:
+		require.Equal(t, simFrame(3, 4), miss.frame)
+		require.Equal(t, vport1, miss.fks[odp.OVS_KEY_ATTR_IN_PORT].(odp.InPortFlowKey).VportID())
+		tunnel := miss.fks[odp.OVS_KEY_ATTR_TUNNEL].(odp.TunnelFlowKey).Key()
+		require.Equal(t, [8]byte{5: 0x12, 6: 0x34, 7: 0x56}, tunnel.TunnelId)
+		require.Equal(t, [4]byte{127, 0, 0, 1}, tunnel.Ipv4Src)
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received over vxlan")
+	}
+
+	// Without a tunnel there is nowhere to send to
+	require.Error(t, d2.Execute(simFrame(3, 4), nil, []odp.Action{odp.NewOutputAction(toD1)}))
+	require.NoError(t, d2.DeleteVport(toD1))
+	_, err = d2.LookupVport(toD1)
+	require.True(t, odp.IsNoSuchVportError(err))
+}
+
+func TestSimDatapathFlows(t *testing.T) {
+	d := NewSimDatapath()
+	defer d.Close()
+	flow := odp.NewFlowSpec()
+	flow.AddKey(odp.NewInPortFlowKey(simContainersVport))
+	flow.AddActions([]odp.Action{odp.NewOutputAction(simContainersVport)})
+	require.NoError(t, d.CreateFlow(flow))
+	flows, err := d.EnumerateFlows()
+	require.NoError(t, err)
+	require.Len(t, flows, 1)
+	require.NoError(t, d.ClearFlow(flow))
+	require.NoError(t, d.DeleteFlow(flow.FlowKeys))
+	require.True(t, odp.IsNoSuchFlowError(d.DeleteFlow(flow.FlowKeys)))
+}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+)
+
+// trustedSubnetsFeature is the connection feature in which we
+// advertise our trusted subnets, so that each end of a connection can
+// tell whether the other trusts it
+const trustedSubnetsFeature = "TrustedSubnets"
+
+// OnTrustedSubnetsChange registers callback, to be called with the
+// trusted subnets whenever SetTrustedSubnets or EncryptPeer change
+// them, e.g. to let traffic from them past strict ingress mode.
+func (router *NetworkRouter) OnTrustedSubnetsChange(callback func([]*net.IPNet) error) {
+	router.trustLock.Lock()
+	defer router.trustLock.Unlock()
+	router.trustCallbacks = append(router.trustCallbacks, callback)
+}
+
+// SetTrustedSubnets replaces the trusted subnets, of the peers whose
+// connections to us are not encrypted, without a relaunch. Narrowing
+// them restarts the unencrypted connections to peers no longer in
+// them, which are then made again, encrypted. The peers given to
+// EncryptPeer stay encrypted.
+func (router *NetworkRouter) SetTrustedSubnets(subnets []*net.IPNet) error {
+	router.trustLock.Lock()
+	defer router.trustLock.Unlock()
+	router.trustedSubnets = subnets
+	return router.applyTrust()
+}
+
+// EncryptPeer has our connection to peer encrypted even though the
+// peer is in a trusted subnet, restarting the connection if it is not
+// already, so that encryption can be rolled out one peer at a time.
+func (router *NetworkRouter) EncryptPeer(peer mesh.PeerName) error {
+	if router.Password == nil {
+		return fmt.Errorf("encryption is not enabled")
+	}
+	fwd := router.overlayConnection(peer)
+	if fwd == nil || fwd.remoteIP == nil {
+		return fmt.Errorf("not connected to %s", peer)
+	}
+	router.trustLock.Lock()
+	defer router.trustLock.Unlock()
+	router.encryptedPeers[peer] = fwd.remoteIP
+	return router.applyTrust()
+}
+
+// applyTrust works out the trusted subnets, less the addresses of the
+// peers to encrypt, which are consulted as each connection is made,
+// hands them to the callbacks, and restarts the connections which are
+// unencrypted but should not be. trustLock must be held.
+func (router *NetworkRouter) applyTrust() error {
+	trusted := router.trustedSubnets
+	for _, ip := range router.encryptedPeers {
+		trusted = subnetsWithout(trusted, ip)
+	}
+	router.trusted = trusted
+	for _, callback := range router.trustCallbacks {
+		if err := callback(trusted); err != nil {
+			return err
+		}
+	}
+	if router.Password == nil {
+		return nil
+	}
+	for _, peer := range router.Peers.Descriptions() {
+		if peer.Self {
+			continue
+		}
+		fwd := router.overlayConnection(peer.Name)
+		if fwd == nil || fwd.encrypted || fwd.remoteIP == nil || subnetsContain(trusted, fwd.remoteIP) {
+			continue
+		}
+		log.Infof("Restarting connection to %s at %s, to encrypt it, as it is no longer trusted", peer.Name, fwd.remoteIP)
+		fwd.restart(fmt.Errorf("no longer trusted; reconnecting to encrypt"))
+	}
+	return nil
+}
+
+// currentTrustedSubnets returns the trusted subnets, less the
+// addresses of the peers to encrypt
+func (router *NetworkRouter) currentTrustedSubnets() []*net.IPNet {
+	router.trustLock.Lock()
+	defer router.trustLock.Unlock()
+	return router.trusted
+}
+
+// addTrustFeatureTo advertises our trusted subnets in the features of
+// a connection
+func (router *NetworkRouter) addTrustFeatureTo(features map[string]string) {
+	var subnets []string
+	for _, subnet := range router.currentTrustedSubnets() {
+		subnets = append(subnets, subnet.String())
+	}
+	features[trustedSubnetsFeature] = strings.Join(subnets, " ")
+}
+
+// trustsConnection tells whether the connection described by params
+// may be left unencrypted: we must trust the remote address, and the
+// remote peer must have advertised that it trusts our address, which
+// it sees as its remote address, so both ends come to the same
+// answer. Peers which do not advertise their trusted subnets trust no
+// one, as mesh, which they leave it to, is told that we trust no one.
+//
+// Should the trusted subnets change between advertising them and
+// this, the ends may not agree, in which case the connection fails,
+// and is made again.
+func (router *NetworkRouter) trustsConnection(params mesh.OverlayConnectionParams) bool {
+	if params.LocalAddr == nil || params.RemoteAddr == nil {
+		return false
+	}
+	if !subnetsContain(router.currentTrustedSubnets(), params.RemoteAddr.IP) {
+		return false
+	}
+	var remoteTrusted []*net.IPNet
+	for _, cidr := range strings.Fields(params.Features[trustedSubnetsFeature]) {
+		if _, subnet, err := net.ParseCIDR(cidr); err == nil {
+			remoteTrusted = append(remoteTrusted, subnet)
+		}
+	}
+	return subnetsContain(remoteTrusted, params.LocalAddr.IP)
+}
+
+// overlayConnection returns the forwarder of our connection to peer,
+// or nil if there is none, or it was made without the overlay switch,
+// to a peer too old to support it
+func (router *NetworkRouter) overlayConnection(peer mesh.PeerName) *overlaySwitchForwarder {
+	conn, found := router.Ourself.ConnectionTo(peer)
+	if !found {
+		return nil
+	}
+	fwd, _ := conn.(*mesh.LocalConnection).OverlayConn.(*overlaySwitchForwarder)
+	return fwd
+}
+
+func subnetsContain(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// subnetsWithout returns subnets less ip: the subnet containing it is
+// replaced by the largest ones within it which do not.
+func subnetsWithout(subnets []*net.IPNet, ip net.IP) []*net.IPNet {
+	var result []*net.IPNet
+	for _, subnet := range subnets {
+		if !subnet.Contains(ip) {
+			result = append(result, subnet)
+			continue
+		}
+		if len(subnet.IP) == net.IPv4len {
+			ip = ip.To4()
+		} else {
+			ip = ip.To16()
+		}
+		ones, bits := subnet.Mask.Size()
+		for prefix := ones + 1; prefix <= bits; prefix++ {
+			// The half of the subnet of ip, one bit shorter, which
+			// ip is not in
+			mask := net.CIDRMask(prefix, bits)
+			sibling := ip.Mask(mask)
+			sibling[(prefix-1)/8] ^= 0x80 >> uint((prefix-1)%8)
+			result = append(result, &net.IPNet{IP: sibling, Mask: mask})
+		}
+	}
+	return result
+}
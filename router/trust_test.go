@@ -0,0 +1,114 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func parseSubnets(t *testing.T, cidrs ...string) []*net.IPNet {
+	var subnets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, subnet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		subnets = append(subnets, subnet)
+	}
+	return subnets
+}
+
+func TestSubnetsWithout(t *testing.T) {
+	parse := func(cidrs ...string) []*net.IPNet { return parseSubnets(t, cidrs...) }
+	trusted := parse("10.0.0.0/29", "192.168.0.0/16", "fd00::/126")
+
+	subnets := subnetsWithout(trusted, net.ParseIP("10.0.0.5"))
+	require.Equal(t, parse("10.0.0.0/30", "10.0.0.6/31", "10.0.0.4/32", "192.168.0.0/16", "fd00::/126"), subnets)
+	require.False(t, subnetsContain(subnets, net.ParseIP("10.0.0.5")))
+	for _, ip := range []string{"10.0.0.0", "10.0.0.4", "10.0.0.7", "192.168.3.4", "fd00::3"} {
+		require.True(t, subnetsContain(subnets, net.ParseIP(ip)), ip)
+	}
+
+	subnets = subnetsWithout(subnets, net.ParseIP("fd00::2"))
+	require.False(t, subnetsContain(subnets, net.ParseIP("fd00::2")))
+	require.True(t, subnetsContain(subnets, net.ParseIP("fd00::3")))
+	require.Equal(t, subnets, subnetsWithout(subnets, net.ParseIP("172.16.0.1")), "not trusted anyway")
+}
+
+func TestTrustsConnection(t *testing.T) {
+	a := &NetworkRouter{trusted: parseSubnets(t, "10.0.0.0/24")}
+	b := &NetworkRouter{trusted: parseSubnets(t, "10.0.0.0/16", "fd00::/64")}
+	aAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6783}
+	bAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 41234}
+
+	// Each end sees the features the other advertised
+	connect := func(a, b *NetworkRouter, aAddr, bAddr *net.TCPAddr) (bool, bool) {
+		aFeatures, bFeatures := make(map[string]string), make(map[string]string)
+		a.addTrustFeatureTo(aFeatures)
+		b.addTrustFeatureTo(bFeatures)
+		return a.trustsConnection(mesh.OverlayConnectionParams{LocalAddr: aAddr, RemoteAddr: bAddr, Features: bFeatures}),
+			b.trustsConnection(mesh.OverlayConnectionParams{LocalAddr: bAddr, RemoteAddr: aAddr, Features: aFeatures})
+	}
+
+	aTrusts, bTrusts := connect(a, b, aAddr, bAddr)
+	require.True(t, aTrusts)
+	require.True(t, bTrusts)
+
+	// Only one end trusting the other leaves both encrypting
+	aTrusts, bTrusts = connect(a, b, aAddr, &net.TCPAddr{IP: net.ParseIP("10.0.1.2"), Port: 41234})
+	require.False(t, aTrusts)
+	require.False(t, bTrusts)
+
+	a.trusted = subnetsWithout(a.trusted, bAddr.IP)
+	aTrusts, bTrusts = connect(a, b, aAddr, bAddr)
+	require.False(t, aTrusts)
+	require.False(t, bTrusts)
+
+	// A peer which does not advertise its trusted subnets is not
+	// trusted to leave the connection unencrypted
+	require.False(t, b.trustsConnection(mesh.OverlayConnectionParams{LocalAddr: bAddr, RemoteAddr: aAddr, Features: map[string]string{}}))
+}
+
+// sessionKeyOverlay records the session keys its connections are
+// prepared with
+type sessionKeyOverlay struct {
+	NullNetworkOverlay
+	keys []*[32]byte
+}
+
+func (o *sessionKeyOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	o.keys = append(o.keys, params.SessionKey)
+	return NullNetworkOverlay{}, nil
+}
+
+// Connections between peers in each other's trusted subnets are not
+// encrypted: fast datapath is given no session key for them, so it
+// sets up neither IPsec SAs nor the rules marking traffic for them
+func TestTrustedSubnetsExcludedFromEncryption(t *testing.T) {
+	overlay := &sessionKeyOverlay{}
+	osw := NewOverlaySwitch()
+	osw.Add("fastdp", overlay)
+	osw.trust = &NetworkRouter{trusted: parseSubnets(t, "10.0.0.0/24")}
+	key := new([32]byte)
+
+	connect := func(remoteIP string) bool {
+		conn, err := osw.PrepareConnection(mesh.OverlayConnectionParams{
+			RemotePeer: &mesh.Peer{},
+			LocalAddr:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6783},
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(remoteIP), Port: 41234},
+			SessionKey: key,
+			Features: map[string]string{
+				"Overlays":            "fastdp",
+				trustedSubnetsFeature: "10.0.0.0/24 172.16.0.0/12",
+			},
+			SendControlMessage: func(byte, []byte) error { return nil },
+		})
+		require.NoError(t, err)
+		defer conn.Stop()
+		return conn.(*overlaySwitchForwarder).encrypted
+	}
+
+	require.False(t, connect("10.0.0.2"), "same rack")
+	require.True(t, connect("172.16.0.2"), "across the WAN")
+	require.Equal(t, []*[32]byte{nil, key}, overlay.keys)
+}
@@ -0,0 +1,140 @@
+package netfilter
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MockIPTables is a common.IPTablesBackend keeping the rules of each
+// chain, joined by spaces, in Chains, keyed by table and chain, e.g.
+// "filter INPUT"
+type MockIPTables struct {
+	sync.Mutex
+	Chains map[string][]string
+}
+
+// builtinChains are those of the tables MockIPTables starts with
+var builtinChains = map[string][]string{
+	"filter": {"INPUT", "FORWARD", "OUTPUT"},
+	"mangle": {"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"},
+	"nat":    {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
+	"raw":    {"PREROUTING", "OUTPUT"},
+}
+
+func NewMockIPTables() *MockIPTables {
+	ipt := &MockIPTables{Chains: make(map[string][]string)}
+	for table, chains := range builtinChains {
+		for _, chain := range chains {
+			ipt.Chains[table+" "+chain] = nil
+		}
+	}
+	return ipt
+}
+
+func (ipt *MockIPTables) rules(table, chain string) ([]string, error) {
+	rules, found := ipt.Chains[table+" "+chain]
+	if !found {
+		return nil, fmt.Errorf("no chain %s in table %s", chain, table)
+	}
+	return rules, nil
+}
+
+func (ipt *MockIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	for _, r := range rules {
+		if r == strings.Join(rulespec, " ") {
+			return true, nil
+		}
+	}
+	return false, err
+}
+
+func (ipt *MockIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	if err != nil {
+		return err
+	}
+	rules = append(rules[:pos-1], append([]string{strings.Join(rulespec, " ")}, rules[pos-1:]...)...)
+	ipt.Chains[table+" "+chain] = rules
+	return nil
+}
+
+func (ipt *MockIPTables) Append(table, chain string, rulespec ...string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	if err != nil {
+		return err
+	}
+	ipt.Chains[table+" "+chain] = append(rules, strings.Join(rulespec, " "))
+	return nil
+}
+
+func (ipt *MockIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	if exists, err := ipt.Exists(table, chain, rulespec...); err != nil || exists {
+		return err
+	}
+	return ipt.Append(table, chain, rulespec...)
+}
+
+func (ipt *MockIPTables) Delete(table, chain string, rulespec ...string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	if err != nil {
+		return err
+	}
+	for i, r := range rules {
+		if r == strings.Join(rulespec, " ") {
+			ipt.Chains[table+" "+chain] = append(rules[:i:i], rules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no such rule in chain %s", chain)
+}
+
+func (ipt *MockIPTables) List(table, chain string) ([]string, error) {
+	ipt.Lock()
+	defer ipt.Unlock()
+	rules, err := ipt.rules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	list := []string{"-N " + chain}
+	for _, r := range rules {
+		list = append(list, "-A "+chain+" "+r)
+	}
+	return list, nil
+}
+
+func (ipt *MockIPTables) NewChain(table, chain string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	if _, err := ipt.rules(table, chain); err == nil {
+		return fmt.Errorf("chain %s already exists", chain)
+	}
+	ipt.Chains[table+" "+chain] = nil
+	return nil
+}
+
+func (ipt *MockIPTables) ClearChain(table, chain string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	ipt.Chains[table+" "+chain] = nil
+	return nil
+}
+
+func (ipt *MockIPTables) DeleteChain(table, chain string) error {
+	ipt.Lock()
+	defer ipt.Unlock()
+	if rules, err := ipt.rules(table, chain); err != nil || len(rules) != 0 {
+		return fmt.Errorf("can't delete chain %s: %v", chain, err)
+	}
+	delete(ipt.Chains, table+" "+chain)
+	return nil
+}